@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/daemon"
+	"github.com/mbags/gtc/pkg/metainfo"
+	"github.com/mbags/gtc/pkg/storage"
+	"github.com/mbags/gtc/pkg/torrent"
+	"github.com/mbags/gtc/pkg/tracker"
+)
+
+// stringList a flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// trackers every tracker of m, the announce key then the announce-list tiers
+func trackers(m *metainfo.MetaInfo) []string {
+	var list []string
+	if m.Announce != "" {
+		list = append(list, m.Announce)
+	}
+	for _, tier := range m.AnnounceList {
+		for _, tr := range tier {
+			if tr != m.Announce {
+				list = append(list, tr)
+			}
+		}
+	}
+	return list
+}
+
+// fileInfo a file of a torrent in info's output
+type fileInfo struct {
+	Path    string `json:"path"`
+	Length  int64  `json:"length"`
+	Attr    string `json:"attr,omitempty"`
+	Symlink string `json:"symlink,omitempty"` // where it points, within the torrent
+	SHA1    string `json:"sha1,omitempty"`
+}
+
+// torrentInfo what info prints about a .torrent
+type torrentInfo struct {
+	Name         string     `json:"name"`
+	InfoHash     string     `json:"info_hash"`
+	Size         int64      `json:"size"`
+	PieceLength  int64      `json:"piece_length"`
+	Pieces       int        `json:"pieces"`
+	Private      bool       `json:"private"`
+	Trackers     []string   `json:"trackers"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	Files        []fileInfo `json:"files"`
+	Magnet       string     `json:"magnet"`
+}
+
+func newTorrentInfo(m *metainfo.MetaInfo) torrentInfo {
+	info := torrentInfo{
+		Name:        m.Name,
+		InfoHash:    fmt.Sprintf("%x", m.InfoHash),
+		Size:        m.TotalLength(),
+		PieceLength: m.PieceLength,
+		Pieces:      m.NumPieces(),
+		Private:     m.Private,
+		Trackers:    trackers(m),
+		CreatedBy:   m.CreatedBy,
+		Comment:     m.Comment,
+		Magnet:      m.Magnet(),
+	}
+	if !m.CreationDate.IsZero() {
+		info.CreationDate = &m.CreationDate
+	}
+	for _, f := range m.Files {
+		if f.Padding() {
+			continue
+		}
+		p := m.Name
+		if len(f.Path) > 0 {
+			p = path.Join(append([]string{m.Name}, f.Path...)...)
+		}
+		fi := fileInfo{Path: p, Length: f.Length, Attr: f.Attr}
+		if f.Symlink() {
+			fi.Symlink = path.Join(append([]string{m.Name}, f.SymlinkPath...)...)
+		}
+		if len(f.SHA1) > 0 {
+			fi.SHA1 = fmt.Sprintf("%x", f.SHA1)
+		}
+		info.Files = append(info.Files, fi)
+	}
+	return info
+}
+
+// infoMain shows what's in a .torrent
+func infoMain(args []string) int {
+	fs := newFlags("info", "<torrent>")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	m, err := metainfo.NewFromFilename(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	info := newTorrentInfo(m)
+	if *asJSON {
+		return printJSON(info)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Info hash:\t%s\n", info.InfoHash)
+	fmt.Fprintf(w, "Size:\t%s (%d bytes)\n", formatBytes(info.Size), info.Size)
+	fmt.Fprintf(w, "Pieces:\t%d x %s\n", info.Pieces, formatBytes(info.PieceLength))
+	fmt.Fprintf(w, "Private:\t%v\n", info.Private)
+	if info.CreationDate != nil {
+		fmt.Fprintf(w, "Created:\t%s\n", info.CreationDate.Format(time.RFC1123))
+	}
+	if info.CreatedBy != "" {
+		fmt.Fprintf(w, "Created by:\t%s\n", info.CreatedBy)
+	}
+	if info.Comment != "" {
+		fmt.Fprintf(w, "Comment:\t%s\n", info.Comment)
+	}
+	for i, tr := range info.Trackers {
+		label := ""
+		if i == 0 {
+			label = "Trackers:"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, tr)
+	}
+	w.Flush()
+	fmt.Println("\nFiles:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, f := range info.Files {
+		name := f.Path
+		switch {
+		case f.Symlink != "":
+			name += " -> " + f.Symlink
+		case strings.Contains(f.Attr, "x"):
+			name += " (executable)"
+		}
+		fmt.Fprintf(w, "  %s\t  %s\t\n", formatBytes(f.Length), name)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// createMain makes a .torrent from a file or directory
+func createMain(args []string) int {
+	fs := newFlags("create", "<file or directory>")
+	out := fs.String("o", "", "where to write the .torrent, <name>.torrent by default")
+	var trs stringList
+	fs.Var(&trs, "t", "tracker URL, repeat for more")
+	pieceLength := fs.Int64("piece-length", 0, "piece length in bytes, picked from the size by default")
+	private := fs.Bool("private", false, "only get peers from the trackers")
+	comment := fs.String("comment", "", "comment to include")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	if *pieceLength != 0 && (*pieceLength < 16<<10 || *pieceLength&(*pieceLength-1) != 0) {
+		fmt.Fprintln(os.Stderr, "gtc: piece length must be a power of two of at least 16384")
+		return exitUsage
+	}
+	m, err := metainfo.Create(fs.Arg(0), *pieceLength)
+	if err != nil {
+		return fail(err)
+	}
+	m.Private = *private
+	switch len(trs) {
+	case 0:
+	case 1:
+		m.Announce = trs[0]
+	default:
+		m.Announce = trs[0]
+		for _, tr := range trs {
+			m.AnnounceList = append(m.AnnounceList, []string{tr})
+		}
+	}
+	m.Comment = *comment
+	m.CreatedBy = "gtc"
+	m.CreationDate = time.Now().Truncate(time.Second)
+
+	if *out == "" {
+		*out = m.Name + ".torrent"
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return fail(err)
+	}
+	err = m.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return fail(err)
+	}
+	// private is part of the info dictionary, read the hash back from the file
+	written, err := metainfo.NewFromFilename(*out)
+	if err != nil {
+		return fail(err)
+	}
+	info := newTorrentInfo(written)
+	if *asJSON {
+		return printJSON(struct {
+			Torrent string `json:"torrent"`
+			torrentInfo
+		}{*out, info})
+	}
+	fmt.Printf("Wrote %s\n", *out)
+	fmt.Printf("Info hash: %s\n", info.InfoHash)
+	fmt.Printf("Magnet: %s\n", info.Magnet)
+	return exitOK
+}
+
+// verifyResult what verify found
+type verifyResult struct {
+	Pieces      int      `json:"pieces"`
+	Verified    int      `json:"verified"`
+	Failed      []int    `json:"failed"`       // piece indexes
+	FailedFiles []string `json:"failed_files"` // paths of files whose own SHA1 doesn't match
+}
+
+// verifyMain checks downloaded data against a .torrent
+func verifyMain(args []string) int {
+	fs := newFlags("verify", "<torrent>")
+	dir := fs.String("dir", ".", "directory the torrent was downloaded into")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	m, err := metainfo.NewFromFilename(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	res := verifyResult{Pieces: m.NumPieces(), Failed: []int{}, FailedFiles: []string{}}
+	err = storage.Verify(*dir, m, func(piece int, ok bool) {
+		if ok {
+			res.Verified++
+		} else {
+			res.Failed = append(res.Failed, piece)
+		}
+	})
+	if err == nil {
+		err = storage.VerifyFiles(*dir, m, func(file int, ok bool) {
+			if !ok {
+				p := path.Join(append([]string{m.Name}, m.Files[file].Path...)...)
+				res.FailedFiles = append(res.FailedFiles, p)
+			}
+		})
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if *asJSON {
+		printJSON(res)
+	} else {
+		fmt.Printf("%d of %d pieces verified\n", res.Verified, res.Pieces)
+		if len(res.Failed) > 0 {
+			fmt.Printf("Failed: %s\n", pieceRanges(res.Failed))
+		}
+		for _, p := range res.FailedFiles {
+			fmt.Printf("Failed file: %s\n", p)
+		}
+	}
+	if len(res.Failed) > 0 || len(res.FailedFiles) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// pieceRanges sorted piece indexes as "0-4, 7, 9-12"
+func pieceRanges(pieces []int) string {
+	var parts []string
+	for i := 0; i < len(pieces); {
+		j := i
+		for j+1 < len(pieces) && pieces[j+1] == pieces[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(pieces[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", pieces[i], pieces[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// downloadMain downloads a torrent in the foreground, exiting once it's
+// complete unless asked to seed
+func downloadMain(args []string) int {
+	fs := newFlags("download", "<torrent or magnet>")
+	flags := config.Flags(fs)
+	seed := fs.Bool("seed", false, "keep seeding once complete")
+	asJSON := fs.Bool("json", false, "print progress as JSON lines")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	cfg, err := flags.Load()
+	if err != nil {
+		return fail(err)
+	}
+	t, err := daemon.NewSession(cfg).OpenSource(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-sig:
+			if !*asJSON {
+				fmt.Fprintln(os.Stderr)
+			}
+			return stop(t)
+		}
+		st := t.Stats()
+		if *asJSON {
+			printJSON(st)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%s: %5.1f%% of %s, %d peers, down %s, up %s\033[K",
+				st.Name, percent(st.Done, st.Size), formatBytes(st.Size), st.Peers,
+				formatRate(st.DownloadRate), formatRate(st.UploadRate))
+		}
+		if st.State == torrent.StateSeeding.String() && !*seed {
+			if !*asJSON {
+				fmt.Fprintln(os.Stderr)
+			}
+			return stop(t)
+		}
+	}
+}
+
+// stop stops t, flushing its data and telling its tracker
+func stop(t *torrent.Torrent) int {
+	if err := t.Stop(); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+func percent(done, size int64) float64 {
+	if size == 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(size)
+}
+
+// scrapeResult one tracker's answer to scrape
+type scrapeResult struct {
+	URL string `json:"url"`
+	tracker.ScrapeResult
+	Error string `json:"error,omitempty"`
+}
+
+// scrapeMain asks a torrent's trackers for peer counts
+func scrapeMain(args []string) int {
+	fs := newFlags("scrape", "<torrent>")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	m, err := metainfo.NewFromFilename(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	trs := trackers(m)
+	if len(trs) == 0 {
+		return fail(errors.New("the torrent has no trackers"))
+	}
+	results := make([]scrapeResult, len(trs))
+	done := make(chan struct{})
+	for i, tr := range trs {
+		go func() {
+			res, err := tracker.Scrape(tr, []byte(m.InfoHash))
+			results[i] = scrapeResult{URL: tr, ScrapeResult: res}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+			done <- struct{}{}
+		}()
+	}
+	answered := 0
+	for range trs {
+		<-done
+	}
+	for _, r := range results {
+		if r.Error == "" {
+			answered++
+		}
+	}
+	if *asJSON {
+		printJSON(results)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TRACKER\tSEEDERS\tLEECHERS\tCOMPLETED\t")
+		for _, r := range results {
+			if r.Error != "" {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", r.URL, r.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", r.URL, r.Seeders, r.Leechers, r.Completed)
+		}
+		w.Flush()
+	}
+	if answered == 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// magnetMain prints a .torrent's magnet link
+func magnetMain(args []string) int {
+	fs := newFlags("magnet", "<torrent>")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	m, err := metainfo.NewFromFilename(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	if *asJSON {
+		return printJSON(map[string]string{"magnet": m.Magnet()})
+	}
+	fmt.Println(m.Magnet())
+	return exitOK
+}
@@ -1,21 +1,286 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/mbags/gtc/pkg/torrent"
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/daemon"
+	"github.com/mbags/gtc/pkg/metrics"
+	"github.com/mbags/gtc/pkg/serve"
 )
 
+// exit codes
+const (
+	exitOK          = 0
+	exitFailure     = 1 // the command ran and failed, or found a problem
+	exitUsage       = 2
+	exitUnavailable = 3 // no daemon to talk to
+	exitNotFound    = 4 // the daemon doesn't have the torrent
+)
+
+const usage = `usage: gtc <command> [flags] [args]
+
+Local commands:
+  info      show what's in a .torrent
+  create    make a .torrent from a file or directory
+  verify    check downloaded data against a .torrent
+  download  download a torrent in the foreground
+  scrape    ask a torrent's trackers for peer counts
+  magnet    print a .torrent's magnet link
+  serve     download torrents while serving their files over HTTP
+  daemon    run torrents in the background, controlled through its API
+
+Daemon commands, through the API at $GTC_API or ` + daemon.DefaultAPIAddr + `
+with the token in $GTC_API_TOKEN or the file the daemon keeps it in:
+  add       add torrents
+  ls        list torrents
+  pause     pause torrents
+  resume    resume paused torrents
+  rm        remove torrents
+  mv        move a torrent's files to another directory
+  rename    move one of a torrent's files within its directory
+  peers     list a torrent's peers
+  trackers  list a torrent's trackers
+  top       watch torrents, their peers, trackers, files and pieces live
+  config    show the daemon's settings, or change them with key=value
+
+Commands take -json for machine readable output, run gtc <command> -h for
+the rest. The download, serve and daemon commands read their settings from
+a JSON config file, then GTC_<KEY> environment variables, then flags. Torrents given to daemon commands are info hashes or any unique
+prefix of one.
+
+Exit status: 0 on success, 1 on failure, 2 on bad usage, 3 when the daemon
+isn't running and 4 when it doesn't have the torrent.`
+
+var commands = map[string]func(args []string) int{
+	"info":     infoMain,
+	"create":   createMain,
+	"verify":   verifyMain,
+	"download": downloadMain,
+	"scrape":   scrapeMain,
+	"magnet":   magnetMain,
+	"serve":    serveMain,
+	"daemon":   daemonMain,
+	"add":      addMain,
+	"ls":       lsMain,
+	"pause":    pauseMain,
+	"resume":   resumeMain,
+	"rm":       rmMain,
+	"mv":       mvMain,
+	"rename":   renameMain,
+	"peers":    peersMain,
+	"trackers": trackersMain,
+	"top":      topMain,
+	"config":   configMain,
+}
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("usage: gtc <torrent>")
-		return
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	switch cmd, ok := commands[name]; {
+	case ok:
+		os.Exit(cmd(os.Args[2:]))
+	case name == "help" || name == "-h" || name == "--help":
+		fmt.Println(usage)
+	case strings.HasSuffix(name, ".torrent"):
+		// gtc <torrent> from before there were subcommands
+		os.Exit(downloadMain(os.Args[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "gtc: unknown command %q\n\n%s\n", name, usage)
+		os.Exit(exitUsage)
+	}
+}
+
+// newFlags a flag set for a command whose positional arguments are described by args
+func newFlags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gtc %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses args and checks the number of positional ones is within
+// [min, max], max < 0 for no limit. A non-zero code means exit with it.
+func parse(fs *flag.FlagSet, args []string, min, max int) int {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return exitUsage
+	}
+	return -1
+}
+
+// fail reports err and picks the exit code for it
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "gtc: %v\n", err)
+	var apiErr *daemon.APIError
+	switch {
+	case errors.Is(err, daemon.ErrUnavailable):
+		return exitUnavailable
+	case errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound:
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+func printJSON(v interface{}) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fail(err)
+	}
+	return exitOK
+}
+
+// formatBytes n in binary units
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+func formatRate(r float64) string {
+	return formatBytes(int64(r)) + "/s"
+}
+
+// serveMain downloads torrents while serving their files over HTTP
+func serveMain(args []string) int {
+	fs := newFlags("serve", "<torrent>...")
+	addr := fs.String("addr", "localhost:8080", "address to serve files on")
+	flags := config.Flags(fs)
+	if code := parse(fs, args, 1, -1); code >= 0 {
+		return code
+	}
+	cfg, err := flags.Load()
+	if err != nil {
+		return fail(err)
+	}
+	s := daemon.NewSession(cfg)
+	srv := serve.New()
+	for _, fn := range fs.Args() {
+		t, err := s.Open(fn)
+		if err != nil {
+			return fail(fmt.Errorf("couldn't open %s: %w", fn, err))
+		}
+		srv.Add(t)
+		log.Printf("Serving %s at http://%s/%x/", t.MetaInfo.Name, *addr, t.MetaInfo.InfoHash)
+	}
+	hs := &http.Server{Addr: *addr, Handler: srv}
+	stopping, stopped := make(chan struct{}), make(chan int)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		close(stopping)
+		// streams still open are cut off, what they read from is stopping
+		hs.Close()
+		log.Printf("Stopping torrents")
+		if err := s.Close(); err != nil {
+			log.Printf("Couldn't stop cleanly: %v", err)
+			stopped <- exitFailure
+			return
+		}
+		stopped <- exitOK
+	}()
+	err = hs.ListenAndServe()
+	select {
+	case <-stopping:
+		return <-stopped
+	default:
+		return fail(err)
 	}
-	t, err := torrent.NewFromFilename(os.Args[1])
+}
+
+// daemonMain runs torrents in the background, controlled through the JSON API
+func daemonMain(args []string) int {
+	fs := newFlags("daemon", "[<torrent>...]")
+	flags := config.Flags(fs)
+	if code := parse(fs, args, 0, -1); code >= 0 {
+		return code
+	}
+	cfg, err := flags.Load()
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.MkdirAll(cfg.DownloadDir, 0755); err != nil {
+		return fail(fmt.Errorf("couldn't use %s: %w", cfg.DownloadDir, err))
+	}
+	token, err := daemon.Token(cfg)
 	if err != nil {
-		panic(err)
+		return fail(fmt.Errorf("couldn't set up the API token: %w", err))
+	}
+	ln, err := daemon.Listen(cfg.API)
+	if err != nil {
+		return fail(fmt.Errorf("couldn't listen for API requests: %w", err))
+	}
+	s := daemon.NewSession(cfg)
+	if err := s.Restore(); err != nil {
+		log.Printf("Couldn't restore torrents from %s: %v", cfg.ResumeDir, err)
+	}
+	for _, fn := range fs.Args() {
+		if _, err := s.Open(fn); err != nil {
+			log.Printf("Couldn't open %s: %v", fn, err)
+		}
+	}
+	s.Start()
+	if cfg.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", metrics.Handler(s))
+		go func() {
+			log.Printf("Metrics at http://%s/metrics", cfg.Metrics)
+			log.Printf("Metrics server stopped: %v", http.ListenAndServe(cfg.Metrics, mux))
+		}()
+	}
+	stopping, stopped := make(chan struct{}), make(chan int)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		close(stopping)
+		// remove a unix socket on the way out
+		ln.Close()
+		log.Printf("Stopping torrents")
+		if err := s.Close(); err != nil {
+			log.Printf("Couldn't stop cleanly: %v", err)
+			stopped <- exitFailure
+			return
+		}
+		stopped <- exitOK
+	}()
+	api := daemon.NewAPI(s)
+	api.Token = token
+	log.Printf("API listening on %s", ln.Addr())
+	err = http.Serve(ln, api)
+	select {
+	case <-stopping:
+		return <-stopped
+	default:
+		return fail(err)
 	}
-	go t.Start()
-	select {}
 }
@@ -4,10 +4,57 @@ type Bitfield struct {
     Bits []byte
 }
 
+// New returns a Bitfield with room for n bits
+func New(n int) Bitfield {
+    return Bitfield{Bits: make([]byte, (n+7)/8)}
+}
+
+// SetAll sets the first n bits
+func (b *Bitfield) SetAll(n int) {
+    for i := 0; i < n; i++ {
+        b.Set(i)
+    }
+}
+
+// Count the number of set bits
+func (b *Bitfield) Count() int {
+    n := 0
+    for _, c := range b.Bits {
+        for ; c != 0; c &= c - 1 {
+            n++
+        }
+    }
+    return n
+}
+
 func (b *Bitfield) IsSet(index int) bool {
+    if index < 0 || index>>3 >= len(b.Bits) {
+        return false
+    }
     return b.Bits[index>>3] & byte(128>>byte(index&7)) != 0
 }
 
+// Set sets the bit at index, ignoring indexes past the end of Bits
 func (b *Bitfield) Set(index int) {
+    if index < 0 || index>>3 >= len(b.Bits) {
+        return
+    }
     b.Bits[index>>3] |= byte(128>>byte(index&7))
 }
+
+// Fits reports whether b is exactly as long as a Bitfield of n bits, with none
+// of the spare bits after the nth set
+func (b *Bitfield) Fits(n int) bool {
+    if len(b.Bits) != (n+7)/8 {
+        return false
+    }
+    return n%8 == 0 || b.Bits[len(b.Bits)-1]&byte(0xff>>byte(n%8)) == 0
+}
+
+// Clear clears the bit at index
+func (b *Bitfield) Clear(index int) {
+    if index < 0 || index>>3 >= len(b.Bits) {
+        return
+    }
+    b.Bits[index>>3] &^= byte(128>>byte(index&7))
+}
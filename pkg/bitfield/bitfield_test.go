@@ -0,0 +1,56 @@
+package bitfield
+
+import "testing"
+
+func TestSetOutOfRange(t *testing.T) {
+	b := New(10)
+	for _, i := range []int{-1, 16, 1 << 31, 0xFFFFFFFF} {
+		b.Set(i)
+		b.Clear(i)
+		if b.IsSet(i) {
+			t.Errorf("IsSet(%d) after setting out of range", i)
+		}
+	}
+	if len(b.Bits) != 2 || b.Count() != 0 {
+		t.Fatalf("Bits %v changed", b.Bits)
+	}
+	b.Set(9)
+	if !b.IsSet(9) || b.Count() != 1 {
+		t.Fatal("in range Set lost")
+	}
+	b.Clear(9)
+	if b.IsSet(9) {
+		t.Fatal("Clear")
+	}
+}
+
+func TestFits(t *testing.T) {
+	tests := []struct {
+		bits []byte
+		n    int
+		want bool
+	}{
+		{[]byte{0xff}, 8, true},
+		{[]byte{0xff, 0xc0}, 10, true},
+		{[]byte{0xff, 0xe0}, 10, false}, // spare bit set
+		{[]byte{0xff, 0x01}, 10, false},
+		{[]byte{0xff}, 10, false},             // short
+		{[]byte{0xff, 0x00, 0x00}, 10, false}, // long
+		{nil, 0, true},
+		{[]byte{0}, 0, false},
+	}
+	for _, tt := range tests {
+		b := Bitfield{tt.bits}
+		if got := b.Fits(tt.n); got != tt.want {
+			t.Errorf("Fits(%x, %d) = %v, want %v", tt.bits, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSetAllCount(t *testing.T) {
+	b := New(13)
+	b.SetAll(13)
+	if b.Count() != 13 || !b.Fits(13) {
+		t.Fatalf("%x", b.Bits)
+	}
+}
@@ -0,0 +1,424 @@
+// config the settings of a session and the torrents in it, read from a JSON
+// file, the environment and command line flags, in rising order of precedence
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/storage"
+)
+
+// Config every setting, with the key it has in the file. A key is also read
+// from the environment as GTC_ and the key in upper case, and is the name of
+// its flag with dashes for underscores.
+type Config struct {
+	Listen   string `json:"listen"`    // for peers, TCP and uTP, also the port we tell trackers and LSD
+	API      string `json:"api"`       // the daemon's API, host:port or "unix:" and a socket path
+	APIToken string `json:"api_token"` // API clients must send it, the one at TokenPath when empty
+	Metrics  string `json:"metrics"`   // host:port to serve Prometheus metrics on, none when empty
+
+	DownloadDir  string `json:"download_dir"`
+	DownloadRate int    `json:"download_rate"` // across torrents, bytes per second with 0 for no cap
+	UploadRate   int    `json:"upload_rate"`
+	MaxConns     int    `json:"max_conns"`  // peer connections across torrents
+	MaxPeers     int    `json:"max_peers"`  // peer connections per torrent
+	Allocation   string `json:"allocation"` // sparse, full or compact, how new torrents' files take up disk space
+
+	Encryption string `json:"encryption"` // disabled, preferred or required
+	DHT        bool   `json:"dht"`
+	PEX        bool   `json:"pex"`
+	LSD        bool   `json:"lsd"`
+
+	PeerIDPrefix string `json:"peer_id_prefix"` // the rest of our peer id is random
+	UserAgent    string `json:"user_agent"`     // sent to HTTP trackers
+	NumWant      int    `json:"numwant"`        // peers asked of a tracker per announce
+
+	Watch     []WatchDir `json:"watch"`
+	ResumeDir string     `json:"resume_dir"` // where the daemon keeps its torrents between runs, nowhere when empty
+}
+
+// WatchDir a directory .torrent and .magnet files are added from as they
+// show up. In the environment and flags a list is JSON, or for short the
+// directories, each optionally followed by = and its download directory,
+// separated by the OS's path list separator.
+type WatchDir struct {
+	Dir         string `json:"dir"`
+	DownloadDir string `json:"download_dir,omitempty"` // the session's when empty
+	MaxPeers    int    `json:"max_peers,omitempty"`    // the session's when 0
+	Paused      bool   `json:"paused,omitempty"`       // add without connecting to peers
+	Allocation  string `json:"allocation,omitempty"`   // the session's when empty
+}
+
+// Default the settings used for whatever isn't configured
+func Default() Config {
+	return Config{
+		Listen:       ":6881",
+		API:          "127.0.0.1:6880",
+		DownloadDir:  ".",
+		MaxConns:     200,
+		MaxPeers:     50,
+		Allocation:   storage.AllocateSparse.String(),
+		Encryption:   mse.Preferred.String(),
+		PEX:          true,
+		LSD:          true,
+		PeerIDPrefix: "-TR2920-", // transmission 2.920 :~)
+		UserAgent:    "Transmission/2.92",
+		NumWant:      50,
+		ResumeDir:    filepath.Join(filepath.Dir(DefaultPath()), "resume"),
+	}
+}
+
+// MaxNumWant the most peers a tracker can be asked for
+const MaxNumWant = 200
+
+// Validate reports the first setting that's out of range
+func (c Config) Validate() error {
+	if _, err := c.Port(); err != nil {
+		return err
+	}
+	switch {
+	case c.API == "":
+		return errors.New("config: api is empty")
+	case c.DownloadDir == "":
+		return errors.New("config: download_dir is empty")
+	case c.DownloadRate < 0 || c.UploadRate < 0:
+		return errors.New("config: rates can't be negative")
+	case c.MaxConns < 1 || c.MaxPeers < 1:
+		return errors.New("config: max_conns and max_peers must be at least 1")
+	case c.DHT:
+		return errors.New("config: dht isn't supported yet")
+	case len(c.PeerIDPrefix) > 16:
+		return fmt.Errorf("config: peer_id_prefix %q is longer than 16 bytes", c.PeerIDPrefix)
+	case c.NumWant < 1 || c.NumWant > MaxNumWant:
+		return fmt.Errorf("config: numwant must be between 1 and %d", MaxNumWant)
+	}
+	for _, w := range c.Watch {
+		if w.Dir == "" {
+			return errors.New("config: watch: dir is empty")
+		}
+		if w.MaxPeers < 0 {
+			return fmt.Errorf("config: watch: %s: max_peers can't be negative", w.Dir)
+		}
+		if w.Allocation != "" {
+			if _, err := storage.ParseAllocation(w.Allocation); err != nil {
+				return fmt.Errorf("config: watch: %s: %w", w.Dir, err)
+			}
+		}
+	}
+	if c.Metrics != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics); err != nil {
+			return fmt.Errorf("config: metrics: %w", err)
+		}
+	}
+	if _, err := mse.ParsePolicy(c.Encryption); err != nil {
+		return fmt.Errorf("config: encryption: %w", err)
+	}
+	if _, err := storage.ParseAllocation(c.Allocation); err != nil {
+		return fmt.Errorf("config: allocation: %w", err)
+	}
+	return nil
+}
+
+// Port the port of the listen address
+func (c Config) Port() (int, error) {
+	_, p, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return 0, fmt.Errorf("config: listen: %w", err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("config: listen: bad port %q", p)
+	}
+	return port, nil
+}
+
+// EncryptionPolicy the encryption setting, Preferred if it isn't valid
+func (c Config) EncryptionPolicy() mse.Policy {
+	p, err := mse.ParsePolicy(c.Encryption)
+	if err != nil {
+		return mse.Preferred
+	}
+	return p
+}
+
+// AllocationMode the allocation setting, sparse if it isn't valid
+func (c Config) AllocationMode() storage.Allocation {
+	a, err := storage.ParseAllocation(c.Allocation)
+	if err != nil {
+		return storage.AllocateSparse
+	}
+	return a
+}
+
+// Changed the keys of the settings that differ between a and b
+func Changed(a, b Config) []string {
+	var keys []string
+	for _, s := range settings {
+		if s.get(&a) != s.get(&b) {
+			keys = append(keys, s.key)
+		}
+	}
+	return keys
+}
+
+// Set the setting with the key to v, parsed as its type
+func (c *Config) Set(key, v string) error {
+	for _, s := range settings {
+		if s.key == key {
+			return s.set(c, v)
+		}
+	}
+	return fmt.Errorf("config: no setting %q", key)
+}
+
+// Keys every setting's key, in the order of Config's fields
+func Keys() []string {
+	keys := make([]string, len(settings))
+	for i, s := range settings {
+		keys[i] = s.key
+	}
+	return keys
+}
+
+// Get the setting with the key, formatted as Set takes it
+func (c Config) Get(key string) string {
+	for _, s := range settings {
+		if s.key == key {
+			return s.get(&c)
+		}
+	}
+	return ""
+}
+
+// setting describes one field of Config
+type setting struct {
+	key   string
+	usage string
+	field func(c *Config) interface{} // *string, *int, *bool or *[]WatchDir
+}
+
+var settings = []setting{
+	{"listen", "address to accept peers on, TCP and uTP", func(c *Config) interface{} { return &c.Listen }},
+	{"api", `API address, host:port or "unix:" and a socket path`, func(c *Config) interface{} { return &c.API }},
+	{"api_token", "secret API clients must send, made up and kept in " + TokenPath() + " when empty", func(c *Config) interface{} { return &c.APIToken }},
+	{"metrics", "serve Prometheus metrics at /metrics on this host:port", func(c *Config) interface{} { return &c.Metrics }},
+	{"download_dir", "directory to download into", func(c *Config) interface{} { return &c.DownloadDir }},
+	{"download_rate", "download cap across torrents in bytes per second, 0 for none", func(c *Config) interface{} { return &c.DownloadRate }},
+	{"upload_rate", "upload cap across torrents in bytes per second, 0 for none", func(c *Config) interface{} { return &c.UploadRate }},
+	{"max_conns", "peer connections across torrents", func(c *Config) interface{} { return &c.MaxConns }},
+	{"max_peers", "peer connections per torrent", func(c *Config) interface{} { return &c.MaxPeers }},
+	{"allocation", "how new torrents' files take up disk space: sparse, full or compact", func(c *Config) interface{} { return &c.Allocation }},
+	{"encryption", "peer connection encryption: disabled, preferred or required", func(c *Config) interface{} { return &c.Encryption }},
+	{"dht", "find peers through the DHT", func(c *Config) interface{} { return &c.DHT }},
+	{"pex", "exchange peers with peers", func(c *Config) interface{} { return &c.PEX }},
+	{"lsd", "find peers on the local network", func(c *Config) interface{} { return &c.LSD }},
+	{"peer_id_prefix", "start of our peer id", func(c *Config) interface{} { return &c.PeerIDPrefix }},
+	{"user_agent", "user agent sent to HTTP trackers", func(c *Config) interface{} { return &c.UserAgent }},
+	{"numwant", "peers asked of a tracker per announce", func(c *Config) interface{} { return &c.NumWant }},
+	{"resume_dir", "where the daemon keeps its torrents between runs, empty for nowhere", func(c *Config) interface{} { return &c.ResumeDir }},
+	{"watch", "directories to add .torrent and .magnet files from, dir[=download_dir] separated by " + string(os.PathListSeparator) + " or JSON", func(c *Config) interface{} { return &c.Watch }},
+}
+
+// set parses s into the setting's field of c
+func (s setting) set(c *Config, v string) error {
+	switch f := s.field(c).(type) {
+	case *string:
+		*f = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %q isn't a number", s.key, v)
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %q isn't true or false", s.key, v)
+		}
+		*f = b
+	case *[]WatchDir:
+		if strings.HasPrefix(v, "[") {
+			var list []WatchDir
+			if err := json.Unmarshal([]byte(v), &list); err != nil {
+				return fmt.Errorf("config: %s: %w", s.key, err)
+			}
+			*f = list
+			return nil
+		}
+		*f = nil
+		for _, item := range filepath.SplitList(v) {
+			if item == "" {
+				continue
+			}
+			dir, download, _ := strings.Cut(item, "=")
+			*f = append(*f, WatchDir{Dir: dir, DownloadDir: download})
+		}
+	}
+	return nil
+}
+
+func (s setting) get(c *Config) string {
+	switch f := s.field(c).(type) {
+	case *string:
+		return *f
+	case *int:
+		return strconv.Itoa(*f)
+	case *bool:
+		return strconv.FormatBool(*f)
+	case *[]WatchDir:
+		items := make([]string, len(*f))
+		for i, w := range *f {
+			if w.MaxPeers != 0 || w.Paused || w.Allocation != "" {
+				// more than the short form holds
+				b, _ := json.Marshal(*f)
+				return string(b)
+			}
+			items[i] = w.Dir
+			if w.DownloadDir != "" {
+				items[i] += "=" + w.DownloadDir
+			}
+		}
+		return strings.Join(items, string(os.PathListSeparator))
+	}
+	return ""
+}
+
+func (s setting) flagName() string {
+	if s.key == "download_dir" {
+		// what the flag was called before there was a config
+		return "dir"
+	}
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+func (s setting) env() string {
+	return "GTC_" + strings.ToUpper(s.key)
+}
+
+// flagValue a setting as a flag, set on the config of a Flags call
+type flagValue struct {
+	s setting
+	c *Config
+}
+
+func (v flagValue) String() string {
+	if v.c == nil {
+		return ""
+	}
+	return v.s.get(v.c)
+}
+
+func (v flagValue) Set(s string) error { return v.s.set(v.c, s) }
+
+func (v flagValue) IsBoolFlag() bool {
+	_, ok := v.s.field(&Config{}).(*bool)
+	return ok
+}
+
+// Flags registers a flag per setting on fs, and -config for the file
+func Flags(fs *flag.FlagSet) *Flagged {
+	f := &Flagged{fs: fs, c: Default()}
+	fs.StringVar(&f.file, "config", "", "config file, $GTC_CONFIG or "+DefaultPath()+" when not given")
+	for _, s := range settings {
+		fs.Var(flagValue{s, &f.c}, s.flagName(), s.usage)
+	}
+	return f
+}
+
+// Flagged the flags registered by Flags
+type Flagged struct {
+	fs   *flag.FlagSet
+	file string
+	c    Config // what the flags set, the defaults for the rest
+}
+
+// Load the config file named by -config, $GTC_CONFIG or the default path, then
+// the environment, then the flags given, once fs has been parsed
+func (f *Flagged) Load() (Config, error) {
+	file, explicit := f.file, true
+	if file == "" {
+		file = os.Getenv("GTC_CONFIG")
+	}
+	if file == "" {
+		file, explicit = DefaultPath(), false
+	}
+	c, err := LoadFile(file)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		c, err = Default(), nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	if err := c.LoadEnv(); err != nil {
+		return Config{}, err
+	}
+	var ferr error
+	f.fs.Visit(func(fl *flag.Flag) {
+		for _, s := range settings {
+			if s.flagName() == fl.Name && ferr == nil {
+				ferr = s.set(&c, s.get(&f.c))
+			}
+		}
+	})
+	if ferr != nil {
+		return Config{}, ferr
+	}
+	return c, c.Validate()
+}
+
+// DefaultPath where the config file is looked for when not named
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "gtc.json"
+	}
+	return filepath.Join(dir, "gtc", "config.json")
+}
+
+// TokenPath where the daemon keeps the API token it made up, for clients run
+// by the same user to read
+func TokenPath() string {
+	return filepath.Join(filepath.Dir(DefaultPath()), "api-token")
+}
+
+// LoadFile the defaults overridden by the JSON file fn
+func LoadFile(fn string) (Config, error) {
+	c := Default()
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return c, err
+	}
+	if err := c.UnmarshalStrict(b); err != nil {
+		return c, fmt.Errorf("config: %s: %w", fn, err)
+	}
+	return c, nil
+}
+
+// UnmarshalStrict sets the keys in the JSON object b on c, refusing ones it doesn't know
+func (c *Config) UnmarshalStrict(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// LoadEnv overrides c with the GTC_ variables that are set
+func (c *Config) LoadEnv() error {
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(c, v); err != nil {
+				return fmt.Errorf("%s: %w", s.env(), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig a config file holding body, in a temporary directory
+func writeConfig(t *testing.T, body string) string {
+	fn := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(fn, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	fn := writeConfig(t, `{"download_rate": 100, "max_peers": 10, "upload_rate": 1, "lsd": false}`)
+	t.Setenv("GTC_MAX_PEERS", "20")
+	t.Setenv("GTC_UPLOAD_RATE", "5")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := Flags(fs)
+	if err := fs.Parse([]string{"-config", fn, "-max-peers", "30", "-dir", "/tmp/dl"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := f.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, want string
+	}{
+		{"download_rate", "100"}, // file
+		{"upload_rate", "5"},     // environment over file
+		{"max_peers", "30"},      // flag over both
+		{"download_dir", "/tmp/dl"},
+		{"lsd", "false"},
+		{"max_conns", "200"}, // default
+	}
+	for _, tt := range tests {
+		if got := c.Get(tt.key); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir()) // no file at the default path
+	t.Setenv("GTC_CONFIG", "")
+	tests := []struct {
+		name string
+		args []string
+		env  string // GTC_NUMWANT
+		ok   bool
+	}{
+		{"no file anywhere", nil, "", true},
+		{"named file missing", []string{"-config", filepath.Join(t.TempDir(), "none.json")}, "", false},
+		{"unknown key", []string{"-config", writeConfig(t, `{"colour": "blue"}`)}, "", false},
+		{"wrong type", []string{"-config", writeConfig(t, `{"max_peers": "ten"}`)}, "", false},
+		{"not json", []string{"-config", writeConfig(t, `max_peers = 10`)}, "", false},
+		{"bad environment", nil, "lots", false},
+		{"invalid value", []string{"-numwant", "0"}, "", false},
+		{"dht", []string{"-dht"}, "", false},
+	}
+	for _, tt := range tests {
+		if tt.env != "" {
+			os.Setenv("GTC_NUMWANT", tt.env)
+		} else {
+			os.Unsetenv("GTC_NUMWANT")
+		}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := Flags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := f.Load(); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+	os.Unsetenv("GTC_NUMWANT")
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    string // in the error, empty for none
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no port", func(c *Config) { c.Listen = "localhost" }, "listen"},
+		{"port out of range", func(c *Config) { c.Listen = ":70000" }, "bad port"},
+		{"negative rate", func(c *Config) { c.UploadRate = -1 }, "negative"},
+		{"no peers", func(c *Config) { c.MaxPeers = 0 }, "max_peers"},
+		{"long prefix", func(c *Config) { c.PeerIDPrefix = strings.Repeat("x", 17) }, "peer_id_prefix"},
+		{"numwant", func(c *Config) { c.NumWant = MaxNumWant + 1 }, "numwant"},
+		{"encryption", func(c *Config) { c.Encryption = "sometimes" }, "encryption"},
+		{"allocation", func(c *Config) { c.Allocation = "eager" }, "allocation"},
+		{"metrics", func(c *Config) { c.Metrics = "9100" }, "metrics"},
+		{"watch without dir", func(c *Config) { c.Watch = []WatchDir{{DownloadDir: "x"}} }, "watch"},
+		{"watch allocation", func(c *Config) { c.Watch = []WatchDir{{Dir: "w", Allocation: "eager"}} }, "watch"},
+	}
+	for _, tt := range tests {
+		c := Default()
+		tt.change(&c)
+		err := c.Validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestWatchSetting(t *testing.T) {
+	sep := string(os.PathListSeparator)
+	tests := []struct {
+		name string
+		v    string
+		want []WatchDir
+	}{
+		{"empty", "", nil},
+		{"one", "/in", []WatchDir{{Dir: "/in"}}},
+		{"with download dirs", "/in=/out" + sep + "/in2", []WatchDir{{Dir: "/in", DownloadDir: "/out"}, {Dir: "/in2"}}},
+		{"json", `[{"dir": "/in", "max_peers": 5, "paused": true}]`, []WatchDir{{Dir: "/in", MaxPeers: 5, Paused: true}}},
+		{"json allocation", `[{"dir": "/in", "allocation": "full"}]`, []WatchDir{{Dir: "/in", Allocation: "full"}}},
+	}
+	for _, tt := range tests {
+		var c Config
+		if err := c.Set("watch", tt.v); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(c.Watch, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, c.Watch, tt.want)
+		}
+		// what Get gives back sets the same thing
+		var again Config
+		if err := again.Set("watch", c.Get("watch")); err != nil || !reflect.DeepEqual(again.Watch, c.Watch) {
+			t.Errorf("%s: %q sets %+v, %v", tt.name, c.Get("watch"), again.Watch, err)
+		}
+	}
+}
+
+func TestChanged(t *testing.T) {
+	a, b := Default(), Default()
+	b.MaxPeers, b.Watch = 7, []WatchDir{{Dir: "/in"}}
+	if got := Changed(a, b); !reflect.DeepEqual(got, []string{"max_peers", "watch"}) {
+		t.Errorf("got %v", got)
+	}
+	if got := Changed(a, a); got != nil {
+		t.Errorf("unchanged config: %v", got)
+	}
+}
@@ -0,0 +1,386 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/storage"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// DefaultAPIAddr where the daemon listens for API requests
+const DefaultAPIAddr = "127.0.0.1:6880"
+
+// Limits the session wide transfer caps, in bytes per second with 0 for none
+type Limits struct {
+	DownloadRate int `json:"download_rate"`
+	UploadRate   int `json:"upload_rate"`
+}
+
+// AddRequest the body of POST /api/torrents. A request with Content-Type
+// application/x-bittorrent carries the .torrent itself instead, and the
+// allocation as a query parameter.
+type AddRequest struct {
+	Source     string `json:"source"`               // a path on the daemon's machine, an http(s) URL or a magnet link
+	Allocation string `json:"allocation,omitempty"` // sparse, full or compact, the session's when empty
+}
+
+// TorrentLimits the body of PUT /api/torrents/{hash}/limits
+type TorrentLimits struct {
+	MaxPeers int `json:"max_peers"`
+}
+
+// FilePriority the body of PUT /api/torrents/{hash}/files/{index}
+type FilePriority struct {
+	Priority string `json:"priority"` // skip, low, normal or high
+}
+
+// PathRequest the body of POST /api/torrents/{hash}/move, where Path is a
+// directory on the daemon's machine, and of POST
+// /api/torrents/{hash}/files/{index}/rename, where it's slash separated and
+// relative to the directory the torrent's files are under
+type PathRequest struct {
+	Path string `json:"path"`
+}
+
+// API serves the session's JSON API:
+//
+//	GET    /api/torrents                      list torrents with their stats
+//	POST   /api/torrents                      add a torrent, see AddRequest
+//	GET    /api/torrents/{hash}               one torrent's stats
+//	DELETE /api/torrents/{hash}?data=1        remove a torrent, and its data with data=1
+//	POST   /api/torrents/{hash}/pause
+//	POST   /api/torrents/{hash}/resume
+//	POST   /api/torrents/{hash}/move          move the torrent's files to another directory, see PathRequest
+//	GET    /api/torrents/{hash}/files
+//	PUT    /api/torrents/{hash}/files/{index} set a file's priority, see FilePriority
+//	POST   /api/torrents/{hash}/files/{index}/rename
+//	GET    /api/torrents/{hash}/peers
+//	GET    /api/torrents/{hash}/trackers
+//	GET    /api/torrents/{hash}/pieces        the pieces we have, see torrent.PieceMap
+//	PUT    /api/torrents/{hash}/limits        see TorrentLimits
+//	GET    /api/limits                        see Limits
+//	PUT    /api/limits
+//	GET    /api/config                        the session's config.Config
+//	PATCH  /api/config                        change the settings in the body, see Session.SetConfig
+//
+// Errors come back as {"error": "..."} with a matching status code.
+//
+// Requests must carry the token as "Authorization: Bearer <token>" when
+// Token is set, and a body only as application/json or
+// application/x-bittorrent. Requests from web pages of other origins are
+// refused, so a page the user visits can't drive the daemon.
+type API struct {
+	Token string
+
+	s   *Session
+	mux *http.ServeMux
+}
+
+func NewAPI(s *Session) *API {
+	a := &API{s: s, mux: http.NewServeMux()}
+	a.mux.HandleFunc("GET /api/torrents", a.list)
+	a.mux.HandleFunc("POST /api/torrents", a.add)
+	a.mux.HandleFunc("GET /api/torrents/{hash}", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		writeJSON(w, t.Stats())
+	}))
+	a.mux.HandleFunc("DELETE /api/torrents/{hash}", a.remove)
+	a.mux.HandleFunc("POST /api/torrents/{hash}/pause", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		t.Pause()
+		writeJSON(w, t.Stats())
+	}))
+	a.mux.HandleFunc("POST /api/torrents/{hash}/resume", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		t.Resume()
+		writeJSON(w, t.Stats())
+	}))
+	a.mux.HandleFunc("POST /api/torrents/{hash}/move", a.withTorrent(a.move))
+	a.mux.HandleFunc("GET /api/torrents/{hash}/files", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		writeJSON(w, t.Files())
+	}))
+	a.mux.HandleFunc("PUT /api/torrents/{hash}/files/{index}", a.withTorrent(a.setPriority))
+	a.mux.HandleFunc("POST /api/torrents/{hash}/files/{index}/rename", a.withTorrent(a.rename))
+	a.mux.HandleFunc("GET /api/torrents/{hash}/peers", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		writeJSON(w, t.PeerStats())
+	}))
+	a.mux.HandleFunc("GET /api/torrents/{hash}/trackers", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		writeJSON(w, t.Trackers())
+	}))
+	a.mux.HandleFunc("GET /api/torrents/{hash}/pieces", a.withTorrent(func(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+		writeJSON(w, t.PieceMap())
+	}))
+	a.mux.HandleFunc("PUT /api/torrents/{hash}/limits", a.withTorrent(a.setTorrentLimits))
+	a.mux.HandleFunc("GET /api/limits", a.limits)
+	a.mux.HandleFunc("PUT /api/limits", a.setLimits)
+	a.mux.HandleFunc("GET /api/config", a.config)
+	a.mux.HandleFunc("PATCH /api/config", a.setConfig)
+	return a
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			writeError(w, errors.New("cross-origin requests aren't allowed"), http.StatusForbidden)
+			return
+		}
+	}
+	if a.Token != "" {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(a.Token)) != 1 {
+			writeError(w, errors.New("missing or wrong API token"), http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.ContentLength != 0 && r.Method != http.MethodGet {
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if ct != "application/json" && ct != "application/x-bittorrent" {
+			writeError(w, errors.New("expected application/json or application/x-bittorrent"), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// Token the API token clients must send: cfg.APIToken, or the one kept at
+// config.TokenPath, made up and saved there the first time
+func Token(cfg config.Config) (string, error) {
+	if cfg.APIToken != "" {
+		return cfg.APIToken, nil
+	}
+	path := config.TokenPath()
+	if b, err := os.ReadFile(path); err == nil && len(bytes.TrimSpace(b)) > 0 {
+		return string(bytes.TrimSpace(b)), nil
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Listen listens for API requests on addr, a TCP address or "unix:" and a socket path
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// a socket left by a daemon that didn't shut down cleanly
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[daemon] couldn't write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error, status int) {
+	writeJSONStatus(w, status, map[string]string{"error": err.Error()})
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrRestart):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func (a *API) withTorrent(h func(http.ResponseWriter, *http.Request, *torrent.Torrent)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := a.s.Torrent(r.PathValue("hash"))
+		if err != nil {
+			writeError(w, err, errorStatus(err))
+			return
+		}
+		h(w, r, t)
+	}
+}
+
+func (a *API) list(w http.ResponseWriter, r *http.Request) {
+	list := []torrent.Stats{}
+	for _, t := range a.s.Torrents() {
+		list = append(list, t.Stats())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, list)
+}
+
+func (a *API) add(w http.ResponseWriter, r *http.Request) {
+	raw := r.Header.Get("Content-Type") == "application/x-bittorrent"
+	var req AddRequest
+	if raw {
+		req.Allocation = r.URL.Query().Get("allocation")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Source == "" {
+		writeError(w, errors.New("expected {\"source\": ...}"), http.StatusBadRequest)
+		return
+	}
+	cfg := a.s.torrentConfig()
+	if req.Allocation != "" {
+		var err error
+		if cfg.Allocation, err = storage.ParseAllocation(req.Allocation); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	var t *torrent.Torrent
+	var err error
+	if raw {
+		t, err = a.s.openReader(r.Body, cfg)
+	} else {
+		t, err = a.s.openSource(req.Source, cfg)
+	}
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, t.Stats())
+}
+
+func (a *API) remove(w http.ResponseWriter, r *http.Request) {
+	deleteData, _ := strconv.ParseBool(r.URL.Query().Get("data"))
+	if err := a.s.Remove(r.PathValue("hash"), deleteData); err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) setPriority(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	var req FilePriority
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	p, err := torrent.ParsePriority(req.Priority)
+	if err == nil {
+		err = t.SetFilePriority(index, p)
+	}
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, fileStats(t, index))
+}
+
+func (a *API) move(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+	var req PathRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeError(w, errors.New("expected {\"path\": ...}"), http.StatusBadRequest)
+		return
+	}
+	if err := t.MoveStorage(req.Path); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, t.Stats())
+}
+
+func (a *API) rename(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	var req PathRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeError(w, errors.New("expected {\"path\": ...}"), http.StatusBadRequest)
+		return
+	}
+	if err := t.RenameFile(index, req.Path); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, fileStats(t, index))
+}
+
+// fileStats the entry of t.Files() for file index, which isn't a pad file
+func fileStats(t *torrent.Torrent, index int) torrent.FileStats {
+	for _, f := range t.Files() {
+		if f.Index == index {
+			return f
+		}
+	}
+	return torrent.FileStats{Index: index}
+}
+
+func (a *API) setTorrentLimits(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+	var req TorrentLimits
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxPeers < 1 {
+		writeError(w, errors.New("expected {\"max_peers\": n} with n at least 1"), http.StatusBadRequest)
+		return
+	}
+	t.Peers.SetMaxConns(req.MaxPeers)
+	writeJSON(w, req)
+}
+
+func (a *API) limits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Limits{a.s.DownloadLimit.Rate(), a.s.UploadLimit.Rate()})
+}
+
+func (a *API) setLimits(w http.ResponseWriter, r *http.Request) {
+	var req Limits
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	a.s.DownloadLimit.SetRate(req.DownloadRate)
+	a.s.UploadLimit.SetRate(req.UploadRate)
+	a.limits(w, r)
+}
+
+func (a *API) config(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.s.Config())
+}
+
+func (a *API) setConfig(w http.ResponseWriter, r *http.Request) {
+	c := a.s.Config()
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err == nil {
+		err = c.UnmarshalStrict(b)
+	}
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := a.s.SetConfig(c); err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+	a.config(w, r)
+}
@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/ratelimit"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+func TestAPIChecks(t *testing.T) {
+	s := &Session{DownloadLimit: ratelimit.New(0), UploadLimit: ratelimit.New(0), torrents: make(map[string]*torrent.Torrent)}
+	api := NewAPI(s)
+	api.Token = "secret"
+	hs := httptest.NewServer(api)
+	defer hs.Close()
+	host := strings.TrimPrefix(hs.URL, "http://")
+
+	tests := []struct {
+		name                string
+		method, path, body  string
+		contentType, origin string
+		token               string
+		want                int
+	}{
+		{"no token", "GET", "/api/torrents", "", "", "", "", 401},
+		{"wrong token", "GET", "/api/torrents", "", "", "", "nope", 401},
+		{"token", "GET", "/api/torrents", "", "", "", "secret", 200},
+		{"same origin", "GET", "/api/torrents", "", "", "http://" + host, "secret", 200},
+		{"foreign origin", "GET", "/api/torrents", "", "", "http://evil.example", "secret", 403},
+		{"foreign origin without token", "POST", "/api/torrents", `{"source": "/etc/passwd"}`, "text/plain", "http://evil.example", "", 403},
+		{"text/plain body", "POST", "/api/torrents", `{"source": "x.torrent"}`, "text/plain", "", "secret", 415},
+		{"form body", "PUT", "/api/limits", `download_rate=1`, "application/x-www-form-urlencoded", "", "secret", 415},
+		{"json body", "PUT", "/api/limits", `{"download_rate": 1000}`, "application/json; charset=utf-8", "", "secret", 200},
+		{"bad allocation", "POST", "/api/torrents", `{"source": "x.torrent", "allocation": "bogus"}`, "application/json", "", "secret", 400},
+		{"no such torrent", "POST", "/api/torrents/abc/pause", "", "", "", "secret", 404},
+		{"wrong method", "PATCH", "/api/limits", "", "", "", "secret", 405},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, hs.URL+tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, res.StatusCode, b, tt.want)
+		}
+	}
+	if s.DownloadLimit.Rate() != 1000 {
+		t.Fatal("limit not set", s.DownloadLimit.Rate())
+	}
+}
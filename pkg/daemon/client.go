@@ -0,0 +1,287 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// ErrUnavailable the daemon couldn't be reached
+var ErrUnavailable = errors.New("daemon not running")
+
+// APIError an error reported by the daemon
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Client talks to a daemon's JSON API
+type Client struct {
+	base  string
+	http  *http.Client
+	token string
+}
+
+// NewClient a client for the daemon at addr, a host:port or "unix:" and a
+// socket path. It sends the API token from $GTC_API_TOKEN, or the one the
+// daemon left at config.TokenPath.
+func NewClient(addr string) *Client {
+	c := &Client{base: "http://" + addr, http: &http.Client{Timeout: 30 * time.Second}}
+	c.token = os.Getenv("GTC_API_TOKEN")
+	if c.token == "" {
+		b, _ := os.ReadFile(config.TokenPath())
+		c.token = strings.TrimSpace(string(b))
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		c.base = "http://gtc"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c
+}
+
+// do sends a request with body encoded as JSON unless it's an io.Reader, and
+// decodes the response into out when it's not nil
+func (c *Client) do(method, path, contentType string, body interface{}, out interface{}) error {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+	default:
+		buf, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("%w: %v", ErrUnavailable, opErr)
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = res.Status
+		}
+		return &APIError{Status: res.StatusCode, Message: e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *Client) get(path string, out interface{}) error {
+	return c.do(http.MethodGet, path, "", nil, out)
+}
+
+func torrentPath(hash string, rest ...string) string {
+	return "/api/torrents/" + url.PathEscape(hash) + strings.Join(rest, "")
+}
+
+// Torrents every torrent the daemon runs
+func (c *Client) Torrents() ([]torrent.Stats, error) {
+	var list []torrent.Stats
+	err := c.get("/api/torrents", &list)
+	return list, err
+}
+
+// Torrent one torrent's stats
+func (c *Client) Torrent(hash string) (torrent.Stats, error) {
+	var st torrent.Stats
+	err := c.get(torrentPath(hash), &st)
+	return st, err
+}
+
+// Add has the daemon open source, a path on its machine, an http(s) URL or a magnet link
+func (c *Client) Add(source string) (torrent.Stats, error) {
+	return c.AddWith(AddRequest{Source: source})
+}
+
+// AddWith has the daemon open req.Source as req says
+func (c *Client) AddWith(req AddRequest) (torrent.Stats, error) {
+	var st torrent.Stats
+	err := c.do(http.MethodPost, "/api/torrents", "application/json", req, &st)
+	return st, err
+}
+
+// AddTorrent sends the daemon the .torrent read from r
+func (c *Client) AddTorrent(r io.Reader) (torrent.Stats, error) {
+	return c.AddTorrentWith(r, "")
+}
+
+// AddTorrentWith sends the daemon the .torrent read from r, to be allocated
+// as allocation says, or as the session's default when it's empty
+func (c *Client) AddTorrentWith(r io.Reader, allocation string) (torrent.Stats, error) {
+	path := "/api/torrents"
+	if allocation != "" {
+		path += "?allocation=" + url.QueryEscape(allocation)
+	}
+	var st torrent.Stats
+	err := c.do(http.MethodPost, path, "application/x-bittorrent", r, &st)
+	return st, err
+}
+
+// Remove drops a torrent, deleting its data if asked to
+func (c *Client) Remove(hash string, deleteData bool) error {
+	path := torrentPath(hash)
+	if deleteData {
+		path += "?data=1"
+	}
+	return c.do(http.MethodDelete, path, "", nil, nil)
+}
+
+// Pause disconnects a torrent from its peers
+func (c *Client) Pause(hash string) (torrent.Stats, error) {
+	var st torrent.Stats
+	err := c.do(http.MethodPost, torrentPath(hash, "/pause"), "", nil, &st)
+	return st, err
+}
+
+// Resume reconnects a paused torrent
+func (c *Client) Resume(hash string) (torrent.Stats, error) {
+	var st torrent.Stats
+	err := c.do(http.MethodPost, torrentPath(hash, "/resume"), "", nil, &st)
+	return st, err
+}
+
+// Move moves a torrent's files to dir, a directory on the daemon's machine
+func (c *Client) Move(hash, dir string) (torrent.Stats, error) {
+	var st torrent.Stats
+	err := c.do(http.MethodPost, torrentPath(hash, "/move"), "application/json", PathRequest{dir}, &st)
+	return st, err
+}
+
+// Files a torrent's files
+func (c *Client) Files(hash string) ([]torrent.FileStats, error) {
+	var list []torrent.FileStats
+	err := c.get(torrentPath(hash, "/files"), &list)
+	return list, err
+}
+
+// SetFilePriority sets the priority of a torrent's file
+func (c *Client) SetFilePriority(hash string, index int, p torrent.Priority) (torrent.FileStats, error) {
+	var fs torrent.FileStats
+	err := c.do(http.MethodPut, torrentPath(hash, fmt.Sprintf("/files/%d", index)), "application/json", FilePriority{p.String()}, &fs)
+	return fs, err
+}
+
+// RenameFile moves a torrent's file to path, slash separated and relative
+// to the directory its files are under
+func (c *Client) RenameFile(hash string, index int, path string) (torrent.FileStats, error) {
+	var fs torrent.FileStats
+	err := c.do(http.MethodPost, torrentPath(hash, fmt.Sprintf("/files/%d/rename", index)), "application/json", PathRequest{path}, &fs)
+	return fs, err
+}
+
+// Peers a torrent's connected peers
+func (c *Client) Peers(hash string) ([]torrent.PeerStats, error) {
+	var list []torrent.PeerStats
+	err := c.get(torrentPath(hash, "/peers"), &list)
+	return list, err
+}
+
+// Trackers a torrent's trackers
+func (c *Client) Trackers(hash string) ([]torrent.TrackerStatus, error) {
+	var list []torrent.TrackerStatus
+	err := c.get(torrentPath(hash, "/trackers"), &list)
+	return list, err
+}
+
+// Pieces the pieces of a torrent the daemon has
+func (c *Client) Pieces(hash string) (torrent.PieceMap, error) {
+	var pm torrent.PieceMap
+	err := c.get(torrentPath(hash, "/pieces"), &pm)
+	return pm, err
+}
+
+// Limits the daemon's transfer caps
+func (c *Client) Limits() (Limits, error) {
+	var l Limits
+	err := c.get("/api/limits", &l)
+	return l, err
+}
+
+// SetLimits sets the daemon's transfer caps
+func (c *Client) SetLimits(l Limits) (Limits, error) {
+	var out Limits
+	err := c.do(http.MethodPut, "/api/limits", "application/json", l, &out)
+	return out, err
+}
+
+// Config the daemon's settings
+func (c *Client) Config() (config.Config, error) {
+	var cfg config.Config
+	err := c.get("/api/config", &cfg)
+	return cfg, err
+}
+
+// SetConfig changes the daemon's settings to cfg, see Session.SetConfig
+func (c *Client) SetConfig(cfg config.Config) (config.Config, error) {
+	var out config.Config
+	err := c.do(http.MethodPatch, "/api/config", "application/json", cfg, &out)
+	return out, err
+}
+
+// Resolve the full info hash of the one torrent whose hash starts with prefix
+func (c *Client) Resolve(prefix string) (string, error) {
+	list, err := c.Torrents()
+	if err != nil {
+		return "", err
+	}
+	prefix = strings.ToLower(prefix)
+	var found []string
+	for _, st := range list {
+		if st.InfoHash == prefix {
+			return prefix, nil
+		}
+		if strings.HasPrefix(st.InfoHash, prefix) {
+			found = append(found, st.InfoHash)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", &APIError{Status: http.StatusNotFound, Message: ErrNotFound.Error()}
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%q matches %d torrents", prefix, len(found))
+}
@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"strconv"
+
+	"github.com/mbags/gtc/pkg/metrics"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// Collect adds the metrics of the session and each of its torrents, their
+// peers, trackers and storage to r
+func (s *Session) Collect(r *metrics.Registry) {
+	states := map[string]int{}
+	r.Gauge("gtc_download_limit_bytes_per_second", "Session download cap, 0 for none.", float64(s.DownloadLimit.Rate()))
+	r.Gauge("gtc_upload_limit_bytes_per_second", "Session upload cap, 0 for none.", float64(s.UploadLimit.Rate()))
+	for _, t := range s.Torrents() {
+		st := t.Stats()
+		states[st.State]++
+		collectTorrent(r, t, st)
+	}
+	for state := torrent.StateChecking; state <= torrent.StateError; state++ {
+		r.Gauge("gtc_torrents", "Torrents in the session by state.", float64(states[state.String()]), "state", state.String())
+	}
+}
+
+func collectTorrent(r *metrics.Registry, t *torrent.Torrent, st torrent.Stats) {
+	ih := []string{"info_hash", st.InfoHash}
+	with := func(labels ...string) []string {
+		return append(append([]string{}, ih...), labels...)
+	}
+	r.Gauge("gtc_torrent_info", "Always 1, labelled with the torrent's name.", 1, with("name", st.Name)...)
+	r.Gauge("gtc_torrent_size_bytes", "Total size of the torrent's files.", float64(st.Size), ih...)
+	r.Gauge("gtc_torrent_done_bytes", "Bytes of the torrent in verified pieces.", float64(st.Done), ih...)
+	r.Gauge("gtc_torrent_pieces", "Pieces in the torrent.", float64(st.Pieces), ih...)
+	r.Gauge("gtc_torrent_pieces_have", "Pieces we have verified.", float64(st.PiecesDone), ih...)
+
+	bytes := "Bytes exchanged with peers by direction and kind, payload for piece data and overhead for the rest of the protocol."
+	r.Counter("gtc_torrent_bytes_total", bytes, float64(st.Downloaded), with("direction", "down", "kind", "payload")...)
+	r.Counter("gtc_torrent_bytes_total", bytes, float64(st.OverheadDownloaded), with("direction", "down", "kind", "overhead")...)
+	r.Counter("gtc_torrent_bytes_total", bytes, float64(st.Uploaded), with("direction", "up", "kind", "payload")...)
+	r.Counter("gtc_torrent_bytes_total", bytes, float64(st.OverheadUploaded), with("direction", "up", "kind", "overhead")...)
+	r.Counter("gtc_torrent_pieces_verified_total", "Pieces downloaded that passed their hash check.", float64(st.PiecesVerified), ih...)
+	r.Counter("gtc_torrent_hash_failures_total", "Pieces downloaded that failed their hash check.", float64(st.HashFailures), ih...)
+	r.Gauge("gtc_storage_queue_depth", "Pieces waiting to be written and disk reads in progress.", float64(st.DiskQueue), ih...)
+
+	choked, unchoked, interested := 0, 0, 0
+	for _, p := range t.PeerStats() {
+		if p.Choked {
+			choked++
+		} else {
+			unchoked++
+		}
+		if p.Interested {
+			interested++
+		}
+	}
+	r.Gauge("gtc_torrent_peers", "Connected peers by whether they choke us.", float64(choked), with("choked", "true")...)
+	r.Gauge("gtc_torrent_peers", "Connected peers by whether they choke us.", float64(unchoked), with("choked", "false")...)
+	r.Gauge("gtc_torrent_peers_interested", "Connected peers interested in our pieces.", float64(interested), ih...)
+	r.Gauge("gtc_torrent_seeds", "Connected peers that have every piece.", float64(st.Seeds), ih...)
+
+	for _, tr := range t.Trackers() {
+		l := with("tracker", tr.URL, "tier", strconv.Itoa(tr.Tier))
+		r.Counter("gtc_tracker_announces_total", "Announces sent to the tracker.", float64(tr.Announces), l...)
+		r.Counter("gtc_tracker_announce_errors_total", "Announces that failed.", float64(tr.Errors), l...)
+		r.Summary("gtc_tracker_announce_duration_seconds", "Time taken by announces.", tr.AnnounceTime.Seconds(), int64(tr.Announces), l...)
+		r.Gauge("gtc_tracker_peers", "Peers returned by the last announce.", float64(tr.Peers), l...)
+	}
+}
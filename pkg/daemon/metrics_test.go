@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/metrics"
+	"github.com/mbags/gtc/pkg/ratelimit"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+func TestCollectEmpty(t *testing.T) {
+	s := &Session{DownloadLimit: ratelimit.New(1000), UploadLimit: ratelimit.New(0), torrents: make(map[string]*torrent.Torrent)}
+	r := metrics.NewRegistry()
+	s.Collect(r)
+	var b bytes.Buffer
+	r.WriteTo(&b)
+	want := `# HELP gtc_download_limit_bytes_per_second Session download cap, 0 for none.
+# TYPE gtc_download_limit_bytes_per_second gauge
+gtc_download_limit_bytes_per_second 1000
+# HELP gtc_upload_limit_bytes_per_second Session upload cap, 0 for none.
+# TYPE gtc_upload_limit_bytes_per_second gauge
+gtc_upload_limit_bytes_per_second 0
+# HELP gtc_torrents Torrents in the session by state.
+# TYPE gtc_torrents gauge
+gtc_torrents{state="checking"} 0
+gtc_torrents{state="downloading_metadata"} 0
+gtc_torrents{state="downloading"} 0
+gtc_torrents{state="seeding"} 0
+gtc_torrents{state="paused"} 0
+gtc_torrents{state="stopped"} 0
+gtc_torrents{state="error"} 0
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
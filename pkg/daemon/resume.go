@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// resumeEvents the events after which a torrent's resume data is saved again
+const resumeEvents = event.StateChanged | event.MetadataReceived | event.StorageMoved | event.FileRenamed | event.FilePriorityChanged
+
+// Restore adds back the torrents saved in the config's resume_dir by an
+// earlier run, and from then on keeps resume data there for every torrent
+// the session has. Call it before adding torrents and before Start.
+// Torrents that can't be restored are logged and left out.
+func (s *Session) Restore() error {
+	dir := s.Config().ResumeDir
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.resumeDir = dir
+	s.mu.Unlock()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		t, err := s.restore(path)
+		if err != nil {
+			log.Printf("Couldn't restore %s: %v", path, err)
+			continue
+		}
+		log.Printf("Restored %s", t.Name())
+	}
+	return nil
+}
+
+func (s *Session) restore(path string) (*torrent.Torrent, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rd torrent.ResumeData
+	if err := json.Unmarshal(b, &rd); err != nil {
+		return nil, err
+	}
+	t, err := torrent.NewFromResumeData(context.Background(), rd, s.torrentConfig())
+	if err != nil {
+		return nil, err
+	}
+	if rd.Paused {
+		t.Pause()
+	}
+	return s.add(t)
+}
+
+// keepResume saves t's resume data now and whenever it changes, if the
+// session keeps resume data at all
+func (s *Session) keepResume(hash string, t *torrent.Torrent) {
+	s.mu.Lock()
+	keep := s.resumeDir != ""
+	s.mu.Unlock()
+	if !keep {
+		return
+	}
+	sub := t.Events.Handle(resumeEvents, 0, func(event.Event) { s.saveResume(hash, t) })
+	s.mu.Lock()
+	s.resumeSubs[hash] = sub
+	s.mu.Unlock()
+	s.saveResume(hash, t)
+}
+
+// saveResume writes t's resume data, unless it's been removed from the
+// session meanwhile. The file is replaced whole so a crash never leaves half of one.
+func (s *Session) saveResume(hash string, t *torrent.Torrent) {
+	// under resumeMu so a save can't land after forgetResume deletes the file
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	s.mu.Lock()
+	dir, current := s.resumeDir, s.torrents[hash] == t
+	s.mu.Unlock()
+	if dir == "" || !current {
+		return
+	}
+	b, err := json.MarshalIndent(t.ResumeData(), "", "\t")
+	if err == nil {
+		path := filepath.Join(dir, hash+".json")
+		if err = os.WriteFile(path+".tmp", b, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't save resume data for %s: %v", t.Name(), err)
+	}
+}
+
+// forgetResume stops saving resume data for a torrent removed from the
+// session, deleting what's saved if asked to
+func (s *Session) forgetResume(hash string, deleteFile bool) error {
+	s.mu.Lock()
+	sub, dir := s.resumeSubs[hash], s.resumeDir
+	delete(s.resumeSubs, hash)
+	s.mu.Unlock()
+	if sub != nil {
+		sub.Close()
+	}
+	if !deleteFile || dir == "" {
+		return nil
+	}
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	if err := os.Remove(filepath.Join(dir, hash+".json")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing resume data: %w", err)
+	}
+	return nil
+}
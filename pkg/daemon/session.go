@@ -0,0 +1,387 @@
+// daemon runs torrents in the background and lets other programs control
+// them through a JSON API
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/lsd"
+	"github.com/mbags/gtc/pkg/ratelimit"
+	"github.com/mbags/gtc/pkg/torrent"
+	"github.com/mbags/gtc/pkg/tracker"
+	"github.com/mbags/gtc/pkg/util"
+	"github.com/mbags/gtc/pkg/utp"
+)
+
+var (
+	ErrNotFound  = errors.New("no such torrent")
+	ErrDuplicate = errors.New("torrent already added")
+	ErrRestart   = errors.New("can't change while running, restart the daemon")
+)
+
+// fetchClient fetches .torrent files added by URL
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// restartOnly settings the session can't change once it's up
+var restartOnly = map[string]bool{
+	"listen": true, "api": true, "api_token": true, "metrics": true, "max_conns": true,
+	"encryption": true, "dht": true, "lsd": true, "resume_dir": true,
+}
+
+// Session the sockets and services shared by every torrent we run, and the torrents themselves
+type Session struct {
+	DownloadLimit, UploadLimit *ratelimit.Limiter // applied across all torrents
+
+	sock     *utp.Socket
+	listener *torrent.Listener
+	lsd      *lsd.Service
+	limiter  *torrent.Limiter
+
+	mu       sync.Mutex
+	cfg      config.Config
+	torrents map[string]*torrent.Torrent // by hex info hash
+	watcher  *watcher                    // nil without watch directories
+	started  bool                        // by Start, watch directories are scanned from then on
+
+	resumeDir  string                         // set by Restore, empty when resume data isn't kept
+	resumeSubs map[string]*event.Subscription // by hex info hash, saving resume data as torrents change
+	resumeMu   sync.Mutex                     // serialises writing and removing resume files
+}
+
+// NewSession listens for peers over TCP and uTP, and starts local service
+// discovery, as cfg says. Whatever fails to start is logged and done without.
+// Watch directories aren't scanned until Start.
+func NewSession(cfg config.Config) *Session {
+	s := &Session{
+		DownloadLimit: ratelimit.New(cfg.DownloadRate),
+		UploadLimit:   ratelimit.New(cfg.UploadRate),
+		limiter:       torrent.NewLimiter(cfg.MaxConns),
+		cfg:           cfg,
+		torrents:      make(map[string]*torrent.Torrent),
+		resumeSubs:    make(map[string]*event.Subscription),
+	}
+	port, _ := cfg.Port()
+	configureTracker(cfg)
+	// one UDP port for uTP peers and UDP trackers
+	sock, err := utp.Listen("udp", cfg.Listen)
+	if err != nil {
+		log.Printf("uTP disabled: %v", err)
+	} else {
+		s.sock = sock
+		tracker.UDPSocket = sock
+	}
+	if l, err := torrent.Listen(cfg.Listen, cfg.EncryptionPolicy()); err != nil {
+		log.Printf("Not accepting incoming connections: %v", err)
+	} else {
+		l.Start()
+		if s.sock != nil {
+			l.Serve(s.sock)
+		}
+		s.listener = l
+	}
+	if cfg.LSD {
+		if svc, err := lsd.New(port); err != nil {
+			log.Printf("Local service discovery disabled: %v", err)
+		} else {
+			svc.Start()
+			s.lsd = svc
+		}
+	}
+	return s
+}
+
+// Start starts scanning the watch directories. Call it once the session is
+// restored, so torrents it brings back aren't added again from there.
+func (s *Session) Start() {
+	s.mu.Lock()
+	s.started = true
+	dirs := s.cfg.Watch
+	s.mu.Unlock()
+	s.watch(dirs)
+}
+
+// watch replaces the watcher with one for dirs
+func (s *Session) watch(dirs []config.WatchDir) {
+	var w *watcher
+	if len(dirs) > 0 {
+		w = newWatcher(s, dirs)
+	}
+	s.mu.Lock()
+	old := s.watcher
+	s.watcher = w
+	s.mu.Unlock()
+	if old != nil {
+		// not under mu, a scan in progress may be adding a torrent
+		old.close()
+	}
+}
+
+func configureTracker(cfg config.Config) {
+	port, _ := cfg.Port()
+	tracker.Configure(tracker.Settings{
+		PeerIDPrefix: cfg.PeerIDPrefix,
+		Port:         port,
+		NumWant:      cfg.NumWant,
+		UserAgent:    cfg.UserAgent,
+	})
+}
+
+// Config the session's settings as they are now
+func (s *Session) Config() config.Config {
+	s.mu.Lock()
+	c := s.cfg
+	s.mu.Unlock()
+	// PUT /api/limits changes these without going through SetConfig
+	c.DownloadRate, c.UploadRate = s.DownloadLimit.Rate(), s.UploadLimit.Rate()
+	return c
+}
+
+// SetConfig applies c to the running session. Rates, max_peers, watch
+// directories and what we tell trackers change straight away, download_dir,
+// allocation, pex and peer_id_prefix apply to torrents added from then on. The rest can
+// only change with a restart, so trying to is an error wrapping ErrRestart.
+func (s *Session) SetConfig(c config.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	old := s.Config()
+	var fixed []string
+	for _, key := range config.Changed(old, c) {
+		if restartOnly[key] {
+			fixed = append(fixed, key)
+		}
+	}
+	if len(fixed) > 0 {
+		return fmt.Errorf("%w: %s", ErrRestart, strings.Join(fixed, ", "))
+	}
+	s.DownloadLimit.SetRate(c.DownloadRate)
+	s.UploadLimit.SetRate(c.UploadRate)
+	configureTracker(c)
+	s.mu.Lock()
+	s.cfg = c
+	started := s.started
+	s.mu.Unlock()
+	if started && c.Get("watch") != old.Get("watch") {
+		s.watch(c.Watch)
+	}
+	if c.MaxPeers != old.MaxPeers {
+		// overrides limits set on single torrents
+		for _, t := range s.Torrents() {
+			t.Peers.SetMaxConns(c.MaxPeers)
+		}
+	}
+	return nil
+}
+
+// torrentConfig how torrents the session opens are set up
+func (s *Session) torrentConfig() torrent.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := s.cfg.PeerIDPrefix
+	return torrent.Config{
+		Dir:        s.cfg.DownloadDir,
+		PeerID:     []byte(prefix + util.SessionID(20-len(prefix))),
+		Limiter:    s.limiter,
+		MaxConns:   s.cfg.MaxPeers,
+		NoPEX:      !s.cfg.PEX,
+		Allocation: s.cfg.AllocationMode(),
+	}
+}
+
+// Open loads a .torrent file and starts downloading it
+func (s *Session) Open(filename string) (*torrent.Torrent, error) {
+	return s.open(filename, s.torrentConfig())
+}
+
+func (s *Session) open(filename string, cfg torrent.Config) (*torrent.Torrent, error) {
+	t, err := torrent.NewFromFilename(context.Background(), filename, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s.add(t)
+}
+
+// OpenSource opens a .torrent given as a path or an http(s) URL, or a magnet link
+func (s *Session) OpenSource(source string) (*torrent.Torrent, error) {
+	return s.openSource(source, s.torrentConfig())
+}
+
+func (s *Session) openSource(source string, cfg torrent.Config) (*torrent.Torrent, error) {
+	switch {
+	case strings.HasPrefix(source, "magnet:"):
+		t, err := torrent.NewFromMagnet(context.Background(), source, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s.add(t)
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		res, err := fetchClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", source, res.Status)
+		}
+		return s.openReader(res.Body, cfg)
+	}
+	return s.open(source, cfg)
+}
+
+// OpenReader opens the .torrent read from r
+func (s *Session) OpenReader(r io.Reader) (*torrent.Torrent, error) {
+	return s.openReader(r, s.torrentConfig())
+}
+
+func (s *Session) openReader(r io.Reader, cfg torrent.Config) (*torrent.Torrent, error) {
+	t, err := torrent.NewFromReader(context.Background(), io.LimitReader(r, 16<<20), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s.add(t)
+}
+
+// add is Add for a torrent the session made, stopping it if it can't be added
+func (s *Session) add(t *torrent.Torrent) (*torrent.Torrent, error) {
+	if err := s.Add(t); err != nil {
+		t.Stop()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Add wires t to the session's sockets, limits and discovery, and starts it
+func (s *Session) Add(t *torrent.Torrent) error {
+	hash := fmt.Sprintf("%x", t.MetaInfo.InfoHash)
+	s.mu.Lock()
+	if _, ok := s.torrents[hash]; ok {
+		s.mu.Unlock()
+		return ErrDuplicate
+	}
+	s.torrents[hash] = t
+	s.mu.Unlock()
+
+	if s.sock != nil {
+		t.Peers.UTP = s.sock
+	}
+	t.Peers.DownloadLimit, t.Peers.UploadLimit = s.DownloadLimit, s.UploadLimit
+	t.Peers.Encryption = s.Config().EncryptionPolicy()
+	if s.listener != nil {
+		s.listener.Add(t)
+	}
+	if s.lsd != nil {
+		t.UseLSD(s.lsd)
+	}
+	t.Start()
+	s.keepResume(hash, t)
+	return nil
+}
+
+// Torrent the torrent with the hex info hash
+func (s *Session) Torrent(hash string) (*torrent.Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[strings.ToLower(hash)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Torrents every torrent in the session
+func (s *Session) Torrents() []*torrent.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*torrent.Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		list = append(list, t)
+	}
+	return list
+}
+
+// Remove drops a torrent from the session, deleting its downloaded data if asked to
+func (s *Session) Remove(hash string, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[strings.ToLower(hash)]
+	delete(s.torrents, strings.ToLower(hash))
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	rerr := s.forgetResume(strings.ToLower(hash), true)
+	if s.listener != nil {
+		s.listener.Remove(t)
+	}
+	if s.lsd != nil {
+		s.lsd.Remove([]byte(t.MetaInfo.InfoHash))
+	}
+	err := t.Stop()
+	if deleteData && t.HasInfo() {
+		err = errors.Join(err, t.Storage.Delete())
+	}
+	return errors.Join(err, rerr)
+}
+
+// Close stops every torrent, returning once they've flushed their data and
+// told their trackers, then stops listening for peers
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.started = false
+	s.mu.Unlock()
+	s.watch(nil)
+	s.mu.Lock()
+	list := make([]*torrent.Torrent, 0, len(s.torrents))
+	for hash, t := range s.torrents {
+		list = append(list, t)
+		delete(s.torrents, hash)
+	}
+	hashes := make([]string, 0, len(s.resumeSubs))
+	for hash := range s.resumeSubs {
+		hashes = append(hashes, hash)
+	}
+	s.mu.Unlock()
+	for _, hash := range hashes {
+		// kept on disk for the next run
+		s.forgetResume(hash, false)
+	}
+	errs := make([]error, len(list))
+	var wg sync.WaitGroup
+	for i, t := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.listener != nil {
+				s.listener.Remove(t)
+			}
+			if s.lsd != nil {
+				s.lsd.Remove([]byte(t.MetaInfo.InfoHash))
+			}
+			errs[i] = t.Stop()
+		}()
+	}
+	wg.Wait()
+	// the torrents are done with them, their last announces included
+	if s.listener != nil {
+		errs = append(errs, s.listener.Close())
+	}
+	if s.lsd != nil {
+		errs = append(errs, s.lsd.Close())
+	}
+	if s.sock != nil {
+		if tracker.UDPSocket == s.sock {
+			tracker.UDPSocket = nil
+		}
+		errs = append(errs, s.sock.Close())
+	}
+	return errors.Join(errs...)
+}
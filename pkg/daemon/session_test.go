@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/tracker"
+)
+
+func TestSessionClose(t *testing.T) {
+	cfg := config.Default()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.LSD = false
+	s := NewSession(cfg)
+	if s.listener == nil || s.sock == nil {
+		t.Skip("couldn't listen here")
+	}
+	tcp := s.listener.Port()
+	udp := s.sock.Addr().String()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tcp))); err == nil {
+		c.Close()
+		t.Errorf("still accepting peers on %d", tcp)
+	}
+	pc, err := net.ListenPacket("udp", udp)
+	if err != nil {
+		t.Errorf("uTP socket still open: %v", err)
+	} else {
+		pc.Close()
+	}
+	if tracker.UDPSocket != nil {
+		t.Errorf("trackers still announce through the closed socket")
+	}
+}
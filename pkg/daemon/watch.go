@@ -0,0 +1,166 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/storage"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+const (
+	watchInterval = 2 * time.Second
+	maxWatchFile  = 16 << 20
+
+	// a watched file is renamed with one of these once dealt with, so it isn't added again
+	addedSuffix  = ".added"
+	failedSuffix = ".failed"
+)
+
+// watcher adds the .torrent and .magnet files that show up in the session's
+// watch directories. Directories are polled, and a file is only read once
+// its size and modification time have held still for a whole interval, so
+// files still being written aren't picked up half done.
+type watcher struct {
+	s    *Session
+	dirs []config.WatchDir
+	seen map[string]fileState // by path, files not yet settled at the last scan
+
+	stop, done chan struct{}
+}
+
+type fileState struct {
+	size int64
+	mod  time.Time
+}
+
+func newWatcher(s *Session, dirs []config.WatchDir) *watcher {
+	w := &watcher{
+		s:    s,
+		dirs: dirs,
+		seen: make(map[string]fileState),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, d := range dirs {
+		log.Printf("Watching %s for torrents", d.Dir)
+	}
+	go w.run()
+	return w
+}
+
+func (w *watcher) run() {
+	defer close(w.done)
+	tick := time.NewTicker(watchInterval)
+	defer tick.Stop()
+	for {
+		w.scan()
+		select {
+		case <-tick.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// close stops watching, returning once a scan in progress has finished
+func (w *watcher) close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *watcher) scan() {
+	seen := make(map[string]fileState)
+	for _, d := range w.dirs {
+		entries, err := os.ReadDir(d.Dir)
+		if err != nil {
+			log.Printf("Couldn't watch %s: %v", d.Dir, err)
+			continue
+		}
+		for _, e := range entries {
+			if !watched(e) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(d.Dir, e.Name())
+			st := fileState{info.Size(), info.ModTime()}
+			if prev, ok := w.seen[path]; !ok || prev != st {
+				seen[path] = st
+				continue
+			}
+			w.add(path, d)
+		}
+	}
+	w.seen = seen
+}
+
+// watched reports whether e is a file that may hold a torrent. Hidden
+// files are skipped, some programs write to one and rename it when done.
+func watched(e os.DirEntry) bool {
+	name := strings.ToLower(e.Name())
+	if !e.Type().IsRegular() || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return strings.HasSuffix(name, ".torrent") || strings.HasSuffix(name, ".magnet")
+}
+
+// add adds the torrent in path with the settings of the directory it's in,
+// then renames the file out of the way
+func (w *watcher) add(path string, d config.WatchDir) {
+	t, err := w.open(path, d)
+	if err == nil {
+		if d.Paused {
+			t.Pause()
+		}
+		_, err = w.s.add(t)
+	}
+	suffix := addedSuffix
+	switch {
+	case errors.Is(err, ErrDuplicate):
+		log.Printf("%s is already added", path)
+	case err != nil:
+		log.Printf("Couldn't add %s: %v", path, err)
+		suffix = failedSuffix
+	default:
+		log.Printf("Added %s from %s", t.Name(), path)
+	}
+	if err := os.Rename(path, path+suffix); err != nil {
+		log.Printf("Couldn't rename %s, it'll be seen again: %v", path, err)
+	}
+}
+
+// open reads the .torrent, or the magnet link in a .magnet file, at path
+func (w *watcher) open(path string, d config.WatchDir) (*torrent.Torrent, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxWatchFile {
+		return nil, errors.New("too big for a torrent")
+	}
+	cfg := w.s.torrentConfig()
+	if d.DownloadDir != "" {
+		cfg.Dir = d.DownloadDir
+	}
+	if d.MaxPeers > 0 {
+		cfg.MaxConns = d.MaxPeers
+	}
+	if d.Allocation != "" {
+		// checked by config.Validate
+		cfg.Allocation, _ = storage.ParseAllocation(d.Allocation)
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".magnet") {
+		return torrent.NewFromMagnet(context.Background(), strings.TrimSpace(string(b)), cfg)
+	}
+	return torrent.NewFromReader(context.Background(), bytes.NewReader(b), cfg)
+}
@@ -0,0 +1,236 @@
+package diskio
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+const (
+	// DefaultWriteCache how many bytes of verified pieces may wait to be
+	// written before a Cache reports itself full
+	DefaultWriteCache = 16 << 20
+	// DefaultReadCache how many bytes of pieces read for seeding a Cache keeps
+	DefaultReadCache = 16 << 20
+)
+
+// Store where a torrent's data is kept, addressed by offsets into the
+// concatenation of its files, like storage.Storage
+type Store interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Cache a torrent's disk reads and writes. Verified pieces are queued whole
+// and written by the pool, and read from memory until they're on disk. A
+// block read for a peer brings in its whole piece, since the rest of it is
+// usually asked for next. Everything reading the torrent's data should go
+// through the Cache, to see pieces not written yet.
+type Cache struct {
+	store Store
+	pool  *Pool
+	m     *metainfo.MetaInfo
+
+	// Drained is called when the write queue, having been full, is down to
+	// half, so the downloading held back can go on
+	Drained func()
+
+	mu         sync.Mutex
+	idle       *sync.Cond     // broadcast when a write finishes
+	dirty      map[int][]byte // verified pieces queued or being written, by index
+	dirtyBytes int64
+	maxDirty   int64
+	full       bool
+	err        error // the first write that failed since the last Flush
+
+	clean      map[int]*list.Element // by index, elements of lru
+	lru        *list.List            // of *cached, most recently used first
+	cleanBytes int64
+	maxClean   int64
+	loading    map[int]*load // pieces being read, so readers missing the same one share a read
+
+	reads atomic.Int64 // in progress
+}
+
+type cached struct {
+	index int
+	data  []byte
+}
+
+type load struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewCache returns a Cache for the torrent m kept in store, doing its I/O on pool
+func NewCache(store Store, pool *Pool, m *metainfo.MetaInfo) *Cache {
+	c := &Cache{
+		store:    store,
+		pool:     pool,
+		m:        m,
+		dirty:    make(map[int][]byte),
+		maxDirty: DefaultWriteCache,
+		clean:    make(map[int]*list.Element),
+		lru:      list.New(),
+		maxClean: DefaultReadCache,
+		loading:  make(map[int]*load),
+	}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// WritePiece queues piece index, already verified, to be written. done, if
+// not nil, is called from the pool once it's on disk or failed to get there.
+// data isn't copied and mustn't change.
+func (c *Cache) WritePiece(index int, data []byte, done func(error)) {
+	c.mu.Lock()
+	c.dirty[index] = data
+	c.dirtyBytes += int64(len(data))
+	if c.dirtyBytes >= c.maxDirty {
+		c.full = true
+	}
+	c.mu.Unlock()
+	c.pool.do(func() {
+		_, err := c.store.WriteAt(data, int64(index)*c.m.PieceLength)
+		c.mu.Lock()
+		delete(c.dirty, index)
+		c.dirtyBytes -= int64(len(data))
+		if err == nil {
+			// peers without it yet are about to ask for it
+			c.insert(index, data)
+		} else if c.err == nil {
+			c.err = err
+		}
+		drained := c.full && c.dirtyBytes <= c.maxDirty/2
+		if drained {
+			c.full = false
+		}
+		c.idle.Broadcast()
+		c.mu.Unlock()
+		if done != nil {
+			done(err)
+		}
+		if drained && c.Drained != nil {
+			c.Drained()
+		}
+	})
+}
+
+// Full reports whether so much is waiting to be written that nothing more
+// should be downloaded until Drained
+func (c *Cache) Full() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.full
+}
+
+// ReadAt reads len(p) bytes starting at off from the pieces it covers, all
+// of which must be verified
+func (c *Cache) ReadAt(p []byte, off int64) (int, error) {
+	c.reads.Add(1)
+	defer c.reads.Add(-1)
+	done := 0
+	for len(p) > 0 {
+		index := int(off / c.m.PieceLength)
+		if index >= c.m.NumPieces() {
+			return done, io.EOF
+		}
+		data, err := c.piece(index)
+		if err != nil {
+			return done, err
+		}
+		n := copy(p, data[off-int64(index)*c.m.PieceLength:])
+		done += n
+		p = p[n:]
+		off += int64(n)
+	}
+	return done, nil
+}
+
+// piece the whole of piece index, from memory or read in by the pool
+func (c *Cache) piece(index int) ([]byte, error) {
+	c.mu.Lock()
+	if data, ok := c.dirty[index]; ok {
+		c.mu.Unlock()
+		return data, nil
+	}
+	if e, ok := c.clean[index]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cached).data, nil
+	}
+	l, ok := c.loading[index]
+	if !ok {
+		l = &load{done: make(chan struct{})}
+		c.loading[index] = l
+	}
+	c.mu.Unlock()
+	if !ok {
+		// not under mu, the pool's queue may be full of jobs waiting for it
+		c.pool.do(func() {
+			data := make([]byte, c.m.PieceSize(index))
+			_, err := c.store.ReadAt(data, int64(index)*c.m.PieceLength)
+			c.mu.Lock()
+			delete(c.loading, index)
+			if err == nil {
+				c.insert(index, data)
+			}
+			c.mu.Unlock()
+			l.data, l.err = data, err
+			close(l.done)
+		})
+	}
+	<-l.done
+	return l.data, l.err
+}
+
+// insert adds a piece to the read cache, dropping the least recently used
+// ones over its size but always keeping the newest. Caller holds mu.
+func (c *Cache) insert(index int, data []byte) {
+	if e, ok := c.clean[index]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.clean[index] = c.lru.PushFront(&cached{index, data})
+	c.cleanBytes += int64(len(data))
+	for c.cleanBytes > c.maxClean && c.lru.Len() > 1 {
+		old := c.lru.Remove(c.lru.Back()).(*cached)
+		delete(c.clean, old.index)
+		c.cleanBytes -= int64(len(old.data))
+	}
+}
+
+// Wait waits until every queued piece has been written, leaving any write
+// that failed for Flush to report
+func (c *Cache) Wait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.dirty) > 0 {
+		c.idle.Wait()
+	}
+}
+
+// Flush waits until every queued piece has been written, returning the
+// first write that failed since the last Flush
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.dirty) > 0 {
+		c.idle.Wait()
+	}
+	err := c.err
+	c.err = nil
+	return err
+}
+
+// Pending the number of pieces waiting to be written and reads in progress
+func (c *Cache) Pending() int {
+	c.mu.Lock()
+	n := len(c.dirty)
+	c.mu.Unlock()
+	return n + int(c.reads.Load())
+}
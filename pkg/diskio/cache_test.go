@@ -0,0 +1,245 @@
+package diskio
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+const pieceLength = 4
+
+// memStore a Store in memory whose writes can be held back or made to fail
+type memStore struct {
+	mu    sync.Mutex
+	data  []byte
+	reads int
+	fail  map[int64]bool // offsets whose writes fail
+	gate  chan struct{}  // writes wait for it to close, nil to go straight through
+}
+
+func newMemStore(n int) *memStore {
+	return &memStore{data: make([]byte, n*pieceLength), fail: make(map[int64]bool)}
+}
+
+func (s *memStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *memStore) WriteAt(p []byte, off int64) (int, error) {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail[off] {
+		return 0, errors.New("write failed")
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *memStore) numReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func testTorrent(n int) *metainfo.MetaInfo {
+	m := &metainfo.MetaInfo{Name: "t", Files: []metainfo.File{{Length: int64(n * pieceLength)}}}
+	m.PieceLength, m.Pieces = pieceLength, make([]byte, n*20)
+	return m
+}
+
+func piece(i int) []byte {
+	return bytes.Repeat([]byte{byte(i + 1)}, pieceLength)
+}
+
+func TestWriteBack(t *testing.T) {
+	tests := []struct {
+		name   string
+		pieces []int
+	}{
+		{"one", []int{0}},
+		{"several", []int{3, 1, 2}},
+		{"all", []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		store := newMemStore(4)
+		store.gate = make(chan struct{})
+		c := NewCache(store, NewPool(1), testTorrent(4))
+		for _, i := range tt.pieces {
+			c.WritePiece(i, piece(i), nil)
+		}
+		// queued pieces read back from memory while the disk is held up
+		for _, i := range tt.pieces {
+			got := make([]byte, pieceLength)
+			if _, err := c.ReadAt(got, int64(i)*pieceLength); err != nil || !bytes.Equal(got, piece(i)) {
+				t.Errorf("%s: piece %d queued read %v, %v", tt.name, i, got, err)
+			}
+		}
+		if c.Pending() != len(tt.pieces) {
+			t.Errorf("%s: %d pending, want %d", tt.name, c.Pending(), len(tt.pieces))
+		}
+		close(store.gate)
+		if err := c.Flush(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, i := range tt.pieces {
+			if !bytes.Equal(store.data[i*pieceLength:(i+1)*pieceLength], piece(i)) {
+				t.Errorf("%s: piece %d not on disk", tt.name, i)
+			}
+			// and from the read cache once written
+			got := make([]byte, pieceLength)
+			c.ReadAt(got, int64(i)*pieceLength)
+			if !bytes.Equal(got, piece(i)) {
+				t.Errorf("%s: piece %d written read %v", tt.name, i, got)
+			}
+		}
+		if store.numReads() != 0 {
+			t.Errorf("%s: %d reads went to disk", tt.name, store.numReads())
+		}
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDirty int64
+		queued   int  // pieces queued while the disk is held up
+		full     bool // once they're queued
+	}{
+		{"room left", 4 * pieceLength, 3, false},
+		{"exactly full", 4 * pieceLength, 4, true},
+		{"over", 2 * pieceLength, 4, true},
+	}
+	for _, tt := range tests {
+		store := newMemStore(4)
+		store.gate = make(chan struct{})
+		c := NewCache(store, NewPool(1), testTorrent(4))
+		c.maxDirty = tt.maxDirty
+		var mu sync.Mutex
+		drained := 0
+		c.Drained = func() {
+			mu.Lock()
+			drained++
+			mu.Unlock()
+		}
+		for i := 0; i < tt.queued; i++ {
+			c.WritePiece(i, piece(i), nil)
+		}
+		if c.Full() != tt.full {
+			t.Errorf("%s: full %v, want %v", tt.name, c.Full(), tt.full)
+		}
+		close(store.gate)
+		c.Flush()
+		if c.Full() {
+			t.Errorf("%s: still full once written", tt.name)
+		}
+		want := 0
+		if tt.full {
+			want = 1
+		}
+		// Flush returns once the last write is done, before its callbacks
+		c.WritePiece(0, piece(0), nil)
+		c.Flush()
+		mu.Lock()
+		got := drained
+		mu.Unlock()
+		if got != want {
+			t.Errorf("%s: drained %d times, want %d", tt.name, got, want)
+		}
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxClean int64
+		reads    []int
+		disk     int // reads that went to the store
+	}{
+		{"cached", 4 * pieceLength, []int{0, 1, 0, 1, 2, 3, 0}, 4},
+		{"least recently used dropped", 2 * pieceLength, []int{0, 1, 2, 0}, 4},
+		{"recently used kept", 2 * pieceLength, []int{0, 1, 0, 2, 0}, 3},
+		{"newest always kept", 1, []int{0, 0, 1, 1, 0}, 3},
+	}
+	for _, tt := range tests {
+		store := newMemStore(4)
+		for i := 0; i < 4; i++ {
+			copy(store.data[i*pieceLength:], piece(i))
+		}
+		c := NewCache(store, NewPool(1), testTorrent(4))
+		c.maxClean = tt.maxClean
+		for _, i := range tt.reads {
+			// a block of the piece brings in all of it
+			got := make([]byte, 1)
+			if _, err := c.ReadAt(got, int64(i)*pieceLength+1); err != nil || got[0] != byte(i+1) {
+				t.Errorf("%s: piece %d read %v, %v", tt.name, i, got, err)
+			}
+		}
+		if store.numReads() != tt.disk {
+			t.Errorf("%s: %d reads went to disk, want %d", tt.name, store.numReads(), tt.disk)
+		}
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   []int // pieces whose writes fail
+		waited bool  // Wait before Flush
+	}{
+		{"none", nil, false},
+		{"one", []int{1}, false},
+		{"several", []int{0, 2}, false},
+		{"after Wait", []int{3}, true},
+	}
+	for _, tt := range tests {
+		store := newMemStore(4)
+		for _, i := range tt.fail {
+			store.fail[int64(i)*pieceLength] = true
+		}
+		c := NewCache(store, NewPool(1), testTorrent(4))
+		var mu sync.Mutex
+		failed := make(map[int]bool)
+		for i := 0; i < 4; i++ {
+			c.WritePiece(i, piece(i), func(err error) {
+				mu.Lock()
+				failed[i] = err != nil
+				mu.Unlock()
+			})
+		}
+		if tt.waited {
+			c.Wait()
+		}
+		if err := c.Flush(); (err != nil) != (len(tt.fail) > 0) {
+			t.Errorf("%s: flushed with %v", tt.name, err)
+		}
+		if err := c.Flush(); err != nil {
+			t.Errorf("%s: %v reported twice", tt.name, err)
+		}
+		// the last write's callback may still be running
+		c.WritePiece(0, piece(0), nil)
+		c.Flush()
+		mu.Lock()
+		for _, i := range tt.fail {
+			if !failed[i] {
+				t.Errorf("%s: piece %d written without an error", tt.name, i)
+			}
+		}
+		mu.Unlock()
+		// what failed to be written isn't served from memory
+		reads := store.numReads()
+		for _, i := range tt.fail {
+			c.ReadAt(make([]byte, pieceLength), int64(i)*pieceLength)
+		}
+		if store.numReads()-reads != len(tt.fail) {
+			t.Errorf("%s: failed pieces read from memory", tt.name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// diskio does torrents' disk reads and writes on a bounded pool of
+// goroutines, so peers never wait on the disk themselves. Each torrent has a
+// Cache holding verified pieces until they're written and pieces read for
+// seeding.
+package diskio
+
+// DefaultWorkers the goroutines in DefaultPool
+const DefaultWorkers = 4
+
+// DefaultPool the pool shared by every torrent unless told otherwise
+var DefaultPool = NewPool(DefaultWorkers)
+
+// Pool a fixed number of goroutines doing disk I/O for any number of torrents
+type Pool struct {
+	jobs chan func()
+}
+
+// NewPool returns a Pool of n goroutines, which run for the life of the program
+func NewPool(n int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+	p := &Pool{jobs: make(chan func(), n*16)}
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *Pool) work() {
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// do queues job, blocking while the queue is full
+func (p *Pool) do(job func()) {
+	p.jobs <- job
+}
@@ -0,0 +1,156 @@
+// event lets programs embedding gtc follow what torrents are doing without
+// scraping logs
+package event
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type what kind of thing happened. Types are bits so a subscriber can ask
+// for several at once.
+type Type uint32
+
+const (
+	PeerConnected       Type = 1 << iota // the handshake with Peer completed
+	PeerDisconnected                     // Peer's connection closed, with Err saying why
+	PeerChoked                           // Peer stopped letting us download
+	PeerUnchoked                         // Peer lets us download
+	PieceCompleted                       // Piece passed its hash check and was written
+	HashFailed                           // Piece didn't match its hash and will be downloaded again
+	TrackerAnnounce                      // Tracker answered with Peers addresses, or failed with Err
+	StateChanged                         // the torrent moved to State
+	StorageError                         // reading or writing the torrent's data failed with Err
+	MetadataReceived                     // a torrent added from a magnet link got its info dictionary
+	StorageMoved                         // the torrent's files moved to under Path
+	FileRenamed                          // File is kept at Path from now on
+	FilePriorityChanged                  // File is downloaded with Priority from now on
+
+	All Type = 1<<iota - 1
+)
+
+var typeNames = []string{
+	"peer_connected", "peer_disconnected", "peer_choked", "peer_unchoked", "piece_completed",
+	"hash_failed", "tracker_announce", "state_changed", "storage_error", "metadata_received",
+	"storage_moved", "file_renamed", "file_priority_changed",
+}
+
+func (t Type) String() string {
+	var names []string
+	for i, name := range typeNames {
+		if t&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Event something that happened to a torrent. Which fields are set depends on Type.
+type Event struct {
+	Type     Type
+	Time     time.Time
+	InfoHash string // hex, of the torrent the event is about
+
+	Peer     string // address of the peer
+	Piece    int
+	Tracker  string // announce URL
+	Peers    int    // addresses returned by the tracker
+	State    string // the torrent's new state
+	File     int    // index of the file
+	Path     string // where files went
+	Priority string // the file's new priority
+	Err      error
+}
+
+// DefaultBuffer events a subscription holds before it starts dropping them
+const DefaultBuffer = 256
+
+// Bus hands published events to its subscribers. Publishing never blocks,
+// a subscriber that falls behind loses events instead. A nil Bus drops
+// everything, so publishers needn't check.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription a subscriber's buffered stream of events
+type Subscription struct {
+	C <-chan Event // closed by Close
+
+	c       chan Event
+	filter  Type
+	bus     *Bus
+	dropped atomic.Int64
+}
+
+// Subscribe starts collecting the events whose type is in filter, holding up
+// to buffer of them, DefaultBuffer when buffer is 0, for the subscriber to read from C
+func (b *Bus) Subscribe(filter Type, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Handle calls fn for each event whose type is in filter, one at a time on a
+// goroutine of its own, until the returned Subscription is closed
+func (b *Bus) Handle(filter Type, buffer int, fn func(Event)) *Subscription {
+	s := b.Subscribe(filter, buffer)
+	go func() {
+		for e := range s.C {
+			fn(e)
+		}
+	}()
+	return s
+}
+
+// Publish sends e to every subscriber that wants it, stamping the time if unset
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.filter&e.Type == 0 {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped how many events didn't fit in the subscription's buffer
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription and closes C once the buffered events are read
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,227 @@
+// lsd Local Service Discovery (BEP 14), finding peers on the LAN through multicast announcements
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/util"
+)
+
+const (
+	announceInterval = 5 * time.Minute
+	minInterval      = time.Minute // a torrent is never announced more often than this
+	maxPacket        = 1400
+	maxHashesPerMsg  = 20 // keeps a message well below maxPacket
+)
+
+// The BEP 14 multicast groups
+var (
+	IPv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	IPv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// FoundFunc receives a peer announcing a torrent we registered
+type FoundFunc func(ip net.IP, port uint16)
+
+type registration struct {
+	found        FoundFunc
+	lastAnnounce time.Time
+}
+
+// Service announces our torrents on the local network and listens for other
+// hosts announcing the same ones
+type Service struct {
+	port   int
+	cookie string
+	done   chan struct{} // closed by Close, stops the announce loop
+	once   sync.Once
+
+	mu       sync.Mutex
+	torrents map[string]*registration // by lowercase hex info hash
+	conns    []*groupConn
+}
+
+// groupConn a socket joined to one multicast group
+type groupConn struct {
+	group *net.UDPAddr
+	conn  *net.UDPConn
+}
+
+// New joins the IPv4 and IPv6 groups, announcing port as our listen port.
+// It fails only if neither group can be joined.
+func New(port int) (*Service, error) {
+	s := &Service{
+		port:     port,
+		cookie:   util.SessionID(16),
+		torrents: make(map[string]*registration),
+		done:     make(chan struct{}),
+	}
+	var errs []string
+	for _, group := range []*net.UDPAddr{IPv4Group, IPv6Group} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		s.conns = append(s.conns, &groupConn{group, conn})
+	}
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("lsd: couldn't join a multicast group: %s", strings.Join(errs, "; "))
+	}
+	return s, nil
+}
+
+// Start begins listening and announcing
+func (s *Service) Start() {
+	for _, gc := range s.conns {
+		go s.listen(gc)
+	}
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.announceAll()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Add registers a torrent, announcing it right away. found is called for every
+// other host announcing it. Private torrents must not be registered.
+func (s *Service) Add(infoHash []byte, found FoundFunc) {
+	key := hex.EncodeToString(infoHash)
+	s.mu.Lock()
+	s.torrents[key] = &registration{found: found}
+	s.mu.Unlock()
+	go s.announce([]string{key})
+}
+
+// Remove unregisters a torrent
+func (s *Service) Remove(infoHash []byte) {
+	s.mu.Lock()
+	delete(s.torrents, hex.EncodeToString(infoHash))
+	s.mu.Unlock()
+}
+
+// Close leaves the multicast groups and stops announcing
+func (s *Service) Close() error {
+	var first error
+	s.once.Do(func() {
+		close(s.done)
+		for _, gc := range s.conns {
+			if err := gc.conn.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	})
+	return first
+}
+
+func (s *Service) announceAll() {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.torrents))
+	for key := range s.torrents {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	s.announce(keys)
+}
+
+// announce sends BT-SEARCH messages for the given info hashes to every group,
+// skipping torrents announced less than minInterval ago
+func (s *Service) announce(keys []string) {
+	now := time.Now()
+	s.mu.Lock()
+	due := keys[:0:0]
+	for _, key := range keys {
+		reg, ok := s.torrents[key]
+		if !ok || now.Sub(reg.lastAnnounce) < minInterval {
+			continue
+		}
+		reg.lastAnnounce = now
+		due = append(due, key)
+	}
+	s.mu.Unlock()
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxHashesPerMsg {
+			n = maxHashesPerMsg
+		}
+		for _, gc := range s.conns {
+			if _, err := gc.conn.WriteToUDP(s.message(gc.group, due[:n]), gc.group); err != nil {
+				log.Printf("[lsd] announce to %v failed: %v", gc.group, err)
+			}
+		}
+		due = due[n:]
+	}
+}
+
+func (s *Service) message(group *net.UDPAddr, keys []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", group)
+	fmt.Fprintf(&b, "Port: %d\r\n", s.port)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", key)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", s.cookie)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func (s *Service) listen(gc *groupConn) {
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := gc.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("[lsd] read from %v failed: %v", gc.group, err)
+			}
+			return
+		}
+		s.handle(buf[:n], from)
+	}
+}
+
+// handle parses an announcement and reports the sender to each matching torrent
+func (s *Service) handle(packet []byte, from *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+	if req.Header.Get("Cookie") == s.cookie {
+		// our own announcement looped back
+		return
+	}
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return
+	}
+	for _, key := range req.Header["Infohash"] {
+		s.mu.Lock()
+		reg, ok := s.torrents[strings.ToLower(strings.TrimSpace(key))]
+		s.mu.Unlock()
+		if ok {
+			reg.found(from.IP, uint16(port))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package lsd
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandle(t *testing.T) {
+	hash := strings.Repeat("ab", 20)
+	other := &Service{port: 6881, cookie: "theirs"}
+	tests := []struct {
+		name   string
+		packet string
+		port   uint16 // 0 for none found
+	}{
+		{"announce", string(other.message(IPv4Group, []string{hash})), 6881},
+		{"upper case hash", strings.Replace(string(other.message(IPv4Group, []string{hash})), hash, strings.ToUpper(hash), 1), 6881},
+		{"unknown hash", string(other.message(IPv4Group, []string{strings.Repeat("cd", 20)})), 0},
+		{"our own", strings.Replace(string(other.message(IPv4Group, []string{hash})), "theirs", "ours", 1), 0},
+		{"no port", strings.Replace(string(other.message(IPv4Group, []string{hash})), "Port: 6881\r\n", "", 1), 0},
+		{"zero port", strings.Replace(string(other.message(IPv4Group, []string{hash})), "Port: 6881", "Port: 0", 1), 0},
+		{"wrong method", strings.Replace(string(other.message(IPv4Group, []string{hash})), "BT-SEARCH", "NOTIFY", 1), 0},
+		{"garbage", "\x00\x01\x02", 0},
+	}
+	for _, tt := range tests {
+		var got uint16
+		s := &Service{cookie: "ours", torrents: map[string]*registration{
+			hash: {found: func(ip net.IP, port uint16) { got = port }},
+		}}
+		s.handle([]byte(tt.packet), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2)})
+		if got != tt.port {
+			t.Errorf("%s: found port %d, want %d", tt.name, got, tt.port)
+		}
+	}
+}
+
+func TestCloseStopsAnnouncing(t *testing.T) {
+	s := &Service{torrents: make(map[string]*registration), done: make(chan struct{})}
+	before := runtime.NumGoroutine()
+	s.Start()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("second Close:", err)
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("announce loop still running after Close")
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const (
+	minPieceLength = 16 << 10
+	maxPieceLength = 16 << 20
+)
+
+// PieceLengthFor a power of two piece length giving a torrent of total bytes
+// around 1500 pieces, between 16KiB and 16MiB
+func PieceLengthFor(total int64) int64 {
+	pl := int64(minPieceLength)
+	for pl < maxPieceLength && total/pl > 1500 {
+		pl *= 2
+	}
+	return pl
+}
+
+// Create builds the MetaInfo for the file or directory at path, hashing its
+// contents. A pieceLength of 0 picks one with PieceLengthFor.
+func Create(path string, pieceLength int64) (*MetaInfo, error) {
+	path = filepath.Clean(path)
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &MetaInfo{Name: filepath.Base(path)}
+	var paths []string
+	if st.IsDir() {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			m.Files = append(m.Files, File{Length: info.Size(), Path: strings.Split(filepath.ToSlash(rel), "/")})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(m.Files) == 0 {
+			return nil, fmt.Errorf("%s has no files", path)
+		}
+	} else {
+		paths = []string{path}
+		m.Files = []File{{Length: st.Size()}}
+	}
+
+	if pieceLength == 0 {
+		pieceLength = PieceLengthFor(m.TotalLength())
+	}
+	if pieceLength <= 0 {
+		return nil, errors.New("piece length must be positive")
+	}
+	m.PieceLength = pieceLength
+	if m.Pieces, err = hashFiles(paths, pieceLength); err != nil {
+		return nil, err
+	}
+	m.InfoHash, err = m.infoHash()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// hashFiles the concatenated SHA1 hashes of the pieces of the files read one after another
+func hashFiles(paths []string, pieceLength int64) ([]byte, error) {
+	readers := make([]io.Reader, 0, len(paths))
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	r := io.MultiReader(readers...)
+	buf := make([]byte, pieceLength)
+	var pieces []byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			pieces = append(pieces, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return pieces, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// info the bencodable info dictionary
+func (m *MetaInfo) info() map[string]interface{} {
+	info := map[string]interface{}{
+		"name":         m.Name,
+		"piece length": m.PieceLength,
+		"pieces":       string(m.Pieces),
+	}
+	if m.Private {
+		info["private"] = 1
+	}
+	if len(m.Files) == 1 && len(m.Files[0].Path) == 0 {
+		info["length"] = m.Files[0].Length
+		if len(m.Files[0].MD5Sum) > 0 {
+			info["md5sum"] = string(m.Files[0].MD5Sum)
+		}
+		m.Files[0].putAttrs(info)
+		return info
+	}
+	files := make([]interface{}, 0, len(m.Files))
+	for _, f := range m.Files {
+		fd := map[string]interface{}{
+			"length": f.Length,
+			"path":   f.Path,
+		}
+		if len(f.MD5Sum) > 0 {
+			fd["md5sum"] = string(f.MD5Sum)
+		}
+		f.putAttrs(fd)
+		files = append(files, fd)
+	}
+	info["files"] = files
+	return info
+}
+
+// putAttrs adds the BEP 47 fields f has to its dictionary d
+func (f File) putAttrs(d map[string]interface{}) {
+	if f.Attr != "" {
+		d["attr"] = f.Attr
+	}
+	if len(f.SymlinkPath) > 0 {
+		d["symlink path"] = f.SymlinkPath
+	}
+	if len(f.SHA1) > 0 {
+		d["sha1"] = string(f.SHA1)
+	}
+}
+
+func (m *MetaInfo) infoHash() (string, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, m.info()); err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(buf.Bytes())
+	return string(sum[:]), nil
+}
+
+// Write bencodes m as a .torrent file to w
+func (m *MetaInfo) Write(w io.Writer) error {
+	d := map[string]interface{}{"info": m.info()}
+	if m.Announce != "" {
+		d["announce"] = m.Announce
+	}
+	if len(m.AnnounceList) > 0 {
+		d["announce-list"] = m.AnnounceList
+	}
+	if !m.CreationDate.IsZero() {
+		d["creation date"] = m.CreationDate.Unix()
+	}
+	if m.Comment != "" {
+		d["comment"] = m.Comment
+	}
+	if m.CreatedBy != "" {
+		d["created by"] = m.CreatedBy
+	}
+	if m.Encoding != "" {
+		d["encoding"] = m.Encoding
+	}
+	return bencode.Marshal(w, d)
+}
+
+// Magnet a magnet link for the torrent with its name and trackers
+func (m *MetaInfo) Magnet() string {
+	v := url.Values{}
+	v.Set("dn", m.Name)
+	if m.Announce != "" {
+		v.Add("tr", m.Announce)
+	}
+	for _, tier := range m.AnnounceList {
+		for _, tr := range tier {
+			if tr != m.Announce {
+				v.Add("tr", tr)
+			}
+		}
+	}
+	// xt goes first and unescaped, some clients insist on it
+	return fmt.Sprintf("magnet:?xt=urn:btih:%x&%s", m.InfoHash, v.Encode())
+}
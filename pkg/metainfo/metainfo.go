@@ -2,16 +2,24 @@
 package metainfo
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"strings"
 	"time"
-    "bytes"
-    "errors"
 
-    bencode	"github.com/jackpal/bencode-go"
+	bencode "github.com/jackpal/bencode-go"
 )
 
+// ErrInvalid wrapped by the errors for torrents that don't follow the spec
+var ErrInvalid = errors.New("metainfo: invalid torrent")
+
 // MetaInfo a mapping of a .torrent file to a struct
 type MetaInfo struct {
 	Info
@@ -24,6 +32,7 @@ type MetaInfo struct {
 	Files        []File
 	Name         string // Single File - name, Multi file - dirname
 	InfoHash     string
+	InfoBytes    []byte // the bencoded info dictionary InfoHash was taken from
 }
 
 // Info fields common to both single and multi file info dictionary
@@ -35,132 +44,295 @@ type Info struct {
 
 // File a struct for files in multifileinfo dicts
 type File struct {
-	Length int64
-	MD5Sum []byte
-	Path   []string
+	Length      int64
+	MD5Sum      []byte
+	Path        []string
+	Attr        string   // BEP 47 attributes, any of p, x, h and l
+	SymlinkPath []string // for a symlink, the path within the torrent it points to
+	SHA1        []byte   // the hash of the whole file, if the torrent gives one
+}
+
+// Padding reports whether f is a pad file, zeros that align the next file
+// to a piece boundary and are never stored
+func (f File) Padding() bool {
+	return strings.ContainsRune(f.Attr, 'p')
+}
+
+// Executable reports whether f should be executable
+func (f File) Executable() bool {
+	return strings.ContainsRune(f.Attr, 'x')
 }
 
+// Hidden reports whether f should be hidden
+func (f File) Hidden() bool {
+	return strings.ContainsRune(f.Attr, 'h')
+}
+
+// Symlink reports whether f is a symlink to SymlinkPath
+func (f File) Symlink() bool {
+	return strings.ContainsRune(f.Attr, 'l')
+}
+
+// NewFromFilename parses the .torrent file fn
 func NewFromFilename(fn string) (*MetaInfo, error) {
 	file, err := os.Open(fn)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-
-	d, err := bencode.Decode(file)
-    file.Close()
+	m, err := NewFromReader(file)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", fn, err)
 	}
+	return m, nil
+}
 
-    data, ok := d.(map[string]interface{})
-    if !ok {
-        fmt.Println("Couldn't parse torrent file")
-        return nil, errors.New("Error parsing torrent file")
-    }
+// NewFromReader parses a .torrent read from r
+func NewFromReader(r io.Reader) (*MetaInfo, error) {
+	d, err := bencode.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	data, ok := d.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: not a dictionary", ErrInvalid)
+	}
 	m := &MetaInfo{}
 
 	// Populate Announce or AnnounceList
 	annLists, ok := data["announce-list"].([]interface{})
-	lists := [][]string{}
 	if !ok {
-		m.Announce = data["announce"].(string)
+		m.Announce, _ = data["announce"].(string)
 	}
 	for _, list := range annLists {
-		al := []string{}
-		for _, URL := range list.([]interface{}) {
-			al = append(al, URL.(string))
+		urls, _ := list.([]interface{})
+		tier := []string{}
+		for _, u := range urls {
+			if s, ok := u.(string); ok {
+				tier = append(tier, s)
+			}
+		}
+		if len(tier) > 0 {
+			m.AnnounceList = append(m.AnnounceList, tier)
 		}
-		lists = append(lists, al)
 	}
-	m.AnnounceList = lists
 
 	// parse additional optional fields
-	if cd, ok := data["creation date"]; ok {
-		m.CreationDate = time.Unix(cd.(int64), 0)
-	}
-	if c, ok := data["comment"]; ok {
-		m.Comment = c.(string)
+	if cd, ok := data["creation date"].(int64); ok {
+		m.CreationDate = time.Unix(cd, 0)
 	}
-	if cb, ok := data["created by"]; ok {
-		m.CreatedBy = cb.(string)
+	m.Comment, _ = data["comment"].(string)
+	m.CreatedBy, _ = data["created by"].(string)
+	m.Encoding, _ = data["encoding"].(string)
+
+	info, ok := data["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: no info dictionary", ErrInvalid)
 	}
-	if enc, ok := data["encoding"]; ok {
-		m.Encoding = enc.(string)
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, info); err != nil {
+		return nil, fmt.Errorf("metainfo: encoding the info dictionary: %w", err)
 	}
-
-	// begin populating the Info dict
-	info := data["info"].(map[string]interface{})
-    var infoHash bytes.Buffer
-	err = bencode.Marshal(&infoHash, info)
-    if err != nil {
-        fmt.Println("Coudn't encode infohash")
-        return nil, err
-    }
-    hash := sha1.New()
-    hash.Write(infoHash.Bytes())
-
-	m.InfoHash = string(hash.Sum(nil))
-
-	if name, ok := info["name"]; ok {
-		m.Name = name.(string)
+	sum := sha1.Sum(buf.Bytes())
+	m.InfoHash, m.InfoBytes = string(sum[:]), buf.Bytes()
+	if err := m.parseInfo(info); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	if plen, ok := info["piece length"]; ok {
-		m.PieceLength = plen.(int64)
+// parseInfo fills in the fields of the info dictionary
+func (m *MetaInfo) parseInfo(info map[string]interface{}) error {
+	var ok bool
+	if m.Name, ok = info["name"].(string); !ok || m.Name == "" {
+		return fmt.Errorf("%w: no name", ErrInvalid)
 	}
-
-	if pieces, ok := info["pieces"]; ok {
-		m.Pieces = []byte(pieces.(string))
+	if m.PieceLength, ok = info["piece length"].(int64); !ok || m.PieceLength <= 0 {
+		return fmt.Errorf("%w: bad piece length", ErrInvalid)
 	}
-
-	if private, ok := info["private"]; ok {
-		if private.(int64) == 1 {
-			m.Private = true
-		} else {
-			m.Private = false
-		}
+	pieces, ok := info["pieces"].(string)
+	if !ok || len(pieces) == 0 || len(pieces)%20 != 0 {
+		return fmt.Errorf("%w: bad pieces", ErrInvalid)
 	}
+	m.Pieces = []byte(pieces)
+	private, _ := info["private"].(int64)
+	m.Private = private == 1
 
+	m.Files = nil
 	if files, exists := info["files"]; !exists {
-		//TODO name and length arent optional, maybe return an err here
 		f := File{}
-
-		if length, ok := info["length"]; ok {
-			f.Length = length.(int64)
+		if f.Length, ok = info["length"].(int64); !ok || f.Length < 0 {
+			return fmt.Errorf("%w: bad length", ErrInvalid)
 		}
-		if md5, ok := info["md5sum"]; ok {
-			f.MD5Sum = md5.([]byte)
+		if md5, ok := info["md5sum"].(string); ok {
+			f.MD5Sum = []byte(md5)
+		}
+		if err := f.parseAttrs(info); err != nil {
+			return err
 		}
-
 		m.Files = append(m.Files, f)
 	} else {
-		for _, file := range files.([]interface{}) {
+		list, ok := files.([]interface{})
+		if !ok || len(list) == 0 {
+			return fmt.Errorf("%w: bad file list", ErrInvalid)
+		}
+		for i, file := range list {
+			fileDict, ok := file.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%w: bad file %d", ErrInvalid, i)
+			}
 			f := File{}
-			fileDict := file.(map[string]interface{})
-			if length, ok := fileDict["length"]; ok {
-				f.Length = length.(int64)
+			if f.Length, ok = fileDict["length"].(int64); !ok || f.Length < 0 {
+				return fmt.Errorf("%w: bad length for file %d", ErrInvalid, i)
 			}
-
-			if path, ok := fileDict["path"]; ok {
-				var pathTokens []string
-				for _, p := range path.([]interface{}) {
-					pathTokens = append(pathTokens, p.(string))
+			path, _ := fileDict["path"].([]interface{})
+			for _, p := range path {
+				s, ok := p.(string)
+				if !ok {
+					return fmt.Errorf("%w: bad path for file %d", ErrInvalid, i)
 				}
-				f.Path = pathTokens
+				f.Path = append(f.Path, s)
 			}
-
-			if md5, ok := fileDict["md5sum"]; ok {
-				f.MD5Sum = md5.([]byte)
+			if len(f.Path) == 0 {
+				return fmt.Errorf("%w: no path for file %d", ErrInvalid, i)
+			}
+			if md5, ok := fileDict["md5sum"].(string); ok {
+				f.MD5Sum = []byte(md5)
+			}
+			if err := f.parseAttrs(fileDict); err != nil {
+				return fmt.Errorf("%w for file %d", err, i)
 			}
-
 			m.Files = append(m.Files, f)
 		}
 	}
+	if want := (m.TotalLength() + m.PieceLength - 1) / m.PieceLength; int64(m.NumPieces()) != want {
+		return fmt.Errorf("%w: %d pieces for %d bytes", ErrInvalid, m.NumPieces(), m.TotalLength())
+	}
+	return nil
+}
+
+// parseAttrs fills in the BEP 47 fields of a file from its dictionary, or
+// from the info dictionary of a single file torrent
+func (f *File) parseAttrs(d map[string]interface{}) error {
+	f.Attr, _ = d["attr"].(string)
+	if sum, ok := d["sha1"].(string); ok && len(sum) == sha1.Size {
+		f.SHA1 = []byte(sum)
+	}
+	if !f.Symlink() {
+		return nil
+	}
+	path, _ := d["symlink path"].([]interface{})
+	for _, p := range path {
+		s, ok := p.(string)
+		if !ok {
+			return fmt.Errorf("%w: bad symlink path", ErrInvalid)
+		}
+		f.SymlinkPath = append(f.SymlinkPath, s)
+	}
+	if len(f.SymlinkPath) == 0 {
+		return fmt.Errorf("%w: no symlink path", ErrInvalid)
+	}
+	return nil
+}
 
+// ParseMagnet the MetaInfo of a magnet link. It has the info hash, and the
+// name and trackers if the link gives them, but no info dictionary until
+// SetInfo is called with one fetched from peers.
+func ParseMagnet(uri string) (*MetaInfo, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("metainfo: bad magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("metainfo: not a magnet link: %s", uri)
+	}
+	q := u.Query()
+	var hash []byte
+	for _, xt := range q["xt"] {
+		v, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(v) {
+		case 40:
+			hash, err = hex.DecodeString(v)
+		case 32:
+			hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(v))
+		default:
+			err = fmt.Errorf("info hash %q has the wrong length", v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("metainfo: bad magnet link: %w", err)
+		}
+		break
+	}
+	if hash == nil {
+		return nil, errors.New("metainfo: magnet link has no BitTorrent info hash")
+	}
+	m := &MetaInfo{InfoHash: string(hash), Name: q.Get("dn")}
+	for _, tr := range q["tr"] {
+		m.AnnounceList = append(m.AnnounceList, []string{tr})
+	}
 	return m, nil
 }
 
+// HasInfo reports whether the info dictionary is known, which it isn't for
+// a magnet link until SetInfo
+func (m *MetaInfo) HasInfo() bool {
+	return len(m.Pieces) > 0
+}
+
+// SetInfo fills in the info dictionary of a MetaInfo from a magnet link,
+// checking b is the one the info hash was taken from
+func (m *MetaInfo) SetInfo(b []byte) error {
+	sum := sha1.Sum(b)
+	if string(sum[:]) != m.InfoHash {
+		return fmt.Errorf("%w: info dictionary doesn't match the info hash", ErrInvalid)
+	}
+	d, err := bencode.Decode(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	info, ok := d.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: info isn't a dictionary", ErrInvalid)
+	}
+	if err := m.parseInfo(info); err != nil {
+		return err
+	}
+	m.InfoBytes = b
+	return nil
+}
+
+// TotalLength the combined length of every file in the torrent
+func (m *MetaInfo) TotalLength() int64 {
+	total := int64(0)
+	for _, f := range m.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// NumPieces the number of pieces in the torrent
+func (m *MetaInfo) NumPieces() int {
+	return len(m.Pieces) / 20
+}
+
+// PieceSize the length of piece i, only the last piece may be shorter than PieceLength
+func (m *MetaInfo) PieceSize(i int) int64 {
+	if i == m.NumPieces()-1 {
+		if rem := m.TotalLength() % m.PieceLength; rem != 0 {
+			return rem
+		}
+	}
+	return m.PieceLength
+}
+
+// PieceHash the SHA1 hash of piece i
+func (m *MetaInfo) PieceHash(i int) []byte {
+	return m.Pieces[i*20 : i*20+20]
+}
+
 func (m *MetaInfo) String() string {
 	ret := fmt.Sprintf("Announce: %v\n", m.Announce)
 	ret += fmt.Sprintf("AnnounceList(opt): %v\n", m.AnnounceList)
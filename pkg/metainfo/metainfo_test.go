@@ -1,3 +1,92 @@
 package metainfo
 
-// this will surely be filled in later
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// torrentWithFile a bencoded torrent of file and a one byte file after it,
+// so that there's at least one piece
+func torrentWithFile(t *testing.T, file map[string]interface{}) []byte {
+	total, _ := file["length"].(int64)
+	total = max(total, 0) + 1
+	files := []interface{}{file, map[string]interface{}{"length": int64(1), "path": []interface{}{"z"}}}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "t",
+			"piece length": int64(16 << 10),
+			"pieces":       strings.Repeat("\x01", 20*int((total+16<<10-1)/(16<<10))),
+			"files":        files,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFileAttrs(t *testing.T) {
+	sum := strings.Repeat("\x02", 20)
+	tests := []struct {
+		name string
+		file map[string]interface{}
+		want File
+		err  bool
+	}{
+		{"plain", map[string]interface{}{"length": int64(5), "path": []interface{}{"a", "b"}},
+			File{Length: 5, Path: []string{"a", "b"}}, false},
+		{"padding", map[string]interface{}{"length": int64(5), "path": []interface{}{".pad", "5"}, "attr": "p"},
+			File{Length: 5, Path: []string{".pad", "5"}, Attr: "p"}, false},
+		{"executable and hidden", map[string]interface{}{"length": int64(5), "path": []interface{}{".run"}, "attr": "xh", "sha1": sum},
+			File{Length: 5, Path: []string{".run"}, Attr: "xh", SHA1: []byte(sum)}, false},
+		{"symlink", map[string]interface{}{"length": int64(0), "path": []interface{}{"link"}, "attr": "l", "symlink path": []interface{}{"dir", "target"}},
+			File{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"dir", "target"}}, false},
+		{"short sha1 ignored", map[string]interface{}{"length": int64(5), "path": []interface{}{"a"}, "sha1": "abc"},
+			File{Length: 5, Path: []string{"a"}}, false},
+		{"symlink without target", map[string]interface{}{"length": int64(0), "path": []interface{}{"link"}, "attr": "l"}, File{}, true},
+		{"symlink with bad target", map[string]interface{}{"length": int64(0), "path": []interface{}{"link"}, "attr": "l", "symlink path": []interface{}{int64(1)}}, File{}, true},
+		{"no path", map[string]interface{}{"length": int64(5)}, File{}, true},
+		{"negative length", map[string]interface{}{"length": int64(-1), "path": []interface{}{"a"}}, File{}, true},
+	}
+	for _, tt := range tests {
+		m, err := NewFromReader(bytes.NewReader(torrentWithFile(t, tt.file)))
+		if tt.err {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("%s: %v, want ErrInvalid", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(m.Files[0], tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, m.Files[0], tt.want)
+		}
+	}
+}
+
+func TestFileAttrMethods(t *testing.T) {
+	tests := []struct {
+		attr                                 string
+		padding, executable, hidden, symlink bool
+	}{
+		{"", false, false, false, false},
+		{"p", true, false, false, false},
+		{"x", false, true, false, false},
+		{"hx", false, true, true, false},
+		{"l", false, false, false, true},
+	}
+	for _, tt := range tests {
+		f := File{Attr: tt.attr}
+		if f.Padding() != tt.padding || f.Executable() != tt.executable || f.Hidden() != tt.hidden || f.Symlink() != tt.symlink {
+			t.Errorf("attr %q: %v %v %v %v", tt.attr, f.Padding(), f.Executable(), f.Hidden(), f.Symlink())
+		}
+	}
+}
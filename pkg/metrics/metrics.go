@@ -0,0 +1,109 @@
+// metrics writes metrics in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// family the samples of one metric name
+type family struct {
+	name, help, typ string
+	samples         []string
+}
+
+// Registry the metrics of one scrape. Samples of the same name are grouped
+// together however they're added, families in the order first seen.
+type Registry struct {
+	families map[string]*family
+	order    []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter adds a sample of a value that only goes up. labels are name, value pairs.
+func (r *Registry) Counter(name, help string, v float64, labels ...string) {
+	r.add(name, help, "counter", name, v, labels)
+}
+
+// Gauge adds a sample of a value that goes up and down
+func (r *Registry) Gauge(name, help string, v float64, labels ...string) {
+	r.add(name, help, "gauge", name, v, labels)
+}
+
+// Summary adds the sum and count of a summary without quantiles, e.g. the
+// total seconds spent on some operation and how many times it ran
+func (r *Registry) Summary(name, help string, sum float64, count int64, labels ...string) {
+	r.add(name, help, "summary", name+"_sum", sum, labels)
+	r.add(name, help, "summary", name+"_count", float64(count), labels)
+}
+
+func (r *Registry) add(name, help, typ, sample string, v float64, labels []string) {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		r.families[name] = f
+		r.order = append(r.order, f)
+	}
+	var b strings.Builder
+	b.WriteString(sample)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	f.samples = append(f.samples, b.String())
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// WriteTo writes every family in the exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, f := range r.order {
+		m, _ := io.WriteString(bw, "# HELP "+f.name+" "+helpEscaper.Replace(f.help)+"\n# TYPE "+f.name+" "+f.typ+"\n")
+		n += int64(m)
+		for _, s := range f.samples {
+			m, _ := io.WriteString(bw, s+"\n")
+			n += int64(m)
+		}
+	}
+	return n, bw.Flush()
+}
+
+// Collector adds its current metrics to a Registry
+type Collector interface {
+	Collect(r *Registry)
+}
+
+// Handler serves the metrics of c, collected afresh for every request
+func Handler(c Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := NewRegistry()
+		c.Collect(r)
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteTo(w)
+	})
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(r *Registry)
+		want string
+	}{
+		{"empty", func(r *Registry) {}, ""},
+		{"counter", func(r *Registry) {
+			r.Counter("a_total", "As seen.", 3)
+		}, `# HELP a_total As seen.
+# TYPE a_total counter
+a_total 3
+`},
+		{"grouped by family", func(r *Registry) {
+			r.Gauge("a", "A.", 1, "x", "1")
+			r.Gauge("b", "B.", 2.5)
+			r.Gauge("a", "A.", 0, "x", "2")
+		}, `# HELP a A.
+# TYPE a gauge
+a{x="1"} 1
+a{x="2"} 0
+# HELP b B.
+# TYPE b gauge
+b 2.5
+`},
+		{"labels escaped", func(r *Registry) {
+			r.Gauge("g", "Help with \\ and\nnewline.", 1, "name", "a \"b\" \\c\nd", "tier", "0")
+		}, `# HELP g Help with \\ and\nnewline.
+# TYPE g gauge
+g{name="a \"b\" \\c\nd",tier="0"} 1
+`},
+		{"summary", func(r *Registry) {
+			r.Summary("d_seconds", "D.", 1.5, 3, "t", "x")
+			r.Summary("d_seconds", "D.", 0, 0, "t", "y")
+		}, `# HELP d_seconds D.
+# TYPE d_seconds summary
+d_seconds_sum{t="x"} 1.5
+d_seconds_count{t="x"} 3
+d_seconds_sum{t="y"} 0
+d_seconds_count{t="y"} 0
+`},
+		{"large values", func(r *Registry) {
+			r.Counter("big_total", "Big.", 1<<40)
+		}, `# HELP big_total Big.
+# TYPE big_total counter
+big_total 1.099511627776e+12
+`},
+	}
+	for _, tt := range tests {
+		r := NewRegistry()
+		tt.add(r)
+		var b bytes.Buffer
+		n, err := r.WriteTo(&b)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, b.String(), tt.want)
+		}
+		if n != int64(b.Len()) {
+			t.Errorf("%s: wrote %d bytes, reported %d", tt.name, b.Len(), n)
+		}
+	}
+}
+
+type collectFunc func(r *Registry)
+
+func (f collectFunc) Collect(r *Registry) { f(r) }
+
+func TestHandler(t *testing.T) {
+	h := Handler(collectFunc(func(r *Registry) { r.Gauge("up", "Up.", 1) }))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); got != ContentType {
+		t.Errorf("content type %q", got)
+	}
+	if got := w.Body.String(); got != "# HELP up Up.\n# TYPE up gauge\nup 1\n" {
+		t.Errorf("body %q", got)
+	}
+}
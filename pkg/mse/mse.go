@@ -0,0 +1,373 @@
+// mse Message Stream Encryption, the Diffie-Hellman key exchange and RC4
+// obfuscation BitTorrent clients use to hide their traffic from middleboxes
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// Policy how encryption is used for peer connections
+type Policy int
+
+const (
+	// Disabled only plaintext connections, encrypted incoming connections are refused
+	Disabled Policy = iota
+	// Preferred encrypt when the other side can, fall back to plaintext otherwise
+	Preferred
+	// Required refuse plaintext connections
+	Required
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy the inverse of Policy.String
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "disabled":
+		return Disabled, nil
+	case "preferred":
+		return Preferred, nil
+	case "required":
+		return Required, nil
+	}
+	return 0, fmt.Errorf("mse: unknown policy %q", s)
+}
+
+// crypto_provide and crypto_select bits
+const (
+	cryptoPlain uint32 = 0x01
+	cryptoRC4   uint32 = 0x02
+)
+
+const (
+	keyLen   = 96 // bytes in a public key
+	maxPad   = 512
+	privBits = 160
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8) // verification constant, eight zero bytes
+)
+
+var (
+	// ErrNoCommonMethod neither side would accept what the other offered
+	ErrNoCommonMethod = errors.New("mse: no common crypto method")
+	// ErrUnknownTorrent the initiator asked for a torrent we don't have
+	ErrUnknownTorrent = errors.New("mse: unknown info hash")
+	// ErrSync the verification constant or hash wasn't found where it should be
+	ErrSync = errors.New("mse: couldn't synchronize with stream")
+)
+
+// Conn a connection after a completed MSE handshake. If RC4 was selected every
+// Read and Write is transparently decrypted and encrypted.
+type Conn struct {
+	net.Conn
+	r        io.Reader
+	enc, dec *rc4.Cipher
+	// Encrypted reports whether RC4 was selected, as opposed to plaintext after the handshake
+	Encrypted bool
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// decryptReader applies an RC4 keystream to everything read through it
+type decryptReader struct {
+	r io.Reader
+	c *rc4.Cipher
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.c.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher an RC4 cipher for the given key name with the first 1024 bytes of keystream discarded
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+// keyPair a Diffie-Hellman private key and our public key padded to keyLen
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	priv, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), privBits))
+	if err != nil {
+		return nil, err
+	}
+	pub := new(big.Int).Exp(generator, priv, prime)
+	return &keyPair{priv, pad(pub.Bytes())}, nil
+}
+
+// secret S, the shared secret for the other side's public key
+func (k *keyPair) secret(other []byte) []byte {
+	y := new(big.Int).SetBytes(other)
+	return pad(new(big.Int).Exp(y, k.private, prime).Bytes())
+}
+
+func pad(b []byte) []byte {
+	if len(b) >= keyLen {
+		return b
+	}
+	return append(make([]byte, keyLen-len(b)), b...)
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	p := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	_, err := rand.Read(p)
+	return p, err
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// Initiate performs the MSE handshake as the connecting side for the torrent
+// infoHash (the SKEY). With Required only RC4 is offered, otherwise plaintext too.
+func Initiate(conn net.Conn, infoHash []byte, policy Policy) (*Conn, error) {
+	provide := cryptoRC4
+	if policy != Required {
+		provide |= cryptoPlain
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.public, padA...)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(conn, keyLen+maxPad+64)
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, yb); err != nil {
+		return nil, err
+	}
+	s := keys.secret(yb)
+	enc := newCipher("keyA", s, infoHash)
+	dec := newCipher("keyB", s, infoHash)
+
+	// step 3: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	msg := hash([]byte("req1"), s)
+	msg = append(msg, xor(hash([]byte("req2"), infoHash), hash([]byte("req3"), s))...)
+	plain := append([]byte(nil), vc...)
+	plain = binary.BigEndian.AppendUint32(plain, provide)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // no PadC
+	plain = binary.BigEndian.AppendUint16(plain, 0) // no initial payload, our handshake follows in the stream
+	enc.XORKeyStream(plain, plain)
+	if _, err := conn.Write(append(msg, plain...)); err != nil {
+		return nil, err
+	}
+
+	// step 4: PadB then ENCRYPT(VC, crypto_select, len(padD), padD)
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+	if err := syncOn(br, encVC, maxPad); err != nil {
+		return nil, err
+	}
+	var hdr [6]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr[:], hdr[:])
+	sel := binary.BigEndian.Uint32(hdr[:4])
+	padD := int(binary.BigEndian.Uint16(hdr[4:]))
+	if padD > maxPad {
+		return nil, ErrSync
+	}
+	padBuf := make([]byte, padD)
+	if _, err := io.ReadFull(br, padBuf); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padBuf, padBuf)
+
+	switch {
+	case sel == cryptoRC4:
+		return &Conn{Conn: conn, r: &decryptReader{br, dec}, enc: enc, dec: dec, Encrypted: true}, nil
+	case sel == cryptoPlain && provide&cryptoPlain != 0:
+		return &Conn{Conn: conn, r: br}, nil
+	}
+	return nil, ErrNoCommonMethod
+}
+
+// syncOn consumes r up to and including marker, which must start within max bytes
+func syncOn(r *bufio.Reader, marker []byte, max int) error {
+	window := make([]byte, 0, max+len(marker))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if len(window) >= len(marker) && bytes.Equal(window[len(window)-len(marker):], marker) {
+			return nil
+		}
+	}
+	return ErrSync
+}
+
+// IsPlaintext reports whether the first bytes of an incoming connection are a
+// plain BitTorrent handshake rather than an MSE public key
+func IsPlaintext(first []byte) bool {
+	const pstr = "\x13BitTorrent protocol"
+	return len(first) >= len(pstr) && string(first[:len(pstr)]) == pstr
+}
+
+// Accept performs the MSE handshake as the receiving side. r must read from
+// conn, it may hold bytes already peeked at. skeys lists the info hashes of
+// the torrents we serve; the one the initiator asked for is returned.
+func Accept(conn net.Conn, r *bufio.Reader, skeys [][]byte, policy Policy) (*Conn, []byte, error) {
+	if policy == Disabled {
+		return nil, nil, ErrNoCommonMethod
+	}
+	ya := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, nil, err
+	}
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(append(keys.public, padB...)); err != nil {
+		return nil, nil, err
+	}
+	s := keys.secret(ya)
+
+	// skip PadA up to HASH('req1', S)
+	if err := syncOn(r, hash([]byte("req1"), s), maxPad); err != nil {
+		return nil, nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, obfuscated); err != nil {
+		return nil, nil, err
+	}
+	req3 := hash([]byte("req3"), s)
+	var skey []byte
+	for _, k := range skeys {
+		if bytes.Equal(xor(hash([]byte("req2"), k), req3), obfuscated) {
+			skey = k
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, ErrUnknownTorrent
+	}
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	var hdr [14]byte // VC, crypto_provide, len(PadC)
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(hdr[:], hdr[:])
+	if !bytes.Equal(hdr[:8], vc) {
+		return nil, nil, ErrSync
+	}
+	provide := binary.BigEndian.Uint32(hdr[8:12])
+	padC := int(binary.BigEndian.Uint16(hdr[12:]))
+	if padC > maxPad {
+		return nil, nil, ErrSync
+	}
+	rest := make([]byte, padC+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padC:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var sel uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		sel = cryptoRC4
+	case provide&cryptoPlain != 0 && policy != Required:
+		sel = cryptoPlain
+	default:
+		return nil, nil, ErrNoCommonMethod
+	}
+	padD, err := randomPad()
+	if err != nil {
+		return nil, nil, err
+	}
+	reply := append([]byte(nil), vc...)
+	reply = binary.BigEndian.AppendUint32(reply, sel)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(padD)))
+	reply = append(reply, padD...)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, nil, err
+	}
+
+	// the initial payload was encrypted even if the rest of the stream won't be
+	if sel == cryptoRC4 {
+		return &Conn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), &decryptReader{r, dec}), enc: enc, dec: dec, Encrypted: true}, skey, nil
+	}
+	return &Conn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), r)}, skey, nil
+}
@@ -0,0 +1,137 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingConn keeps a copy of everything written through it
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+// tcpPair a connected pair of loopback TCP connections
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetDeadline(time.Now().Add(10 * time.Second))
+	b.SetDeadline(time.Now().Add(10 * time.Second))
+	return a, b
+}
+
+func TestHandshake(t *testing.T) {
+	ours, other := bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)
+	tests := []struct {
+		name             string
+		initiate, accept Policy
+		skey             []byte
+		acceptErr        error
+	}{
+		{"preferred", Preferred, Preferred, ours, nil},
+		{"initiator requires", Required, Preferred, ours, nil},
+		{"receiver requires", Preferred, Required, ours, nil},
+		{"unknown torrent", Preferred, Preferred, other, ErrUnknownTorrent},
+		{"receiver disabled", Preferred, Disabled, ours, ErrNoCommonMethod},
+	}
+	for _, tt := range tests {
+		a, b := tcpPair(t)
+		rec := &recordingConn{Conn: a}
+		type result struct {
+			c   *Conn
+			err error
+		}
+		initiated := make(chan result, 1)
+		go func() {
+			c, err := Initiate(rec, tt.skey, tt.initiate)
+			initiated <- result{c, err}
+		}()
+		bc, skey, err := Accept(b, bufio.NewReader(b), [][]byte{ours}, tt.accept)
+		if err != tt.acceptErr {
+			t.Errorf("%s: Accept %v, want %v", tt.name, err, tt.acceptErr)
+		}
+		if err != nil {
+			b.Close()
+			if r := <-initiated; r.err == nil {
+				t.Errorf("%s: Initiate succeeded", tt.name)
+			}
+			a.Close()
+			continue
+		}
+		r := <-initiated
+		if r.err != nil {
+			t.Fatalf("%s: Initiate %v", tt.name, r.err)
+		}
+		if !bytes.Equal(skey, ours) || !r.c.Encrypted || !bc.Encrypted {
+			t.Errorf("%s: skey %x, encrypted %v and %v", tt.name, skey, r.c.Encrypted, bc.Encrypted)
+		}
+
+		msg := []byte("\x13BitTorrent protocol, sent after the handshake")
+		r.c.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(bc, got); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: received %q, %v", tt.name, got, err)
+		}
+		bc.Write([]byte("reply"))
+		got = make([]byte, 5)
+		if _, err := io.ReadFull(r.c, got); err != nil || string(got) != "reply" {
+			t.Errorf("%s: received %q, %v", tt.name, got, err)
+		}
+		if bytes.Contains(rec.written.Bytes(), []byte("BitTorrent protocol")) {
+			t.Errorf("%s: plaintext on the wire", tt.name)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestIsPlaintext(t *testing.T) {
+	tests := []struct {
+		first string
+		want  bool
+	}{
+		{"\x13BitTorrent protocol\x00\x00", true},
+		{"\x13BitTorrent protoco", false},
+		{"\x13BitTorrent Protocol", false},
+		{string(bytes.Repeat([]byte{0xab}, keyLen)), false},
+	}
+	for _, tt := range tests {
+		if got := IsPlaintext([]byte(tt.first)); got != tt.want {
+			t.Errorf("IsPlaintext(%q) = %v", tt.first, got)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Disabled, Preferred, Required} {
+		if got, err := ParsePolicy(p.String()); err != nil || got != p {
+			t.Errorf("%v: got %v, %v", p, got, err)
+		}
+	}
+	if got, err := ParsePolicy("Required"); err != nil || got != Required {
+		t.Errorf("case: got %v, %v", got, err)
+	}
+	if _, err := ParsePolicy("sometimes"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
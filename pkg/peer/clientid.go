@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// azureusClients two letter client codes used in Azureus-style peer ids: -XX1234-
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"CD": "Enhanced CTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"ST": "SymTorrent",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients one letter client codes used in Shadow-style peer ids: S58B-----
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ClientName decodes the client name and version from an Azureus-style
+// (-TR2920-), Shadow-style (S58B-----) or Mainline-style (M4-3-6--) peer id.
+// It returns "unknown" if the id follows none of them.
+func ClientName(id string) string {
+	name, version := parseClientID(id)
+	if name == "" {
+		return "unknown"
+	}
+	if version == "" {
+		return name
+	}
+	return name + " " + version
+}
+
+func parseClientID(id string) (name, version string) {
+	switch {
+	case len(id) >= 8 && id[0] == '-' && id[7] == '-':
+		return azureus(id[1:3], id[3:7])
+	case len(id) >= 8 && id[0] == 'M' && isMainline(id[1:8]):
+		return "BitTorrent", strings.Join(strings.FieldsFunc(id[1:8], func(r rune) bool { return r == '-' }), ".")
+	case len(id) >= 6:
+		if name, ok := shadowClients[id[0]]; ok {
+			return name, shadowVersion(id[1:6])
+		}
+	}
+	return "", ""
+}
+
+func azureus(code, v string) (name, version string) {
+	name, ok := azureusClients[code]
+	if !ok {
+		name = code
+	}
+	if code == "TR" {
+		// Transmission packs major and a two digit minor: 2920 is 2.92
+		if v[0] == '0' {
+			// 0.x releases used all four digits for the minor version
+			return name, "0." + strings.TrimLeft(v[1:], "0")
+		}
+		return name, v[:1] + "." + v[1:3]
+	}
+	parts := make([]string, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		n, ok := versionDigit(v[i])
+		if !ok {
+			return name, ""
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return name, strings.Join(parts, ".")
+}
+
+// shadowVersion decodes up to five version characters, stopping at the first '-'
+func shadowVersion(v string) string {
+	parts := []string{}
+	for i := 0; i < len(v) && v[i] != '-'; i++ {
+		n, ok := versionDigit(v[i])
+		if !ok {
+			return ""
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, ".")
+}
+
+// versionDigit 0-9, then A-Z for 10-35 and a-z for 36-61
+func versionDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	}
+	return 0, false
+}
+
+// isMainline checks for the "4-3-6--" or "4-10-1-" version layout after the leading 'M'
+func isMainline(v string) bool {
+	dashes := 0
+	for i := 0; i < len(v); i++ {
+		switch {
+		case v[i] == '-':
+			dashes++
+		case v[i] < '0' || v[i] > '9':
+			return false
+		}
+	}
+	return dashes >= 2 && v[0] != '-' && v[len(v)-1] == '-'
+}
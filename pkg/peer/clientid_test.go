@@ -0,0 +1,29 @@
+package peer
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"-TR2920-abcdefghijkl", "Transmission 2.92"},
+		{"-TR0072-abcdefghijkl", "Transmission 0.72"},
+		{"-qB4250-abcdefghijkl", "qBittorrent 4.2.5.0"},
+		{"-UT355S-abcdefghijkl", "µTorrent 3.5.5.28"},
+		{"-LT1200-abcdefghijkl", "libtorrent 1.2.0.0"},
+		{"-ZZ1000-abcdefghijkl", "ZZ 1.0.0.0"},
+		{"-DE13!0-abcdefghijkl", "Deluge"},
+		{"S58B-----abcdefghijk", "Shadow 5.8.11"},
+		{"T03I--00abcdefghijkl", "BitTornado 0.3.18"},
+		{"M4-3-6--abcdefghijkl", "BitTorrent 4.3.6"},
+		{"M4-10-1-abcdefghijkl", "BitTorrent 4.10.1"},
+		{"\x00\x01\x02\x03\x04\x05\x06\x07abcdefghijkl", "unknown"},
+		{"-TR", "unknown"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := ClientName(tt.id); got != tt.want {
+			t.Errorf("ClientName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// MsgExtended the BEP 10 extension protocol message id
+const MsgExtended MessageID = 20
+
+// extHandshakeID the extended message id of the extension handshake
+const extHandshakeID = 0
+
+// ErrExtensionNotSupported the peer didn't advertise the extension in its handshake
+var ErrExtensionNotSupported = errors.New("peer: extension not supported by peer")
+
+// Extended a BEP 10 extension message, ExtID 0 being the extension handshake
+type Extended struct {
+	ExtID   uint8
+	Payload []byte
+}
+
+func (Extended) ID() MessageID { return MsgExtended }
+
+func (m Extended) payload() []byte { return append([]byte{m.ExtID}, m.Payload...) }
+
+func parseExtended(p []byte) (Message, error) {
+	if len(p) < 1 {
+		return nil, fmt.Errorf("peer: empty extended message")
+	}
+	return Extended{p[0], p[1:]}, nil
+}
+
+// ExtensionHandler handles the messages of one BEP 10 extension
+type ExtensionHandler interface {
+	// Name the extension's name in the handshake's "m" dictionary, e.g. ut_pex
+	Name() string
+	// Handle a message for the extension. It runs on the peer's reader
+	// goroutine, so it may use the peer's methods but shouldn't block for long.
+	Handle(p *Peer, payload []byte)
+}
+
+// HandshakeExtender is implemented by extension handlers that add keys of
+// their own to the extension handshake, like ut_metadata's metadata_size
+type HandshakeExtender interface {
+	ExtendHandshake(d map[string]interface{})
+}
+
+// sendExtHandshake advertises our extensions, each under its index+1 in p.Extensions
+func (p *Peer) sendExtHandshake() error {
+	m := make(map[string]interface{}, len(p.Extensions))
+	for i, h := range p.Extensions {
+		m[h.Name()] = i + 1
+	}
+	d := map[string]interface{}{
+		"m": m,
+		"v": ClientVersion,
+	}
+	for _, h := range p.Extensions {
+		if x, ok := h.(HandshakeExtender); ok {
+			x.ExtendHandshake(d)
+		}
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, d); err != nil {
+		return err
+	}
+	return p.Send(Extended{extHandshakeID, buf.Bytes()})
+}
+
+// handleExtended dispatches an extension message, called without state held
+func (p *Peer) handleExtended(msg Extended) {
+	if msg.ExtID == extHandshakeID {
+		if err := p.readExtHandshake(msg.Payload); err != nil {
+			log.Printf("Bad extension handshake from %s :: %v\n", p.IP, err)
+		}
+		return
+	}
+	i := int(msg.ExtID) - 1
+	if i < 0 || i >= len(p.Extensions) {
+		log.Printf("Extension message %d from peer %s :: %s\n", msg.ExtID, p.IP, p.ID)
+		return
+	}
+	p.Extensions[i].Handle(p, msg.Payload)
+}
+
+func (p *Peer) readExtHandshake(payload []byte) error {
+	d, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	dict, ok := d.(map[string]interface{})
+	if !ok {
+		return errors.New("handshake isn't a dictionary")
+	}
+	m, _ := dict["m"].(map[string]interface{})
+	p.state.Lock()
+	defer p.state.Unlock()
+	// later handshakes may update or, with id 0, disable extensions
+	for name, id := range m {
+		n, ok := id.(int64)
+		if !ok || n < 0 || n > 255 {
+			continue
+		}
+		if n == 0 {
+			delete(p.extensions, name)
+		} else {
+			p.extensions[name] = uint8(n)
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		p.Client = v
+	}
+	if size, ok := dict["metadata_size"].(int64); ok && size > 0 && size <= MaxMetadataSize {
+		p.metadataSize = int(size)
+	}
+	return nil
+}
+
+// SupportsExtension reports whether the peer advertised the named extension
+func (p *Peer) SupportsExtension(name string) bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	_, ok := p.extensions[name]
+	return ok
+}
+
+// SendExtended sends payload to the peer's handler of the named extension
+func (p *Peer) SendExtended(name string, payload []byte) error {
+	p.state.Lock()
+	id, ok := p.extensions[name]
+	p.state.Unlock()
+	if !ok {
+		return ErrExtensionNotSupported
+	}
+	return p.Send(Extended{id, payload})
+}
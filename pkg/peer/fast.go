@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// BEP 6 Fast Extension message ids
+const (
+	MsgSuggestPiece  MessageID = 0x0D
+	MsgHaveAll       MessageID = 0x0E
+	MsgHaveNone      MessageID = 0x0F
+	MsgRejectRequest MessageID = 0x10
+	MsgAllowedFast   MessageID = 0x11
+)
+
+// AllowedFastCount the number of pieces we let a choked peer download from us
+const AllowedFastCount = 10
+
+type (
+	// SuggestPiece the sender would rather serve this piece, e.g. because it's in its cache
+	SuggestPiece struct {
+		Index uint32
+	}
+	// HaveAll replaces a bitfield with every bit set
+	HaveAll struct{}
+	// HaveNone replaces an empty bitfield
+	HaveNone struct{}
+	// RejectRequest the sender will not answer a Request
+	RejectRequest struct {
+		Index, Begin, Length uint32
+	}
+	// AllowedFast the receiver may request this piece even while choked
+	AllowedFast struct {
+		Index uint32
+	}
+)
+
+func (SuggestPiece) ID() MessageID  { return MsgSuggestPiece }
+func (HaveAll) ID() MessageID       { return MsgHaveAll }
+func (HaveNone) ID() MessageID      { return MsgHaveNone }
+func (RejectRequest) ID() MessageID { return MsgRejectRequest }
+func (AllowedFast) ID() MessageID   { return MsgAllowedFast }
+
+func (m SuggestPiece) payload() []byte  { return binary.BigEndian.AppendUint32(nil, m.Index) }
+func (HaveAll) payload() []byte         { return nil }
+func (HaveNone) payload() []byte        { return nil }
+func (m RejectRequest) payload() []byte { return blockPayload(m.Index, m.Begin, m.Length) }
+func (m AllowedFast) payload() []byte   { return binary.BigEndian.AppendUint32(nil, m.Index) }
+
+// parseFast decodes the Fast Extension messages, ok is false for any other id
+func parseFast(id MessageID, p []byte) (m Message, ok bool, err error) {
+	want := map[MessageID]int{
+		MsgSuggestPiece:  4,
+		MsgHaveAll:       0,
+		MsgHaveNone:      0,
+		MsgRejectRequest: 12,
+		MsgAllowedFast:   4,
+	}
+	n, ok := want[id]
+	if !ok {
+		return nil, false, nil
+	}
+	if len(p) != n {
+		return nil, true, fmt.Errorf("peer: message %d with %d byte payload, want %d", id, len(p), n)
+	}
+	switch id {
+	case MsgSuggestPiece:
+		return SuggestPiece{binary.BigEndian.Uint32(p)}, true, nil
+	case MsgHaveAll:
+		return HaveAll{}, true, nil
+	case MsgHaveNone:
+		return HaveNone{}, true, nil
+	case MsgRejectRequest:
+		return RejectRequest{binary.BigEndian.Uint32(p), binary.BigEndian.Uint32(p[4:]), binary.BigEndian.Uint32(p[8:])}, true, nil
+	default:
+		return AllowedFast{binary.BigEndian.Uint32(p)}, true, nil
+	}
+}
+
+// AllowedFastSet generates the k piece indexes a peer at ip may fetch from a
+// torrent with numPieces pieces while choked, using the algorithm from BEP 6.
+// Only IPv4 addresses are covered by the BEP, for others the set is empty.
+func AllowedFastSet(k int, numPieces int, infoHash []byte, ip net.IP) []uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	x := make([]byte, 0, 24)
+	// the last octet is masked so peers behind the same /24 share a set
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash...)
+
+	set := make([]uint32, 0, k)
+	seen := make(map[uint32]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,40 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	tests := []struct {
+		name      string
+		k, pieces int
+		ip        string
+		want      []uint32
+	}{
+		// the reference vectors from BEP 6
+		{"bep 6, 7 pieces", 7, 1313, "80.4.4.200", []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"bep 6, 9 pieces", 9, 1313, "80.4.4.200", []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"same /24", 7, 1313, "80.4.4.1", []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"ipv6", 7, 1313, "2001:db8::1", nil},
+		{"no pieces", 7, 0, "80.4.4.200", nil},
+	}
+	for _, tt := range tests {
+		if got := AllowedFastSet(tt.k, tt.pieces, infoHash, net.ParseIP(tt.ip)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedFastSetSmallTorrent(t *testing.T) {
+	// more pieces asked for than there are gives every piece once
+	got := AllowedFastSet(AllowedFastCount, 3, bytes.Repeat([]byte{0xaa}, 20), net.ParseIP("10.0.0.1"))
+	slices.Sort(got)
+	if !reflect.DeepEqual(got, []uint32{0, 1, 2}) {
+		t.Fatal(got)
+	}
+}
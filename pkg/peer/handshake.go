@@ -0,0 +1,110 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol the protocol string every BitTorrent handshake starts with
+const Protocol = "BitTorrent protocol"
+
+// handshakeLen pstrlen + pstr + reserved + info hash + peer id
+const handshakeLen = 1 + len(Protocol) + 8 + 20 + 20
+
+var (
+	// ErrBadProtocol the remote end doesn't speak the BitTorrent protocol
+	ErrBadProtocol = errors.New("peer: bad protocol string in handshake")
+	// ErrInfoHashMismatch the peer is serving a different torrent
+	ErrInfoHashMismatch = errors.New("peer: info hash mismatch")
+	// ErrSelfConnection the peer is us, usually our own address handed back by a tracker
+	ErrSelfConnection = errors.New("peer: connected to ourselves")
+)
+
+// Capability a reserved handshake bit advertising a protocol extension
+type Capability struct {
+	byte int
+	mask byte
+}
+
+// Capabilities we know about
+var (
+	CapDHT      = Capability{7, 0x01} // BEP 5
+	CapFast     = Capability{7, 0x04} // BEP 6
+	CapExtended = Capability{5, 0x10} // BEP 10
+)
+
+// Reserved the 8 reserved handshake bytes
+type Reserved [8]byte
+
+// Has reports whether c is set
+func (r Reserved) Has(c Capability) bool {
+	return r[c.byte]&c.mask != 0
+}
+
+// Set sets c
+func (r *Reserved) Set(c Capability) {
+	r[c.byte] |= c.mask
+}
+
+// Handshake the first message each side sends on a connection
+type Handshake struct {
+	Reserved Reserved
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// NewHandshake returns a handshake for infoHash and peerID, both of which must be 20 bytes
+func NewHandshake(infoHash, peerID []byte) (*Handshake, error) {
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		return nil, fmt.Errorf("peer: handshake needs a 20 byte info hash and peer id, got %d and %d", len(infoHash), len(peerID))
+	}
+	h := &Handshake{}
+	copy(h.InfoHash[:], infoHash)
+	copy(h.PeerID[:], peerID)
+	return h, nil
+}
+
+// Bytes the wire encoding of h
+func (h *Handshake) Bytes() []byte {
+	buf := make([]byte, 0, handshakeLen)
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	return append(buf, h.PeerID[:]...)
+}
+
+// ReadHandshake reads a handshake from r, checking the protocol string
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+	if int(buf[0]) != len(Protocol) {
+		return nil, ErrBadProtocol
+	}
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, err
+	}
+	if string(buf[1:1+len(Protocol)]) != Protocol {
+		return nil, ErrBadProtocol
+	}
+	h := &Handshake{}
+	rest := buf[1+len(Protocol):]
+	copy(h.Reserved[:], rest[:8])
+	copy(h.InfoHash[:], rest[8:28])
+	copy(h.PeerID[:], rest[28:48])
+	return h, nil
+}
+
+// Validate checks a received handshake against the one we sent
+func (h *Handshake) Validate(ours *Handshake) error {
+	if h.InfoHash != ours.InfoHash {
+		return ErrInfoHashMismatch
+	}
+	if h.PeerID == ours.PeerID {
+		return ErrSelfConnection
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	h, err := NewHandshake(bytes.Repeat([]byte{1}, 20), []byte("-GT0001-abcdefghijkl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Reserved.Set(CapFast)
+	h.Reserved.Set(CapExtended)
+	got, err := ReadHandshake(bytes.NewReader(h.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *h {
+		t.Fatalf("got %+v, want %+v", got, h)
+	}
+	if !got.Reserved.Has(CapFast) || !got.Reserved.Has(CapExtended) || got.Reserved.Has(CapDHT) {
+		t.Errorf("reserved %x", got.Reserved)
+	}
+}
+
+func TestNewHandshakeLengths(t *testing.T) {
+	tests := []struct {
+		name             string
+		infoHash, peerID []byte
+		ok               bool
+	}{
+		{"valid", make([]byte, 20), make([]byte, 20), true},
+		{"short info hash", make([]byte, 19), make([]byte, 20), false},
+		{"long peer id", make([]byte, 20), make([]byte, 21), false},
+		{"nil", nil, nil, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewHandshake(tt.infoHash, tt.peerID); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestReadHandshakeMalformed(t *testing.T) {
+	good, _ := NewHandshake(make([]byte, 20), make([]byte, 20))
+	b := good.Bytes()
+	wrongName := append([]byte{}, b...)
+	copy(wrongName[1:], "BitTorrent protocoX")
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"wrong length byte", append([]byte{18}, b[1:]...), ErrBadProtocol},
+		{"wrong protocol string", wrongName, ErrBadProtocol},
+		{"truncated", b[:40], io.ErrUnexpectedEOF},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), ErrBadProtocol},
+	}
+	for _, tt := range tests {
+		if _, err := ReadHandshake(bytes.NewReader(tt.in)); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateHandshake(t *testing.T) {
+	ours, _ := NewHandshake(bytes.Repeat([]byte{1}, 20), []byte("-GT0001-ourselvesour"))
+	tests := []struct {
+		name             string
+		infoHash, peerID string
+		want             error
+	}{
+		{"ok", string(bytes.Repeat([]byte{1}, 20)), "-TR2920-someoneelse1", nil},
+		{"other torrent", string(bytes.Repeat([]byte{2}, 20)), "-TR2920-someoneelse1", ErrInfoHashMismatch},
+		{"ourselves", string(bytes.Repeat([]byte{1}, 20)), "-GT0001-ourselvesour", ErrSelfConnection},
+	}
+	for _, tt := range tests {
+		theirs, _ := NewHandshake([]byte(tt.infoHash), []byte(tt.peerID))
+		if err := theirs.Validate(ours); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
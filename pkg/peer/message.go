@@ -0,0 +1,254 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxMessageSize the largest message length we accept from a peer. A piece
+// message carries at most a 16KiB block, but bitfields of torrents with many
+// pieces can be much larger.
+const MaxMessageSize = 1 << 20
+
+// ErrMessageTooLarge returned by ReadMessage when a peer announces a message longer than MaxMessageSize
+var ErrMessageTooLarge = errors.New("peer: message too large")
+
+// MessageID the id byte following the length prefix of every non keep-alive message
+type MessageID uint8
+
+// BEP 3 message ids
+const (
+	MsgChoke MessageID = iota
+	MsgUnchoke
+	MsgInterested
+	MsgNotInterested
+	MsgHave
+	MsgBitfield
+	MsgRequest
+	MsgPiece
+	MsgCancel
+	MsgPort
+)
+
+func (id MessageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgSuggestPiece:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgRejectRequest:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("message(%d)", uint8(id))
+}
+
+// Message a decoded peer wire message
+type Message interface {
+	// ID the message id, KeepAlive has none and reports 0xff
+	ID() MessageID
+	// payload the bytes following the id
+	payload() []byte
+}
+
+type (
+	// KeepAlive a zero length message
+	KeepAlive struct{}
+	// Choke we won't be served requests
+	Choke struct{}
+	// Unchoke requests will be served
+	Unchoke struct{}
+	// Interested the sender wants pieces from the receiver
+	Interested struct{}
+	// NotInterested the sender wants nothing from the receiver
+	NotInterested struct{}
+	// Have the sender completed and verified a piece
+	Have struct {
+		Index uint32
+	}
+	// BitfieldMessage the pieces the sender has, only valid directly after the handshake
+	BitfieldMessage struct {
+		Bits []byte
+	}
+	// Request asks for a block of a piece
+	Request struct {
+		Index, Begin, Length uint32
+	}
+	// Piece a block of data answering a Request
+	Piece struct {
+		Index, Begin uint32
+		Block        []byte
+	}
+	// Cancel withdraws a Request
+	Cancel struct {
+		Index, Begin, Length uint32
+	}
+	// Port the sender's DHT port
+	Port struct {
+		Port uint16
+	}
+	// Unknown a message with an id we don't understand
+	Unknown struct {
+		Type    MessageID
+		Payload []byte
+	}
+)
+
+func (KeepAlive) ID() MessageID       { return 0xff }
+func (Choke) ID() MessageID           { return MsgChoke }
+func (Unchoke) ID() MessageID         { return MsgUnchoke }
+func (Interested) ID() MessageID      { return MsgInterested }
+func (NotInterested) ID() MessageID   { return MsgNotInterested }
+func (Have) ID() MessageID            { return MsgHave }
+func (BitfieldMessage) ID() MessageID { return MsgBitfield }
+func (Request) ID() MessageID         { return MsgRequest }
+func (Piece) ID() MessageID           { return MsgPiece }
+func (Cancel) ID() MessageID          { return MsgCancel }
+func (Port) ID() MessageID            { return MsgPort }
+func (m Unknown) ID() MessageID       { return m.Type }
+
+func (KeepAlive) payload() []byte         { return nil }
+func (Choke) payload() []byte             { return nil }
+func (Unchoke) payload() []byte           { return nil }
+func (Interested) payload() []byte        { return nil }
+func (NotInterested) payload() []byte     { return nil }
+func (m Have) payload() []byte            { return binary.BigEndian.AppendUint32(nil, m.Index) }
+func (m BitfieldMessage) payload() []byte { return m.Bits }
+func (m Request) payload() []byte         { return blockPayload(m.Index, m.Begin, m.Length) }
+func (m Cancel) payload() []byte          { return blockPayload(m.Index, m.Begin, m.Length) }
+func (m Port) payload() []byte            { return binary.BigEndian.AppendUint16(nil, m.Port) }
+func (m Unknown) payload() []byte         { return m.Payload }
+
+func (m Piece) payload() []byte {
+	buf := make([]byte, 8, 8+len(m.Block))
+	binary.BigEndian.PutUint32(buf, m.Index)
+	binary.BigEndian.PutUint32(buf[4:], m.Begin)
+	return append(buf, m.Block...)
+}
+
+func blockPayload(index, begin, length uint32) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf, index)
+	binary.BigEndian.PutUint32(buf[4:], begin)
+	binary.BigEndian.PutUint32(buf[8:], length)
+	return buf
+}
+
+// WriteMessage writes the length prefixed encoding of m to w in a single Write
+func WriteMessage(w io.Writer, m Message) error {
+	_, err := w.Write(AppendMessage(nil, m))
+	return err
+}
+
+// AppendMessage appends the length prefixed encoding of m to buf
+func AppendMessage(buf []byte, m Message) []byte {
+	if _, ok := m.(KeepAlive); ok {
+		return binary.BigEndian.AppendUint32(buf, 0)
+	}
+	p := m.payload()
+	buf = binary.BigEndian.AppendUint32(buf, uint32(1+len(p)))
+	buf = append(buf, byte(m.ID()))
+	return append(buf, p...)
+}
+
+// ReadMessage reads one length prefixed message from r
+func ReadMessage(r io.Reader) (Message, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return KeepAlive{}, nil
+	}
+	if length > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return parseMessage(MessageID(buf[0]), buf[1:])
+}
+
+func parseMessage(id MessageID, p []byte) (Message, error) {
+	size := func(n int) error {
+		if len(p) != n {
+			return fmt.Errorf("peer: %v message with %d byte payload, want %d", id, len(p), n)
+		}
+		return nil
+	}
+	switch id {
+	case MsgChoke:
+		return Choke{}, size(0)
+	case MsgUnchoke:
+		return Unchoke{}, size(0)
+	case MsgInterested:
+		return Interested{}, size(0)
+	case MsgNotInterested:
+		return NotInterested{}, size(0)
+	case MsgHave:
+		if err := size(4); err != nil {
+			return nil, err
+		}
+		return Have{binary.BigEndian.Uint32(p)}, nil
+	case MsgBitfield:
+		return BitfieldMessage{p}, nil
+	case MsgRequest, MsgCancel:
+		if err := size(12); err != nil {
+			return nil, err
+		}
+		index, begin, length := binary.BigEndian.Uint32(p), binary.BigEndian.Uint32(p[4:]), binary.BigEndian.Uint32(p[8:])
+		if id == MsgCancel {
+			return Cancel{index, begin, length}, nil
+		}
+		return Request{index, begin, length}, nil
+	case MsgPiece:
+		if len(p) < 8 {
+			return nil, fmt.Errorf("peer: piece message with %d byte payload", len(p))
+		}
+		return Piece{binary.BigEndian.Uint32(p), binary.BigEndian.Uint32(p[4:]), p[8:]}, nil
+	case MsgPort:
+		if err := size(2); err != nil {
+			return nil, err
+		}
+		return Port{binary.BigEndian.Uint16(p)}, nil
+	}
+	if m, ok, err := parseFast(id, p); ok {
+		return m, err
+	}
+	if id == MsgExtended {
+		return parseExtended(p)
+	}
+	return Unknown{id, p}, nil
+}
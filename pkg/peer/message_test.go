@@ -0,0 +1,116 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []Message{
+		KeepAlive{},
+		Choke{},
+		Unchoke{},
+		Interested{},
+		NotInterested{},
+		Have{0xFFFFFFFF},
+		BitfieldMessage{[]byte{0xa5, 0x80}},
+		Request{1, 16384, 16384},
+		Piece{2, 0, []byte("block")},
+		Piece{3, 4, []byte{}},
+		Cancel{1, 16384, 16384},
+		Port{6881},
+		SuggestPiece{7},
+		HaveAll{},
+		HaveNone{},
+		RejectRequest{1, 2, 3},
+		AllowedFast{9},
+		Extended{1, []byte("d1:ai1ee")},
+		Unknown{42, []byte{1, 2}},
+	}
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		if err := WriteMessage(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range msgs {
+		got, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("%T: %v", want, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+	if _, err := ReadMessage(&buf); err != io.EOF {
+		t.Fatal("after the last message", err)
+	}
+}
+
+func TestMessageMalformed(t *testing.T) {
+	frame := func(id MessageID, payload ...byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+		return append(append(b, byte(id)), payload...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"choke with payload", frame(MsgChoke, 0), nil},
+		{"short have", frame(MsgHave, 0, 0, 1), nil},
+		{"long have", frame(MsgHave, 0, 0, 0, 1, 0), nil},
+		{"short request", frame(MsgRequest, make([]byte, 11)...), nil},
+		{"long cancel", frame(MsgCancel, make([]byte, 13)...), nil},
+		{"short piece", frame(MsgPiece, make([]byte, 7)...), nil},
+		{"short port", frame(MsgPort, 1), nil},
+		{"have all with payload", frame(MsgHaveAll, 1), nil},
+		{"short reject", frame(MsgRejectRequest, make([]byte, 8)...), nil},
+		{"empty extended", frame(MsgExtended), nil},
+		{"too large", binary.BigEndian.AppendUint32(nil, MaxMessageSize+1), ErrMessageTooLarge},
+		{"truncated", frame(MsgHave, 0, 0, 0, 1)[:6], io.ErrUnexpectedEOF},
+		{"truncated prefix", []byte{0, 0}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		m, err := ReadMessage(bytes.NewReader(tt.data))
+		if err == nil {
+			t.Errorf("%s: parsed as %#v", tt.name, m)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMessageWireFormat(t *testing.T) {
+	tests := []struct {
+		msg  Message
+		want string
+	}{
+		{KeepAlive{}, "\x00\x00\x00\x00"},
+		{Choke{}, "\x00\x00\x00\x01\x00"},
+		{Interested{}, "\x00\x00\x00\x01\x02"},
+		{Have{5}, "\x00\x00\x00\x05\x04\x00\x00\x00\x05"},
+		{BitfieldMessage{[]byte{0xff, 0x80}}, "\x00\x00\x00\x03\x05\xff\x80"},
+		{Request{1, 0x4000, 0x4000}, "\x00\x00\x00\x0d\x06\x00\x00\x00\x01\x00\x00\x40\x00\x00\x00\x40\x00"},
+		{Piece{1, 2, []byte("ab")}, "\x00\x00\x00\x0b\x07\x00\x00\x00\x01\x00\x00\x00\x02ab"},
+		{Port{6881}, "\x00\x00\x00\x03\x09\x1a\xe1"},
+		{HaveAll{}, "\x00\x00\x00\x01\x0e"},
+		{AllowedFast{3}, "\x00\x00\x00\x05\x11\x00\x00\x00\x03"},
+		{Extended{0, []byte("de")}, "\x00\x00\x00\x04\x14\x00de"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteMessage(&buf, tt.msg); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%#v: % x, want % x", tt.msg, buf.Bytes(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// MetadataExtension the BEP 9 extension name
+const MetadataExtension = "ut_metadata"
+
+// MetadataPieceSize the size of every piece of the info dictionary but the last
+const MetadataPieceSize = 16 << 10
+
+// MaxMetadataSize info dictionaries larger than this are refused
+const MaxMetadataSize = 16 << 20
+
+// ut_metadata message types
+const (
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+// MetadataMessage a ut_metadata message. Data messages carry one piece of
+// the info dictionary after the bencoded header.
+type MetadataMessage struct {
+	Type      int
+	Piece     int
+	TotalSize int // of the whole info dictionary, data messages only
+	Data      []byte
+}
+
+// Marshal the ut_metadata payload
+func (m *MetadataMessage) Marshal() ([]byte, error) {
+	d := map[string]interface{}{"msg_type": m.Type, "piece": m.Piece}
+	if m.Type == MetadataData {
+		d["total_size"] = m.TotalSize
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, d); err != nil {
+		return nil, err
+	}
+	return append(buf.Bytes(), m.Data...), nil
+}
+
+// ParseMetadata decodes a ut_metadata payload
+func ParseMetadata(payload []byte) (*MetadataMessage, error) {
+	n, err := bencodedLen(payload)
+	if err != nil {
+		return nil, fmt.Errorf("peer: bad metadata message: %w", err)
+	}
+	d, err := bencode.Decode(bytes.NewReader(payload[:n]))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := d.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("peer: metadata message isn't a dictionary")
+	}
+	typ, ok1 := dict["msg_type"].(int64)
+	piece, ok2 := dict["piece"].(int64)
+	if !ok1 || !ok2 || piece < 0 || piece > MaxMetadataSize/MetadataPieceSize {
+		return nil, errors.New("peer: metadata message without a type or piece")
+	}
+	m := &MetadataMessage{Type: int(typ), Piece: int(piece)}
+	if m.Type == MetadataData {
+		size, _ := dict["total_size"].(int64)
+		if size <= 0 || size > MaxMetadataSize {
+			return nil, fmt.Errorf("peer: metadata size %d out of range", size)
+		}
+		m.TotalSize, m.Data = int(size), payload[n:]
+	}
+	return m, nil
+}
+
+// bencodedLen the length of the bencoded value at the start of b
+func bencodedLen(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errors.New("truncated")
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		i := bytes.IndexByte(b, 'e')
+		if i < 0 {
+			return 0, errors.New("unterminated integer")
+		}
+		return i + 1, nil
+	case c == 'l' || c == 'd':
+		n := 1
+		for n < len(b) && b[n] != 'e' {
+			m, err := bencodedLen(b[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += m
+		}
+		if n >= len(b) {
+			return 0, errors.New("unterminated list")
+		}
+		return n + 1, nil
+	case c >= '0' && c <= '9':
+		i := bytes.IndexByte(b, ':')
+		if i < 0 {
+			return 0, errors.New("bad string")
+		}
+		l, err := strconv.Atoi(string(b[:i]))
+		if err != nil || l < 0 || i+1+l > len(b) {
+			return 0, errors.New("bad string length")
+		}
+		return i + 1 + l, nil
+	}
+	return 0, fmt.Errorf("unexpected %q", b[0])
+}
+
+// MetadataSize the size of the info dictionary the peer advertised in its
+// extension handshake, 0 if it didn't
+func (p *Peer) MetadataSize() int {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.metadataSize
+}
@@ -1,15 +1,33 @@
 package peer
 
 import (
-	"bytes"
-	"encoding/binary"
-	"io"
+	"errors"
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/mbags/gtc/pkg/bitfield"
-	"github.com/mbags/gtc/pkg/util"
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/ratelimit"
+	"github.com/mbags/gtc/pkg/utp"
+)
+
+// ClientVersion our client name, sent in the extension handshake
+const ClientVersion = "gtc"
+
+const (
+	dialTimeout      = 10 * time.Second
+	utpDialTimeout   = 5 * time.Second // short, we fall back to TCP after it
+	handshakeTimeout = 20 * time.Second
+	maxSuggested     = 16
+)
+
+var (
+	errClosed      = errors.New("peer: connection closed")
+	errBadHave     = errors.New("peer: have for a piece past the end of the torrent")
+	errBadBitfield = errors.New("peer: bitfield doesn't match the torrent's pieces")
 )
 
 /*
@@ -24,125 +42,375 @@ type Peer struct {
 	Port           uint16
 	Conn           net.Conn
 	ID             string
+	Client         string   // client name and version decoded from ID
+	Reserved       Reserved // capabilities from the peer's handshake
 	amChoking      bool
 	amInterested   bool
 	peerChoking    bool
 	peerInterested bool
 	Bitfield       bitfield.Bitfield
+
+	NumPieces  int                // pieces in the torrent, needed to make sense of HaveAll
+	Downloader Downloader         // supplies the blocks we request, nil to only chat
+	Uploader   Uploader           // serves the blocks peers request, nil to never upload
+	Extensions []ExtensionHandler // BEP 10 extensions we offer the peer
+	Pipeline   PipelineConfig     // zero for DefaultPipeline
+	Encryption mse.Policy         // for outgoing connections
+	UTP        *utp.Socket        // tried before TCP for outgoing connections, nil for TCP only
+	Transport  string             // "tcp" or "utp" once connected
+	Encrypted  bool               // the connection is RC4 encrypted
+	Incoming   bool               // the peer connected to us
+	OnConnect  func(*Peer)        // called once the handshake completes, may be nil
+	Traffic    *Traffic           // counts the bytes we exchange, may be nil
+
+	DownloadLimit, UploadLimit *ratelimit.Limiter // shared with other peers, nil for no limit
+
+	mu        sync.Mutex
+	closed    bool
+	connected bool
+	sendq     chan Message
+	done      chan struct{}
+	dead      chan struct{}   // closed when the write loop fails
+	writer    sync.WaitGroup  // the write loop, waited for before Connect or Accept return
+	queued    map[Request]int // blocks in sendq by the request they answer
+	cancelled map[Request]int // of those, how many the peer cancelled, skipped by the writer
+
+	state       sync.Mutex // guards the choke/interest flags, Bitfield and outstanding once connected
+	outstanding map[Request]time.Time
+	down, up    rateMeter
+
+	fast           bool            // both sides support the Fast Extension
+	allowedFastIn  map[uint32]bool // pieces the peer lets us request while choked
+	allowedFastOut map[uint32]bool // pieces we serve the peer while choking it
+	suggested      []uint32
+	extensions     map[string]uint8 // the peer's extension ids by name
+	metadataSize   int              // of the info dictionary, from the extension handshake
 }
 
-// Connect connects to a peer, handshakes, and checks for matching infohash
-func (p *Peer) Connect(infoHash, peerID []byte, activate, deactivate chan<- *Peer) {
-	buf := bytes.Buffer{}
-	buf.WriteByte(19)
-	buf.WriteString("BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00")
-	buf.Write(infoHash)
-	buf.Write(peerID)
-	handshake := buf.Bytes()
+// Addr the "ip:port" address of the peer, used to key peers before their ID is known
+func (p *Peer) Addr() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// Connected reports whether the handshake with the peer has completed
+func (p *Peer) Connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
+}
+
+// Close closes the connection to the peer, causing Connect to return
+func (p *Peer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.Conn == nil {
+		return nil
+	}
+	return p.Conn.Close()
+}
+
+// setConn records conn as the peer's connection unless the peer was closed while dialing
+func (p *Peer) setConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return false
+	}
+	p.Conn = conn
+	p.sendq = make(chan Message, sendQueueLen)
+	p.queued = make(map[Request]int)
+	p.cancelled = make(map[Request]int)
+	p.done = make(chan struct{})
+	p.dead = make(chan struct{})
+	return true
+}
+
+// Connect connects to a peer, handshakes, and checks for matching infohash.
+// It blocks reading messages until the connection fails or is closed.
+func (p *Peer) Connect(infoHash, peerID []byte, activate, deactivate chan<- *Peer) error {
+	ours, err := p.ourHandshake(infoHash, peerID)
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Connecting to %s\n", p.IP)
-	conn, err := net.Dial("tcp", p.IP.String()+":"+strconv.Itoa(int(p.Port)))
+	conn, err := p.dial(infoHash)
 	if err != nil {
 		log.Printf("Couldn't connect to %s\n", p.IP)
-		return
+		return err
+	}
+	if !p.setConn(conn) {
+		return errClosed
 	}
+	defer p.writer.Wait()
+	defer conn.Close()
+	defer close(p.done)
 
 	// do handshake
 
 	log.Printf("Sending handshake to %s\n", p.IP)
-	if _, err := conn.Write(handshake); err != nil {
+	if _, err := conn.Write(ours.Bytes()); err != nil {
 		log.Printf("Send handshake failed w/ : %v\n", p.IP)
-		return
+		return err
 	}
 
-	p.Conn = conn
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	theirs, err := ReadHandshake(conn)
+	if err != nil {
+		log.Printf("Couldnt get handshake response from: %v :: %v\n", p.IP, err)
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return p.run(conn, ours, theirs, activate, deactivate)
+}
 
-	res, err := p.readN(68)
+// Accept takes over an incoming connection whose handshake, theirs, has
+// already been read. It answers with ours and then behaves like Connect.
+func (p *Peer) Accept(conn net.Conn, theirs *Handshake, peerID []byte, activate, deactivate chan<- *Peer) error {
+	ours, err := p.ourHandshake(theirs.InfoHash[:], peerID)
 	if err != nil {
-		log.Printf("Couldnt get handshake response from: %v\n", p.IP)
-		return
+		conn.Close()
+		return err
+	}
+	if !p.setConn(conn) {
+		return errClosed
+	}
+	defer p.writer.Wait()
+	defer conn.Close()
+	defer close(p.done)
+
+	if _, err := conn.Write(ours.Bytes()); err != nil {
+		return err
+	}
+	return p.run(conn, ours, theirs, activate, deactivate)
+}
+
+func (p *Peer) ourHandshake(infoHash, peerID []byte) (*Handshake, error) {
+	ours, err := NewHandshake(infoHash, peerID)
+	if err != nil {
+		return nil, err
+	}
+	ours.Reserved.Set(CapFast)
+	if len(p.Extensions) > 0 {
+		ours.Reserved.Set(CapExtended)
+	}
+	return ours, nil
+}
+
+// dial opens a TCP connection to the peer and, unless encryption is disabled,
+// performs the MSE handshake, retrying in plaintext if it's merely preferred
+func (p *Peer) dial(infoHash []byte) (net.Conn, error) {
+	conn, err := p.dialTransport()
+	if err != nil || p.Encryption == mse.Disabled {
+		return conn, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ec, err := mse.Initiate(conn, infoHash, p.Encryption)
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		p.Encrypted = ec.Encrypted
+		return ec, nil
+	}
+	conn.Close()
+	if p.Encryption == mse.Required {
+		return nil, err
+	}
+	log.Printf("Encrypted handshake with %s failed, retrying in plaintext :: %v\n", p.IP, err)
+	return p.dialTransport()
+}
+
+// dialTransport connects over uTP when the peer answers, otherwise over TCP
+func (p *Peer) dialTransport() (net.Conn, error) {
+	if p.UTP != nil {
+		conn, err := p.UTP.DialTimeout(p.Addr(), utpDialTimeout)
+		if err == nil {
+			p.Transport = "utp"
+			return conn, nil
+		}
 	}
+	p.Transport = "tcp"
+	return net.DialTimeout("tcp", p.Addr(), dialTimeout)
+}
 
-	// TODO cut up the handshake and set fields in peer
+// run validates the peer's handshake then exchanges messages until the connection ends
+func (p *Peer) run(conn net.Conn, ours, theirs *Handshake, activate, deactivate chan<- *Peer) error {
+	if err := theirs.Validate(ours); err != nil {
+		log.Printf("Bad handshake from %v :: %v\n", p.IP, err)
+		return err
+	}
+
+	// both handshakes are behind us by now
+	p.Traffic.down(handshakeLen, 0)
+	p.Traffic.up(handshakeLen, 0)
+
+	p.ID = string(theirs.PeerID[:])
+	p.Client = ClientName(p.ID)
+	p.Reserved = theirs.Reserved
+	log.Printf("Connected to peer: %v :: %s", p.IP, p.Client)
+
+	conn = ratelimit.Conn(conn, p.DownloadLimit, p.UploadLimit)
+	p.writer.Add(1)
+	go func() {
+		defer p.writer.Done()
+		p.writeLoop(conn, p.sendq, p.done, p.dead)
+	}()
+
+	p.state.Lock()
+	p.outstanding = make(map[Request]time.Time)
+	p.Bitfield = bitfield.New(p.NumPieces)
+	p.amChoking, p.peerChoking = true, true
+	p.amInterested = true
+	p.fast = theirs.Reserved.Has(CapFast)
+	p.allowedFastIn = make(map[uint32]bool)
+	p.allowedFastOut = make(map[uint32]bool)
+	p.extensions = make(map[string]uint8)
+	p.state.Unlock()
+	p.mu.Lock()
+	p.connected = true
+	p.mu.Unlock()
+	if p.OnConnect != nil {
+		p.OnConnect(p)
+	}
+	if err := p.sendHaves(ours.InfoHash[:]); err != nil {
+		return err
+	}
+	if len(p.Extensions) > 0 && theirs.Reserved.Has(CapExtended) {
+		if err := p.sendExtHandshake(); err != nil {
+			return err
+		}
+	}
+	if err := p.Send(Interested{}); err != nil {
+		return err
+	}
 
-	if peerInfoHash := string(res[28:48]); peerInfoHash == string(infoHash) {
-		p.ID = string(res[48:])
-		p.amInterested = true
+	err := p.readMessages(conn, activate, deactivate)
+	p.state.Lock()
+	// choked for good, so later FillPipeline calls don't queue requests nobody will send
+	p.peerChoking = true
+	p.returnOutstanding()
+	if p.Downloader != nil {
+		// the pieces it had no longer count, the Bitfield stays for whoever looks at the peer
+		p.Downloader.Replaced(p, p.Bitfield, bitfield.Bitfield{})
 	}
-	log.Printf("Connected to peer: %v", p.IP)
-	p.readMessages(conn, activate, deactivate)
+	p.state.Unlock()
+	return err
 }
 
-func (p *Peer) readMessages(conn net.Conn, activate, deactivate chan<- *Peer) {
-	var connectionResponseBytes = make([]byte, 4)
-	var messageID byte
-	var length uint32
-	var err error
+// replaceBitfield sets the pieces the peer has to b, caller holds state
+func (p *Peer) replaceBitfield(b bitfield.Bitfield) {
+	had := p.Bitfield
+	p.Bitfield = b
+	if p.Downloader != nil {
+		p.Downloader.Replaced(p, had, b)
+	}
+}
 
+func (p *Peer) readMessages(conn net.Conn, activate, deactivate chan<- *Peer) error {
+	r := &countingReader{r: conn}
 	for {
-		connectionResponseBytes = make([]byte, 4)
-		_, err = conn.Read(connectionResponseBytes)
+		conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		r.n = 0
+		msg, err := ReadMessage(r)
 		if err != nil {
-			log.Println("Error receiving response")
+			log.Printf("Error receiving message from peer %s :: %v\n", p.IP, err)
+			return err
 		}
-		connectionResponse := bytes.NewBuffer(connectionResponseBytes)
-		err = binary.Read(connectionResponse, binary.BigEndian, &length)
-		if err != nil {
-			return
-		}
-		if length == 0 {
-			log.Printf("Keep-alive message from peer %s\n", p.IP)
-			continue
-		}
-		connectionResponseBytes = make([]byte, 1)
-		_, err = conn.Read(connectionResponseBytes)
-		connectionResponse = bytes.NewBuffer(connectionResponseBytes)
-		err = binary.Read(connectionResponse, binary.BigEndian, &messageID)
-		if err != nil {
-			log.Printf("Error receiving message id from peer %s\n", p.IP)
-			return
+		payload := 0
+		if piece, ok := msg.(Piece); ok {
+			payload = len(piece.Block)
 		}
+		p.Traffic.down(r.n, payload)
 
-		connectionResponseBytes = make([]byte, length-1)
-		_, err = conn.Read(connectionResponseBytes)
-
-		switch messageID {
-		case 0:
+		var bad error
+		p.state.Lock()
+		switch msg := msg.(type) {
+		case KeepAlive:
+			log.Printf("Keep-alive message from peer %s\n", p.IP)
+		case Choke:
 			p.peerChoking = true
+			if !p.fast {
+				// with the Fast Extension the peer rejects each request explicitly
+				p.returnOutstanding()
+			}
 			log.Printf("Choked by peer %s :: %s\n", p.IP, p.ID)
-			deactivate <- p
-		case 1:
+		case Unchoke:
 			p.peerChoking = false
 			log.Printf("Unchoked by peer %s :: %s\n", p.IP, p.ID)
-			activate <- p
-		case 2:
+		case Interested:
 			p.peerInterested = true
 			log.Printf("Interested message by peer %s :: %s\n", p.IP, p.ID)
-		case 3:
+		case NotInterested:
 			p.peerInterested = false
 			log.Printf("Not interested message by peer %s :: %s\n", p.IP, p.ID)
-		case 4:
-			p.Bitfield.Set(util.BytesToInt(connectionResponseBytes))
-			log.Printf("Have [%d] message from peer %s :: %s\n", util.BytesToInt(connectionResponseBytes), p.IP, p.ID)
-		case 5:
-			p.Bitfield.Bits = connectionResponseBytes
+		case Have:
+			// without the info dictionary NumPieces is 0 and there's nothing
+			// to check against, the peer is reconnected once it's fetched
+			if p.NumPieces > 0 && int64(msg.Index) >= int64(p.NumPieces) {
+				bad = errBadHave
+			}
+			if !p.Bitfield.IsSet(int(msg.Index)) {
+				p.Bitfield.Set(int(msg.Index))
+				if bad == nil && p.Downloader != nil {
+					p.Downloader.Have(p, int(msg.Index))
+				}
+			}
+			log.Printf("Have [%d] message from peer %s :: %s\n", msg.Index, p.IP, p.ID)
+		case BitfieldMessage:
+			if b := (bitfield.Bitfield{Bits: msg.Bits}); b.Fits(p.NumPieces) {
+				p.replaceBitfield(b)
+			} else if p.NumPieces > 0 {
+				bad = errBadBitfield
+			}
 			log.Printf("Bitfield message from peer %s :: %s\n", p.IP, p.ID)
-		case 6:
-			log.Printf("Request message from peer %s :: %s\n", p.IP, p.ID)
-		case 7:
-			log.Printf("Piece message from peer %s :: %s\n", p.IP, p.ID)
-		case 8:
+		case Request:
+			p.serveRequest(msg)
+		case Piece:
+			p.receivePiece(msg)
+		case Cancel:
+			p.cancel(Request(msg))
 			log.Printf("Cancel message from peer %s :: %s\n", p.IP, p.ID)
-		case 9: // for DHT later
+		case Port: // for DHT later
 			log.Printf("Port message from %s :: %s\n", p.IP, p.ID)
+		case HaveAll:
+			all := bitfield.New(p.NumPieces)
+			all.SetAll(p.NumPieces)
+			p.replaceBitfield(all)
+			log.Printf("Have all message from peer %s :: %s\n", p.IP, p.ID)
+		case HaveNone:
+			p.replaceBitfield(bitfield.New(p.NumPieces))
+			log.Printf("Have none message from peer %s :: %s\n", p.IP, p.ID)
+		case SuggestPiece:
+			if len(p.suggested) == maxSuggested {
+				p.suggested = p.suggested[1:]
+			}
+			p.suggested = append(p.suggested, msg.Index)
+		case RejectRequest:
+			p.rejected(Request(msg))
+		case AllowedFast:
+			p.allowedFastIn[msg.Index] = true
+		case Extended:
+			// handled below
 		default:
-			log.Printf("Message id %d received from peer %s :: %s\n", messageID, p.IP, p.ID)
+			log.Printf("Message id %d received from peer %s :: %s\n", msg.ID(), p.IP, p.ID)
 		}
-	}
-}
+		if bad != nil {
+			p.state.Unlock()
+			log.Printf("Dropping peer %s :: %v\n", p.IP, bad)
+			return bad
+		}
+		p.fillPipeline()
+		p.state.Unlock()
 
-func (p *Peer) readN(n int) ([]byte, error) {
-	buf := make([]byte, n)
-	_, err := io.ReadFull(p.Conn, buf) // look up LimitedReader or something instead later
-	return buf, err
+		// tell the torrent after releasing state, it may call back into the peer
+		switch msg := msg.(type) {
+		case Choke:
+			deactivate <- p
+		case Unchoke:
+			activate <- p
+		case Extended:
+			p.handleExtended(msg)
+		}
+	}
 }
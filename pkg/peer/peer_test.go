@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mbags/gtc/pkg/bitfield"
+)
+
+// readFrom runs the reader of a connected peer of a torrent with numPieces
+// pieces over msgs, returning what ended it
+func readFrom(t *testing.T, numPieces int, msgs ...Message) (*Peer, error) {
+	return read(t, &Peer{IP: net.IPv4(127, 0, 0, 1), NumPieces: numPieces}, msgs...)
+}
+
+// read runs the reader of p over msgs, with no writer taking what it queues
+func read(t *testing.T, p *Peer, msgs ...Message) (*Peer, error) {
+	ours, theirs := net.Pipe()
+	p.setConn(ours)
+	p.outstanding = make(map[Request]time.Time)
+	p.allowedFastIn = make(map[uint32]bool)
+	p.allowedFastOut = make(map[uint32]bool)
+	p.extensions = make(map[string]uint8)
+	p.Bitfield.Bits = make([]byte, (p.NumPieces+7)/8)
+	go func() {
+		for _, m := range msgs {
+			if WriteMessage(theirs, m) != nil {
+				return
+			}
+		}
+		theirs.Close()
+	}()
+	errc := make(chan error, 1)
+	go func() { errc <- p.readMessages(ours, make(chan *Peer, 1), make(chan *Peer, 1)) }()
+	select {
+	case err := <-errc:
+		return p, err
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader didn't return")
+		return nil, nil
+	}
+}
+
+func TestReadValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		numPieces int
+		msgs      []Message
+		want      error
+		count     int // bits set in the peer's bitfield when want is nil
+	}{
+		{"have", 10, []Message{Have{9}}, nil, 1},
+		{"have past the end", 10, []Message{Have{10}}, errBadHave, 0},
+		{"huge have", 10, []Message{Have{0xFFFFFFFF}}, errBadHave, 0},
+		{"bitfield", 10, []Message{BitfieldMessage{[]byte{0xff, 0xc0}}}, nil, 10},
+		{"short bitfield", 10, []Message{BitfieldMessage{[]byte{0xff}}}, errBadBitfield, 0},
+		{"long bitfield", 10, []Message{BitfieldMessage{[]byte{0xff, 0xc0, 0}}}, errBadBitfield, 0},
+		{"spare bits", 10, []Message{BitfieldMessage{[]byte{0xff, 0xc1}}}, errBadBitfield, 0},
+		{"have all", 10, []Message{HaveAll{}}, nil, 10},
+		{"have none", 10, []Message{Have{1}, HaveNone{}}, nil, 0},
+		// without the info dictionary there's nothing to check against
+		{"have without info", 0, []Message{Have{0xFFFFFFFF}}, nil, 0},
+		{"bitfield without info", 0, []Message{BitfieldMessage{[]byte{0xff}}}, nil, 0},
+	}
+	for _, tt := range tests {
+		p, err := readFrom(t, tt.numPieces, tt.msgs...)
+		if tt.want != nil {
+			if err != tt.want {
+				t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err == errBadHave || err == errBadBitfield {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if n := p.Bitfield.Count(); n != tt.count || len(p.Bitfield.Bits) > (tt.numPieces+7)/8 {
+			t.Errorf("%s: %d pieces in %d bytes, want %d", tt.name, n, len(p.Bitfield.Bits), tt.count)
+		}
+	}
+}
+
+// zeroes an Uploader with every piece, all zero bytes
+type zeroes struct{}
+
+func (zeroes) HavePieces() bitfield.Bitfield         { return bitfield.Bitfield{} }
+func (zeroes) ReadBlock(req Request) ([]byte, error) { return make([]byte, req.Length), nil }
+
+func TestCancel(t *testing.T) {
+	a, b := Request{0, 0, 4}, Request{1, 0, 4}
+	block := func(r Request) Piece { return Piece{r.Index, r.Begin, make([]byte, r.Length)} }
+	tests := []struct {
+		name string
+		fast bool
+		msgs []Message
+		want []Message // what we send
+	}{
+		{"served", false, []Message{a, b}, []Message{block(a), block(b)}},
+		{"cancelled", false, []Message{a, b, Cancel(a)}, []Message{block(b)}},
+		{"not queued", false, []Message{Cancel(a), a}, []Message{block(a)}},
+		{"asked again", false, []Message{a, Cancel(a), Cancel(a), a}, []Message{block(a)}},
+		{"rejected with fast", true, []Message{a, b, Cancel(b)}, []Message{block(a), RejectRequest(b)}},
+	}
+	for _, tt := range tests {
+		p := &Peer{IP: net.IPv4(127, 0, 0, 1), NumPieces: 2, Uploader: zeroes{}}
+		p.fast = tt.fast
+		if _, err := read(t, p, tt.msgs...); err == nil {
+			t.Fatalf("%s: reader ended without an error", tt.name)
+		}
+		// the writer only starts now, with everything the reader queued
+		ours, theirs := net.Pipe()
+		go p.writeLoop(ours, p.sendq, p.done, p.dead)
+		p.Send(KeepAlive{})
+		var got []Message
+		for {
+			theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+			m, err := ReadMessage(theirs)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if _, ok := m.(KeepAlive); ok {
+				break
+			}
+			got = append(got, m)
+		}
+		close(p.done)
+		theirs.Close()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// PexExtension the BEP 11 extension name
+const PexExtension = "ut_pex"
+
+// PEX flags describing an added peer
+const (
+	PexEncryption = 0x01 // prefers encrypted connections
+	PexSeed       = 0x02 // is a seed
+	PexUTP        = 0x04 // supports uTP
+	PexHolepunch  = 0x08 // supports ut_holepunch
+	PexReachable  = 0x10 // accepted an outgoing connection, so it isn't firewalled
+)
+
+// PexPeer a peer in a PEX message
+type PexPeer struct {
+	IP    net.IP
+	Port  uint16
+	Flags byte
+}
+
+// Addr the "ip:port" address of the peer
+func (pp PexPeer) Addr() string {
+	return (&Peer{IP: pp.IP, Port: pp.Port}).Addr()
+}
+
+// PexMessage the peers the sender connected to and dropped since its last message
+type PexMessage struct {
+	Added, Dropped []PexPeer
+}
+
+// Marshal the bencoded ut_pex payload, with IPv4 and IPv6 peers in separate compact lists
+func (m *PexMessage) Marshal() ([]byte, error) {
+	added, addedF, added6, added6F := compactPeers(m.Added, true)
+	dropped, _, dropped6, _ := compactPeers(m.Dropped, false)
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"added":    string(added),
+		"added.f":  string(addedF),
+		"added6":   string(added6),
+		"added6.f": string(added6F),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	})
+	return buf.Bytes(), err
+}
+
+func compactPeers(peers []PexPeer, flags bool) (v4, v4f, v6, v6f []byte) {
+	for _, pp := range peers {
+		if ip := pp.IP.To4(); ip != nil {
+			v4 = binary.BigEndian.AppendUint16(append(v4, ip...), pp.Port)
+			if flags {
+				v4f = append(v4f, pp.Flags)
+			}
+		} else if ip := pp.IP.To16(); ip != nil {
+			v6 = binary.BigEndian.AppendUint16(append(v6, ip...), pp.Port)
+			if flags {
+				v6f = append(v6f, pp.Flags)
+			}
+		}
+	}
+	return
+}
+
+// ParsePex decodes a ut_pex payload
+func ParsePex(payload []byte) (*PexMessage, error) {
+	d, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := d.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("peer: pex message isn't a dictionary")
+	}
+	field := func(k string) []byte {
+		s, _ := dict[k].(string)
+		return []byte(s)
+	}
+	m := &PexMessage{}
+	m.Added = append(parseCompact(field("added"), field("added.f"), net.IPv4len), parseCompact(field("added6"), field("added6.f"), net.IPv6len)...)
+	m.Dropped = append(parseCompact(field("dropped"), nil, net.IPv4len), parseCompact(field("dropped6"), nil, net.IPv6len)...)
+	return m, nil
+}
+
+func parseCompact(b, flags []byte, ipLen int) []PexPeer {
+	size := ipLen + 2
+	peers := make([]PexPeer, 0, len(b)/size)
+	for i := 0; i+size <= len(b); i += size {
+		pp := PexPeer{
+			IP:   net.IP(append([]byte(nil), b[i:i+ipLen]...)),
+			Port: binary.BigEndian.Uint16(b[i+ipLen:]),
+		}
+		if n := i / size; n < len(flags) {
+			pp.Flags = flags[n]
+		}
+		peers = append(peers, pp)
+	}
+	return peers
+}
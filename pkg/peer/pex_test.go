@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+)
+
+// pexAddrs the addresses and flags of peers, for comparing
+func pexAddrs(peers []PexPeer) []string {
+	var out []string
+	for _, pp := range peers {
+		out = append(out, fmt.Sprintf("%s/%d", pp.Addr(), pp.Flags))
+	}
+	return out
+}
+
+func TestPexRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		msg            PexMessage
+		added, dropped []string // IPv4 peers come back first, dropped ones without flags
+	}{
+		{"empty", PexMessage{}, nil, nil},
+		{"ipv4", PexMessage{Added: []PexPeer{{net.ParseIP("10.0.0.1"), 6881, PexSeed | PexUTP}, {net.ParseIP("10.0.0.2"), 51413, 0}}},
+			[]string{"10.0.0.1:6881/6", "10.0.0.2:51413/0"}, nil},
+		{"ipv6", PexMessage{Added: []PexPeer{{net.ParseIP("2001:db8::1"), 6881, PexEncryption}}},
+			[]string{"[2001:db8::1]:6881/1"}, nil},
+		{"mixed", PexMessage{
+			Added:   []PexPeer{{net.ParseIP("2001:db8::2"), 1, PexReachable}, {net.ParseIP("192.168.1.9"), 2, PexSeed}},
+			Dropped: []PexPeer{{net.ParseIP("2001:db8::3"), 4, PexSeed}, {net.ParseIP("10.1.1.1"), 3, 0}},
+		}, []string{"192.168.1.9:2/2", "[2001:db8::2]:1/16"}, []string{"10.1.1.1:3/0", "[2001:db8::3]:4/0"}},
+	}
+	for _, tt := range tests {
+		b, err := tt.msg.Marshal()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		m, err := ParsePex(b)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := pexAddrs(m.Added); !slices.Equal(got, tt.added) {
+			t.Errorf("%s: added %v, want %v", tt.name, got, tt.added)
+		}
+		if got := pexAddrs(m.Dropped); !slices.Equal(got, tt.dropped) {
+			t.Errorf("%s: dropped %v, want %v", tt.name, got, tt.dropped)
+		}
+	}
+}
+
+func TestParsePex(t *testing.T) {
+	tests := []struct {
+		name           string
+		payload        string
+		added, dropped []string
+		err            bool
+	}{
+		{"not bencode", "xyz", nil, nil, true},
+		{"not a dictionary", "li1ee", nil, nil, true},
+		{"no flags", "d5:added6:\x0a\x00\x00\x01\x1a\xe1e", []string{"10.0.0.1:6881/0"}, nil, false},
+		{"short flags", "d5:added12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe17:added.f1:\x02e",
+			[]string{"10.0.0.1:6881/2", "10.0.0.2:6881/0"}, nil, false},
+		{"trailing bytes ignored", "d7:dropped8:\x0a\x00\x00\x01\x1a\xe1\xff\xffe", nil, []string{"10.0.0.1:6881/0"}, false},
+		{"wrong types ignored", "d5:addedi1e7:droppedlee", nil, nil, false},
+	}
+	for _, tt := range tests {
+		m, err := ParsePex([]byte(tt.payload))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := pexAddrs(m.Added); !slices.Equal(got, tt.added) {
+			t.Errorf("%s: added %v, want %v", tt.name, got, tt.added)
+		}
+		if got := pexAddrs(m.Dropped); !slices.Equal(got, tt.dropped) {
+			t.Errorf("%s: dropped %v, want %v", tt.name, got, tt.dropped)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/bitfield"
+)
+
+// BlockSize the size of the blocks we request, the largest every client accepts
+const BlockSize = 16 << 10
+
+// Downloader hands out blocks to request from peers and receives their data.
+// Its methods are called from the peer's goroutines, possibly for many peers at once.
+type Downloader interface {
+	// NextRequest returns the next block to request from p, or false if p has nothing we want.
+	// It is called with p's state locked: it may read p.Bitfield but must not call p's methods.
+	NextRequest(p *Peer) (Request, bool)
+	// Received hands over a block we requested from p
+	Received(p *Peer, block Piece)
+	// Returned gives back requests p will never answer, e.g. because it choked us
+	Returned(p *Peer, reqs []Request)
+	// Have tells of a piece p announced it has since its bitfield, called with p's state locked
+	Have(p *Peer, index int)
+	// Replaced tells that p has the pieces set in has rather than those set in had,
+	// an empty has once p disconnects. It's called with p's state locked.
+	Replaced(p *Peer, had, has bitfield.Bitfield)
+}
+
+// PipelineConfig bounds the number of block requests kept outstanding with a peer.
+// Within the bounds the depth follows the peer's measured download rate so that
+// Latency worth of data is always in flight.
+type PipelineConfig struct {
+	Min, Max int
+	Latency  time.Duration
+}
+
+// DefaultPipeline the pipeline used by peers that don't set their own
+var DefaultPipeline = PipelineConfig{Min: 4, Max: 250, Latency: 3 * time.Second}
+
+// depth the number of requests to keep outstanding at rate bytes per second
+func (c PipelineConfig) depth(rate float64) int {
+	d := int(math.Ceil(rate * c.Latency.Seconds() / BlockSize))
+	if d < c.Min {
+		return c.Min
+	}
+	if d > c.Max {
+		return c.Max
+	}
+	return d
+}
+
+// rateMeter a moving average of bytes per second
+type rateMeter struct {
+	mu          sync.Mutex
+	total       int64
+	window      int64
+	windowStart time.Time
+	rate        float64
+}
+
+const rateWindow = time.Second
+
+func (r *rateMeter) add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total += int64(n)
+	r.window += int64(n)
+	r.tick(time.Now())
+}
+
+// tick folds the current window into the average once it's long enough, caller holds mu
+func (r *rateMeter) tick(now time.Time) {
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+		return
+	}
+	elapsed := now.Sub(r.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	current := float64(r.window) / elapsed.Seconds()
+	r.rate = 0.6*r.rate + 0.4*current
+	r.window = 0
+	r.windowStart = now
+}
+
+// Rate bytes per second
+func (r *rateMeter) Rate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tick(time.Now())
+	return r.rate
+}
+
+// Total bytes counted so far
+func (r *rateMeter) Total() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total
+}
+
+// DownloadRate payload bytes per second received from the peer
+func (p *Peer) DownloadRate() float64 { return p.down.Rate() }
+
+// UploadRate payload bytes per second sent to the peer
+func (p *Peer) UploadRate() float64 { return p.up.Rate() }
+
+// Downloaded payload bytes received from the peer
+func (p *Peer) Downloaded() int64 { return p.down.Total() }
+
+// Uploaded payload bytes sent to the peer
+func (p *Peer) Uploaded() int64 { return p.up.Total() }
+
+// FillPipeline requests blocks from the Downloader until the pipeline is full.
+// The peer calls it itself whenever its state changes; call it after making
+// new blocks available, e.g. when another peer returned its requests.
+func (p *Peer) FillPipeline() {
+	p.state.Lock()
+	defer p.state.Unlock()
+	p.fillPipeline()
+}
+
+// fillPipeline caller holds state
+func (p *Peer) fillPipeline() {
+	if p.Downloader == nil || !p.amInterested || (p.peerChoking && len(p.allowedFastIn) == 0) {
+		return
+	}
+	cfg := p.Pipeline
+	if cfg.Max == 0 {
+		cfg = DefaultPipeline
+	}
+	for depth := cfg.depth(p.down.Rate()); len(p.outstanding) < depth; {
+		req, ok := p.Downloader.NextRequest(p)
+		if !ok {
+			return
+		}
+		if err := p.Send(req); err != nil {
+			p.Downloader.Returned(p, []Request{req})
+			return
+		}
+		p.outstanding[req] = time.Now()
+	}
+}
+
+// returnOutstanding hands every outstanding request back to the Downloader, caller holds state
+func (p *Peer) returnOutstanding() {
+	if len(p.outstanding) == 0 {
+		return
+	}
+	reqs := make([]Request, 0, len(p.outstanding))
+	for req := range p.outstanding {
+		reqs = append(reqs, req)
+		delete(p.outstanding, req)
+	}
+	if p.Downloader != nil {
+		p.Downloader.Returned(p, reqs)
+	}
+}
+
+// receivePiece matches a block against our outstanding requests, caller holds state
+func (p *Peer) receivePiece(block Piece) {
+	req := Request{block.Index, block.Begin, uint32(len(block.Block))}
+	if _, ok := p.outstanding[req]; !ok {
+		// unrequested, or cancelled and sent anyway
+		return
+	}
+	delete(p.outstanding, req)
+	p.down.add(len(block.Block))
+	p.Downloader.Received(p, block)
+}
+
+// HasPiece reports whether the peer has announced piece index
+func (p *Peer) HasPiece(index int) bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.Bitfield.IsSet(index)
+}
+
+// PieceCount how many pieces the peer has
+func (p *Peer) PieceCount() int {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.Bitfield.Count()
+}
+
+// Choked reports whether the peer is choking us
+func (p *Peer) Choked() bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.peerChoking
+}
+
+// Interested reports whether the peer wants pieces from us
+func (p *Peer) Interested() bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.peerInterested
+}
+
+// Seed reports whether the peer has every piece
+func (p *Peer) Seed() bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.NumPieces > 0 && p.Bitfield.Count() >= p.NumPieces
+}
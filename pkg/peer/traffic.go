@@ -0,0 +1,42 @@
+package peer
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Traffic byte counts for the BitTorrent protocol, usually shared by the
+// peers of a torrent. Payload is piece data; overhead is everything else,
+// handshakes, message headers and the messages that carry no data.
+type Traffic struct {
+	PayloadDown, PayloadUp   atomic.Int64
+	OverheadDown, OverheadUp atomic.Int64
+}
+
+// down counts a received message of n bytes carrying payload bytes of piece data
+func (t *Traffic) down(n, payload int) {
+	if t != nil {
+		t.PayloadDown.Add(int64(payload))
+		t.OverheadDown.Add(int64(n - payload))
+	}
+}
+
+// up counts a sent message of n bytes carrying payload bytes of piece data
+func (t *Traffic) up(n, payload int) {
+	if t != nil {
+		t.PayloadUp.Add(int64(payload))
+		t.OverheadUp.Add(int64(n - payload))
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,164 @@
+package peer
+
+import (
+	"log"
+
+	"github.com/mbags/gtc/pkg/bitfield"
+)
+
+// maxRequestLength requests for larger blocks are refused
+const maxRequestLength = 128 << 10
+
+// Uploader tells peers what we have and serves the blocks they request
+type Uploader interface {
+	// HavePieces returns a copy of the bitfield of pieces we have
+	HavePieces() bitfield.Bitfield
+	// ReadBlock reads the data for a request, which must lie within a piece we have
+	ReadBlock(req Request) ([]byte, error)
+}
+
+// sendHaves tells a newly connected peer what we have, using HaveAll and
+// HaveNone when the Fast Extension allows it, followed by its allowed fast set
+func (p *Peer) sendHaves(infoHash []byte) error {
+	if p.Uploader == nil {
+		return nil
+	}
+	have, n := p.Uploader.HavePieces(), p.NumPieces
+	count := have.Count()
+	var msg Message
+	switch {
+	case p.fast && count == n:
+		msg = HaveAll{}
+	case p.fast && count == 0:
+		msg = HaveNone{}
+	case count > 0:
+		msg = BitfieldMessage{have.Bits}
+	}
+	if msg != nil {
+		if err := p.Send(msg); err != nil {
+			return err
+		}
+	}
+	if !p.fast {
+		return nil
+	}
+	p.state.Lock()
+	defer p.state.Unlock()
+	for _, index := range AllowedFastSet(AllowedFastCount, n, infoHash, p.IP) {
+		p.allowedFastOut[index] = true
+		if have.IsSet(int(index)) {
+			if err := p.Send(AllowedFast{index}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Choking reports whether we're choking the peer
+func (p *Peer) Choking() bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.amChoking
+}
+
+// SetChoking chokes or unchokes the peer, telling it if that's a change.
+// Peers start out choked.
+func (p *Peer) SetChoking(choke bool) error {
+	if !p.Connected() {
+		return errClosed
+	}
+	p.state.Lock()
+	defer p.state.Unlock()
+	if p.amChoking == choke {
+		return nil
+	}
+	p.amChoking = choke
+	if choke {
+		return p.Send(Choke{})
+	}
+	return p.Send(Unchoke{})
+}
+
+// serveRequest answers a peer's request, or rejects it if it may not have
+// it or too much is already queued for it, caller holds state
+func (p *Peer) serveRequest(req Request) {
+	allowed := !p.amChoking || p.allowedFastOut[req.Index]
+	if p.Uploader == nil || !allowed || req.Length > maxRequestLength || p.backlogged() {
+		if p.fast {
+			p.Send(RejectRequest{req.Index, req.Begin, req.Length})
+		}
+		return
+	}
+	block, err := p.Uploader.ReadBlock(req)
+	if err != nil {
+		log.Printf("Couldn't serve piece %d to %s :: %v\n", req.Index, p.IP, err)
+		if p.fast {
+			p.Send(RejectRequest{req.Index, req.Begin, req.Length})
+		}
+		return
+	}
+	p.mu.Lock()
+	p.queued[req]++
+	p.mu.Unlock()
+	p.Send(Piece{req.Index, req.Begin, block})
+}
+
+// cancel withdraws a block queued for the peer, so the writer skips it when
+// its turn comes. With the Fast Extension the request is rejected instead,
+// as the peer waits for one or the other. Caller holds state.
+func (p *Peer) cancel(req Request) {
+	p.mu.Lock()
+	withdrawn := p.queued[req] > p.cancelled[req]
+	if withdrawn {
+		p.cancelled[req]++
+	}
+	p.mu.Unlock()
+	if withdrawn && p.fast {
+		p.Send(RejectRequest{req.Index, req.Begin, req.Length})
+	}
+}
+
+// sending takes block off the queued ones as the writer comes to it,
+// reporting whether it's still to be sent
+func (p *Peer) sending(block Piece) bool {
+	req := Request{block.Index, block.Begin, uint32(len(block.Block))}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued[req]--; p.queued[req] <= 0 {
+		delete(p.queued, req)
+	}
+	if p.cancelled[req] == 0 {
+		return true
+	}
+	if p.cancelled[req]--; p.cancelled[req] == 0 {
+		delete(p.cancelled, req)
+	}
+	return false
+}
+
+// rejected drops a request the peer refused and hands it back, caller holds state
+func (p *Peer) rejected(req Request) {
+	if _, ok := p.outstanding[req]; !ok {
+		return
+	}
+	delete(p.outstanding, req)
+	if p.Downloader != nil {
+		p.Downloader.Returned(p, []Request{req})
+	}
+}
+
+// Requestable reports whether we may request blocks of piece index from the
+// peer right now. Like Bitfield it may be read from Downloader.NextRequest.
+func (p *Peer) Requestable(index int) bool {
+	if !p.Bitfield.IsSet(index) {
+		return false
+	}
+	return !p.peerChoking || p.allowedFastIn[uint32(index)]
+}
+
+// Suggested the pieces the peer suggested we download, most recent last.
+// Like Bitfield it may be read from Downloader.NextRequest.
+func (p *Peer) Suggested() []uint32 {
+	return p.suggested
+}
@@ -0,0 +1,123 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// KeepAliveInterval how long the connection may go without us sending anything
+	KeepAliveInterval = 2 * time.Minute
+	// IdleTimeout how long we wait for any message, keep-alives included, before dropping a peer
+	IdleTimeout = 3 * time.Minute
+
+	sendQueueLen  = 1024
+	writeBufSize  = 64 << 10
+	writeDeadline = 30 * time.Second
+)
+
+var errSendQueueFull = errors.New("peer: send queue full")
+
+// Send queues m for the peer's writer goroutine without ever blocking, as
+// it's called by readers holding peer state, ours and other peers'. It
+// returns an error once the connection is closed or its writer has failed,
+// and drops the connection when so much is queued the peer can't be keeping up.
+func (p *Peer) Send(m Message) error {
+	p.mu.Lock()
+	conn, sendq, done, dead := p.Conn, p.sendq, p.done, p.dead
+	p.mu.Unlock()
+	if sendq == nil {
+		return errClosed
+	}
+	select {
+	case <-done:
+		return errClosed
+	case <-dead:
+		return errClosed
+	default:
+	}
+	select {
+	case sendq <- m:
+		return nil
+	default:
+		log.Printf("Send queue for %s is full, disconnecting\n", p.IP)
+		// the reader sees the closed connection and tears the peer down
+		conn.Close()
+		return errSendQueueFull
+	}
+}
+
+// backlogged reports whether the send queue is too full to take more blocks,
+// leaving room for requests and haves
+func (p *Peer) backlogged() bool {
+	return len(p.sendq) >= sendQueueLen/2
+}
+
+// writeLoop writes queued messages until done is closed, closing dead if a
+// write fails. Everything queued while a write is in progress goes out
+// together in the next one, so runs of small messages like have and request
+// share a syscall.
+func (p *Peer) writeLoop(conn net.Conn, sendq <-chan Message, done <-chan struct{}, dead chan<- struct{}) {
+	bw := bufio.NewWriterSize(conn, writeBufSize)
+	keepAlive := time.NewTimer(KeepAliveInterval)
+	defer keepAlive.Stop()
+	var buf []byte
+
+	write := func(m Message) error {
+		if piece, ok := m.(Piece); ok && !p.sending(piece) {
+			return nil
+		}
+		buf = AppendMessage(buf[:0], m)
+		_, err := bw.Write(buf)
+		payload := 0
+		if piece, ok := m.(Piece); ok {
+			payload = len(piece.Block)
+			p.up.add(payload)
+		}
+		p.Traffic.up(len(buf), payload)
+		return err
+	}
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case m := <-sendq:
+			conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+			err = write(m)
+		drain:
+			for err == nil {
+				select {
+				case m := <-sendq:
+					err = write(m)
+				default:
+					break drain
+				}
+			}
+		case <-keepAlive.C:
+			conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+			err = write(KeepAlive{})
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			// the reader notices the closed connection and tears the peer
+			// down, Send stops queueing for nobody
+			conn.Close()
+			close(dead)
+			return
+		}
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
+			}
+		}
+		keepAlive.Reset(KeepAliveInterval)
+	}
+}
@@ -0,0 +1,58 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendAfterWriteFails(t *testing.T) {
+	ours, theirs := net.Pipe()
+	theirs.Close()
+	p := &Peer{IP: net.IPv4(127, 0, 0, 1)}
+	if !p.setConn(ours) {
+		t.Fatal("setConn refused")
+	}
+	go p.writeLoop(ours, p.sendq, p.done, p.dead)
+	p.Send(KeepAlive{})
+	select {
+	case <-p.dead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer didn't report its failure")
+	}
+	sent := make(chan error)
+	go func() {
+		// far more than the queue holds, none of it may block
+		var err error
+		for i := 0; i < 2*sendQueueLen; i++ {
+			err = p.Send(Have{uint32(i)})
+		}
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		if err != errClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked on a dead writer")
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	p := &Peer{IP: net.IPv4(127, 0, 0, 1)}
+	p.setConn(ours)
+	// no writer, as if the peer stopped reading
+	var err error
+	for i := 0; i <= sendQueueLen && err == nil; i++ {
+		err = p.Send(Have{uint32(i)})
+	}
+	if err != errSendQueueFull {
+		t.Fatal(err)
+	}
+	if _, err := ours.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection left open")
+	}
+}
@@ -0,0 +1,95 @@
+// ratelimit token buckets capping how fast bytes move, shared by any number of connections
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter lets Rate bytes through per second, with bursts of up to a second's worth
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 for unlimited
+	tokens float64 // negative while callers are waiting off a debt
+	last   time.Time
+}
+
+// New returns a Limiter passing rate bytes per second, 0 for unlimited
+func New(rate int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the limit, 0 for unlimited
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = float64(rate)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate the limit in bytes per second, 0 for unlimited
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// WaitN blocks until n bytes may pass. Callers run into debt and sleep it off,
+// so a large n is fine and concurrent callers queue up fairly.
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// limitedConn a connection whose reads and writes are metered
+type limitedConn struct {
+	net.Conn
+	down, up *Limiter
+}
+
+// Conn wraps c so reads are paced by down and writes by up, either may be nil
+func Conn(c net.Conn, down, up *Limiter) net.Conn {
+	if down == nil && up == nil {
+		return c
+	}
+	return &limitedConn{c, down, up}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	// pausing after the read stops us reading from the socket, so TCP's
+	// window and uTP's receive window slow the sender down
+	c.down.WaitN(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.up.WaitN(len(p))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,149 @@
+// serve exposes the files of torrents over HTTP while they download. Every
+// request reads through a torrent.Reader, so the pieces clients ask for are
+// fetched first and Range requests let players seek.
+package serve
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// Server an http.Handler serving /<info hash>/<file path> for every torrent added to it
+type Server struct {
+	mu       sync.Mutex
+	torrents map[string]*torrent.Torrent // by hex info hash
+}
+
+func New() *Server {
+	return &Server{torrents: make(map[string]*torrent.Torrent)}
+}
+
+// Add serves t's files
+func (s *Server) Add(t *torrent.Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[hexHash(t)] = t
+}
+
+// Remove stops serving t's files, requests already running finish
+func (s *Server) Remove(t *torrent.Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, hexHash(t))
+}
+
+func hexHash(t *torrent.Torrent) string {
+	return fmt.Sprintf("%x", t.MetaInfo.InfoHash)
+}
+
+// filePath the path a file is served under, relative to its torrent
+func filePath(t *torrent.Torrent, i int) string {
+	f := t.MetaInfo.Files[i]
+	if len(f.Path) == 0 {
+		// single file torrent
+		return t.MetaInfo.Name
+	}
+	return path.Join(f.Path...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if p == "" {
+		s.serveIndex(w)
+		return
+	}
+	hash, name, _ := strings.Cut(p, "/")
+	s.mu.Lock()
+	t, ok := s.torrents[strings.ToLower(hash)]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !t.HasInfo() {
+		http.Error(w, torrent.ErrNoMetadata.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if name == "" {
+		s.serveFiles(w, t)
+		return
+	}
+	for i, f := range t.MetaInfo.Files {
+		if !f.Padding() && filePath(t, i) == name {
+			s.serveFile(w, r, t, i)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, t *torrent.Torrent, i int) {
+	rd, err := t.NewReader(i)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the client going away unblocks a read waiting on a piece
+	stop := context.AfterFunc(r.Context(), func() { rd.Close() })
+	defer stop()
+	defer rd.Close()
+	log.Printf("[serve] %s %s %s", r.RemoteAddr, r.URL.Path, r.Header.Get("Range"))
+	http.ServeContent(w, r, path.Base(filePath(t, i)), t.MetaInfo.CreationDate, rd)
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<title>{{.Title}}</title>
+<h1>{{.Title}}</h1>
+<ul>
+{{range .Links}}<li><a href="{{.Href}}">{{.Text}}</a></li>
+{{end}}</ul>
+`))
+
+type link struct {
+	Href, Text string
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter) {
+	s.mu.Lock()
+	links := make([]link, 0, len(s.torrents))
+	for hash, t := range s.torrents {
+		links = append(links, link{"/" + hash + "/", t.Name()})
+	}
+	s.mu.Unlock()
+	sort.Slice(links, func(i, j int) bool { return links[i].Text < links[j].Text })
+	indexTemplate.Execute(w, struct {
+		Title string
+		Links []link
+	}{"Torrents", links})
+}
+
+func (s *Server) serveFiles(w http.ResponseWriter, t *torrent.Torrent) {
+	links := make([]link, 0, len(t.MetaInfo.Files))
+	for i, f := range t.MetaInfo.Files {
+		if f.Padding() {
+			continue
+		}
+		name := filePath(t, i)
+		href := (&url.URL{Path: name}).String()
+		links = append(links, link{href, fmt.Sprintf("%s (%d bytes)", name, f.Length)})
+	}
+	indexTemplate.Execute(w, struct {
+		Title string
+		Links []link
+	}{t.MetaInfo.Name, links})
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Allocation how a torrent's files take up disk space
+type Allocation int
+
+const (
+	// AllocateSparse creates files at their full length with nothing
+	// allocated, disk space is taken as pieces are written
+	AllocateSparse Allocation = iota
+	// AllocateFull allocates every byte of a file when it's created, with
+	// fallocate where there is one, so the disk can't fill up partway
+	AllocateFull
+	// AllocateCompact grows files only at their end, so they never have
+	// holes, keeping pieces that arrive early in the partfile until the
+	// file reaches them
+	AllocateCompact
+)
+
+// ErrDiskFull returned when the disk hasn't room for a torrent's files
+var ErrDiskFull = errors.New("storage: not enough disk space")
+
+func (a Allocation) String() string {
+	switch a {
+	case AllocateSparse:
+		return "sparse"
+	case AllocateFull:
+		return "full"
+	case AllocateCompact:
+		return "compact"
+	}
+	return fmt.Sprintf("Allocation(%d)", int(a))
+}
+
+// ParseAllocation the Allocation named s
+func ParseAllocation(s string) (Allocation, error) {
+	for a := AllocateSparse; a <= AllocateCompact; a++ {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown allocation %q, expected sparse, full or compact", s)
+}
+
+// Allocation how the storage's files take up disk space
+func (s *Storage) Allocation() Allocation {
+	return s.alloc
+}
+
+// Allocate creates the files not skipped as the storage's Allocation says,
+// only the torrent's symlinks for AllocateCompact. For AllocateFull it first
+// makes sure the disk has room for what they still need, returning an error
+// wrapping ErrDiskFull if it hasn't, the other modes take space as pieces
+// are written.
+func (s *Storage) Allocate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	need := int64(0)
+	for _, f := range s.files {
+		if s.alloc != AllocateFull || f.skip || f.virtual() {
+			continue
+		}
+		used := int64(0)
+		if info, err := os.Stat(f.path); err == nil {
+			used = allocated(info)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if used < f.length {
+			need += f.length - used
+		}
+	}
+	if need > 0 {
+		// when it can't be told, writes will fail as the disk fills instead
+		if free, err := freeSpace(existingParent(s.dir)); err == nil && need > free {
+			return fmt.Errorf("%w under %s: %d more bytes needed, %d free", ErrDiskFull, s.dir, need, free)
+		}
+	}
+	for i, f := range s.files {
+		var err error
+		if f.link != "" {
+			err = s.symlink(i)
+		} else if !f.skip && !f.pad && f.length > 0 && s.alloc != AllocateCompact {
+			_, err = s.openFile(i)
+		}
+		if err != nil {
+			return diskFull(err)
+		}
+	}
+	return nil
+}
+
+// allocate sizes file i, just opened as f, as the storage's Allocation says. Caller holds mu.
+func (s *Storage) allocate(f *os.File, i int) error {
+	if s.alloc == AllocateCompact {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	length := s.files[i].length
+	switch {
+	case s.alloc == AllocateFull && allocated(info) < length:
+		return diskFull(preallocate(f, info.Size(), length))
+	case info.Size() < length:
+		return f.Truncate(length)
+	}
+	return nil
+}
+
+// diskFull wraps err with ErrDiskFull if it's the disk filling up
+func diskFull(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %v", ErrDiskFull, err)
+	}
+	return err
+}
+
+// preallocateZeros allocates f up to length by writing zeros after its
+// current size, for where there's no fallocate
+func preallocateZeros(f *os.File, size, length int64) error {
+	buf := make([]byte, 1<<20)
+	for off := size; off < length; off += int64(len(buf)) {
+		b := buf
+		if rest := length - off; rest < int64(len(b)) {
+			b = b[:rest]
+		}
+		if _, err := f.WriteAt(b, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existingParent dir or the nearest of its parents that exists
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate allocates the first length bytes of f, whose size is size
+func preallocate(f *os.File, size, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		// the filesystem can't, do it the slow way
+		return preallocateZeros(f, size, length)
+	}
+	return err
+}
+
+// allocated the bytes of disk a file takes up, less than its size when it has holes
+func allocated(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+// freeSpace the bytes available to us on the filesystem holding dir
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// preallocate allocates the first length bytes of f, whose size is size
+func preallocate(f *os.File, size, length int64) error {
+	return preallocateZeros(f, size, length)
+}
+
+// allocated the bytes of disk a file takes up, taken to be its size
+func allocated(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// freeSpace isn't known here, so Allocate doesn't check
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("storage: free space unknown")
+}
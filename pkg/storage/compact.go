@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// With AllocateCompact a file only ever grows at its end, so it never has
+// holes and takes up no more disk than the bytes written into it. Pieces
+// that arrive for further on wait in the partfile, in slots handed out in
+// the order they came, and are appended to the file once it has grown as
+// far as them. It relies on pieces being written whole, as the torrent
+// writes them.
+
+// compactView file i of an AllocateCompact storage, open as f
+type compactView struct {
+	s      *Storage
+	i      int
+	f      *os.File
+	offset int64 // of the file in the torrent's byte stream
+}
+
+// ReadAt reads what the file has grown to hold from it, and the rest from
+// the partfile
+func (v compactView) ReadAt(p []byte, off int64) (int, error) {
+	v.s.grow.Lock()
+	defer v.s.grow.Unlock()
+	size, err := v.s.size(v.i)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if off < size {
+		n, err = v.f.ReadAt(p[:min(int64(len(p)), size-off)], off)
+		if err != nil {
+			return n, err
+		}
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := v.s.part.ReadAt(p[n:], v.offset+off+int64(n))
+	return n + m, err
+}
+
+// WriteAt appends p to the file if it reaches the file's end, along with
+// whatever waits in the partfile to follow it, or otherwise puts p in the
+// partfile until the file grows that far
+func (v compactView) WriteAt(p []byte, off int64) (int, error) {
+	v.s.grow.Lock()
+	defer v.s.grow.Unlock()
+	size, err := v.s.size(v.i)
+	if err != nil {
+		return 0, err
+	}
+	if off > size {
+		return v.s.part.WriteAt(p, v.offset+off)
+	}
+	n, err := v.f.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	if end := off + int64(n); end > size {
+		v.s.sizes[v.i] = end
+	}
+	return n, v.s.settle(v.i, v.f)
+}
+
+// size how far file i has grown, caller holds grow
+func (s *Storage) size(i int) (int64, error) {
+	if size, ok := s.sizes[i]; ok {
+		return size, nil
+	}
+	s.mu.Lock()
+	path := s.files[i].path
+	s.mu.Unlock()
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	s.sizes[i] = info.Size()
+	return info.Size(), nil
+}
+
+// settle appends to file i, open as f, the pieces waiting for it in the
+// partfile for as long as they follow on from its end, freeing their slots
+// once nothing else waits on them. Caller holds grow.
+func (s *Storage) settle(i int, f *os.File) error {
+	s.mu.Lock()
+	offset, length := s.files[i].offset, s.files[i].length
+	s.mu.Unlock()
+	size, err := s.size(i)
+	if err != nil {
+		return err
+	}
+	for size < length {
+		off := offset + size
+		piece := int(off / s.pieceLength)
+		buf := make([]byte, min(int64(piece+1)*s.pieceLength, offset+length)-off)
+		if _, err := s.part.ReadAt(buf, off); errors.Is(err, io.ErrUnexpectedEOF) {
+			// not downloaded yet
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf, size); err != nil {
+			return err
+		}
+		size += int64(len(buf))
+		s.sizes[i] = size
+		if err := s.release(piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release frees the partfile slot of piece unless a skipped file has bytes
+// in it, or a file hasn't grown past its bytes in it yet. Caller holds grow.
+func (s *Storage) release(piece int) error {
+	start, end := int64(piece)*s.pieceLength, int64(piece+1)*s.pieceLength
+	s.mu.Lock()
+	waiting := s.skipsPiece(piece)
+	need := make(map[int]int64) // by file, the size it has to grow to past the piece
+	for i, f := range s.files {
+		if !f.skip && !f.virtual() && f.length > 0 && f.offset < end && f.offset+f.length > start {
+			need[i] = min(end, f.offset+f.length) - f.offset
+		}
+	}
+	s.mu.Unlock()
+	for i, n := range need {
+		if waiting {
+			break
+		}
+		size, err := s.size(i)
+		if err != nil {
+			return err
+		}
+		waiting = size < n
+	}
+	if waiting {
+		return nil
+	}
+	return s.part.drop(piece)
+}
+
+// settleFile appends to file i what waits for it in the partfile, for a
+// file that's stopped being skipped
+func (s *Storage) settleFile(i int) error {
+	s.io.RLock()
+	defer s.io.RUnlock()
+	s.mu.Lock()
+	f, err := s.openFile(i)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.grow.Lock()
+	defer s.grow.Unlock()
+	return s.settle(i, f)
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+func TestCompact(t *testing.T) {
+	const pieceLength = 16
+	// pieces 0-2 are a, 3 is shared, 4-5 are b
+	m := &metainfo.MetaInfo{
+		Info:     metainfo.Info{PieceLength: pieceLength, Pieces: make([]byte, 6*20)},
+		Name:     "t",
+		InfoHash: string(make([]byte, 20)),
+		Files:    []metainfo.File{{Length: 3*pieceLength + 8, Path: []string{"a"}}, {Length: 2*pieceLength + 8, Path: []string{"b"}}},
+	}
+	data := make([]byte, 6*pieceLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		name  string
+		order []int
+		sizes [][2]int64 // of a and b on disk after each piece
+	}{
+		{"in order", []int{0, 1, 2, 3, 4, 5}, [][2]int64{{16, 0}, {32, 0}, {48, 0}, {56, 8}, {56, 24}, {56, 40}}},
+		{"backwards", []int{5, 4, 3, 2, 1, 0}, [][2]int64{{0, 0}, {0, 0}, {0, 40}, {0, 40}, {0, 40}, {56, 40}}},
+		{"shared piece last", []int{4, 0, 2, 1, 5, 3}, [][2]int64{{0, 0}, {16, 0}, {16, 0}, {48, 0}, {48, 0}, {56, 40}}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		s, err := New(dir, m, AllocateCompact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Allocate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, piece := range tt.order {
+			b := data[piece*pieceLength : (piece+1)*pieceLength]
+			if _, err := s.WriteAt(b, int64(piece)*pieceLength); err != nil {
+				t.Fatalf("%s: piece %d: %v", tt.name, piece, err)
+			}
+			for f, name := range []string{"a", "b"} {
+				size := int64(0)
+				if info, err := os.Stat(filepath.Join(dir, "t", name)); err == nil {
+					size = info.Size()
+				}
+				if size != tt.sizes[i][f] {
+					t.Errorf("%s: after piece %d %s is %d bytes, want %d", tt.name, piece, name, size, tt.sizes[i][f])
+				}
+			}
+			// what's written reads back whether it's in place or waiting
+			got := make([]byte, pieceLength)
+			if _, err := s.ReadAt(got, int64(piece)*pieceLength); err != nil || !bytes.Equal(got, b) {
+				t.Errorf("%s: piece %d read back %v, %v", tt.name, piece, got, err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := os.ReadFile(filepath.Join(dir, "t", "a"))
+		b, _ := os.ReadFile(filepath.Join(dir, "t", "b"))
+		if !bytes.Equal(append(a, b...), data) {
+			t.Errorf("%s: files differ from the data", tt.name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, partName(m.InfoHash))); !os.IsNotExist(err) {
+			t.Errorf("%s: partfile left: %v", tt.name, err)
+		}
+	}
+
+	// a piece not yet downloaded reads like a short file
+	s, _ := New(t.TempDir(), m, AllocateCompact)
+	s.WriteAt(data[2*pieceLength:3*pieceLength], 2*pieceLength)
+	if _, err := s.ReadAt(make([]byte, pieceLength), pieceLength); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("missing piece: %v", err)
+	}
+	s.Close()
+
+	// a file wanted again takes in what was kept for it while skipped
+	dir := t.TempDir()
+	s, _ = New(dir, m, AllocateCompact)
+	s.Skip(1, true)
+	s.WriteAt(data[3*pieceLength:], 3*pieceLength)
+	if err := s.Skip(1, false); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if b, _ := os.ReadFile(filepath.Join(dir, "t", "b")); !bytes.Equal(b, data[56:]) {
+		t.Errorf("unskipped b is %v", b)
+	}
+}
+
+func TestAllocateFreeSpace(t *testing.T) {
+	m := &metainfo.MetaInfo{
+		Info:     metainfo.Info{PieceLength: 1 << 20, Pieces: make([]byte, 20)},
+		Name:     "t",
+		InfoHash: string(make([]byte, 20)),
+		Files:    []metainfo.File{{Length: 1 << 60}}, // more than any disk
+	}
+	if _, err := freeSpace(t.TempDir()); err != nil {
+		t.Skip("free space unknown here")
+	}
+	tests := []struct {
+		alloc Allocation
+		full  bool
+	}{
+		{AllocateFull, true},
+		{AllocateCompact, false},
+	}
+	for _, tt := range tests {
+		s, _ := New(t.TempDir(), m, tt.alloc)
+		err := s.Allocate()
+		if errors.Is(err, ErrDiskFull) != tt.full {
+			t.Errorf("%v: %v", tt.alloc, err)
+		}
+	}
+}
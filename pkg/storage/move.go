@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Dir the directory the torrent's files are under
+func (s *Storage) Dir() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dir
+}
+
+// FilePath where file i is kept, relative to Dir
+func (s *Storage) FilePath(i int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[i].rel
+}
+
+// Move moves the torrent's files and its partfile from under Dir to under
+// dir, renaming them where it can and copying them across filesystems.
+// Copying goes on alongside reads and writes, which only wait while the
+// files written to meanwhile are copied again and the storage switches over
+// to dir. Files not on disk yet are created under dir when first written.
+// Nothing is overwritten, and if moving a file fails the ones already moved
+// are moved back.
+func (s *Storage) Move(dir string) error {
+	dir = filepath.Clean(dir)
+	s.moving.Lock()
+	defer s.moving.Unlock()
+	old := s.Dir()
+	if dir == old {
+		return nil
+	}
+	moves := s.moves(dir)
+	var copied map[string]bool
+	if !renames(old, dir) {
+		var err error
+		if copied, err = s.copyAhead(moves); err != nil {
+			return err
+		}
+	}
+	return s.switchTo(dir, moves, copied)
+}
+
+// moves every file of the storage and its partfile to where they go under dir
+func (s *Storage) moves(dir string) []move {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moves := make([]move, 0, len(s.files)+1)
+	for _, f := range s.files {
+		moves = append(moves, move{f.path, filepath.Join(dir, f.rel)})
+	}
+	return append(moves, move{s.part.path, filepath.Join(dir, filepath.Base(s.part.path))})
+}
+
+// switchTo moves the files to under dir, finishing those copied ahead, and
+// keeps them there from then on. Reads and writes wait until it's done.
+func (s *Storage) switchTo(dir string, moves []move, copied map[string]bool) error {
+	s.io.Lock()
+	defer s.io.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.changed
+	s.changed = nil
+	if err := s.moveAll(moves, copied, changed); err != nil {
+		dropCopies(moves, copied)
+		return err
+	}
+	old := s.dir
+	s.dir = dir
+	for i := range s.files {
+		s.files[i].path = filepath.Join(dir, s.files[i].rel)
+	}
+	s.part.setPath(moves[len(moves)-1].to)
+	for _, m := range moves {
+		removeEmptyDirs(filepath.Dir(m.from), old)
+	}
+	return nil
+}
+
+// Rename moves file i to rel, a path under Dir, where it's kept from then
+// on. A symlink still points at the same file after it's moved, pad files
+// can't be renamed.
+func (s *Storage) Rename(i int, rel string) error {
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("storage: %q isn't a path under the torrent's directory", rel)
+	}
+	rel = filepath.Clean(rel)
+	s.moving.Lock()
+	defer s.moving.Unlock()
+	s.io.Lock()
+	defer s.io.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i < 0 || i >= len(s.files) {
+		return fmt.Errorf("storage: no file %d", i)
+	}
+	f := &s.files[i]
+	if f.pad {
+		return fmt.Errorf("storage: file %d is padding", i)
+	}
+	if rel == f.rel {
+		return nil
+	}
+	to := filepath.Join(s.dir, rel)
+	taken := rel == filepath.Base(s.part.path)
+	for j, other := range s.files {
+		taken = taken || (j != i && other.path == to)
+	}
+	if taken {
+		return fmt.Errorf("storage: %s is taken", rel)
+	}
+	from := f.path
+	if f.link != "" {
+		// made again where it's going, its target relative to there
+		if err := os.Remove(from); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		f.rel, f.path = rel, to
+		if err := s.symlink(i); err != nil {
+			return err
+		}
+	} else {
+		if err := s.moveAll([]move{{from, to}}, nil, nil); err != nil {
+			return err
+		}
+		f.rel, f.path = rel, to
+	}
+	removeEmptyDirs(filepath.Dir(from), s.dir)
+	return nil
+}
+
+type move struct {
+	from, to string
+}
+
+// moveAll closes every open file and moves those of moves that exist,
+// moving them back if one fails. The sources in copied are already copied
+// to where they're going, those in changed have been written to since and
+// are copied again. Caller holds io and mu.
+func (s *Storage) moveAll(moves []move, copied, changed map[string]bool) error {
+	if err := s.closeFiles(); err != nil {
+		return err
+	}
+	var todo []move
+	for _, m := range moves {
+		if _, err := os.Lstat(m.from); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(m.to); err == nil && !copied[m.from] {
+			return fmt.Errorf("storage: %s already exists", m.to)
+		}
+		todo = append(todo, m)
+	}
+	for i, m := range todo {
+		var err error
+		if copied[m.from] {
+			err = finishCopy(m, changed[m.from])
+		} else {
+			err = moveFile(m.from, m.to)
+		}
+		if err != nil {
+			for _, done := range todo[:i] {
+				if uerr := moveFile(done.to, done.from); uerr != nil {
+					err = errors.Join(err, fmt.Errorf("storage: couldn't move %s back: %w", done.to, uerr))
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// renames reports whether files under from can be renamed to under to,
+// rather than copied, trying it out with an empty file. With nothing under
+// from yet there's nothing to copy either.
+func renames(from, to string) bool {
+	probe, err := os.CreateTemp(from, ".move")
+	if err != nil {
+		return true
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return true
+	}
+	moved := filepath.Join(to, filepath.Base(probe.Name()))
+	err = os.Rename(probe.Name(), moved)
+	if err == nil {
+		os.Remove(moved)
+	}
+	return !errors.Is(err, syscall.EXDEV)
+}
+
+// copyAhead copies those of moves that are files on disk to where they're
+// going while reads and writes go on, noting the ones written to meanwhile
+// in s.changed. It returns the sources it copied, on failure having removed
+// the copies.
+func (s *Storage) copyAhead(moves []move) (map[string]bool, error) {
+	s.mu.Lock()
+	s.changed = make(map[string]bool)
+	s.mu.Unlock()
+	copied := make(map[string]bool)
+	for _, m := range moves {
+		info, err := os.Lstat(m.from)
+		if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+			// symlinks are made again when the rest are moved
+			continue
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(m.to), 0755)
+		}
+		if err == nil {
+			err = copyFile(m.from, m.to)
+		}
+		if err != nil {
+			dropCopies(moves, copied)
+			s.mu.Lock()
+			s.changed = nil
+			s.mu.Unlock()
+			return nil, err
+		}
+		copied[m.from] = true
+	}
+	return copied, nil
+}
+
+// finishCopy removes the source of a move copied ahead, copying it again
+// first if it changed since
+func finishCopy(m move, changed bool) error {
+	if changed {
+		if err := os.Remove(m.to); err != nil {
+			return err
+		}
+		if err := copyFile(m.from, m.to); err != nil {
+			return err
+		}
+	}
+	return os.Remove(m.from)
+}
+
+// dropCopies removes the copies made ahead of moves that didn't happen, the
+// ones whose source is still there
+func dropCopies(moves []move, copied map[string]bool) {
+	for _, m := range moves {
+		if !copied[m.from] {
+			continue
+		}
+		if _, err := os.Lstat(m.from); err == nil {
+			os.Remove(m.to)
+		}
+	}
+}
+
+// moveFile renames from to to, or copies it when they're on different filesystems
+func moveFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if target, lerr := os.Readlink(from); lerr == nil {
+		// copying would follow it
+		err = os.Symlink(target, to)
+	} else {
+		err = copyFile(from, to)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+func copyFile(from, to string) (err error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(to)
+		}
+	}()
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// removeEmptyDirs removes dir and its parents up to but not including stop
+// while they're empty
+func removeEmptyDirs(dir, stop string) {
+	for d := dir; d != stop && d != "." && d != string(filepath.Separator); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			// not empty, and neither are its parents
+			return
+		}
+	}
+}
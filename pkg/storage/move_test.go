@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+func TestMove(t *testing.T) {
+	const pieceLength = 1 << 10
+	m := &metainfo.MetaInfo{
+		Info:     metainfo.Info{PieceLength: pieceLength, Pieces: make([]byte, 5*20)},
+		Name:     "t",
+		InfoHash: string(make([]byte, 20)),
+		Files:    []metainfo.File{{Length: 4 * pieceLength, Path: []string{"a"}}, {Length: pieceLength, Path: []string{"d", "b"}}},
+	}
+	tests := []struct {
+		name   string
+		across bool  // filesystems, so the files are copied ahead
+		off    int64 // of a write once they're copied, before switching over
+		n      int
+	}{
+		{"renamed", false, 0, 0},
+		{"renamed after a write", false, 3 * pieceLength, 2 * pieceLength},
+		{"copied", true, 0, 0},
+		{"first file written", true, 0, pieceLength},
+		{"second file written", true, 4 * pieceLength, 10},
+		{"both written", true, 3*pieceLength + 1, pieceLength},
+	}
+	for _, tt := range tests {
+		src, dst := t.TempDir(), t.TempDir()
+		if tt.across {
+			shm, err := os.MkdirTemp("/dev/shm", "move")
+			if err != nil {
+				t.Logf("%s: skipped, %v", tt.name, err)
+				continue
+			}
+			defer os.RemoveAll(shm)
+			dst = shm
+		}
+		if renames(src, dst) == tt.across {
+			t.Logf("%s: skipped, %s and %s aren't on the filesystems expected", tt.name, src, dst)
+			continue
+		}
+		s, err := New(src, m, AllocateSparse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bytes.Repeat([]byte{1}, 5*pieceLength)
+		if _, err := s.WriteAt(want, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// as Move does it, with a write while reads and writes go on
+		moves := s.moves(dst)
+		var copied map[string]bool
+		if tt.across {
+			if copied, err = s.copyAhead(moves); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		b := bytes.Repeat([]byte{2}, tt.n)
+		if _, err := s.WriteAt(b, tt.off); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		copy(want[tt.off:], b)
+		if err := s.switchTo(dst, moves, copied); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := os.ReadFile(filepath.Join(dst, "t", "a"))
+		bf, _ := os.ReadFile(filepath.Join(dst, "t", "d", "b"))
+		if !bytes.Equal(append(a, bf...), want) {
+			t.Errorf("%s: moved files differ from what was written", tt.name)
+		}
+		if _, err := os.Stat(filepath.Join(src, "t")); !os.IsNotExist(err) {
+			t.Errorf("%s: left behind: %v", tt.name, err)
+		}
+		if s.Dir() != dst {
+			t.Errorf("%s: dir %s", tt.name, s.Dir())
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// partfile holds the bytes of skipped files that fall in pieces downloaded for
+// a neighbouring wanted file, so skipped files never appear on disk. It starts
+// with a table of one big endian uint32 per piece, zero for none or slot+1,
+// followed by the slots, each one piece long.
+type partfile struct {
+	path        string
+	pieceLength int64
+	numPieces   int
+
+	mu     sync.Mutex
+	f      *os.File
+	loaded bool
+	slots  map[int]int // piece index to slot
+}
+
+func newPartfile(path string, pieceLength int64, numPieces int) *partfile {
+	return &partfile{path: path, pieceLength: pieceLength, numPieces: numPieces, slots: make(map[int]int)}
+}
+
+func (pf *partfile) headerLen() int64 {
+	return 4 * int64(pf.numPieces)
+}
+
+// load reads the slot table of a partfile left by an earlier run, caller holds mu
+func (pf *partfile) load() error {
+	if pf.loaded {
+		return nil
+	}
+	f, err := os.OpenFile(pf.path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		pf.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	table := make([]byte, pf.headerLen())
+	if _, err := f.ReadAt(table, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("storage: bad partfile %s: %v", pf.path, err)
+	}
+	for i := 0; i < pf.numPieces; i++ {
+		if v := binary.BigEndian.Uint32(table[4*i:]); v != 0 {
+			pf.slots[i] = int(v - 1)
+		}
+	}
+	pf.f, pf.loaded = f, true
+	return nil
+}
+
+// slot finds the slot of piece, allocating the lowest free one if create is set, caller holds mu
+func (pf *partfile) slot(piece int, create bool) (int, error) {
+	if s, ok := pf.slots[piece]; ok {
+		return s, nil
+	}
+	if !create {
+		// never written, like reading a file past its end
+		return 0, io.ErrUnexpectedEOF
+	}
+	if pf.f == nil {
+		f, err := os.OpenFile(pf.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		if err := f.Truncate(pf.headerLen()); err != nil {
+			f.Close()
+			return 0, err
+		}
+		pf.f = f
+	}
+	used := make(map[int]bool, len(pf.slots))
+	for _, s := range pf.slots {
+		used[s] = true
+	}
+	s := 0
+	for used[s] {
+		s++
+	}
+	if err := pf.setEntry(piece, s+1); err != nil {
+		return 0, err
+	}
+	pf.slots[piece] = s
+	return s, nil
+}
+
+func (pf *partfile) setEntry(piece, v int) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	_, err := pf.f.WriteAt(b[:], 4*int64(piece))
+	return err
+}
+
+// ReadAt reads len(p) bytes at off, an offset into the torrent's byte stream
+func (pf *partfile) ReadAt(p []byte, off int64) (int, error) {
+	return pf.each(p, off, false, (*os.File).ReadAt)
+}
+
+// WriteAt writes p at off, an offset into the torrent's byte stream
+func (pf *partfile) WriteAt(p []byte, off int64) (int, error) {
+	return pf.each(p, off, true, (*os.File).WriteAt)
+}
+
+// each splits [off, off+len(p)) on piece boundaries and applies op within each piece's slot
+func (pf *partfile) each(p []byte, off int64, create bool, op func(*os.File, []byte, int64) (int, error)) (int, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if err := pf.load(); err != nil {
+		return 0, err
+	}
+	done := 0
+	for len(p) > 0 {
+		piece := int(off / pf.pieceLength)
+		within := off % pf.pieceLength
+		n := int64(len(p))
+		if n > pf.pieceLength-within {
+			n = pf.pieceLength - within
+		}
+		s, err := pf.slot(piece, create)
+		if err != nil {
+			return done, err
+		}
+		m, err := op(pf.f, p[:n], pf.headerLen()+int64(s)*pf.pieceLength+within)
+		done += m
+		if err != nil {
+			return done, err
+		}
+		p = p[n:]
+		off += n
+	}
+	return done, nil
+}
+
+// pieces the pieces that have a slot
+func (pf *partfile) pieces() ([]int, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if err := pf.load(); err != nil {
+		return nil, err
+	}
+	pieces := make([]int, 0, len(pf.slots))
+	for piece := range pf.slots {
+		pieces = append(pieces, piece)
+	}
+	return pieces, nil
+}
+
+// drop frees the slot of piece, removing the partfile once nothing is left in it
+func (pf *partfile) drop(piece int) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if _, ok := pf.slots[piece]; !ok {
+		return nil
+	}
+	delete(pf.slots, piece)
+	if len(pf.slots) > 0 {
+		return pf.setEntry(piece, 0)
+	}
+	pf.f.Close()
+	pf.f = nil
+	return os.Remove(pf.path)
+}
+
+func (pf *partfile) sync() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.f == nil {
+		return nil
+	}
+	return pf.f.Sync()
+}
+
+func (pf *partfile) close() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.f == nil {
+		return nil
+	}
+	err := pf.f.Close()
+	pf.f, pf.loaded = nil, false
+	pf.slots = make(map[int]int)
+	return err
+}
+
+// setPath points the closed partfile at path, where it's been moved to
+func (pf *partfile) setPath(path string) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.path = path
+}
+
+// partView a skipped file's window onto the partfile, offsets relative to the file
+type partView struct {
+	pf   *partfile
+	base int64
+}
+
+func (v partView) ReadAt(p []byte, off int64) (int, error)  { return v.pf.ReadAt(p, v.base+off) }
+func (v partView) WriteAt(p []byte, off int64) (int, error) { return v.pf.WriteAt(p, v.base+off) }
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPartfile(t *testing.T) {
+	const pieceLength = 16
+	tests := []struct {
+		name   string
+		off    int64
+		data   string
+		pieces []int // with a slot afterwards
+	}{
+		{"within a piece", 20, "abcd", []int{1}},
+		{"across pieces", 30, "0123456789", []int{1, 2}},
+		{"far piece", 9*pieceLength + 1, "zz", []int{1, 2, 9}},
+		{"piece start", 0, "start", []int{0, 1, 2, 9}},
+	}
+	path := filepath.Join(t.TempDir(), ".part")
+	pf := newPartfile(path, pieceLength, 10)
+	for _, tt := range tests {
+		if n, err := pf.WriteAt([]byte(tt.data), tt.off); err != nil || n != len(tt.data) {
+			t.Fatalf("%s: wrote %d, %v", tt.name, n, err)
+		}
+		got := make([]byte, len(tt.data))
+		if _, err := pf.ReadAt(got, tt.off); err != nil || string(got) != tt.data {
+			t.Errorf("%s: read %q, %v", tt.name, got, err)
+		}
+		pieces, _ := pf.pieces()
+		slices.Sort(pieces)
+		if !slices.Equal(pieces, tt.pieces) {
+			t.Errorf("%s: pieces %v, want %v", tt.name, pieces, tt.pieces)
+		}
+	}
+	if _, err := pf.ReadAt(make([]byte, 1), 5*pieceLength); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading a piece never written: %v", err)
+	}
+
+	// the slot table survives closing
+	if err := pf.close(); err != nil {
+		t.Fatal(err)
+	}
+	pf = newPartfile(path, pieceLength, 10)
+	for _, tt := range tests {
+		got := make([]byte, len(tt.data))
+		if _, err := pf.ReadAt(got, tt.off); err != nil || string(got) != tt.data {
+			t.Errorf("%s after reopening: read %q, %v", tt.name, got, err)
+		}
+	}
+
+	// a dropped piece's slot is reused, and the file goes with the last piece
+	if err := pf.drop(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf.ReadAt(make([]byte, 1), 20); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading a dropped piece: %v", err)
+	}
+	if _, err := pf.WriteAt([]byte("again"), 4*pieceLength); err != nil {
+		t.Fatal(err)
+	}
+	if s := pf.slots[4]; s != 0 {
+		// piece 1 was written first, into slot 0
+		t.Errorf("piece 4 in slot %d, want the freed slot 0", s)
+	}
+	got := make([]byte, 2)
+	if _, err := pf.ReadAt(got, 2*pieceLength); err != nil || !bytes.Equal(got, []byte("23")) {
+		t.Errorf("neighbour of the reused slot: %q, %v", got, err)
+	}
+	for _, piece := range []int{0, 2, 4, 9} {
+		if err := pf.drop(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("partfile left behind: %v", err)
+	}
+}
@@ -0,0 +1,436 @@
+// storage maps a torrent's pieces onto the files described by its MetaInfo
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+// file a file of the torrent and its offset in the torrent's byte stream
+type file struct {
+	path   string // rel under the storage's dir, the file on disk
+	rel    string // the torrent's name and the file's path, unless renamed
+	offset int64
+	length int64
+	skip   bool // kept off disk, its bytes in pieces we download go to the partfile
+	pad    bool // a pad file, zeros never stored
+	exec   bool
+	link   string // for a symlink, what it points to relative to the storage's dir
+}
+
+// fileIO where a file's bytes live, the file itself or its view of the partfile
+type fileIO interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Storage reads and writes a torrent's data addressed by offsets into the
+// concatenation of all its files. Files are opened lazily on first access.
+type Storage struct {
+	pieceLength int64
+	part        *partfile
+	alloc       Allocation
+
+	// held for reading by reads and writes, for writing while files move
+	io     sync.RWMutex
+	moving sync.Mutex    // held by Move and Rename, so only one moves files at a time
+	grow   sync.Mutex    // for AllocateCompact, held while files grow
+	sizes  map[int]int64 // under grow, how far files have grown, by index
+
+	mu      sync.Mutex
+	dir     string
+	files   []file
+	open    map[int]*os.File
+	changed map[string]bool // while Move copies files, those written to since, by path
+}
+
+// New returns a Storage placing the torrent's files under dir, allocated as alloc says
+func New(dir string, m *metainfo.MetaInfo, alloc Allocation) (*Storage, error) {
+	s := &Storage{
+		dir:         filepath.Clean(dir),
+		open:        make(map[int]*os.File),
+		sizes:       make(map[int]int64),
+		pieceLength: m.PieceLength,
+		alloc:       alloc,
+		part:        newPartfile(filepath.Join(dir, partName(m.InfoHash)), m.PieceLength, m.NumPieces()),
+	}
+	offset := int64(0)
+	for _, f := range m.Files {
+		rel, err := filePath("", m.Name, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		link := ""
+		if f.Symlink() {
+			if link, err = filePath("", m.Name, f.SymlinkPath); err != nil {
+				return nil, err
+			}
+		}
+		s.files = append(s.files, file{
+			path:   filepath.Join(s.dir, rel),
+			rel:    rel,
+			offset: offset,
+			length: f.Length,
+			pad:    f.Padding(),
+			exec:   f.Executable(),
+			link:   link,
+		})
+		offset += f.Length
+	}
+	return s, nil
+}
+
+// partName the name of the partfile of the torrent with infoHash
+func partName(infoHash string) string {
+	return fmt.Sprintf(".%x.parts", infoHash)
+}
+
+// filePath joins the torrent's name and a file's path components under dir,
+// refusing components that would escape it
+func filePath(dir, name string, path []string) (string, error) {
+	parts := []string{dir}
+	for _, p := range append([]string{name}, path...) {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, "/\\") {
+			return "", fmt.Errorf("storage: invalid path component %q", p)
+		}
+		parts = append(parts, p)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// ReadAt reads len(p) bytes starting at off
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	s.io.RLock()
+	defer s.io.RUnlock()
+	return s.each(p, off, func(f fileIO, b []byte, off int64) (int, error) {
+		n, err := f.ReadAt(b, off)
+		if err == io.EOF && n < len(b) {
+			// the file hasn't been written this far yet
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	})
+}
+
+// WriteAt writes p starting at off
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	s.io.RLock()
+	defer s.io.RUnlock()
+	s.touch(off, int64(len(p)))
+	n, err := s.each(p, off, fileIO.WriteAt)
+	return n, diskFull(err)
+}
+
+// each splits the range [off, off+len(p)) across the files it covers
+func (s *Storage) each(p []byte, off int64, op func(fileIO, []byte, int64) (int, error)) (int, error) {
+	done := 0
+	for i := range s.files {
+		// only offset and length, the rest changes under mu
+		f := &s.files[i]
+		if len(p) == 0 {
+			break
+		}
+		if off >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+		rel := off - f.offset
+		n := int64(len(p))
+		if rel+n > f.length {
+			n = f.length - rel
+		}
+		fh, err := s.file(i)
+		if err != nil {
+			return done, err
+		}
+		m, err := op(fh, p[:n], rel)
+		done += m
+		if err != nil {
+			return done, err
+		}
+		p = p[n:]
+		off += n
+	}
+	if len(p) != 0 {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+// touch notes the files a write to [off, off+n) changes while Move copies
+// them, so they're copied again
+func (s *Storage) touch(off, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed == nil {
+		return
+	}
+	for _, f := range s.files {
+		if f.virtual() || f.length == 0 || f.offset >= off+n || f.offset+f.length <= off {
+			continue
+		}
+		if f.skip || s.alloc == AllocateCompact {
+			// compact files' pieces wait there until they can be appended
+			s.changed[s.part.path] = true
+		}
+		if !f.skip {
+			s.changed[f.path] = true
+		}
+	}
+}
+
+func (s *Storage) file(i int) (fileIO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files[i].virtual() {
+		return zeroIO{}, nil
+	}
+	if s.files[i].skip {
+		return partView{s.part, s.files[i].offset}, nil
+	}
+	if s.alloc == AllocateCompact {
+		f, err := s.openFile(i)
+		if err != nil {
+			return nil, err
+		}
+		return compactView{s, i, f, s.files[i].offset}, nil
+	}
+	return s.openFile(i)
+}
+
+// openFile opens file i, creating it and its directories if needed and
+// allocating it as the storage's Allocation says. Caller holds mu.
+func (s *Storage) openFile(i int) (*os.File, error) {
+	if f, ok := s.open[i]; ok {
+		return f, nil
+	}
+	path := s.files[i].path
+	if s.changed != nil {
+		// allocating it may change it
+		s.changed[path] = true
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allocate(f, i)
+	if err == nil && s.files[i].exec {
+		err = setExec(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.open[i] = f
+	return f, nil
+}
+
+// setExec makes f executable by whoever can read it
+func setExec(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	perm := info.Mode().Perm()
+	if want := perm | perm&0444>>2; want != perm {
+		return f.Chmod(want)
+	}
+	return nil
+}
+
+// virtual reports whether f has no data of its own on disk, its bytes read
+// as zeros and writes to them are dropped
+func (f *file) virtual() bool {
+	return f.pad || f.link != ""
+}
+
+// zeroIO the bytes of a virtual file
+type zeroIO struct{}
+
+func (zeroIO) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (zeroIO) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+
+// symlink creates the symlink file i is, pointing at its target relative to
+// where it is, unless something is there already. Caller holds mu.
+func (s *Storage) symlink(i int) error {
+	f := &s.files[i]
+	if _, err := os.Lstat(f.path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(f.path), filepath.Join(s.dir, f.link))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, f.path)
+}
+
+// Skip keeps file i off disk, or brings it back with whatever the partfile
+// holds of it. A file that's already on disk stays in use when skipped.
+func (s *Storage) Skip(i int, skip bool) error {
+	if !skip && s.alloc == AllocateCompact {
+		s.mu.Lock()
+		f := &s.files[i]
+		skipped := f.skip
+		f.skip = false
+		if s.changed != nil {
+			s.changed[f.path], s.changed[s.part.path] = true, true
+		}
+		s.mu.Unlock()
+		if !skipped {
+			return nil
+		}
+		// what the partfile holds of it is appended as it grows, starting now
+		return s.settleFile(i)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := &s.files[i]
+	if f.skip == skip || f.virtual() {
+		return nil
+	}
+	if skip {
+		if _, open := s.open[i]; open {
+			return nil
+		}
+		if _, err := os.Stat(f.path); err == nil {
+			return nil
+		}
+		f.skip = true
+		return nil
+	}
+	f.skip = false
+	if s.changed != nil {
+		s.changed[f.path], s.changed[s.part.path] = true, true
+	}
+	pieces, err := s.part.pieces()
+	if err != nil {
+		return err
+	}
+	for _, piece := range pieces {
+		start, end := int64(piece)*s.pieceLength, int64(piece+1)*s.pieceLength
+		if start < f.offset {
+			start = f.offset
+		}
+		if end > f.offset+f.length {
+			end = f.offset + f.length
+		}
+		if start < end {
+			buf := make([]byte, end-start)
+			if _, err := s.part.ReadAt(buf, start); err != nil {
+				return err
+			}
+			fh, err := s.openFile(i)
+			if err != nil {
+				return err
+			}
+			if _, err := fh.WriteAt(buf, start-f.offset); err != nil {
+				return err
+			}
+		}
+		if !s.skipsPiece(piece) {
+			if err := s.part.drop(piece); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipsPiece reports whether a skipped file has bytes in piece, caller holds mu
+func (s *Storage) skipsPiece(piece int) bool {
+	start, end := int64(piece)*s.pieceLength, int64(piece+1)*s.pieceLength
+	for _, f := range s.files {
+		if f.skip && f.length > 0 && f.offset < end && f.offset+f.length > start {
+			return true
+		}
+	}
+	return false
+}
+
+// Exists reports whether any of the torrent's files, or its partfile, is
+// already on disk
+func (s *Storage) Exists() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.part.path); err == nil {
+		return true
+	}
+	for _, f := range s.files {
+		if f.virtual() {
+			continue
+		}
+		if _, err := os.Stat(f.path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync flushes what has been written to every open file to disk
+func (s *Storage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := s.part.sync()
+	for _, f := range s.open {
+		if err := f.Sync(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close closes every open file
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFiles()
+}
+
+// closeFiles closes every open file, they're opened again when next used.
+// Caller holds mu.
+func (s *Storage) closeFiles() error {
+	first := s.part.close()
+	for i, f := range s.open {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(s.open, i)
+	}
+	return first
+}
+
+// Delete closes the storage and removes the torrent's files, its partfile and
+// any directories left empty
+func (s *Storage) Delete() error {
+	first := s.Close()
+	remove := func(path string) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	for _, f := range s.files {
+		if !f.pad {
+			remove(f.path)
+		}
+	}
+	remove(s.part.path)
+	for _, f := range s.files {
+		removeEmptyDirs(filepath.Dir(f.path), s.dir)
+	}
+	return first
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path []string
+		want string // empty when refused
+	}{
+		{"single file", nil, filepath.Join("dir", "t")},
+		{"nested", []string{"a", "b.txt"}, filepath.Join("dir", "t", "a", "b.txt")},
+		{"pad file", []string{".pad", "1024"}, filepath.Join("dir", "t", ".pad", "1024")},
+		{"dot dot", []string{"..", "etc", "passwd"}, ""},
+		{"dot", []string{".", "a"}, ""},
+		{"empty component", []string{"a", ""}, ""},
+		{"slash", []string{"a/../../b"}, ""},
+		{"backslash", []string{`..\b`}, ""},
+	}
+	for _, tt := range tests {
+		got, err := filePath("dir", "t", tt.path)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %s", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %q, %v", tt.name, got, err)
+		}
+	}
+	if _, err := filePath("dir", "..", nil); err == nil {
+		t.Error("a torrent named .. accepted")
+	}
+}
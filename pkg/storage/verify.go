@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+// Verify hashes the pieces of m found under dir and calls fn with each
+// piece's result, in order. Missing or short files fail the pieces they
+// cover, pad files and symlinks count as zeros. Nothing is created or
+// written.
+func Verify(dir string, m *metainfo.MetaInfo, fn func(piece int, ok bool)) error {
+	readers := make([]io.Reader, 0, len(m.Files))
+	for _, f := range m.Files {
+		if f.Padding() || f.Symlink() {
+			readers = append(readers, io.LimitReader(zeros{}, f.Length))
+			continue
+		}
+		path, err := filePath(dir, m.Name, f.Path)
+		if err != nil {
+			return err
+		}
+		fh, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil {
+			readers = append(readers, io.LimitReader(zeros{}, f.Length))
+			continue
+		}
+		defer fh.Close()
+		// a short file reads as zeros past its end, a long one is cut off
+		readers = append(readers, io.LimitReader(io.MultiReader(fh, zeros{}), f.Length))
+	}
+	r := io.MultiReader(readers...)
+	buf := make([]byte, m.PieceLength)
+	for i := 0; i < m.NumPieces(); i++ {
+		b := buf[:m.PieceSize(i)]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		sum := sha1.Sum(b)
+		fn(i, bytes.Equal(sum[:], m.PieceHash(i)))
+	}
+	return nil
+}
+
+// VerifyFiles hashes the files of m found under dir that the torrent gives
+// a SHA1 for and calls fn with each one's result, in order. A missing file,
+// or one of the wrong length, fails.
+func VerifyFiles(dir string, m *metainfo.MetaInfo, fn func(file int, ok bool)) error {
+	for i, f := range m.Files {
+		if len(f.SHA1) == 0 || f.Padding() || f.Symlink() {
+			continue
+		}
+		path, err := filePath(dir, m.Name, f.Path)
+		if err != nil {
+			return err
+		}
+		ok, err := fileMatches(path, f)
+		if err != nil {
+			return err
+		}
+		fn(i, ok)
+	}
+	return nil
+}
+
+// fileMatches reports whether the file at path has f's length and SHA1
+func fileMatches(path string, f metainfo.File) (bool, error) {
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, fh)
+	if err != nil {
+		return false, err
+	}
+	return n == f.Length && bytes.Equal(h.Sum(nil), f.SHA1), nil
+}
+
+// zeros an endless stream of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
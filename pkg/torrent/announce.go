@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/peer"
+	"github.com/mbags/gtc/pkg/tracker"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute // when the tracker doesn't say
+	minAnnounceInterval     = time.Minute      // however often a tracker asks
+	announceRetry           = 2 * time.Minute  // after every tracker failed
+	stoppedTimeout          = 5 * time.Second  // for the stopped announce, so Stop doesn't hang on a dead tracker
+)
+
+// TrackerStatus what we know about one of the torrent's trackers
+type TrackerStatus struct {
+	URL          string    `json:"url"`
+	Tier         int       `json:"tier"`
+	LastAnnounce time.Time `json:"last_announce"`
+	Peers        int       `json:"peers"` // returned by the last announce
+	Error        string    `json:"error,omitempty"`
+
+	Announces    int           `json:"announces"`
+	Errors       int           `json:"errors"`        // failed announces
+	Latency      time.Duration `json:"latency"`       // of the last announce
+	AnnounceTime time.Duration `json:"announce_time"` // spent on every announce together
+}
+
+// trackerTiers the torrent's trackers, the announce key on its own or else the announce-list tiers
+func (t *Torrent) trackerTiers() [][]string {
+	if t.MetaInfo.Announce != "" {
+		return [][]string{{t.MetaInfo.Announce}}
+	}
+	return t.MetaInfo.AnnounceList
+}
+
+// announce asks the trackers for peers tier by tier, stopping at the first
+// that answers, and returns when it wants to hear from us again
+func (t *Torrent) announce(ctx context.Context, ev tracker.Event) ([]*peer.Peer, time.Duration, error) {
+	err := errors.New("no trackers")
+	for tier, urls := range t.trackerTiers() {
+		for _, url := range urls {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			var peers []*peer.Peer
+			var interval time.Duration
+			peers, interval, err = t.announceTo(ctx, url, tier, ev)
+			if err == nil {
+				t.mu.Lock()
+				t.tracker, t.trackerTier = url, tier
+				t.mu.Unlock()
+				if interval == 0 {
+					interval = defaultAnnounceInterval
+				}
+				return peers, max(interval, minAnnounceInterval), nil
+			}
+		}
+	}
+	return nil, 0, err
+}
+
+// announceLoop announces that we've started, then again as often as the
+// tracker asks and once the download completes, until the torrent stops
+func (t *Torrent) announceLoop() {
+	ev := tracker.Started
+	for {
+		peers, interval, err := t.announce(t.ctx, ev)
+		if t.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// ev stays as it was, the trackers still have to hear it
+			log.Printf("Couldn't get peers for %x from its trackers: %v", t.MetaInfo.InfoHash, err)
+			interval = announceRetry
+		} else {
+			t.Peers.Add(peers...)
+			ev = tracker.None
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-t.finished:
+			timer.Stop()
+			if ev != tracker.Started {
+				ev = tracker.Completed
+			}
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// announceStopped tells the tracker that last answered that we're going
+func (t *Torrent) announceStopped() {
+	t.mu.Lock()
+	url, tier := t.tracker, t.trackerTier
+	t.mu.Unlock()
+	if url == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	if _, _, err := t.announceTo(ctx, url, tier, tracker.Stopped); err != nil {
+		log.Printf("Couldn't tell %s we stopped: %v", url, err)
+	}
+}
+
+// announceTo announces ev to one tracker, recording and publishing the outcome
+func (t *Torrent) announceTo(ctx context.Context, url string, tier int, ev tracker.Event) ([]*peer.Peer, time.Duration, error) {
+	start := time.Now()
+	peers, interval, err := tracker.AnnounceContext(ctx, url, t.MetaInfo, ev, t.announcement())
+	t.announced(url, tier, start, len(peers), err)
+	t.publish(event.Event{Type: event.TrackerAnnounce, Tracker: url, Peers: len(peers), Err: err})
+	return peers, interval, err
+}
+
+// announcement what trackers are told about us: the peer id we handshake
+// with and how far along the download is
+func (t *Torrent) announcement() tracker.Announcement {
+	a := tracker.Announcement{PeerID: t.Peers.peerID, Left: -1}
+	if !t.HasInfo() {
+		return a
+	}
+	size := t.MetaInfo.TotalLength()
+	t.picker.mu.Lock()
+	defer t.picker.mu.Unlock()
+	a.Left = size - t.picker.bytesDone(0, size)
+	a.Uploaded, a.Downloaded = t.picker.uploaded, t.picker.downloaded
+	return a
+}
+
+// announced records the outcome of an announce that began at start
+func (t *Torrent) announced(url string, tier int, start time.Time, peers int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.trackers == nil {
+		t.trackers = make(map[string]TrackerStatus)
+	}
+	st := t.trackers[url]
+	st.URL, st.Tier = url, tier
+	st.LastAnnounce, st.Latency = time.Now(), time.Since(start)
+	st.Peers, st.Error = peers, ""
+	st.Announces++
+	st.AnnounceTime += st.Latency
+	if err != nil {
+		st.Error = err.Error()
+		st.Errors++
+	}
+	t.trackers[url] = st
+}
+
+// Trackers the status of every tracker, in tier order
+func (t *Torrent) Trackers() []TrackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []TrackerStatus
+	for tier, urls := range t.trackerTiers() {
+		for _, url := range urls {
+			st, ok := t.trackers[url]
+			if !ok {
+				st = TrackerStatus{URL: url, Tier: tier}
+			}
+			list = append(list, st)
+		}
+	}
+	return list
+}
@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+func TestAnnounceEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events, sent []string // what each announce said, event then peer id, left and downloaded
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ev := q.Get("event")
+		mu.Lock()
+		events = append(events, ev)
+		sent = append(sent, fmt.Sprintf("%s %s %s %s", ev, q.Get("peer_id"), q.Get("left"), q.Get("downloaded")))
+		mu.Unlock()
+		if ev == "stopped" {
+			<-r.Context().Done() // Stop mustn't wait for this one for long
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer hs.Close()
+
+	m, data := testMeta(20*16<<10, 16<<10)
+	seedDir, dlDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(seedDir, "f"), data, 0644)
+	seedMeta := *m // only the leech announces
+	seed, err := New(context.Background(), &seedMeta, Config{Dir: seedDir, PeerID: []byte("-GT0001-seedseedseed"), Limiter: NewLimiter(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("127.0.0.1:0", mse.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Start()
+	l.Add(seed)
+	seed.Start()
+	defer seed.Stop()
+
+	m.Announce = hs.URL
+	dl, err := New(context.Background(), m, Config{Dir: dlDir, PeerID: []byte("-GT0001-leechleechle"), Limiter: NewLimiter(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.Peers.Encryption = mse.Disabled
+	dl.Peers.Add(&peer.Peer{IP: []byte{127, 0, 0, 1}, Port: uint16(l.Port())})
+	dl.Start()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		mu.Lock()
+		done := slices.Contains(events, "completed")
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no completed announce, got %q", events)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	start := time.Now()
+	dl.Stop()
+	if d := time.Since(start); d > stoppedTimeout+2*time.Second {
+		t.Errorf("Stop took %v", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"started", "completed", "stopped"}; !slices.Equal(events, want) {
+		t.Fatalf("events %q, want %q", events, want)
+	}
+	// the tracker sees the peer id we handshake with, and what we've got
+	size := len(data)
+	want := []string{
+		fmt.Sprintf("started -GT0001-leechleechle %d 0", size),
+		fmt.Sprintf("completed -GT0001-leechleechle 0 %d", size),
+		fmt.Sprintf("stopped -GT0001-leechleechle 0 %d", size),
+	}
+	if !slices.Equal(sent, want) {
+		t.Errorf("announced %q, want %q", sent, want)
+	}
+}
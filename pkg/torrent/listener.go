@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+const acceptTimeout = 20 * time.Second // for the encryption and BitTorrent handshakes of an incoming connection
+
+// Listener accepts incoming peer connections and hands each to the torrent it asks for
+type Listener struct {
+	Encryption mse.Policy
+
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[string]*Torrent // by info hash
+}
+
+// Listen listens for peers on addr, e.g. ":6881"
+func Listen(addr string, policy mse.Policy) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Encryption: policy, ln: ln, torrents: make(map[string]*Torrent)}, nil
+}
+
+// Port the port we're listening on
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Add accepts connections for t
+func (l *Listener) Add(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.MetaInfo.InfoHash] = t
+}
+
+// Remove stops accepting connections for t
+func (l *Listener) Remove(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, t.MetaInfo.InfoHash)
+}
+
+// Start begins accepting connections
+func (l *Listener) Start() {
+	l.Serve(l.ln)
+}
+
+// Serve accepts connections from another listener too, such as a uTP socket,
+// until it's closed
+func (l *Listener) Serve(ln net.Listener) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return
+			}
+			go l.handle(conn)
+		}
+	}()
+}
+
+// Close stops listening on the TCP port, connections already handed to torrents stay open
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) infoHashes() [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hashes := make([][]byte, 0, len(l.torrents))
+	for ih := range l.torrents {
+		hashes = append(hashes, []byte(ih))
+	}
+	return hashes
+}
+
+// bufferedConn a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// handle works out whether conn is encrypted, reads its handshake and passes it to the torrent
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(acceptTimeout))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(20)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var c net.Conn = &bufferedConn{conn, br}
+	var skey []byte // the torrent an encrypted connection asked for
+	encrypted := false
+	if mse.IsPlaintext(first) {
+		if l.Encryption == mse.Required {
+			conn.Close()
+			return
+		}
+	} else {
+		ec, key, err := mse.Accept(conn, br, l.infoHashes(), l.Encryption)
+		if err != nil {
+			log.Printf("Encrypted handshake from %s failed :: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		c, encrypted, skey = ec, ec.Encrypted, key
+	}
+
+	theirs, err := peer.ReadHandshake(c)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if skey != nil && !bytes.Equal(skey, theirs.InfoHash[:]) {
+		log.Printf("Handshake from %s is for another torrent than its encrypted handshake", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	l.mu.Lock()
+	t, ok := l.torrents[string(theirs.InfoHash[:])]
+	l.mu.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t.Peers.Accept(c, theirs, encrypted)
+}
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+func TestListenerHandshakeHash(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", mse.Preferred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Start()
+	var hashes [][]byte
+	for _, id := range []string{"-GT0001-aaaaaaaaaaaa", "-GT0001-bbbbbbbbbbbb"} {
+		m, _ := testMeta(16<<10, 16<<10)
+		tr, err := New(context.Background(), m, Config{Dir: t.TempDir(), PeerID: []byte(id), Limiter: NewLimiter(10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Add(tr)
+		tr.Start()
+		defer tr.Stop()
+		hashes = append(hashes, []byte(m.InfoHash))
+	}
+	a, b := hashes[0], hashes[1]
+
+	tests := []struct {
+		name      string
+		skey      []byte // nil for plaintext
+		handshake []byte
+		accepted  bool
+	}{
+		{"plaintext", nil, b, true},
+		{"encrypted", a, a, true},
+		{"encrypted for another torrent", a, b, false},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(l.Port()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		var c net.Conn = conn
+		if tt.skey != nil {
+			if c, err = mse.Initiate(conn, tt.skey, mse.Required); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		h, _ := peer.NewHandshake(tt.handshake, []byte("-GT0001-cccccccccccc"))
+		c.Write(h.Bytes())
+		_, err = peer.ReadHandshake(c)
+		if accepted := err == nil; accepted != tt.accepted {
+			t.Errorf("%s: accepted %v, want %v", tt.name, accepted, tt.accepted)
+		}
+		if !tt.accepted && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: %v, want the connection closed", tt.name, err)
+		}
+		conn.Close()
+	}
+}
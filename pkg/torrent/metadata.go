@@ -0,0 +1,167 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+const (
+	metadataInterval = time.Second      // how often peers are asked for missing pieces of the metadata
+	metadataTimeout  = 10 * time.Second // a piece asked for this long ago is asked of another peer
+)
+
+// metadata fetches the info dictionary of a torrent added from a magnet link
+// from peers supporting ut_metadata (BEP 9), and serves it to peers once known
+type metadata struct {
+	infoHash string
+	done     chan struct{} // closed once info is known
+
+	mu        sync.Mutex
+	info      []byte // verified, nil until known
+	buf       []byte // being assembled, as long as the first size a peer gave us
+	have      []bool // per piece of buf
+	requested map[int]time.Time
+}
+
+func newMetadata(m *metainfo.MetaInfo) *metadata {
+	md := &metadata{infoHash: m.InfoHash, done: make(chan struct{}), requested: make(map[int]time.Time)}
+	if m.HasInfo() {
+		md.info = m.InfoBytes
+		close(md.done)
+	}
+	return md
+}
+
+func (md *metadata) Name() string { return peer.MetadataExtension }
+
+// ExtendHandshake tells peers how big the info dictionary is, once we have it
+func (md *metadata) ExtendHandshake(d map[string]interface{}) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if md.info != nil {
+		d["metadata_size"] = len(md.info)
+	}
+}
+
+// Handle serves requests for pieces of the info dictionary and collects the
+// pieces we asked for
+func (md *metadata) Handle(p *peer.Peer, payload []byte) {
+	msg, err := peer.ParseMetadata(payload)
+	if err != nil {
+		log.Printf("Bad metadata message from %s :: %v", p.Addr(), err)
+		return
+	}
+	switch msg.Type {
+	case peer.MetadataRequest:
+		md.serve(p, msg.Piece)
+	case peer.MetadataData:
+		md.receive(p, msg)
+	case peer.MetadataReject:
+		md.mu.Lock()
+		delete(md.requested, msg.Piece)
+		md.mu.Unlock()
+	}
+}
+
+func (md *metadata) serve(p *peer.Peer, piece int) {
+	md.mu.Lock()
+	info := md.info
+	md.mu.Unlock()
+	reply := &peer.MetadataMessage{Type: peer.MetadataReject, Piece: piece}
+	if start := piece * peer.MetadataPieceSize; info != nil && start < len(info) {
+		end := min(start+peer.MetadataPieceSize, len(info))
+		reply = &peer.MetadataMessage{Type: peer.MetadataData, Piece: piece, TotalSize: len(info), Data: info[start:end]}
+	}
+	if b, err := reply.Marshal(); err == nil {
+		p.SendExtended(peer.MetadataExtension, b)
+	}
+}
+
+func (md *metadata) receive(p *peer.Peer, msg *peer.MetadataMessage) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if md.info != nil || msg.TotalSize != len(md.buf) || msg.Piece >= len(md.have) {
+		return
+	}
+	start := msg.Piece * peer.MetadataPieceSize
+	end := min(start+peer.MetadataPieceSize, len(md.buf))
+	if len(msg.Data) != end-start {
+		return
+	}
+	copy(md.buf[start:end], msg.Data)
+	md.have[msg.Piece] = true
+	delete(md.requested, msg.Piece)
+	for _, ok := range md.have {
+		if !ok {
+			return
+		}
+	}
+	if sum := sha1.Sum(md.buf); string(sum[:]) != md.infoHash {
+		log.Printf("Metadata from %s and others doesn't match the info hash, starting over", p.Addr())
+		md.buf, md.have = nil, nil
+		return
+	}
+	md.info = md.buf
+	close(md.done)
+}
+
+// request asks peers that have the info dictionary for the pieces we're
+// missing, one piece per peer per call
+func (md *metadata) request(peers []*peer.Peer) {
+	type ask struct {
+		p   *peer.Peer
+		msg []byte
+	}
+	var asks []ask
+	md.mu.Lock()
+	if md.info != nil {
+		md.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	for _, p := range peers {
+		if !p.Connected() || !p.SupportsExtension(peer.MetadataExtension) {
+			continue
+		}
+		size := p.MetadataSize()
+		if size == 0 {
+			continue
+		}
+		if md.buf == nil {
+			// trust the first size we hear, a wrong one fails the hash check
+			md.buf = make([]byte, size)
+			md.have = make([]bool, (size+peer.MetadataPieceSize-1)/peer.MetadataPieceSize)
+		}
+		if size != len(md.buf) {
+			continue
+		}
+		for i, ok := range md.have {
+			if ok || now.Sub(md.requested[i]) < metadataTimeout {
+				continue
+			}
+			b, err := (&peer.MetadataMessage{Type: peer.MetadataRequest, Piece: i}).Marshal()
+			if err != nil {
+				break
+			}
+			md.requested[i] = now
+			asks = append(asks, ask{p, b})
+			break
+		}
+	}
+	md.mu.Unlock()
+	for _, a := range asks {
+		a.p.SendExtended(peer.MetadataExtension, a.msg)
+	}
+}
+
+// bytes the verified info dictionary, nil until known
+func (md *metadata) bytes() []byte {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return md.info
+}
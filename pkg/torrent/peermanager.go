@@ -0,0 +1,557 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/peer"
+	"github.com/mbags/gtc/pkg/ratelimit"
+	"github.com/mbags/gtc/pkg/utp"
+)
+
+const (
+	// DefaultMaxConns connections allowed per torrent
+	DefaultMaxConns = 50
+	// DefaultGlobalMaxConns connections allowed across every torrent
+	DefaultGlobalMaxConns = 200
+	// DefaultUploadSlots peers per torrent we upload to at once, one of them
+	// picked at random
+	DefaultUploadSlots = 4
+
+	maxCandidates   = 1000             // further addresses are ignored until the pool drains
+	maxFailures     = 5                // candidates are forgotten after this many failed attempts
+	baseBackoff     = 15 * time.Second // wait before retrying a candidate, doubled per failure
+	maxBackoff      = 10 * time.Minute
+	uselessTimeout  = 2 * time.Minute // a peer choking us this long may be replaced
+	manageInterval  = 5 * time.Second
+	chokeInterval   = 10 * time.Second
+	optimisticEvery = 3 // choke rounds between picking a new optimistic unchoke
+)
+
+// Limiter caps the number of simultaneous peer connections. One Limiter can be shared by many torrents.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing n simultaneous connections
+func NewLimiter(n int) *Limiter {
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+// GlobalLimiter the limiter shared by every torrent unless told otherwise
+var GlobalLimiter = NewLimiter(DefaultGlobalMaxConns)
+
+func (l *Limiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
+
+// candidate a peer address we know about, connected or not
+type candidate struct {
+	peer        *peer.Peer
+	failures    int
+	nextAttempt time.Time
+	chokedSince time.Time // zero while the peer is unchoking us
+	useless     bool      // dropped to make room for another candidate
+	incoming    bool      // connected to us from an ephemeral port, not worth retrying
+	reconnect   bool      // dropped to be dialled again straight away
+}
+
+// PeerManager keeps a torrent's peer connections between its limits, retrying
+// failed candidates with backoff and replacing peers that never unchoke us.
+// It uploads to the interested peers that give the most, or take the most
+// once we're seeding, plus one picked at random so newcomers get a start.
+type PeerManager struct {
+	MaxConns    int
+	UploadSlots int
+	NumPieces   int
+	Downloader  peer.Downloader // handed to every peer we connect to
+	Uploader    peer.Uploader
+	Extensions  []peer.ExtensionHandler
+	Encryption  mse.Policy  // for outgoing connections
+	UTP         *utp.Socket // tried before TCP when connecting, nil for TCP only
+
+	DownloadLimit, UploadLimit *ratelimit.Limiter // usually shared by every torrent
+	Events                     *event.Bus         // gets peer events, may be nil
+	Traffic                    peer.Traffic       // bytes exchanged with every peer so far
+
+	infoHash, peerID []byte
+	limiter          *Limiter
+
+	mu         sync.Mutex
+	candidates map[string]*candidate // waiting to be connected
+	conns      map[string]*candidate // connecting or connected
+	paused     bool
+	started    bool
+	stopped    bool
+
+	activate, deactivate chan *peer.Peer
+	disconnected         chan disconnect
+	stop, done           chan struct{} // Stop was called, run has returned
+
+	// run's own
+	chokeRounds int
+	optimistic  *peer.Peer
+}
+
+type disconnect struct {
+	c   *candidate
+	err error
+}
+
+// NewPeerManager returns a PeerManager for the torrent identified by infoHash,
+// sharing limiter with other torrents
+func NewPeerManager(infoHash, peerID []byte, limiter *Limiter) *PeerManager {
+	return &PeerManager{
+		MaxConns:     DefaultMaxConns,
+		UploadSlots:  DefaultUploadSlots,
+		Encryption:   mse.Preferred,
+		infoHash:     infoHash,
+		peerID:       peerID,
+		limiter:      limiter,
+		candidates:   make(map[string]*candidate),
+		conns:        make(map[string]*candidate),
+		activate:     make(chan *peer.Peer),
+		deactivate:   make(chan *peer.Peer),
+		disconnected: make(chan disconnect),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Add adds peers to the candidate pool, ignoring ones already known
+func (m *PeerManager) Add(peers ...*peer.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range peers {
+		if len(m.candidates) >= maxCandidates {
+			return
+		}
+		addr := connKey(p)
+		if _, ok := m.conns[addr]; ok {
+			continue
+		}
+		if _, ok := m.candidates[addr]; ok {
+			continue
+		}
+		m.candidates[addr] = &candidate{peer: &peer.Peer{IP: p.IP, Port: p.Port}}
+	}
+}
+
+// Peers returns the peers currently connecting or connected
+func (m *PeerManager) Peers() []*peer.Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]*peer.Peer, 0, len(m.conns))
+	for _, c := range m.conns {
+		peers = append(peers, c.peer)
+	}
+	return peers
+}
+
+// Start begins connecting to candidates and watching peer state
+func (m *PeerManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started {
+		return
+	}
+	m.started = true
+	go m.run()
+}
+
+// Stop disconnects every peer and stops making or accepting connections for
+// good. It returns once the peers' goroutines and the manager's own have exited.
+func (m *PeerManager) Stop() {
+	m.mu.Lock()
+	if !m.stopped {
+		m.stopped = true
+		close(m.stop)
+		if !m.started {
+			// incoming peers may have been accepted before Start, someone has to see them off
+			m.started = true
+			go m.run()
+		}
+	}
+	m.mu.Unlock()
+	<-m.done
+}
+
+func (m *PeerManager) run() {
+	ticker := time.NewTicker(manageInterval)
+	defer ticker.Stop()
+	choker := time.NewTicker(chokeInterval)
+	defer choker.Stop()
+	defer close(m.done)
+	m.fill()
+	stop := m.stop
+	for {
+		select {
+		case p := <-m.activate:
+			m.setChoked(p, false)
+			m.publish(event.Event{Type: event.PeerUnchoked, Peer: p.Addr()})
+			log.Printf("%s unchoked us", p.Addr())
+		case p := <-m.deactivate:
+			m.setChoked(p, true)
+			m.publish(event.Event{Type: event.PeerChoked, Peer: p.Addr()})
+			log.Printf("%s choked us", p.Addr())
+		case d := <-m.disconnected:
+			m.remove(d.c, d.err)
+			// take the free slot, or redial a peer dropped by reconnect
+			m.fill()
+		case <-ticker.C:
+			m.replaceUseless()
+			m.fill()
+		case <-choker.C:
+			m.rechoke()
+		case <-stop:
+			stop = nil
+			m.closeAll()
+		}
+		if stop == nil && m.drained() {
+			// nothing can send on them any more
+			close(m.activate)
+			close(m.deactivate)
+			close(m.disconnected)
+			return
+		}
+	}
+}
+
+// closeAll closes the connection of every peer
+func (m *PeerManager) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.conns {
+		c.peer.Close()
+	}
+}
+
+// drained reports whether every peer's goroutine has returned
+func (m *PeerManager) drained() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns) == 0
+}
+
+func (m *PeerManager) publish(e event.Event) {
+	e.InfoHash = fmt.Sprintf("%x", m.infoHash)
+	m.Events.Publish(e)
+}
+
+func (m *PeerManager) setChoked(p *peer.Peer, choked bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conns[connKey(p)]
+	if !ok {
+		return
+	}
+	if !choked {
+		c.chokedSince = time.Time{}
+	} else if c.chokedSince.IsZero() {
+		c.chokedSince = time.Now()
+	}
+}
+
+// fill connects to ready candidates until the torrent or global limit is reached
+func (m *PeerManager) fill() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused || m.stopped {
+		return
+	}
+	now := time.Now()
+	for addr, c := range m.candidates {
+		if len(m.conns) >= m.MaxConns {
+			return
+		}
+		if now.Before(c.nextAttempt) {
+			continue
+		}
+		if !m.limiter.tryAcquire() {
+			return
+		}
+		delete(m.candidates, addr)
+		// a fresh Peer for every attempt so no state leaks between connections
+		c.peer = m.newPeer(c.peer.IP, c.peer.Port)
+		c.chokedSince = now
+		c.useless = false
+		m.conns[addr] = c
+		go m.connect(c)
+	}
+}
+
+// newPeer a Peer set up with the torrent's handlers
+func (m *PeerManager) newPeer(ip net.IP, port uint16) *peer.Peer {
+	return &peer.Peer{
+		IP:         ip,
+		Port:       port,
+		NumPieces:  m.NumPieces,
+		Downloader: m.Downloader,
+		Uploader:   m.Uploader,
+		Extensions: m.Extensions,
+		Encryption: m.Encryption,
+		UTP:        m.UTP,
+		Traffic:    &m.Traffic,
+		OnConnect: func(p *peer.Peer) {
+			m.publish(event.Event{Type: event.PeerConnected, Peer: p.Addr()})
+		},
+
+		DownloadLimit: m.DownloadLimit,
+		UploadLimit:   m.UploadLimit,
+	}
+}
+
+// Accept takes over an incoming connection whose handshake has been read, if
+// the limits allow it
+func (m *PeerManager) Accept(conn net.Conn, theirs *peer.Handshake, encrypted bool) {
+	var ip net.IP
+	var port int
+	transport := "tcp"
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port, transport = addr.IP, addr.Port, "utp"
+	default:
+		conn.Close()
+		return
+	}
+	p := m.newPeer(ip, uint16(port))
+	p.Incoming, p.Encrypted, p.Transport = true, encrypted, transport
+	key := connKey(p)
+	m.mu.Lock()
+	_, known := m.conns[key]
+	if known || m.paused || m.stopped || len(m.conns) >= m.MaxConns || !m.limiter.tryAcquire() {
+		m.mu.Unlock()
+		conn.Close()
+		return
+	}
+	c := &candidate{peer: p, chokedSince: time.Now(), incoming: true}
+	m.conns[key] = c
+	m.mu.Unlock()
+
+	go func() {
+		err := p.Accept(conn, theirs, m.peerID, m.activate, m.deactivate)
+		m.limiter.release()
+		m.disconnected <- disconnect{c, err}
+	}()
+}
+
+func (m *PeerManager) connect(c *candidate) {
+	err := c.peer.Connect(m.infoHash, m.peerID, m.activate, m.deactivate)
+	m.limiter.release()
+	m.disconnected <- disconnect{c, err}
+}
+
+// connKey what candidates and conns are keyed by for p, the same whether p
+// was connected to or connected to us
+func connKey(p *peer.Peer) string {
+	return p.Addr()
+}
+
+// remove forgets a disconnected peer, returning its address to the candidate
+// pool with a backoff unless it has failed too often
+func (m *PeerManager) remove(c *candidate, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addr := connKey(c.peer)
+	delete(m.conns, addr)
+	log.Printf("%s disconnected: %v", addr, err)
+	if c.peer.ID != "" {
+		m.publish(event.Event{Type: event.PeerDisconnected, Peer: addr, Err: err})
+	}
+
+	if c.incoming || errors.Is(err, peer.ErrSelfConnection) {
+		// an ephemeral port, or the tracker handed us our own address
+		return
+	}
+	if c.reconnect {
+		c.reconnect, c.failures, c.nextAttempt = false, 0, time.Time{}
+		m.candidates[addr] = c
+		return
+	}
+	if c.peer.ID != "" && !c.useless {
+		// we got as far as a handshake, the address is good
+		c.failures = 0
+	} else {
+		c.failures++
+	}
+	if c.failures >= maxFailures {
+		return
+	}
+	if _, ok := m.candidates[addr]; ok {
+		return
+	}
+	c.nextAttempt = time.Now().Add(backoff(c.failures))
+	m.candidates[addr] = c
+}
+
+// replaceUseless drops peers that have choked us for too long, but only when
+// there are candidates waiting to take their place
+func (m *PeerManager) replaceUseless() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conns) < m.MaxConns || len(m.candidates) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, c := range m.conns {
+		if !c.chokedSince.IsZero() && now.Sub(c.chokedSince) > uselessTimeout {
+			log.Printf("Dropping %s, choked for %v", c.peer.Addr(), now.Sub(c.chokedSince).Round(time.Second))
+			c.useless = true
+			c.peer.Close()
+		}
+	}
+}
+
+// rechoke unchokes the interested peers with the best rates, by what they
+// upload to us or, when we're seeding, what we upload to them, and an
+// optimistic unchoke rotated every few rounds. Every other peer is choked.
+func (m *PeerManager) rechoke() {
+	m.mu.Lock()
+	uploader, numPieces, slots := m.Uploader, m.NumPieces, m.UploadSlots
+	m.mu.Unlock()
+	if uploader == nil {
+		// nothing to upload without the info dictionary
+		return
+	}
+	have := uploader.HavePieces()
+	seeding := have.Count() >= numPieces
+	var interested, others []*peer.Peer
+	for _, p := range m.Peers() {
+		if !p.Connected() {
+			continue
+		}
+		if p.Interested() {
+			interested = append(interested, p)
+		} else {
+			others = append(others, p)
+		}
+	}
+	// taken once, the meters move while sorting
+	rates := make(map[*peer.Peer]float64, len(interested))
+	for _, p := range interested {
+		if seeding {
+			rates[p] = p.UploadRate()
+		} else {
+			rates[p] = p.DownloadRate()
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool { return rates[interested[i]] > rates[interested[j]] })
+	regular := len(interested)
+	if regular > slots {
+		// the last slot is the optimistic one
+		regular = max(slots-1, 0)
+	}
+	unchoke := make(map[*peer.Peer]bool)
+	for _, p := range interested[:regular] {
+		unchoke[p] = true
+	}
+	rest := interested[regular:]
+	if m.chokeRounds%optimisticEvery == 0 || !slices.Contains(rest, m.optimistic) {
+		m.optimistic = nil
+		if len(rest) > 0 {
+			m.optimistic = rest[rand.Intn(len(rest))]
+		}
+	}
+	m.chokeRounds++
+	if m.optimistic != nil && len(unchoke) < slots {
+		unchoke[m.optimistic] = true
+	}
+	for _, p := range append(interested, others...) {
+		p.SetChoking(!unchoke[p])
+	}
+}
+
+// setInfo hands the piece count, downloader, uploader and extensions to the
+// peers connected from now on, for a torrent whose metadata just arrived
+func (m *PeerManager) setInfo(numPieces int, d peer.Downloader, u peer.Uploader, ext []peer.ExtensionHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.NumPieces, m.Downloader, m.Uploader, m.Extensions = numPieces, d, u, ext
+}
+
+// reconnect drops every peer and dials them again straight away, so they're
+// set up with what setInfo changed
+func (m *PeerManager) reconnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.conns {
+		c.reconnect = true
+		c.peer.Close()
+	}
+}
+
+// Pause disconnects every peer and stops making or accepting connections
+func (m *PeerManager) Pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused = true
+	for _, c := range m.conns {
+		c.peer.Close()
+	}
+}
+
+// Resume reconnects after Pause, starting with the peers it disconnected
+func (m *PeerManager) Resume() {
+	m.mu.Lock()
+	m.paused = false
+	for _, c := range m.candidates {
+		c.nextAttempt = time.Time{}
+	}
+	m.mu.Unlock()
+	m.fill()
+}
+
+// Paused reports whether the manager is paused
+func (m *PeerManager) Paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
+
+// SetMaxConns changes MaxConns while running, dropping peers over the new limit
+func (m *PeerManager) SetMaxConns(n int) {
+	m.mu.Lock()
+	m.MaxConns = n
+	excess := len(m.conns) - n
+	for _, c := range m.conns {
+		if excess <= 0 {
+			break
+		}
+		c.useless = true
+		c.peer.Close()
+		excess--
+	}
+	m.mu.Unlock()
+	m.fill()
+}
+
+func backoff(failures int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
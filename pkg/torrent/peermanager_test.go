@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+	"github.com/mbags/gtc/pkg/mse"
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+// testMeta a single file torrent of random data in pieces of pieceLength
+func testMeta(size, pieceLength int) (*metainfo.MetaInfo, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	m := &metainfo.MetaInfo{Name: "f", Files: []metainfo.File{{Length: int64(size)}}}
+	m.PieceLength = int64(pieceLength)
+	for off := 0; off < size; off += pieceLength {
+		s := sha1.Sum(data[off:min(off+pieceLength, size)])
+		m.Pieces = append(m.Pieces, s[:]...)
+	}
+	s := sha1.Sum(m.Pieces)
+	m.InfoHash = string(s[:])
+	return m, data
+}
+
+func TestSeedUnchokes(t *testing.T) {
+	// far more pieces than the allowed fast set, so the seed must unchoke
+	m, data := testMeta(60*16<<10, 16<<10)
+	seedDir, dlDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(seedDir, "f"), data, 0644)
+	seed, err := New(context.Background(), m, Config{Dir: seedDir, PeerID: []byte("-GT0001-seedseedseed"), Limiter: NewLimiter(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("127.0.0.1:0", mse.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Start()
+	l.Add(seed)
+	seed.Start()
+	defer seed.Stop()
+
+	dl, err := New(context.Background(), m, Config{Dir: dlDir, PeerID: []byte("-GT0001-leechleechle"), Limiter: NewLimiter(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.Peers.Encryption = mse.Disabled
+	dl.Peers.Add(&peer.Peer{IP: []byte{127, 0, 0, 1}, Port: uint16(l.Port())})
+	dl.Start()
+	defer dl.Stop()
+	for deadline := time.Now().Add(30 * time.Second); dl.Stats().Done < int64(len(data)); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stalled at %d of %d bytes", dl.Stats().Done, len(data))
+		}
+	}
+	dl.Stop()
+	got, _ := os.ReadFile(filepath.Join(dlDir, "f"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+	for _, p := range seed.Peers.Peers() {
+		if p.Connected() && p.Choking() {
+			t.Error("seed still choking", p.Addr())
+		}
+	}
+}
+
+// addrConn a connection that says it's from addr
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestAcceptForgotten(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51413}},
+		{"ipv6 with a zone", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 51413, Zone: "eth0"}},
+		{"ipv4 in ipv6", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 51413}},
+		{"utp", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}},
+	}
+	for _, tt := range tests {
+		limiter := NewLimiter(1)
+		m := NewPeerManager(make([]byte, 20), []byte("-GT0001-acceptaccept"), limiter)
+		m.Start()
+		ours, theirs := net.Pipe()
+		theirs.Close() // the handshake fails straight away
+		m.Accept(addrConn{ours, tt.addr}, &peer.Handshake{}, false)
+		deadline := time.Now().Add(5 * time.Second)
+		for !m.drained() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !m.drained() {
+			t.Errorf("%s: still connected after it went", tt.name)
+		}
+		// its connection slot is free again
+		if !limiter.tryAcquire() {
+			t.Errorf("%s: connection slot leaked", tt.name)
+		}
+		m.Stop()
+	}
+}
@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+const (
+	pexInterval    = time.Minute
+	pexMinInterval = 45 * time.Second // messages arriving faster than this from one peer are ignored
+	pexMaxPeers    = 50               // added and dropped entries per message, both ways
+)
+
+// pex exchanges peer lists with connected peers using ut_pex (BEP 11).
+// It's never set up for private torrents.
+type pex struct {
+	peers *PeerManager
+
+	mu       sync.Mutex
+	sent     map[*peer.Peer]map[string]peer.PexPeer // what each peer has been told about
+	received map[*peer.Peer]time.Time
+}
+
+func newPex(peers *PeerManager) *pex {
+	return &pex{
+		peers:    peers,
+		sent:     make(map[*peer.Peer]map[string]peer.PexPeer),
+		received: make(map[*peer.Peer]time.Time),
+	}
+}
+
+func (x *pex) Name() string { return peer.PexExtension }
+
+// Handle adds the peers p tells us about to the candidate pool
+func (x *pex) Handle(p *peer.Peer, payload []byte) {
+	x.mu.Lock()
+	last, ok := x.received[p]
+	now := time.Now()
+	if ok && now.Sub(last) < pexMinInterval {
+		x.mu.Unlock()
+		return
+	}
+	x.received[p] = now
+	x.mu.Unlock()
+
+	msg, err := peer.ParsePex(payload)
+	if err != nil {
+		log.Printf("Bad pex message from %s :: %v", p.Addr(), err)
+		return
+	}
+	added := msg.Added
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+	candidates := make([]*peer.Peer, 0, len(added))
+	for _, pp := range added {
+		if pp.Port == 0 || pp.IP.IsUnspecified() {
+			continue
+		}
+		candidates = append(candidates, &peer.Peer{IP: pp.IP, Port: pp.Port})
+	}
+	x.peers.Add(candidates...)
+}
+
+// run broadcasts every pexInterval until ctx is done
+func (x *pex) run(ctx context.Context) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			x.broadcast()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// broadcast sends every peer supporting ut_pex the peers added and dropped since its last message
+func (x *pex) broadcast() {
+	connected := make(map[string]peer.PexPeer)
+	var recipients []*peer.Peer
+	for _, p := range x.peers.Peers() {
+		if !p.Connected() {
+			continue
+		}
+		if p.SupportsExtension(peer.PexExtension) {
+			recipients = append(recipients, p)
+		}
+		if p.Incoming {
+			// we only know the port it connected from, not the one it listens on
+			continue
+		}
+		// we dialed it, so it accepts incoming connections
+		flags := byte(peer.PexReachable)
+		if p.Seed() {
+			flags |= peer.PexSeed
+		}
+		if p.Encrypted {
+			flags |= peer.PexEncryption
+		}
+		if p.Transport == "utp" {
+			flags |= peer.PexUTP
+		}
+		connected[p.Addr()] = peer.PexPeer{IP: p.IP, Port: p.Port, Flags: flags}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sent := make(map[*peer.Peer]map[string]peer.PexPeer, len(recipients))
+	for _, p := range recipients {
+		known := x.sent[p]
+		if known == nil {
+			known = make(map[string]peer.PexPeer)
+		}
+		msg := &peer.PexMessage{}
+		for addr, pp := range connected {
+			if len(msg.Added) == pexMaxPeers {
+				break
+			}
+			if _, ok := known[addr]; !ok && addr != p.Addr() {
+				msg.Added = append(msg.Added, pp)
+			}
+		}
+		for addr, pp := range known {
+			if len(msg.Dropped) == pexMaxPeers {
+				break
+			}
+			if _, ok := connected[addr]; !ok {
+				msg.Dropped = append(msg.Dropped, pp)
+			}
+		}
+		sent[p] = known
+		if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+			continue
+		}
+		payload, err := msg.Marshal()
+		if err != nil {
+			log.Printf("Couldn't encode pex message :: %v", err)
+			continue
+		}
+		if err := p.SendExtended(peer.PexExtension, payload); err != nil {
+			continue
+		}
+		for _, pp := range msg.Added {
+			known[pp.Addr()] = pp
+		}
+		for _, pp := range msg.Dropped {
+			delete(known, pp.Addr())
+		}
+	}
+	// forget the state of peers that went away
+	x.sent = sent
+	for p := range x.received {
+		if _, ok := sent[p]; !ok {
+			delete(x.received, p)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/bitfield"
+	"github.com/mbags/gtc/pkg/diskio"
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/metainfo"
+	"github.com/mbags/gtc/pkg/peer"
+	"github.com/mbags/gtc/pkg/storage"
+)
+
+// partial a piece being downloaded
+type partial struct {
+	data      []byte
+	requested []bool // per block
+	received  []bool
+	remaining int
+	// per block, who it was last asked of and when, for urgent pieces to ask again
+	from        []*peer.Peer
+	requestedAt []time.Time
+}
+
+// picker decides which blocks to request from which peer, assembles them into
+// pieces and queues verified pieces to be written. It implements
+// peer.Downloader and, to serve what it has downloaded, peer.Uploader.
+type picker struct {
+	m      *metainfo.MetaInfo
+	store  *storage.Storage
+	disk   *diskio.Cache // reads and writes of verified pieces, checking reads store directly
+	events *event.Bus
+
+	mu        sync.Mutex
+	have      bitfield.Bitfield
+	partials  map[uint32]*partial
+	filePrio  []Priority
+	piecePrio []Priority // the highest priority of the files in each piece
+	avail     []int      // per piece, how many connected peers have it
+	want      [PriorityHigh + 1]wanted
+	streams   map[*Reader]stream
+	urgent    []int      // pieces with deadlines, soonest first
+	verified  *sync.Cond // broadcast when a piece is verified, for readers waiting on it
+
+	stopped              bool  // the torrent stopped, nothing more will be verified
+	halted               error // the torrent is paused or failed, waiting readers give up with it
+	downloaded, uploaded int64 // payload bytes over the torrent's lifetime
+	verifiedPieces       int   // pieces downloaded and verified since the torrent started
+	hashFailures         int
+	// returned is called when blocks became requestable again, so idle
+	// peers should be woken. It mustn't block.
+	returned func()
+	// completed is called with each newly verified piece
+	completed func(index int)
+	// failed is called when a verified piece couldn't be written
+	failed func(err error)
+}
+
+func newPicker(m *metainfo.MetaInfo, store *storage.Storage, disk *diskio.Cache) *picker {
+	pk := &picker{
+		m:         m,
+		store:     store,
+		disk:      disk,
+		have:      bitfield.New(m.NumPieces()),
+		partials:  make(map[uint32]*partial),
+		filePrio:  make([]Priority, len(m.Files)),
+		piecePrio: make([]Priority, m.NumPieces()),
+		avail:     make([]int, m.NumPieces()),
+		streams:   make(map[*Reader]stream),
+	}
+	pk.verified = sync.NewCond(&pk.mu)
+	// what was held back while the disk caught up can be asked for now
+	disk.Drained = pk.wake
+	for i := range pk.filePrio {
+		pk.filePrio[i] = PriorityNormal
+	}
+	pk.updatePiecePriorities()
+	return pk
+}
+
+func (pk *picker) filePriority(i int) Priority {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return pk.filePrio[i]
+}
+
+func (pk *picker) setFilePriority(i int, p Priority) {
+	pk.mu.Lock()
+	raised := p > pk.filePrio[i]
+	pk.filePrio[i] = p
+	pk.updatePiecePriorities()
+	for index := range pk.partials {
+		if pk.piecePrio[index] == PrioritySkip && !pk.isUrgent(int(index)) {
+			// blocks still on their way are dropped when they arrive
+			delete(pk.partials, index)
+		}
+	}
+	pk.mu.Unlock()
+	if raised {
+		pk.wake()
+	}
+}
+
+// updatePiecePriorities derives piece priorities from file priorities, caller holds mu
+func (pk *picker) updatePiecePriorities() {
+	for i := range pk.piecePrio {
+		pk.piecePrio[i] = PrioritySkip
+	}
+	offset := int64(0)
+	for i, f := range pk.m.Files {
+		if f.Length > 0 {
+			first, last := offset/pk.m.PieceLength, (offset+f.Length-1)/pk.m.PieceLength
+			for piece := first; piece <= last; piece++ {
+				if pk.filePrio[i] > pk.piecePrio[piece] {
+					pk.piecePrio[piece] = pk.filePrio[i]
+				}
+			}
+		}
+		offset += f.Length
+	}
+	for prio := range pk.want {
+		pk.want[prio] = nil
+	}
+	for i := range pk.piecePrio {
+		if pk.wants(i) {
+			pk.want[pk.piecePrio[i]].add(i, pk.avail[i])
+		}
+	}
+}
+
+// wanted the pieces of one priority we lack, by how many connected peers have them
+type wanted []map[int]bool
+
+func (w *wanted) add(i, avail int) {
+	for len(*w) <= avail {
+		*w = append(*w, make(map[int]bool))
+	}
+	(*w)[avail][i] = true
+}
+
+func (w wanted) remove(i, avail int) {
+	if avail < len(w) {
+		delete(w[avail], i)
+	}
+}
+
+// wants reports whether piece i is one to download, caller holds mu
+func (pk *picker) wants(i int) bool {
+	return !pk.have.IsSet(i) && pk.piecePrio[i] != PrioritySkip
+}
+
+// setHave marks piece i as had or not, taking it out of or putting it back
+// in the wanted pieces, caller holds mu
+func (pk *picker) setHave(i int, have bool) {
+	if pk.wants(i) {
+		pk.want[pk.piecePrio[i]].remove(i, pk.avail[i])
+	}
+	if have {
+		pk.have.Set(i)
+	} else {
+		pk.have.Clear(i)
+	}
+	if pk.wants(i) {
+		pk.want[pk.piecePrio[i]].add(i, pk.avail[i])
+	}
+}
+
+// setAvail records that n connected peers have piece i, caller holds mu
+func (pk *picker) setAvail(i, n int) {
+	if pk.wants(i) {
+		pk.want[pk.piecePrio[i]].remove(i, pk.avail[i])
+		pk.want[pk.piecePrio[i]].add(i, n)
+	}
+	pk.avail[i] = n
+}
+
+// Have counts piece index as had by one more peer
+func (pk *picker) Have(p *peer.Peer, index int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if index >= 0 && index < len(pk.avail) {
+		pk.setAvail(index, pk.avail[index]+1)
+	}
+}
+
+// Replaced counts the pieces p has anew
+func (pk *picker) Replaced(p *peer.Peer, had, has bitfield.Bitfield) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := range pk.avail {
+		switch before, now := had.IsSet(i), has.IsSet(i); {
+		case now && !before:
+			pk.setAvail(i, pk.avail[i]+1)
+		case before && !now:
+			pk.setAvail(i, pk.avail[i]-1)
+		}
+	}
+}
+
+func (pk *picker) numBlocks(index int) int {
+	return int((pk.m.PieceSize(index) + peer.BlockSize - 1) / peer.BlockSize)
+}
+
+// NextRequest prefers finishing pieces already in progress, then pieces the
+// peer suggested, then of the pieces the peer has that we lack, those of the
+// highest priority and of them the rarest, the one fewest connected peers
+// have. Equally rare pieces are picked between at random. Nothing is
+// requested while the disk is behind.
+func (pk *picker) NextRequest(p *peer.Peer) (peer.Request, bool) {
+	if pk.disk.Full() {
+		return peer.Request{}, false
+	}
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for index, pt := range pk.partials {
+		if !p.Requestable(int(index)) {
+			continue
+		}
+		if req, ok := pk.nextBlock(p, index, pt); ok {
+			return req, true
+		}
+	}
+	for _, i := range pk.urgent {
+		if pt, ok := pk.partials[uint32(i)]; ok {
+			if p.Requestable(i) {
+				if req, ok := pk.nextBlock(p, uint32(i), pt); ok {
+					return req, true
+				}
+				if req, ok := pk.overdueBlock(p, uint32(i), pt); ok {
+					return req, true
+				}
+			}
+		} else if req, ok := pk.start(p, i); ok {
+			return req, true
+		}
+	}
+	suggested := p.Suggested()
+	for i := len(suggested) - 1; i >= 0; i-- {
+		if req, ok := pk.start(p, int(suggested[i])); ok {
+			return req, true
+		}
+	}
+	for prio := PriorityHigh; prio > PrioritySkip; prio-- {
+		// map order is random, and so which of equally rare pieces comes first
+		for _, pieces := range pk.want[prio] {
+			for i := range pieces {
+				if req, ok := pk.start(p, i); ok {
+					return req, true
+				}
+			}
+		}
+	}
+	return peer.Request{}, false
+}
+
+// start begins downloading piece i from p if we need it and p can give it to us, caller holds mu
+func (pk *picker) start(p *peer.Peer, i int) (peer.Request, bool) {
+	if i >= pk.m.NumPieces() || pk.have.IsSet(i) || !p.Requestable(i) {
+		return peer.Request{}, false
+	}
+	if pk.piecePrio[i] == PrioritySkip && !pk.isUrgent(i) {
+		return peer.Request{}, false
+	}
+	index := uint32(i)
+	if _, ok := pk.partials[index]; ok {
+		return peer.Request{}, false
+	}
+	n := pk.numBlocks(i)
+	pt := &partial{
+		data:        make([]byte, pk.m.PieceSize(i)),
+		requested:   make([]bool, n),
+		received:    make([]bool, n),
+		remaining:   n,
+		from:        make([]*peer.Peer, n),
+		requestedAt: make([]time.Time, n),
+	}
+	pk.partials[index] = pt
+	return pk.nextBlock(p, index, pt)
+}
+
+// nextBlock the first block of the piece not yet asked for, to ask p for
+func (pk *picker) nextBlock(p *peer.Peer, index uint32, pt *partial) (peer.Request, bool) {
+	for b, requested := range pt.requested {
+		if requested {
+			continue
+		}
+		return pt.request(p, index, b), true
+	}
+	return peer.Request{}, false
+}
+
+// overdueBlock a block of an urgent piece that another peer has been asked
+// for urgentTimeout ago without sending it, to ask p for as well. Whichever
+// copy arrives second is dropped.
+func (pk *picker) overdueBlock(p *peer.Peer, index uint32, pt *partial) (peer.Request, bool) {
+	now := time.Now()
+	for b, requested := range pt.requested {
+		if !requested || pt.received[b] || pt.from[b] == p || now.Sub(pt.requestedAt[b]) < urgentTimeout {
+			continue
+		}
+		return pt.request(p, index, b), true
+	}
+	return peer.Request{}, false
+}
+
+// request marks block b as asked of p and returns the request for it
+func (pt *partial) request(p *peer.Peer, index uint32, b int) peer.Request {
+	pt.requested[b] = true
+	pt.from[b], pt.requestedAt[b] = p, time.Now()
+	begin := b * peer.BlockSize
+	length := peer.BlockSize
+	if rest := len(pt.data) - begin; rest < length {
+		length = rest
+	}
+	return peer.Request{Index: index, Begin: uint32(begin), Length: uint32(length)}
+}
+
+// Received stores a block and verifies the piece once it's complete
+func (pk *picker) Received(p *peer.Peer, block peer.Piece) {
+	pk.mu.Lock()
+	pk.downloaded += int64(len(block.Block))
+	pt, ok := pk.partials[block.Index]
+	b := int(block.Begin / peer.BlockSize)
+	if !ok || pt.received[b] {
+		pk.mu.Unlock()
+		return
+	}
+	copy(pt.data[block.Begin:], block.Block)
+	pt.received[b] = true
+	pt.remaining--
+	if pt.remaining > 0 {
+		pk.mu.Unlock()
+		return
+	}
+	delete(pk.partials, block.Index)
+	pk.mu.Unlock()
+
+	pk.finish(int(block.Index), pt.data)
+}
+
+// finish verifies a complete piece and queues it to be written. It counts
+// as had straight away, reads see it in the cache until it's on disk, and
+// stops counting if the write fails.
+func (pk *picker) finish(index int, data []byte) {
+	sum := sha1.Sum(data)
+	if !bytes.Equal(sum[:], pk.m.PieceHash(index)) {
+		log.Printf("Piece %d failed hash check", index)
+		pk.mu.Lock()
+		pk.hashFailures++
+		pk.mu.Unlock()
+		pk.publish(event.Event{Type: event.HashFailed, Piece: index})
+		pk.wake()
+		return
+	}
+	// marked before the write is queued, a failing write may call back first
+	pk.mu.Lock()
+	pk.setHave(index, true)
+	pk.verifiedPieces++
+	pk.verified.Broadcast()
+	pk.mu.Unlock()
+	pk.disk.WritePiece(index, data, func(err error) {
+		if err == nil {
+			return
+		}
+		log.Printf("Couldn't write piece %d: %v", index, err)
+		pk.mu.Lock()
+		pk.setHave(index, false)
+		pk.verifiedPieces--
+		pk.mu.Unlock()
+		pk.publish(event.Event{Type: event.StorageError, Piece: index, Err: err})
+		if pk.failed != nil {
+			pk.failed(err)
+		}
+		pk.wake()
+	})
+	pk.mu.Lock()
+	had := pk.have.IsSet(index)
+	pk.mu.Unlock()
+	if !had {
+		// the write already failed, don't announce it
+		return
+	}
+	log.Printf("Piece %d complete", index)
+	pk.publish(event.Event{Type: event.PieceCompleted, Piece: index})
+	if pk.completed != nil {
+		pk.completed(index)
+	}
+}
+
+// check hashes the data already in storage, marking the pieces that pass
+// as had. Pieces that are missing or short are left to be downloaded.
+func (pk *picker) check(ctx context.Context) error {
+	buf := make([]byte, pk.m.PieceLength)
+	for i := 0; i < pk.m.NumPieces(); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b := buf[:pk.m.PieceSize(i)]
+		_, err := pk.store.ReadAt(b, int64(i)*pk.m.PieceLength)
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			pk.publish(event.Event{Type: event.StorageError, Piece: i, Err: err})
+			return err
+		}
+		sum := sha1.Sum(b)
+		if !bytes.Equal(sum[:], pk.m.PieceHash(i)) {
+			continue
+		}
+		pk.mu.Lock()
+		pk.setHave(i, true)
+		pk.verified.Broadcast()
+		pk.mu.Unlock()
+	}
+	return nil
+}
+
+// complete reports whether every piece is verified
+func (pk *picker) complete() bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return pk.have.Count() == pk.m.NumPieces()
+}
+
+// halt has readers waiting for pieces give up with err while the torrent is
+// paused or failed, nil lets them wait again
+func (pk *picker) halt(err error) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.halted = err
+	pk.verified.Broadcast()
+}
+
+// stop wakes readers waiting for pieces that will now never arrive, then
+// waits for the verified pieces still queued to be written
+func (pk *picker) stop() error {
+	pk.mu.Lock()
+	pk.stopped = true
+	pk.verified.Broadcast()
+	pk.mu.Unlock()
+	return pk.disk.Flush()
+}
+
+func (pk *picker) publish(e event.Event) {
+	e.InfoHash = fmt.Sprintf("%x", pk.m.InfoHash)
+	pk.events.Publish(e)
+}
+
+// Returned makes blocks requestable again
+func (pk *picker) Returned(p *peer.Peer, reqs []peer.Request) {
+	pk.mu.Lock()
+	for _, req := range reqs {
+		if pt, ok := pk.partials[req.Index]; ok {
+			b := int(req.Begin / peer.BlockSize)
+			if !pt.received[b] {
+				pt.requested[b] = false
+			}
+		}
+	}
+	pk.mu.Unlock()
+	pk.wake()
+}
+
+// wake has idle peers look for blocks to request, without blocking
+func (pk *picker) wake() {
+	if pk.returned != nil {
+		pk.returned()
+	}
+}
+
+// HavePieces a copy of the pieces we have
+func (pk *picker) HavePieces() bitfield.Bitfield {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	bits := make([]byte, len(pk.have.Bits))
+	copy(bits, pk.have.Bits)
+	return bitfield.Bitfield{Bits: bits}
+}
+
+// ReadBlock reads a requested block back from the disk cache
+func (pk *picker) ReadBlock(req peer.Request) ([]byte, error) {
+	pk.mu.Lock()
+	have := pk.have.IsSet(int(req.Index))
+	pk.mu.Unlock()
+	if !have || int(req.Index) >= pk.m.NumPieces() || int64(req.Begin)+int64(req.Length) > pk.m.PieceSize(int(req.Index)) {
+		return nil, fmt.Errorf("invalid request for piece %d at %d", req.Index, req.Begin)
+	}
+	block := make([]byte, req.Length)
+	if _, err := pk.disk.ReadAt(block, int64(req.Index)*pk.m.PieceLength+int64(req.Begin)); err != nil {
+		pk.publish(event.Event{Type: event.StorageError, Piece: int(req.Index), Err: err})
+		return nil, err
+	}
+	pk.mu.Lock()
+	pk.uploaded += int64(len(block))
+	pk.mu.Unlock()
+	return block, nil
+}
@@ -0,0 +1,192 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mbags/gtc/pkg/bitfield"
+	"github.com/mbags/gtc/pkg/diskio"
+	"github.com/mbags/gtc/pkg/metainfo"
+	"github.com/mbags/gtc/pkg/peer"
+)
+
+// failingStore a diskio.Store whose writes all fail
+type failingStore struct{}
+
+func (failingStore) ReadAt(p []byte, off int64) (int, error)  { return 0, errors.New("read failed") }
+func (failingStore) WriteAt(p []byte, off int64) (int, error) { return 0, errors.New("write failed") }
+
+func TestFinishFailedWrite(t *testing.T) {
+	data := []byte("piece")
+	sum := sha1.Sum(data)
+	m := &metainfo.MetaInfo{Name: "t", Files: []metainfo.File{{Length: int64(len(data))}}}
+	m.PieceLength, m.Pieces = int64(len(data)), sum[:]
+	for i := 0; i < 100; i++ {
+		pk := newPicker(m, nil, diskio.NewCache(failingStore{}, diskio.NewPool(1), m))
+		var announced, failed atomic.Int32
+		pk.completed = func(int) { announced.Add(1) }
+		pk.failed = func(error) { failed.Add(1) }
+		pk.finish(0, data)
+		// stopping reports it, as it does for the torrent
+		if err := pk.stop(); err == nil {
+			t.Fatal("write didn't fail")
+		}
+		// the callback runs on the pool after the write is off the queue
+		for deadline := time.Now().Add(5 * time.Second); failed.Load() == 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		pk.mu.Lock()
+		had, verified := pk.have.IsSet(0), pk.verifiedPieces
+		pk.mu.Unlock()
+		if had || verified != 0 || failed.Load() != 1 {
+			t.Fatalf("had %v, %d verified, failed %d times", had, verified, failed.Load())
+		}
+		if announced.Load() > 1 {
+			t.Fatal("announced twice")
+		}
+	}
+}
+
+// seedingPeer a peer that has all n pieces and isn't choking us
+func seedingPeer(n int) *peer.Peer {
+	bf := bitfield.New(n)
+	bf.SetAll(n)
+	return &peer.Peer{Bitfield: bf}
+}
+
+func TestOverdueBlock(t *testing.T) {
+	m := &metainfo.MetaInfo{Name: "t", Files: []metainfo.File{{Length: 2 * peer.BlockSize}}}
+	m.PieceLength, m.Pieces = 2*peer.BlockSize, make([]byte, 20)
+	tests := []struct {
+		name     string
+		age      time.Duration // since both blocks were asked of the first peer
+		same     bool          // the first peer asks again
+		received bool          // the first block arrived
+		want     bool
+		begin    uint32
+	}{
+		{"not overdue", time.Second, false, false, false, 0},
+		{"overdue", urgentTimeout + time.Second, false, false, true, 0},
+		{"overdue, same peer", urgentTimeout + time.Second, true, false, false, 0},
+		{"first block arrived", urgentTimeout + time.Second, false, true, true, peer.BlockSize},
+	}
+	for _, tt := range tests {
+		pk := newPicker(m, nil, diskio.NewCache(failingStore{}, diskio.NewPool(1), m))
+		pk.urgent = []int{0}
+		slow, fast := seedingPeer(1), seedingPeer(1)
+		pk.NextRequest(slow)
+		pk.NextRequest(slow)
+		pt := pk.partials[0]
+		for b := range pt.requestedAt {
+			pt.requestedAt[b] = time.Now().Add(-tt.age)
+		}
+		pt.received[0] = tt.received
+		p := fast
+		if tt.same {
+			p = slow
+		}
+		req, ok := pk.NextRequest(p)
+		if ok != tt.want || ok && req.Begin != tt.begin {
+			t.Errorf("%s: got %+v %v", tt.name, req, ok)
+		}
+	}
+}
+
+func TestWaitHalted(t *testing.T) {
+	m := &metainfo.MetaInfo{Name: "t", Files: []metainfo.File{{Length: 10}}}
+	m.PieceLength, m.Pieces = 10, make([]byte, 20)
+	failure := errors.New("disk on fire")
+	tests := []struct {
+		name   string
+		change func(pk *picker)
+		want   error
+	}{
+		{"paused", func(pk *picker) { pk.halt(ErrPaused) }, ErrPaused},
+		{"failed", func(pk *picker) { pk.halt(failure) }, failure},
+		{"stopped", func(pk *picker) { pk.stop() }, ErrStopped},
+		{"verified", func(pk *picker) {
+			pk.mu.Lock()
+			pk.have.Set(0)
+			pk.verified.Broadcast()
+			pk.mu.Unlock()
+		}, nil},
+	}
+	for _, tt := range tests {
+		pk := newPicker(m, nil, diskio.NewCache(failingStore{}, diskio.NewPool(1), m))
+		errc := make(chan error, 1)
+		go func() { errc <- pk.wait(&Reader{}, 0) }()
+		time.Sleep(10 * time.Millisecond)
+		tt.change(pk)
+		select {
+		case err := <-errc:
+			if err != tt.want {
+				t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: still waiting", tt.name)
+		}
+	}
+}
+
+func TestRarestFirst(t *testing.T) {
+	m := &metainfo.MetaInfo{Name: "t", Files: []metainfo.File{{Length: 3 * peer.BlockSize}, {Length: peer.BlockSize}}}
+	m.PieceLength, m.Pieces = peer.BlockSize, make([]byte, 4*20)
+	tests := []struct {
+		name   string
+		others [][]int  // the pieces other connected peers have
+		gone   int      // of the others, how many disconnect again
+		have   []int    // pieces we have
+		prio   Priority // of the second file, piece 3
+		want   [][]int  // pieces in the order they're started, any order within a group
+	}{
+		{"no others", nil, 0, nil, PriorityNormal, [][]int{{0, 1, 2, 3}}},
+		{"rarest first", [][]int{{0, 1}, {1}, {1, 2}}, 0, nil, PriorityNormal, [][]int{{3}, {0, 2}, {1}}},
+		{"disconnected", [][]int{{0, 1}, {1, 2}, {0, 3}, {0, 3}}, 2, nil, PriorityNormal, [][]int{{1, 2}, {0, 3}}},
+		{"priority before rarity", [][]int{{0, 1, 2}}, 0, nil, PriorityHigh, [][]int{{3}, {0, 1, 2}}},
+		{"low priority last", [][]int{{3}, {3}}, 0, nil, PriorityLow, [][]int{{0, 1, 2}, {3}}},
+		{"skipped", nil, 0, nil, PrioritySkip, [][]int{{0, 1, 2}}},
+		{"had", [][]int{{1}}, 0, []int{0, 2}, PriorityNormal, [][]int{{3}, {1}}},
+	}
+	for _, tt := range tests {
+		pk := newPicker(m, nil, diskio.NewCache(failingStore{}, diskio.NewPool(1), m))
+		pk.filePrio[1] = tt.prio
+		pk.updatePiecePriorities()
+		for _, i := range tt.have {
+			pk.setHave(i, true)
+		}
+		for n, pieces := range tt.others {
+			other := &peer.Peer{}
+			bf := bitfield.New(4)
+			pk.Replaced(other, other.Bitfield, bf)
+			for _, i := range pieces {
+				bf.Set(i)
+				pk.Have(other, i)
+			}
+			if n < tt.gone {
+				pk.Replaced(other, bf, bitfield.Bitfield{})
+			}
+		}
+		p := seedingPeer(4)
+		pk.Replaced(p, bitfield.Bitfield{}, p.Bitfield)
+		for _, group := range tt.want {
+			left := make(map[int]bool)
+			for _, i := range group {
+				left[i] = true
+			}
+			for range group {
+				req, ok := pk.NextRequest(p)
+				if !ok || !left[int(req.Index)] {
+					t.Errorf("%s: started %d %v, want one of %v", tt.name, req.Index, ok, group)
+					break
+				}
+				delete(left, int(req.Index))
+			}
+		}
+		if req, ok := pk.NextRequest(p); ok {
+			t.Errorf("%s: started %d after all wanted pieces", tt.name, req.Index)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/mbags/gtc/pkg/event"
+)
+
+// Priority how eagerly a file's pieces are downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota // not downloaded and not created on disk
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority the Priority named s
+func ParsePriority(s string) (Priority, error) {
+	for p := PrioritySkip; p <= PriorityHigh; p++ {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+// SetFilePriority sets the priority of file i. A piece is downloaded with the
+// highest priority of the files it holds bytes of, so the parts of skipped
+// files sharing a piece with a wanted one still arrive and go to the partfile.
+// A skipped file wanted again is allocated, and if the disk hasn't room for it
+// the error, wrapping storage.ErrDiskFull, comes back with the priority set.
+func (t *Torrent) SetFilePriority(i int, p Priority) error {
+	if !t.HasInfo() {
+		return ErrNoMetadata
+	}
+	if i < 0 || i >= len(t.MetaInfo.Files) {
+		return fmt.Errorf("no file %d in %s", i, t.MetaInfo.Name)
+	}
+	if t.MetaInfo.Files[i].Padding() {
+		return fmt.Errorf("file %d of %s is padding", i, t.MetaInfo.Name)
+	}
+	if p < PrioritySkip || p > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", p)
+	}
+	wasSkipped := t.picker.filePriority(i) == PrioritySkip
+	if err := t.Storage.Skip(i, p == PrioritySkip); err != nil {
+		return err
+	}
+	t.picker.setFilePriority(i, p)
+	t.publish(event.Event{Type: event.FilePriorityChanged, File: i, Priority: p.String()})
+	t.mu.Lock()
+	// until then, checking allocates everything wanted
+	checked := t.checked
+	t.mu.Unlock()
+	if wasSkipped && p != PrioritySkip && checked {
+		return t.Storage.Allocate()
+	}
+	return nil
+}
+
+// FilePriority the priority of file i
+func (t *Torrent) FilePriority(i int) Priority {
+	if !t.HasInfo() {
+		return PriorityNormal
+	}
+	return t.picker.filePriority(i)
+}
@@ -0,0 +1,239 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReadahead how far ahead of the read position a Reader has pieces fetched
+const DefaultReadahead = 4 << 20
+
+// readaheadStep how much later each piece further from the read position is
+// needed, so the nearest pieces are requested first
+const readaheadStep = 100 * time.Millisecond
+
+// urgentTimeout how long a block of a piece a Reader wants may be outstanding
+// with one peer before it's asked of another as well
+const urgentTimeout = 3 * time.Second
+
+var errReaderClosed = errors.New("torrent: reader closed")
+
+// stream the pieces a Reader wants soon
+type stream struct {
+	first, last int // pieces from the read position to the end of the readahead window
+	at          time.Time
+}
+
+// Reader streams one file of a torrent while it downloads. Pieces just ahead of
+// the read position get deadlines that put them before everything else, and
+// Read blocks until the piece it needs has arrived and been verified. A Reader
+// isn't safe for concurrent use, except that Close unblocks a waiting Read.
+type Reader struct {
+	t              *Torrent
+	offset, length int64 // the file's place in the torrent's byte stream
+
+	pos       int64
+	readahead int64
+	closed    atomic.Bool
+}
+
+// NewReader returns a Reader positioned at the start of file fileIndex
+func (t *Torrent) NewReader(fileIndex int) (*Reader, error) {
+	if !t.HasInfo() {
+		return nil, ErrNoMetadata
+	}
+	files := t.MetaInfo.Files
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("no file %d in %s", fileIndex, t.MetaInfo.Name)
+	}
+	offset := int64(0)
+	for _, f := range files[:fileIndex] {
+		offset += f.Length
+	}
+	return &Reader{t: t, offset: offset, length: files[fileIndex].Length, readahead: DefaultReadahead}, nil
+}
+
+// SetReadahead sets how many bytes past the read position are fetched early
+func (r *Reader) SetReadahead(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	r.readahead = n
+	r.want()
+}
+
+// want tells the picker which pieces the reader needs next
+func (r *Reader) want() {
+	if r.closed.Load() || r.pos >= r.length {
+		r.t.picker.removeStream(r)
+		return
+	}
+	pl := r.t.MetaInfo.PieceLength
+	end := r.pos + r.readahead
+	if end > r.length {
+		end = r.length
+	}
+	first := int((r.offset + r.pos) / pl)
+	last := first
+	if end > r.pos {
+		last = int((r.offset + end - 1) / pl)
+	}
+	r.t.picker.setStream(r, first, last)
+}
+
+// Read reads from the file, waiting for the pieces it covers to be downloaded
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.closed.Load() {
+		return 0, errReaderClosed
+	}
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.want()
+	pl := r.t.MetaInfo.PieceLength
+	global := r.offset + r.pos
+	piece := int(global / pl)
+	if err := r.t.picker.wait(r, piece); err != nil {
+		return 0, err
+	}
+	n := int64(len(p))
+	if rest := int64(piece+1)*pl - global; n > rest {
+		n = rest
+	}
+	if rest := r.length - r.pos; n > rest {
+		n = rest
+	}
+	m, err := r.t.picker.disk.ReadAt(p[:n], global)
+	r.pos += int64(m)
+	return m, err
+}
+
+// Seek sets the read position, part of io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed.Load() {
+		return 0, errReaderClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, fmt.Errorf("torrent: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("torrent: negative position %d", offset)
+	}
+	r.pos = offset
+	r.want()
+	return offset, nil
+}
+
+// Close drops the reader's deadlines and wakes a Read waiting on a piece
+func (r *Reader) Close() error {
+	r.closed.Store(true)
+	r.t.picker.removeStream(r)
+	return nil
+}
+
+func (pk *picker) setStream(r *Reader, first, last int) {
+	pk.mu.Lock()
+	s, ok := pk.streams[r]
+	if ok && s.first == first && s.last == last {
+		pk.mu.Unlock()
+		return
+	}
+	pk.streams[r] = stream{first: first, last: last, at: time.Now()}
+	pk.updateUrgent()
+	pk.mu.Unlock()
+	// idle peers may have something to fetch now
+	pk.wake()
+}
+
+func (pk *picker) removeStream(r *Reader) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if _, ok := pk.streams[r]; ok {
+		delete(pk.streams, r)
+		pk.updateUrgent()
+	}
+	// a Read of a closed reader may be waiting
+	pk.verified.Broadcast()
+}
+
+// updateUrgent orders the pieces streams want by deadline, a piece wanted by
+// several streams taking the earliest, caller holds mu
+func (pk *picker) updateUrgent() {
+	deadlines := make(map[int]time.Time)
+	for _, s := range pk.streams {
+		for i := s.first; i <= s.last && i < pk.m.NumPieces(); i++ {
+			d := s.at.Add(time.Duration(i-s.first) * readaheadStep)
+			if old, ok := deadlines[i]; !ok || d.Before(old) {
+				deadlines[i] = d
+			}
+		}
+	}
+	pk.urgent = pk.urgent[:0]
+	for i := range deadlines {
+		pk.urgent = append(pk.urgent, i)
+	}
+	sort.Slice(pk.urgent, func(a, b int) bool {
+		return deadlines[pk.urgent[a]].Before(deadlines[pk.urgent[b]])
+	})
+}
+
+// isUrgent reports whether a stream wants piece i, caller holds mu
+func (pk *picker) isUrgent(i int) bool {
+	for _, u := range pk.urgent {
+		if u == i {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until piece i is verified, r is closed or the torrent stops,
+// pauses or fails
+func (pk *picker) wait(r *Reader, i int) error {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if pk.have.IsSet(i) {
+		return nil
+	}
+	// idle peers are woken now and then to take over blocks overdue elsewhere
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		tick := time.NewTicker(urgentTimeout)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				pk.wake()
+			case <-done:
+				return
+			}
+		}
+	}()
+	for !pk.have.IsSet(i) {
+		if r.closed.Load() {
+			return errReaderClosed
+		}
+		if pk.stopped {
+			return ErrStopped
+		}
+		if pk.halted != nil {
+			return pk.halted
+		}
+		pk.verified.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/metainfo"
+	"github.com/mbags/gtc/pkg/storage"
+)
+
+// ResumeData what it takes to carry on with a torrent after a restart, short
+// of the data itself, which is checked again
+type ResumeData struct {
+	InfoHash   string         `json:"info_hash"` // hex
+	Name       string         `json:"name,omitempty"`
+	Trackers   [][]string     `json:"trackers,omitempty"`
+	Info       []byte         `json:"info,omitempty"` // the info dictionary, nil while a magnet link's is fetched
+	Dir        string         `json:"dir"`
+	Files      map[int]string `json:"files,omitempty"`      // renamed files by index, slash separated under Dir
+	Priorities map[int]string `json:"priorities,omitempty"` // files not at normal priority by index, see Priority
+	Paused     bool           `json:"paused,omitempty"`
+	Allocation string         `json:"allocation,omitempty"` // sparse, full or compact
+}
+
+// ResumeData the torrent's resume data as it is now
+func (t *Torrent) ResumeData() ResumeData {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rd := ResumeData{
+		InfoHash:   fmt.Sprintf("%x", t.MetaInfo.InfoHash),
+		Name:       t.MetaInfo.Name,
+		Trackers:   t.trackerTiers(),
+		Dir:        t.dir,
+		Paused:     t.state == StatePaused,
+		Allocation: t.alloc.String(),
+	}
+	if abs, err := filepath.Abs(t.dir); err == nil {
+		rd.Dir = abs
+	}
+	if t.hasInfo {
+		rd.Info = t.MetaInfo.InfoBytes
+		t.picker.mu.Lock()
+		for i, p := range t.picker.filePrio {
+			if p != PriorityNormal {
+				if rd.Priorities == nil {
+					rd.Priorities = make(map[int]string)
+				}
+				rd.Priorities[i] = p.String()
+			}
+		}
+		t.picker.mu.Unlock()
+	}
+	if len(t.renamed) > 0 {
+		rd.Files = make(map[int]string, len(t.renamed))
+		for i, p := range t.renamed {
+			rd.Files[i] = p
+		}
+	}
+	return rd
+}
+
+// NewFromResumeData returns a Torrent carrying on from rd, see New. Its
+// files are under rd.Dir, named, prioritised and allocated as rd says
+// whatever cfg says. It isn't paused, that's up to the caller.
+func NewFromResumeData(ctx context.Context, rd ResumeData, cfg Config) (*Torrent, error) {
+	hash, err := hex.DecodeString(rd.InfoHash)
+	if err != nil || len(hash) != 20 {
+		return nil, fmt.Errorf("torrent: bad info hash %q in resume data", rd.InfoHash)
+	}
+	m := &metainfo.MetaInfo{InfoHash: string(hash), Name: rd.Name, AnnounceList: rd.Trackers}
+	if rd.Info != nil {
+		if err := m.SetInfo(rd.Info); err != nil {
+			return nil, fmt.Errorf("torrent: %w", err)
+		}
+	}
+	cfg.Dir = rd.Dir
+	if rd.Allocation != "" {
+		if cfg.Allocation, err = storage.ParseAllocation(rd.Allocation); err != nil {
+			return nil, fmt.Errorf("torrent: %w", err)
+		}
+	}
+	t, err := New(ctx, m, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range rd.Files {
+		if err := t.RenameFile(i, p); err != nil {
+			t.Stop()
+			return nil, err
+		}
+	}
+	for i, name := range rd.Priorities {
+		p, err := ParsePriority(name)
+		if err == nil {
+			err = t.SetFilePriority(i, p)
+		}
+		if err != nil {
+			t.Stop()
+			return nil, fmt.Errorf("torrent: file %d: %w", i, err)
+		}
+	}
+	return t, nil
+}
+
+// MoveStorage moves the torrent's files to under dir while it keeps running,
+// renaming them or copying them across filesystems. Reads and writes go on
+// while they're copied, waiting only while the torrent switches over to dir.
+func (t *Torrent) MoveStorage(dir string) error {
+	if !t.HasInfo() {
+		return ErrNoMetadata
+	}
+	if err := t.Storage.Move(dir); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.dir = t.Storage.Dir()
+	t.mu.Unlock()
+	t.publish(event.Event{Type: event.StorageMoved, Path: dir})
+	return nil
+}
+
+// RenameFile moves file i to path, slash separated and relative to the
+// directory the torrent's files are under, where it's kept from then on
+func (t *Torrent) RenameFile(i int, path string) error {
+	if !t.HasInfo() {
+		return ErrNoMetadata
+	}
+	if i < 0 || i >= len(t.MetaInfo.Files) {
+		return fmt.Errorf("no file %d in %s", i, t.Name())
+	}
+	if t.MetaInfo.Files[i].Padding() {
+		return fmt.Errorf("file %d of %s is padding", i, t.Name())
+	}
+	if err := t.Storage.Rename(i, filepath.FromSlash(path)); err != nil {
+		return err
+	}
+	path = filepath.ToSlash(t.Storage.FilePath(i))
+	t.mu.Lock()
+	if t.renamed == nil {
+		t.renamed = make(map[int]string)
+	}
+	t.renamed[i] = path
+	t.mu.Unlock()
+	t.publish(event.Event{Type: event.FileRenamed, File: i, Path: path})
+	return nil
+}
@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+func TestResumePriorities(t *testing.T) {
+	var info bytes.Buffer
+	bencode.Marshal(&info, map[string]interface{}{
+		"name":         "r",
+		"piece length": 16 << 10,
+		"pieces":       string(make([]byte, 3*20)),
+		"files": []interface{}{
+			map[string]interface{}{"length": 16 << 10, "path": []interface{}{"a"}},
+			map[string]interface{}{"length": 16 << 10, "path": []interface{}{"b"}},
+			map[string]interface{}{"length": 16 << 10, "path": []interface{}{"c"}},
+		},
+	})
+	hash := sha1.Sum(info.Bytes())
+
+	tests := []struct {
+		name  string
+		set   map[int]Priority
+		saved string // the priorities in the resume data
+	}{
+		{"all normal", nil, "null"},
+		{"skipped", map[int]Priority{1: PrioritySkip}, `{"1":"skip"}`},
+		{"mixed", map[int]Priority{0: PriorityHigh, 1: PriorityNormal, 2: PrioritySkip}, `{"0":"high","2":"skip"}`},
+	}
+	for _, tt := range tests {
+		m := &metainfo.MetaInfo{InfoHash: string(hash[:])}
+		if err := m.SetInfo(info.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		cfg := Config{Dir: t.TempDir(), PeerID: []byte("-GT0001-resumeresume")}
+		tr, err := New(context.Background(), m, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range tt.set {
+			if err := tr.SetFilePriority(i, p); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		b, _ := json.Marshal(tr.ResumeData())
+		tr.Stop()
+		var rd ResumeData
+		json.Unmarshal(b, &rd)
+		if saved, _ := json.Marshal(rd.Priorities); string(saved) != tt.saved {
+			t.Errorf("%s: saved %s, want %s", tt.name, saved, tt.saved)
+		}
+
+		back, err := NewFromResumeData(context.Background(), rd, cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i := range m.Files {
+			want, ok := tt.set[i]
+			if !ok {
+				want = PriorityNormal
+			}
+			if got := back.FilePriority(i); got != want {
+				t.Errorf("%s: file %d restored as %v, want %v", tt.name, i, got, want)
+			}
+		}
+		back.Stop()
+	}
+}
@@ -0,0 +1,332 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mbags/gtc/pkg/event"
+)
+
+// State where a torrent is in its lifecycle
+type State int
+
+const (
+	StateChecking            State = iota // hashing data left on disk by an earlier run
+	StateDownloadingMetadata              // fetching the info dictionary of a magnet link from peers
+	StateDownloading
+	StateSeeding // has every piece
+	StatePaused  // disconnected from peers until Resume
+	StateStopped // shut down for good by Stop or its context
+	StateError   // Err says what went wrong, Resume carries on regardless
+)
+
+var stateNames = [...]string{"checking", "downloading_metadata", "downloading", "seeding", "paused", "stopped", "error"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// ErrStopped returned by a Reader whose torrent stopped before the data arrived
+var ErrStopped = errors.New("torrent: stopped")
+
+// ErrPaused returned by a Reader whose torrent was paused before the data arrived
+var ErrPaused = errors.New("torrent: paused")
+
+// State the torrent's current state
+func (t *Torrent) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Err the error that put the torrent in StateError, nil in any other state
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// setState moves the torrent to s and tells subscribers, caller holds mu
+func (t *Torrent) setState(s State) {
+	if t.state == s {
+		return
+	}
+	t.state = s
+	if t.picker != nil {
+		// a Reader waiting on a piece shouldn't block while none can arrive
+		switch s {
+		case StatePaused:
+			t.picker.halt(ErrPaused)
+		case StateError:
+			t.picker.halt(t.err)
+		default:
+			t.picker.halt(nil)
+		}
+	}
+	t.publish(event.Event{Type: event.StateChanged, State: s.String(), Err: t.err})
+}
+
+// activeState the state of a running torrent that isn't paused, caller holds mu
+func (t *Torrent) activeState() State {
+	switch {
+	case !t.hasInfo:
+		return StateDownloadingMetadata
+	case !t.checked:
+		return StateChecking
+	case t.picker.complete():
+		return StateSeeding
+	}
+	return StateDownloading
+}
+
+// Start checks any data already on disk, then announces the torrent and
+// connects to peers. It returns straight away, the torrent runs until Stop is
+// called or its context is done.
+func (t *Torrent) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started {
+		return
+	}
+	t.started = true
+	t.wg.Add(1)
+	go t.run()
+}
+
+func (t *Torrent) run() {
+	defer t.wg.Done()
+	var wg sync.WaitGroup // announces, pex and work
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.work()
+	}()
+	connected := false
+	connect := func() {
+		connected = true
+		t.Peers.Start()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.announceLoop()
+		}()
+	}
+
+	magnet := !t.HasInfo()
+	if magnet {
+		if t.ctx.Err() == nil {
+			connect()
+		}
+		if !t.fetchMetadata() {
+			<-t.ctx.Done()
+			t.shutdown(&wg)
+			return
+		}
+	}
+	t.check()
+	if t.ctx.Err() == nil {
+		if !connected {
+			connect()
+		}
+		if magnet {
+			// peers connected while we had no pieces to offer, set them up again
+			t.Peers.reconnect()
+		}
+		if t.pex != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.pex.run(t.ctx)
+			}()
+		}
+	}
+	<-t.ctx.Done()
+	t.shutdown(&wg)
+}
+
+// fetchMetadata asks peers for the info dictionary until it arrives,
+// reporting false if the torrent stopped or failed first
+func (t *Torrent) fetchMetadata() bool {
+	tick := time.NewTicker(metadataInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.meta.done:
+			if err := t.gotMetadata(t.meta.bytes()); err != nil {
+				// it matched the info hash, so asking again won't help
+				log.Printf("Bad metadata for %x: %v", t.MetaInfo.InfoHash, err)
+				t.fail(err)
+				return false
+			}
+			return true
+		case <-tick.C:
+			t.meta.request(t.Peers.Peers())
+		case <-t.ctx.Done():
+			return false
+		}
+	}
+}
+
+// check hashes any data left on disk by an earlier run and allocates the
+// files still to download, then moves the torrent on to downloading or
+// seeding. A disk without room for them fails the torrent before any piece
+// is asked for.
+func (t *Torrent) check() {
+	var err error
+	if t.Storage.Exists() {
+		log.Printf("Checking %s", t.MetaInfo.Name)
+		if err = t.picker.check(t.ctx); err != nil && t.ctx.Err() == nil {
+			log.Printf("Couldn't check %s: %v", t.MetaInfo.Name, err)
+			t.fail(err)
+		}
+	}
+	if err == nil && t.ctx.Err() == nil && !t.picker.complete() {
+		if err := t.Storage.Allocate(); err != nil {
+			log.Printf("Couldn't allocate %s: %v", t.MetaInfo.Name, err)
+			t.fail(err)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checked = true
+	if t.state == StateChecking {
+		t.setState(t.activeState())
+	}
+}
+
+// shutdown disconnects every peer, waits for the goroutines in wg, flushes
+// the data and tells the tracker we've gone
+func (t *Torrent) shutdown(wg *sync.WaitGroup) {
+	t.Peers.Stop()
+	wg.Wait()
+	t.mu.Lock()
+	pk, store := t.picker, t.Storage
+	t.mu.Unlock()
+	var err error
+	if pk != nil {
+		err = pk.stop()
+		if serr := store.Sync(); err == nil {
+			err = serr
+		}
+		if cerr := store.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Printf("Couldn't flush %s: %v", t.MetaInfo.Name, err)
+		}
+	}
+	t.announceStopped()
+	t.mu.Lock()
+	t.stopErr = err
+	t.setState(StateStopped)
+	t.mu.Unlock()
+}
+
+// Stop disconnects every peer, flushes the torrent's data to disk and tells
+// the tracker we're going, returning once all of the torrent's goroutines
+// have exited. A stopped torrent can't be started again.
+func (t *Torrent) Stop() error {
+	t.cancel()
+	t.mu.Lock()
+	if !t.started {
+		// run notices the context is done and goes straight to shutting down
+		t.started = true
+		t.wg.Add(1)
+		go t.run()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stopErr
+}
+
+// Pause disconnects from every peer until Resume
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case StatePaused, StateStopped, StateError:
+		return
+	}
+	t.Peers.Pause()
+	t.setState(StatePaused)
+}
+
+// Resume reconnects to peers after Pause, or tries again after an error
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != StatePaused && t.state != StateError {
+		return
+	}
+	t.err = nil
+	t.Peers.Resume()
+	t.setState(t.activeState())
+}
+
+// fail puts the torrent in StateError, disconnecting from its peers
+func (t *Torrent) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == StateStopped {
+		return
+	}
+	t.err = err
+	t.Peers.Pause()
+	t.setState(StateError)
+}
+
+// pieceCompleted has the torrent move to seeding once it has every piece
+func (t *Torrent) pieceCompleted() {
+	if t.picker.complete() {
+		signal(t.completed)
+	}
+}
+
+// seed moves a downloading torrent that has every piece to seeding. Pieces
+// count as had before their writes land, so it waits for the disk first,
+// whoever follows the state then finds the files complete. A write that
+// failed has already put the torrent in StateError, its error is left for
+// shutdown to report.
+func (t *Torrent) seed() {
+	t.picker.disk.Wait()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == StateDownloading && t.picker.complete() {
+		t.setState(StateSeeding)
+		signal(t.finished)
+	}
+}
+
+// work does what peers' goroutines hand off rather than wait on: filling
+// idle peers' pipelines once blocks can be asked for again, and seeding once
+// the download completes. Signals sent while it's busy merge into one.
+func (t *Torrent) work() {
+	for {
+		select {
+		case <-t.fill:
+			for _, p := range t.Peers.Peers() {
+				p.FillPipeline()
+			}
+		case <-t.completed:
+			t.seed()
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// signal wakes whoever receives from c, a channel buffered by one, unless
+// it's already been woken
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
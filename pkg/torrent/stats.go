@@ -0,0 +1,202 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+)
+
+// Stats a snapshot of a torrent's progress
+type Stats struct {
+	Name         string  `json:"name"`
+	InfoHash     string  `json:"info_hash"`       // hex
+	State        string  `json:"state"`           // see State
+	Error        string  `json:"error,omitempty"` // why State is error
+	Dir          string  `json:"dir"`             // the torrent's files are under it
+	Allocation   string  `json:"allocation"`      // how the files take up disk space
+	Size         int64   `json:"size"`
+	Done         int64   `json:"done"` // bytes in verified pieces
+	Pieces       int     `json:"pieces"`
+	PiecesDone   int     `json:"pieces_done"`
+	Downloaded   int64   `json:"downloaded"` // payload bytes over the torrent's lifetime
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate float64 `json:"download_rate"` // bytes per second
+	UploadRate   float64 `json:"upload_rate"`
+	Peers        int     `json:"peers"` // connected
+	Seeds        int     `json:"seeds"` // connected peers with every piece
+
+	OverheadDownloaded int64 `json:"overhead_downloaded"` // protocol bytes besides the payload
+	OverheadUploaded   int64 `json:"overhead_uploaded"`
+	PiecesVerified     int   `json:"pieces_verified"` // downloaded and verified since the torrent started
+	HashFailures       int   `json:"hash_failures"`
+	DiskQueue          int   `json:"disk_queue"` // pieces waiting to be written and reads in progress
+}
+
+// FileStats a file of the torrent and how much of it we have
+type FileStats struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Done     int64  `json:"done"`
+	Priority string `json:"priority"`
+	Attr     string `json:"attr,omitempty"` // BEP 47 attributes, any of x, h and l
+}
+
+// PeerStats a connected peer
+type PeerStats struct {
+	Addr         string  `json:"addr"`
+	Client       string  `json:"client"`
+	Transport    string  `json:"transport"`
+	Encrypted    bool    `json:"encrypted"`
+	Incoming     bool    `json:"incoming"`
+	Pieces       int     `json:"pieces"` // the peer has
+	Seed         bool    `json:"seed"`
+	Choked       bool    `json:"choked"`     // the peer is choking us
+	Interested   bool    `json:"interested"` // the peer wants pieces from us
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+}
+
+// Stats the torrent's current progress
+func (t *Torrent) Stats() Stats {
+	m := t.MetaInfo
+	t.mu.Lock()
+	st := Stats{
+		Name:       m.Name,
+		InfoHash:   fmt.Sprintf("%x", m.InfoHash),
+		Dir:        t.dir,
+		Allocation: t.alloc.String(),
+	}
+	hasInfo := t.hasInfo
+	t.mu.Unlock()
+	if hasInfo {
+		st.Size, st.Pieces = m.TotalLength(), m.NumPieces()
+		t.picker.mu.Lock()
+		st.PiecesDone = t.picker.have.Count()
+		st.Done = t.picker.bytesDone(0, st.Size)
+		st.Downloaded, st.Uploaded = t.picker.downloaded, t.picker.uploaded
+		st.PiecesVerified, st.HashFailures = t.picker.verifiedPieces, t.picker.hashFailures
+		t.picker.mu.Unlock()
+		st.DiskQueue = t.picker.disk.Pending()
+	}
+	st.OverheadDownloaded = t.Peers.Traffic.OverheadDown.Load()
+	st.OverheadUploaded = t.Peers.Traffic.OverheadUp.Load()
+	for _, p := range t.Peers.Peers() {
+		if !p.Connected() {
+			continue
+		}
+		st.Peers++
+		if p.Seed() {
+			st.Seeds++
+		}
+		st.DownloadRate += p.DownloadRate()
+		st.UploadRate += p.UploadRate()
+	}
+	st.State = t.State().String()
+	if err := t.Err(); err != nil {
+		st.Error = err.Error()
+	}
+	return st
+}
+
+// Files the torrent's files with their progress and priority, nil until the
+// metadata of a magnet link arrives. Pad files are left out, the others keep
+// their index in MetaInfo.Files.
+func (t *Torrent) Files() []FileStats {
+	if !t.HasInfo() {
+		return nil
+	}
+	files := make([]FileStats, 0, len(t.MetaInfo.Files))
+	offset := int64(0)
+	t.picker.mu.Lock()
+	defer t.picker.mu.Unlock()
+	for i, f := range t.MetaInfo.Files {
+		if f.Padding() {
+			offset += f.Length
+			continue
+		}
+		files = append(files, FileStats{
+			Index:    i,
+			Path:     filepath.ToSlash(t.Storage.FilePath(i)),
+			Length:   f.Length,
+			Done:     t.picker.bytesDone(offset, f.Length),
+			Priority: t.picker.filePrio[i].String(),
+			Attr:     f.Attr,
+		})
+		offset += f.Length
+	}
+	return files
+}
+
+// PeerStats the connected peers
+func (t *Torrent) PeerStats() []PeerStats {
+	var list []PeerStats
+	for _, p := range t.Peers.Peers() {
+		if !p.Connected() {
+			continue
+		}
+		list = append(list, PeerStats{
+			Addr:         p.Addr(),
+			Client:       p.Client,
+			Transport:    p.Transport,
+			Encrypted:    p.Encrypted,
+			Incoming:     p.Incoming,
+			Pieces:       p.PieceCount(),
+			Seed:         p.Seed(),
+			Choked:       p.Choked(),
+			Interested:   p.Interested(),
+			Downloaded:   p.Downloaded(),
+			Uploaded:     p.Uploaded(),
+			DownloadRate: p.DownloadRate(),
+			UploadRate:   p.UploadRate(),
+		})
+	}
+	return list
+}
+
+// PieceMap which of the torrent's pieces we have
+type PieceMap struct {
+	Pieces int    `json:"pieces"`
+	Have   []byte `json:"have"` // bitfield, high bit first
+}
+
+// Has reports whether piece i is in the map
+func (pm PieceMap) Has(i int) bool {
+	return i >= 0 && i < pm.Pieces && pm.Have[i>>3]&(128>>(i&7)) != 0
+}
+
+// PieceMap the pieces we have verified, empty until the metadata of a
+// magnet link arrives
+func (t *Torrent) PieceMap() PieceMap {
+	if !t.HasInfo() {
+		return PieceMap{}
+	}
+	t.picker.mu.Lock()
+	defer t.picker.mu.Unlock()
+	return PieceMap{Pieces: t.MetaInfo.NumPieces(), Have: bytes.Clone(t.picker.have.Bits)}
+}
+
+// bytesDone how much of [offset, offset+length) lies in verified pieces, caller holds mu
+func (pk *picker) bytesDone(offset, length int64) int64 {
+	if length == 0 {
+		return 0
+	}
+	pl := pk.m.PieceLength
+	done := int64(0)
+	for i := int(offset / pl); int64(i)*pl < offset+length; i++ {
+		if !pk.have.IsSet(i) {
+			continue
+		}
+		start, end := int64(i)*pl, int64(i+1)*pl
+		if start < offset {
+			start = offset
+		}
+		if end > offset+length {
+			end = offset + length
+		}
+		done += end - start
+	}
+	return done
+}
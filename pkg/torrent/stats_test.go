@@ -0,0 +1,38 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+func TestPadFilesHidden(t *testing.T) {
+	m, _ := testMeta(3*16<<10, 16<<10)
+	m.Files = []metainfo.File{
+		{Length: 10000, Path: []string{"a"}},
+		{Length: 16<<10 - 10000, Path: []string{".pad", "6384"}, Attr: "p"},
+		{Length: 2 * 16 << 10, Path: []string{"b"}, Attr: "x"},
+	}
+	tr, err := New(context.Background(), m, Config{Dir: t.TempDir(), PeerID: []byte("-GT0001-padspadspads")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Stop()
+	files := tr.Files()
+	if len(files) != 2 || files[0].Index != 0 || files[1].Index != 2 || files[1].Path != "f/b" {
+		t.Fatalf("files %+v", files)
+	}
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"priority", func() error { return tr.SetFilePriority(1, PrioritySkip) }},
+		{"rename", func() error { return tr.RenameFile(1, "f/pad") }},
+	}
+	for _, tt := range tests {
+		if err := tt.fn(); err == nil {
+			t.Errorf("%s of a pad file succeeded", tt.name)
+		}
+	}
+}
@@ -1,68 +1,263 @@
 package torrent
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"sync"
 
+	"github.com/mbags/gtc/pkg/diskio"
+	"github.com/mbags/gtc/pkg/event"
+	"github.com/mbags/gtc/pkg/lsd"
 	"github.com/mbags/gtc/pkg/metainfo"
 	"github.com/mbags/gtc/pkg/peer"
+	"github.com/mbags/gtc/pkg/storage"
 	"github.com/mbags/gtc/pkg/tracker"
 	"github.com/mbags/gtc/pkg/util"
 )
 
-// Torrent torrent data(MetaInfo) and connected peers
+// Torrent torrent data(MetaInfo) and its peers
 type Torrent struct {
-	MetaInfo             *metainfo.MetaInfo
-	Lock                 sync.Mutex
-	ActivePeers          map[string]*peer.Peer
-	Activate, Deactivate chan *peer.Peer
+	// MetaInfo of a torrent added from a magnet link has only the info hash,
+	// name and trackers until HasInfo, when the rest is filled in
+	MetaInfo *metainfo.MetaInfo
+	Peers    *PeerManager
+	Storage  *storage.Storage // nil until HasInfo
+	Events   *event.Bus       // what happens to the torrent, subscribe to follow it
+
+	picker *picker // nil until HasInfo
+	pex    *pex
+	meta   *metadata
+	dir    string // under mu
+	noPEX  bool
+	disk   *diskio.Pool
+	alloc  storage.Allocation
+
+	ctx       context.Context // done once the torrent is stopping
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup // run, waited for by Stop
+	finished  chan struct{}  // the download completed, the trackers are told
+	fill      chan struct{}  // blocks can be asked for again, for work to give to idle peers
+	completed chan struct{}  // every piece is had, for work to move to seeding
+
+	mu          sync.Mutex
+	state       State
+	err         error // what put the torrent in StateError
+	stopErr     error // flushing the data when stopping failed
+	started     bool
+	hasInfo     bool                     // MetaInfo is complete, picker and Storage are set
+	checked     bool                     // the data on disk has been hashed
+	renamed     map[int]string           // by RenameFile, file index to path
+	trackers    map[string]TrackerStatus // by URL
+	tracker     string                   // the tracker that last answered, told when we stop
+	trackerTier int
+	lsd         *lsd.Service // set by UseLSD, the torrent is registered once known not to be private
 }
 
-// New return a Torrent struct with MetaInfo and ActivePeers populated
-func NewFromFilename(filename string) (*Torrent, error) {
+// Config how a torrent is set up, the zero value gives the defaults
+type Config struct {
+	Dir        string             // the torrent's files go under it, "." when empty
+	PeerID     []byte             // ours, 20 bytes, one is made up when nil
+	Limiter    *Limiter           // caps connections across torrents, GlobalLimiter when nil
+	MaxConns   int                // for this torrent, DefaultMaxConns when 0
+	NoPEX      bool               // don't exchange peers with peers, private torrents never do
+	Disk       *diskio.Pool       // does disk reads and writes across torrents, diskio.DefaultPool when nil
+	Allocation storage.Allocation // how the torrent's files take up disk space, sparse by default
+}
 
+// New returns a Torrent for m, ready to Start. m may come from a magnet
+// link, in which case the info dictionary is fetched from peers first. The
+// torrent stops when ctx is done. Nothing touches the network until Start.
+func New(ctx context.Context, m *metainfo.MetaInfo, cfg Config) (*Torrent, error) {
+	if len(m.InfoHash) != 20 {
+		return nil, fmt.Errorf("torrent: info hash is %d bytes, not 20", len(m.InfoHash))
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "."
+	}
+	if cfg.PeerID == nil {
+		cfg.PeerID = []byte(tracker.PeerID + util.SessionID(12))
+	}
+	if len(cfg.PeerID) != 20 {
+		return nil, fmt.Errorf("torrent: peer id is %d bytes, not 20", len(cfg.PeerID))
+	}
+	if cfg.Limiter == nil {
+		cfg.Limiter = GlobalLimiter
+	}
+	if cfg.Disk == nil {
+		cfg.Disk = diskio.DefaultPool
+	}
+	t := &Torrent{
+		MetaInfo:  m,
+		Peers:     NewPeerManager([]byte(m.InfoHash), cfg.PeerID, cfg.Limiter),
+		Events:    event.NewBus(),
+		meta:      newMetadata(m),
+		dir:       cfg.Dir,
+		noPEX:     cfg.NoPEX,
+		disk:      cfg.Disk,
+		alloc:     cfg.Allocation,
+		finished:  make(chan struct{}, 1),
+		fill:      make(chan struct{}, 1),
+		completed: make(chan struct{}, 1),
+	}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.Peers.Events = t.Events
+	t.Peers.Extensions = []peer.ExtensionHandler{t.meta}
+	if cfg.MaxConns > 0 {
+		t.Peers.MaxConns = cfg.MaxConns
+	}
+	if m.HasInfo() {
+		if err := t.initInfo(); err != nil {
+			t.cancel()
+			return nil, err
+		}
+	} else {
+		t.state = StateDownloadingMetadata
+	}
+	return t, nil
+}
+
+// NewFromFilename returns a Torrent for the .torrent file filename, see New
+func NewFromFilename(ctx context.Context, filename string, cfg Config) (*Torrent, error) {
 	m, err := metainfo.NewFromFilename(filename)
 	if err != nil {
-		log.Fatalf("Couldnt create metainfo for %v", filename)
+		return nil, fmt.Errorf("torrent: %w", err)
 	}
-	// pretty print the parsed .torrent
-	fmt.Println(m)
-	// fetch & print initial peers
-	peerList, err := tracker.FindPeers(m)
+	return New(ctx, m, cfg)
+}
+
+// NewFromReader returns a Torrent for the .torrent read from r, see New
+func NewFromReader(ctx context.Context, r io.Reader, cfg Config) (*Torrent, error) {
+	m, err := metainfo.NewFromReader(r)
 	if err != nil {
-		log.Fatalf("Couldn't get the peers list")
-		return nil, err
-	}
-	t := &Torrent{m, sync.Mutex{}, make(map[string]*peer.Peer), make(chan *peer.Peer), make(chan *peer.Peer)}
-	for _, peer := range peerList {
-		go peer.Connect([]byte(m.InfoHash), []byte(tracker.PeerID+util.SessionID(12)), t.Activate, t.Deactivate) // might want the same id for each peer
+		return nil, fmt.Errorf("torrent: %w", err)
 	}
+	return New(ctx, m, cfg)
+}
 
-	return t, nil
+// NewFromMagnet returns a Torrent for a magnet link. It fetches the info
+// dictionary from peers once started, see New.
+func NewFromMagnet(ctx context.Context, uri string, cfg Config) (*Torrent, error) {
+	m, err := metainfo.ParseMagnet(uri)
+	if err != nil {
+		return nil, fmt.Errorf("torrent: %w", err)
+	}
+	return New(ctx, m, cfg)
 }
 
-func (t *Torrent) Start() {
-	// activate watcher
-	go func() {
-		for p := range t.Activate {
-			t.Lock.Lock()
-			t.ActivePeers[p.ID] = p
-			log.Printf("%s is active!!", p.ID)
-			t.Lock.Unlock()
-		}
-	}()
-
-	// deactivate watcher
-	go func() {
-		for p := range t.Deactivate {
-			t.Lock.Lock()
-			t.ActivePeers[p.ID] = nil
-			log.Printf("%s is kill!!", p.ID)
-			t.Lock.Unlock()
+// initInfo sets up storage and the picker once MetaInfo is complete, and has
+// peers connected from then on use them. Caller holds mu if the torrent is running.
+func (t *Torrent) initInfo() error {
+	m := t.MetaInfo
+	store, err := storage.New(t.dir, m, t.alloc)
+	if err != nil {
+		return fmt.Errorf("torrent: %w", err)
+	}
+	pk := newPicker(m, store, diskio.NewCache(store, t.disk, m))
+	pk.events = t.Events
+	pk.returned = func() {
+		// blocks went back into the pool, let idle peers pick them up
+		signal(t.fill)
+	}
+	pk.completed = func(index int) {
+		for _, p := range t.Peers.Peers() {
+			p.Send(peer.Have{Index: uint32(index)})
 		}
-	}()
+		t.pieceCompleted()
+	}
+	pk.failed = t.fail
+	ext := []peer.ExtensionHandler{t.meta}
+	if !m.Private && !t.noPEX {
+		// private torrents must only get peers from their tracker
+		t.pex = newPex(t.Peers)
+		ext = append(ext, t.pex)
+	}
+	t.Storage, t.picker = store, pk
+	t.Peers.setInfo(m.NumPieces(), pk, pk, ext)
+	t.hasInfo = true
+	return nil
+}
+
+// gotMetadata completes MetaInfo with the info dictionary fetched from peers
+// and reconnects to them, now able to exchange pieces
+func (t *Torrent) gotMetadata(info []byte) error {
+	full := metainfo.MetaInfo{InfoHash: t.MetaInfo.InfoHash}
+	if err := full.SetInfo(info); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	// field by field, InfoHash and the trackers are read without the lock
+	m := t.MetaInfo
+	m.Info, m.Name, m.Files, m.InfoBytes = full.Info, full.Name, full.Files, full.InfoBytes
+	err := t.initInfo()
+	if err == nil && t.state == StateDownloadingMetadata {
+		t.setState(t.activeState())
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("Got metadata for %s", full.Name)
+	t.publish(event.Event{Type: event.MetadataReceived})
+	t.mu.Lock()
+	svc := t.lsd
+	t.mu.Unlock()
+	if svc != nil && t.ctx.Err() == nil {
+		t.registerLSD(svc)
+	}
+	t.Peers.reconnect()
+	return nil
+}
+
+// ErrNoMetadata returned for what needs the info dictionary of a magnet link
+// before it has arrived
+var ErrNoMetadata = errors.New("torrent: metadata not yet known")
+
+// HasInfo reports whether the torrent's info dictionary is known, which for
+// one added from a magnet link is once its state leaves StateDownloadingMetadata
+func (t *Torrent) HasInfo() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hasInfo
+}
+
+// Name the torrent's name, from the magnet link's dn until the metadata arrives
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.MetaInfo.Name
+}
 
-	// TODO daemon for downloading chunks
-	go func() {}()
+// publish sends e about the torrent to its subscribers
+func (t *Torrent) publish(e event.Event) {
+	e.InfoHash = fmt.Sprintf("%x", t.MetaInfo.InfoHash)
+	t.Events.Publish(e)
+}
+
+// UseLSD announces the torrent through Local Service Discovery and connects to
+// the peers found with it. Private torrents are never announced, and as
+// whether a magnet link's torrent is private is only known from its info
+// dictionary, nothing is announced for one until the metadata arrives.
+func (t *Torrent) UseLSD(s *lsd.Service) {
+	t.mu.Lock()
+	t.lsd = s
+	hasInfo := t.hasInfo
+	t.mu.Unlock()
+	if hasInfo {
+		t.registerLSD(s)
+	}
+}
+
+// registerLSD adds the torrent to s unless it's private. Only call it once
+// HasInfo.
+func (t *Torrent) registerLSD(s *lsd.Service) {
+	if t.MetaInfo.Private {
+		return
+	}
+	s.Add([]byte(t.MetaInfo.InfoHash), func(ip net.IP, port uint16) {
+		t.Peers.Add(&peer.Peer{IP: ip, Port: port})
+	})
 }
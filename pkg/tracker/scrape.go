@@ -0,0 +1,172 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ScrapeResult a tracker's counts for one torrent
+type ScrapeResult struct {
+	Seeders   int `json:"seeders"`
+	Leechers  int `json:"leechers"`
+	Completed int `json:"completed"` // downloads the tracker has seen finish
+}
+
+// Scrape asks a tracker how many peers it knows for the torrent without announcing to it
+func Scrape(tracker string, infoHash []byte) (ScrapeResult, error) {
+	switch {
+	case strings.HasPrefix(tracker, "udp"):
+		return scrapeUDP(tracker, infoHash)
+	case strings.HasPrefix(tracker, "http"):
+		return scrapeHTTP(tracker, infoHash)
+	}
+	return ScrapeResult{}, fmt.Errorf("unsupported tracker %s", tracker)
+}
+
+// scrapeURL the scrape convention's URL for an announce URL, whose last path
+// segment must start with "announce"
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", errors.New("tracker doesn't support scrape")
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	return u.String(), nil
+}
+
+func scrapeHTTP(tracker string, infoHash []byte) (ScrapeResult, error) {
+	reqURL, err := scrapeURL(tracker)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	sep := "?"
+	if strings.Contains(reqURL, "?") {
+		sep = "&"
+	}
+	reqURL += sep + "info_hash=" + url.QueryEscape(string(infoHash))
+	res, err := httpGet(context.Background(), reqURL)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ScrapeResult{}, fmt.Errorf("scrape: %s", res.Status)
+	}
+	d, err := bencode.Decode(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	dict, _ := d.(map[string]interface{})
+	if reason, ok := dict["failure reason"].(string); ok {
+		return ScrapeResult{}, errors.New(reason)
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	stats, ok := files[string(infoHash)].(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, errors.New("tracker doesn't know the torrent")
+	}
+	count := func(key string) int {
+		n, _ := stats[key].(int64)
+		return int(n)
+	}
+	return ScrapeResult{Seeders: count("complete"), Leechers: count("incomplete"), Completed: count("downloaded")}, nil
+}
+
+func scrapeUDP(tracker string, infoHash []byte) (ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	con, err := dialUDP(addr)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(udpTimeout))
+
+	connectionID, err := udpConnect(con)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	transactionID := rand.Uint32()
+	req := make([]byte, 36)
+	binary.BigEndian.PutUint64(req, connectionID)
+	binary.BigEndian.PutUint32(req[8:], 2) // scrape
+	binary.BigEndian.PutUint32(req[12:], transactionID)
+	copy(req[16:], infoHash)
+	res, err := udpRoundTrip(con, req, 2, transactionID)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	if len(res) < 12 {
+		return ScrapeResult{}, errors.New("short scrape response")
+	}
+	return ScrapeResult{
+		Seeders:   int(binary.BigEndian.Uint32(res)),
+		Completed: int(binary.BigEndian.Uint32(res[4:])),
+		Leechers:  int(binary.BigEndian.Uint32(res[8:])),
+	}, nil
+}
+
+// udpConnect obtains a connection ID from a UDP tracker
+func udpConnect(con net.Conn) (uint64, error) {
+	transactionID := rand.Uint32()
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req, 0x41727101980)
+	binary.BigEndian.PutUint32(req[8:], 0) // connect
+	binary.BigEndian.PutUint32(req[12:], transactionID)
+	res, err := udpRoundTrip(con, req, 0, transactionID)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 8 {
+		return 0, errors.New("short connect response")
+	}
+	return binary.BigEndian.Uint64(res), nil
+}
+
+// udpRoundTrip sends req and returns the body of the response past its action
+// and transaction ID, which must match
+func udpRoundTrip(con net.Conn, req []byte, action, transactionID uint32) ([]byte, error) {
+	if _, err := con.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, err := con.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+			// a late answer to some earlier request
+			continue
+		}
+		switch binary.BigEndian.Uint32(buf) {
+		case action:
+			return bytes.Clone(buf[8:n]), nil
+		case 3:
+			return nil, fmt.Errorf("tracker error: %s", buf[8:n])
+		}
+		return nil, errors.New("unexpected response action")
+	}
+}
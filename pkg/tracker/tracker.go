@@ -2,6 +2,7 @@ package tracker
 
 import (
     "bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
     "math/rand"
+	"sync"
+	"time"
 
 	"github.com/jackpal/bencode-go"
 	metainfo "github.com/mbags/gtc/pkg/metainfo"
@@ -20,12 +23,118 @@ const (
 	PeerID = "-TR2920-" // transmission 2.920 :~)
 )
 
+const udpTimeout = 15 * time.Second
+
+// Settings what announces tell trackers about us
+type Settings struct {
+	PeerIDPrefix string // the rest of the peer id is random
+	Port         int    // we accept peers on
+	NumWant      int    // peers asked for, at most MaxNumWant
+	UserAgent    string // sent to HTTP trackers
+}
+
+// MaxNumWant the most peers an announce asks for
+const MaxNumWant = 200
+
+var (
+	settingsMu sync.Mutex
+	settings   = Settings{PeerIDPrefix: PeerID, Port: 6881, NumWant: 50, UserAgent: "Transmission/2.92"}
+)
+
+// Configure sets what announces from now on tell trackers
+func Configure(s Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	s.NumWant = min(max(s.NumWant, 1), MaxNumWant)
+	settings = s
+}
+
+// current the settings announces use
+func current() Settings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return settings
+}
+
+// httpGet requests reqURL from an HTTP tracker with our user agent
+func httpGet(ctx context.Context, reqURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ua := current().UserAgent; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	client := http.Client{Timeout: udpTimeout}
+	return client.Do(req)
+}
+
+// peerID ours for an announce, the configured prefix then random characters
+func (s Settings) peerID() string {
+	return s.PeerIDPrefix + util.SessionID(20-len(s.PeerIDPrefix))
+}
+
+// Announcement who we are and how far along the torrent is, as told to a tracker
+type Announcement struct {
+	PeerID     []byte // the one we handshake with, so the tracker can tell our announces apart; made up when nil
+	Uploaded   int64  // payload bytes
+	Downloaded int64
+	Left       int64 // bytes still to download, negative when not yet known
+}
+
+// fresh the announcement of a torrent nothing has been downloaded for yet
+func fresh(m *metainfo.MetaInfo) Announcement {
+	return Announcement{Left: m.TotalLength()}
+}
+
+// peerID a's peer id, or one made up from the settings
+func (a Announcement) peerID(s Settings) string {
+	if a.PeerID != nil {
+		return string(a.PeerID)
+	}
+	return s.peerID()
+}
+
+// UDPSocket when set, UDP tracker requests go out through it so they share
+// a port with uTP, otherwise each request gets a socket of its own
+var UDPSocket interface{ PacketConn() net.PacketConn }
+
+// udpConn a connection to one address over a shared packet socket
+type udpConn struct {
+	net.PacketConn
+	remote net.Addr
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(p)
+		if err != nil || from.String() == c.remote.String() {
+			return n, err
+		}
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.remote)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func dialUDP(addr *net.UDPAddr) (net.Conn, error) {
+	if UDPSocket != nil {
+		return &udpConn{UDPSocket.PacketConn(), addr}, nil
+	}
+	return net.DialUDP("udp", nil, addr)
+}
+
 func FindPeers(m *metainfo.MetaInfo) (peerList []*peer.Peer, err error) {
 	if m.Announce == "" {
 	found:
 		for _, list := range m.AnnounceList {
 			for _, tracker := range list {
-                peerList, err = queryTracker(tracker, m)
+                peerList, _, err = queryTracker(context.Background(), tracker, m, Started, fresh(m))
                 if err != nil {
                     log.Printf("Error getting peers from %s", tracker)
                     continue found
@@ -34,38 +143,68 @@ func FindPeers(m *metainfo.MetaInfo) (peerList []*peer.Peer, err error) {
 			}
 		}
 	} else {
-        peerList, err = queryTracker(m.Announce, m)
+        peerList, _, err = queryTracker(context.Background(), m.Announce, m, Started, fresh(m))
 	}
 	return
 }
 
-func queryTracker(tracker string, m *metainfo.MetaInfo) (peerList []*peer.Peer, err error) {
+// Event what an announce tells the tracker, numbered as in the UDP protocol
+type Event uint32
+
+const (
+	None      Event = iota // a regular announce
+	Completed              // the download just finished
+	Started                // the first announce
+	Stopped                // we're going away, the tracker can forget us
+)
+
+func (e Event) String() string {
+	return [...]string{"", "completed", "started", "stopped"}[e]
+}
+
+// Announce asks a single tracker for peers
+func Announce(tracker string, m *metainfo.MetaInfo) ([]*peer.Peer, error) {
+	return AnnounceEvent(tracker, m, Started)
+}
+
+// AnnounceEvent announces to a single tracker with ev, returning the peers it gives us
+func AnnounceEvent(tracker string, m *metainfo.MetaInfo, ev Event) ([]*peer.Peer, error) {
+	peers, _, err := queryTracker(context.Background(), tracker, m, ev, fresh(m))
+	return peers, err
+}
+
+// AnnounceContext announces a and ev to a single tracker, giving up once ctx
+// is done. Besides the peers it returns how long the tracker wants us to
+// wait before the next announce, zero if it didn't say.
+func AnnounceContext(ctx context.Context, tracker string, m *metainfo.MetaInfo, ev Event, a Announcement) ([]*peer.Peer, time.Duration, error) {
+	return queryTracker(ctx, tracker, m, ev, a)
+}
+
+func queryTracker(ctx context.Context, tracker string, m *metainfo.MetaInfo, ev Event, a Announcement) (peerList []*peer.Peer, interval time.Duration, err error) {
     if tracker[:3] == "udp" {
-        peerList, err = queryUDPTracker(tracker, m)
+        peerList, interval, err = queryUDPTracker(ctx, tracker, m, ev, a)
 	}
     if tracker[:4] == "http" {
-        peerList, err = queryHTTPTracker(tracker, m)
+        peerList, interval, err = queryHTTPTracker(ctx, tracker, m, ev, a)
     }
     return
 }
 
-func queryHTTPTracker(reqURL string, m *metainfo.MetaInfo) (peerList []*peer.Peer, err error) {
+func queryHTTPTracker(ctx context.Context, reqURL string, m *metainfo.MetaInfo, ev Event, a Announcement) (peerList []*peer.Peer, interval time.Duration, err error) {
+	s := current()
 	reqURL += fmt.Sprintf("?info_hash=%s", url.QueryEscape(string(m.InfoHash[:])))
-	reqURL += fmt.Sprintf("&peer_id=%s", PeerID+url.QueryEscape(util.SessionID(12)))
-	reqURL += "&uploaded=0&downloaded=0&port=6881"
-	if l := len(m.Files); l == 1 {
-		reqURL += fmt.Sprintf("&left=%v", m.Files[0].Length)
-	} else if l > 1 {
-		len := int64(0)
-		for _, f := range m.Files {
-			len += f.Length
-		}
-		reqURL += fmt.Sprintf("&left=%v", len)
+	reqURL += fmt.Sprintf("&peer_id=%s", url.QueryEscape(a.peerID(s)))
+	reqURL += fmt.Sprintf("&uploaded=%d&downloaded=%d&port=%d&numwant=%d", a.Uploaded, a.Downloaded, s.Port, s.NumWant)
+	if a.Left >= 0 {
+		reqURL += fmt.Sprintf("&left=%d", a.Left)
 	}
 	reqURL += fmt.Sprintf("&compact=1")
-	res, err := http.Get(reqURL)
+	if ev != None {
+		reqURL += "&event=" + ev.String()
+	}
+	res, err := httpGet(ctx, reqURL)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, err
 	}
 	defer res.Body.Close()
 	dict, err := bencode.Decode(res.Body)
@@ -74,6 +213,9 @@ func queryHTTPTracker(reqURL string, m *metainfo.MetaInfo) (peerList []*peer.Pee
         return
     }
 	// make this conditional on successful type assertion
+	if secs, ok := dict.(map[string]interface{})["interval"].(int64); ok && secs > 0 {
+		interval = time.Duration(secs) * time.Second
+	}
 	peers := dict.(map[string]interface{})["peers"]
 	peerList, err = GetPeerList(peers)
 	if err != nil {
@@ -82,7 +224,7 @@ func queryHTTPTracker(reqURL string, m *metainfo.MetaInfo) (peerList []*peer.Pee
 	return
 }
 
-func queryUDPTracker(reqURL string, m *metainfo.MetaInfo) (pl []*peer.Peer, err error) {
+func queryUDPTracker(ctx context.Context, reqURL string, m *metainfo.MetaInfo, ev Event, a Announcement) (pl []*peer.Peer, interval time.Duration, err error) {
     u, err := url.Parse(reqURL)
     serverAddress, err := net.ResolveUDPAddr("udp", u.Host)
 
@@ -90,10 +232,18 @@ func queryUDPTracker(reqURL string, m *metainfo.MetaInfo) (pl []*peer.Peer, err
         log.Println("Error parsing URL")
         return
     }
-    con, err := net.DialUDP("udp", nil, serverAddress)
+    con, err := dialUDP(serverAddress)
     if err != nil {
         return
     }
+    defer con.Close()
+    deadline := time.Now().Add(udpTimeout)
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+    con.SetDeadline(deadline)
+    // closing the connection unblocks a read when ctx is cancelled
+    defer context.AfterFunc(ctx, func() { con.Close() })()
     var connectionID uint64 = 0x41727101980
     var action uint32 = 0
     transactionID := rand.Uint32()
@@ -150,10 +300,11 @@ func queryUDPTracker(reqURL string, m *metainfo.MetaInfo) (pl []*peer.Peer, err
         return
     }
 
-    return announcementRequest(con, connectionID, m)
+    return announcementRequest(con, connectionID, m, ev, a)
 }
 
-func announcementRequest(con *net.UDPConn, connectionID uint64, m *metainfo.MetaInfo) (pl []*peer.Peer, err error) {
+func announcementRequest(con net.Conn, connectionID uint64, m *metainfo.MetaInfo, ev Event, a Announcement) (pl []*peer.Peer, interval time.Duration, err error) {
+    s := current()
     transactionID := rand.Uint32()
 
     announcementRequest := new(bytes.Buffer)
@@ -176,30 +327,28 @@ func announcementRequest(con *net.UDPConn, connectionID uint64, m *metainfo.Meta
     if err != nil {
         return
     }
-    err = binary.Write(announcementRequest, binary.BigEndian, []byte(PeerID+url.QueryEscape(util.SessionID(12))))
+    err = binary.Write(announcementRequest, binary.BigEndian, []byte(a.peerID(s)))
     if err != nil {
         return
     }
 
-    var downloaded uint64 = 0
-    err = binary.Write(announcementRequest, binary.BigEndian, downloaded)
+    err = binary.Write(announcementRequest, binary.BigEndian, a.Downloaded)
     if err != nil {
         return
     }
 
-   err = binary.Write(announcementRequest, binary.BigEndian, m.Files[0].Length)
+   // UDP has no way to leave it out, an amount not yet known goes as 0
+   err = binary.Write(announcementRequest, binary.BigEndian, max(a.Left, 0))
    if err != nil {
        return
    }
 
-   var uploaded uint64 = 0
-   err = binary.Write(announcementRequest, binary.BigEndian, uploaded)
+   err = binary.Write(announcementRequest, binary.BigEndian, a.Uploaded)
    if err != nil {
        return
    }
 
-    var event uint32 = 2
-    err = binary.Write(announcementRequest, binary.BigEndian, event)
+    err = binary.Write(announcementRequest, binary.BigEndian, uint32(ev))
     if err != nil {
         return
     }
@@ -216,14 +365,14 @@ func announcementRequest(con *net.UDPConn, connectionID uint64, m *metainfo.Meta
         return
     }
 
-    const peerRequestCount = 10
-    var peerCount uint32 = peerRequestCount
+    peerRequestCount := s.NumWant
+    var peerCount uint32 = uint32(peerRequestCount)
     err = binary.Write(announcementRequest, binary.BigEndian, peerCount)
     if err != nil {
         return
     }
 
-    var port uint16 = 6881
+    var port uint16 = uint16(s.Port)
     err = binary.Write(announcementRequest, binary.BigEndian, port)
     if err != nil {
         return
@@ -236,15 +385,14 @@ func announcementRequest(con *net.UDPConn, connectionID uint64, m *metainfo.Meta
 
     const minResponseLen = 20
     const peerDataLen = 6
-    expectedResponse := minResponseLen + peerDataLen*peerRequestCount
-    responseBytes := make([]byte, expectedResponse)
+    responseBytes := make([]byte, minResponseLen + peerDataLen*peerRequestCount)
 
     var responseLen int
     responseLen, err = con.Read(responseBytes)
     if err != nil {
         return
     }
-    if responseLen < expectedResponse {
+    if responseLen < minResponseLen {
         log.Println("Unexpected response length")
         return
     }
@@ -269,11 +417,12 @@ func announcementRequest(con *net.UDPConn, connectionID uint64, m *metainfo.Meta
         log.Println("Unexpected transaction id")
     }
 
-    var interval uint32
-    err = binary.Read(response, binary.BigEndian, &interval)
+    var secs uint32
+    err = binary.Read(response, binary.BigEndian, &secs)
     if err != nil {
         return
     }
+    interval = time.Duration(secs) * time.Second
 
     var leechers uint32
     err = binary.Read(response, binary.BigEndian, &leechers)
@@ -294,10 +443,7 @@ func announcementRequest(con *net.UDPConn, connectionID uint64, m *metainfo.Meta
         return
     }
 
-    fmt.Printf("Seeders: %d\n", seeders)
-    fmt.Printf("Leechers: %d\n", leechers)
-    fmt.Printf("Interval: %d\n", interval)
-    fmt.Printf("Peers: %d\n", peerCountResponse)
+    log.Printf("[tracker] %d seeders, %d leechers, %d peers, interval %ds", seeders, leechers, peerCountResponse, secs)
 
     pl, err = GetPeerList(string(peerDataBytes))
     if err != nil {
@@ -322,7 +468,7 @@ func GetPeerList(p interface{}) ([]*peer.Peer, error) {
 		}
 	case []interface{}: // []dict format
 		//doesnt happen because we only support &compact=1 anyway for now
-		fmt.Println("peers in dict format")
+		log.Println("[tracker] peers in dict format")
 	}
 	return pl, nil
 }
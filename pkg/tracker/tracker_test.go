@@ -0,0 +1,53 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mbags/gtc/pkg/metainfo"
+)
+
+func TestAnnounceContext(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("event") {
+		case "stopped":
+			<-r.Context().Done() // a tracker that never answers
+		case "completed":
+			w.Write([]byte("d5:peers0:e"))
+		default:
+			w.Write([]byte("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+		}
+	}))
+	defer hs.Close()
+	m := &metainfo.MetaInfo{InfoHash: strings.Repeat("\x01", 20)}
+
+	tests := []struct {
+		name     string
+		ev       Event
+		timeout  time.Duration
+		peers    int
+		interval time.Duration
+		err      bool
+	}{
+		{"started", Started, time.Second, 1, 900 * time.Second, false},
+		{"regular", None, time.Second, 1, 900 * time.Second, false},
+		{"no interval", Completed, time.Second, 0, 0, false},
+		{"cancelled", Stopped, 100 * time.Millisecond, 0, 0, true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+		start := time.Now()
+		peers, interval, err := AnnounceContext(ctx, hs.URL, m, tt.ev, Announcement{Left: -1})
+		cancel()
+		if (err != nil) != tt.err || len(peers) != tt.peers || interval != tt.interval {
+			t.Errorf("%s: %d peers, interval %v, err %v", tt.name, len(peers), interval, err)
+		}
+		if time.Since(start) > tt.timeout+time.Second {
+			t.Errorf("%s: took %v", tt.name, time.Since(start))
+		}
+	}
+}
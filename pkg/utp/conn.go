@@ -0,0 +1,515 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	recvWindow     = 1 << 20
+	target         = 100 * time.Millisecond // LEDBAT: the queuing delay we're willing to add
+	maxCwndGain    = 3000                   // bytes the window may grow by per RTT
+	minWindow      = maxPayload
+	initialRTO     = time.Second
+	minRTO         = 500 * time.Millisecond
+	maxRTO         = 60 * time.Second
+	maxRetransmits = 8
+	keepAlive      = 29 * time.Second
+	dupAckLimit    = 3
+	baseDelaySlot  = time.Minute // base delay is the minimum over the last two slots
+)
+
+// connection states
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+var errReset = errors.New("utp: connection reset by peer")
+
+// outPacket a sent packet awaiting its ack
+type outPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+}
+
+// Conn a uTP connection, implementing net.Conn
+type Conn struct {
+	s              *Socket
+	remote         net.Addr
+	recvID, sendID uint16
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+	err   error // set once the connection failed or was closed
+
+	// send side
+	seq        uint16 // next sequence number to send
+	unacked    []*outPacket
+	inFlight   int     // payload bytes in unacked
+	cwnd       float64 // LEDBAT congestion window
+	peerWnd    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	dupAcks    int
+	recovering bool   // retransmitting after a loss
+	recoverSeq uint16 // the last packet sent when the loss was detected
+	lastSend   time.Time
+	finSent    bool
+	baseDelays [2]uint32 // minimum delay samples for the current and previous slot
+	slotStart  time.Time
+	replyDiff  uint32 // our clock minus the remote's, echoed in tsDiff
+
+	// receive side
+	ack     uint16 // last in-order sequence number received
+	readBuf []byte
+	ooo     map[uint16]*inPacket
+	gotFin  bool
+
+	readDeadline, writeDeadline time.Time
+}
+
+type inPacket struct {
+	typ     byte
+	payload []byte
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:       s,
+		remote:  remote,
+		recvID:  recvID,
+		sendID:  sendID,
+		cwnd:    minWindow * 2,
+		peerWnd: recvWindow,
+		rto:     initialRTO,
+		ooo:     make(map[uint16]*inPacket),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.baseDelays = [2]uint32{math.MaxUint32, math.MaxUint32}
+	return c
+}
+
+// connect sends the SYN and waits for the ST_STATE answering it
+func (c *Conn) connect(ctx context.Context) error {
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seq = 1
+	c.sendPacket(stSyn, nil)
+	c.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.state == stateSynSent && c.err == nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.cond.Wait()
+	}
+	return c.err
+}
+
+// handleSyn answers an incoming SYN, again if it was retransmitted
+func (c *Conn) handleSyn(h header, dup bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !dup {
+		c.state = stateConnected
+		c.seq = uint16(rand.Uint32())
+		c.ack = h.seq
+		c.replyDiff = micros() - h.ts
+		c.peerWnd = int(h.wnd)
+	}
+	c.sendState()
+}
+
+// header a header for our next packet, caller holds mu
+func (c *Conn) header(typ byte) header {
+	wnd := recvWindow - len(c.readBuf)
+	if wnd < 0 {
+		wnd = 0
+	}
+	id := c.sendID
+	if typ == stSyn {
+		id = c.recvID
+	}
+	return header{typ: typ, connID: id, ts: micros(), tsDiff: c.replyDiff, wnd: uint32(wnd), seq: c.seq, ack: c.ack}
+}
+
+// sendPacket sends a packet that consumes a sequence number and must be acked, caller holds mu
+func (c *Conn) sendPacket(typ byte, payload []byte) {
+	pkt := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.unacked = append(c.unacked, pkt)
+	c.inFlight += len(payload)
+	c.transmit(pkt)
+}
+
+func (c *Conn) transmit(pkt *outPacket) {
+	h := c.header(pkt.typ)
+	h.seq = pkt.seq
+	pkt.sent = time.Now()
+	pkt.transmissions++
+	c.lastSend = pkt.sent
+	c.s.write(h.marshal(pkt.payload), c.remote)
+}
+
+// sendState acks everything received so far, caller holds mu
+func (c *Conn) sendState() {
+	h := c.header(stState)
+	c.lastSend = time.Now()
+	c.s.write(h.marshal(nil), c.remote)
+}
+
+// reset aborts the connection and tells the remote end
+func (c *Conn) reset() {
+	c.mu.Lock()
+	h := c.header(stReset)
+	c.s.write(h.marshal(nil), c.remote)
+	c.mu.Unlock()
+	c.fail(errReset)
+}
+
+// fail closes the connection with err, waking anything blocked on it
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.s.remove(c)
+}
+
+// handle processes a packet from the remote end
+func (c *Conn) handle(h header, payload []byte) {
+	if h.typ == stReset {
+		c.fail(errReset)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	c.replyDiff = micros() - h.ts
+	c.peerWnd = int(h.wnd)
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		// the state packet carries the seq of the remote's first data packet
+		c.ack = h.seq - 1
+	}
+
+	c.processAck(h)
+
+	switch h.typ {
+	case stData, stFin:
+		if c.receive(h, payload) {
+			c.sendState()
+		}
+	}
+	c.cond.Broadcast()
+
+	if c.finSent && len(c.unacked) == 0 {
+		// our FIN is acked, nothing more will be sent
+		c.state = stateClosed
+		go c.s.remove(c)
+	}
+}
+
+// processAck drops acked packets and updates RTT and the congestion window, caller holds mu
+func (c *Conn) processAck(h header) {
+	now := time.Now()
+	acked := 0
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		pkt := c.unacked[0]
+		c.unacked = c.unacked[1:]
+		c.inFlight -= len(pkt.payload)
+		acked += len(pkt.payload)
+		if pkt.transmissions == 1 {
+			// Karn's algorithm, retransmitted packets give ambiguous samples
+			c.updateRTT(now.Sub(pkt.sent))
+		}
+	}
+	if acked == 0 {
+		if h.typ == stState && len(c.unacked) > 0 {
+			c.dupAcks++
+			if c.dupAcks == dupAckLimit && !c.recovering {
+				c.lost()
+				c.transmit(c.unacked[0])
+			}
+		}
+		return
+	}
+	c.dupAcks = 0
+	if c.recovering {
+		if len(c.unacked) > 0 && seqLess(h.ack, c.recoverSeq) {
+			// a partial ack, the next packet was lost as well
+			c.transmit(c.unacked[0])
+		} else {
+			c.recovering = false
+		}
+	}
+	if h.tsDiff != 0 {
+		c.ledbat(h.tsDiff, acked, now)
+	}
+}
+
+// lost halves the window and starts recovery, caller holds mu
+func (c *Conn) lost() {
+	c.cwnd /= 2
+	if c.cwnd < minWindow {
+		c.cwnd = minWindow
+	}
+	c.recovering = true
+	c.recoverSeq = c.seq - 1
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// ledbat grows or shrinks the window by how far the queuing delay is from target
+func (c *Conn) ledbat(delay uint32, acked int, now time.Time) {
+	if now.Sub(c.slotStart) > baseDelaySlot {
+		c.baseDelays[1], c.baseDelays[0] = c.baseDelays[0], math.MaxUint32
+		c.slotStart = now
+	}
+	if delay < c.baseDelays[0] {
+		c.baseDelays[0] = delay
+	}
+	base := c.baseDelays[0]
+	if c.baseDelays[1] < base {
+		base = c.baseDelays[1]
+	}
+	ourDelay := time.Duration(delay-base) * time.Microsecond
+	offTarget := float64(target-ourDelay) / float64(target)
+	c.cwnd += maxCwndGain * offTarget * float64(acked) / c.cwnd
+	if c.cwnd < minWindow {
+		c.cwnd = minWindow
+	}
+}
+
+// receive delivers data in order, buffering packets that arrive early. It
+// reports false for a packet dropped because the read buffer hasn't room for
+// it, which mustn't be acked so the remote sends it again once Read made
+// room. Caller holds mu.
+func (c *Conn) receive(h header, payload []byte) bool {
+	if !seqLess(c.ack, h.seq) {
+		// a duplicate, the ack we send will tell the remote
+		return true
+	}
+	if h.seq != c.ack+1 {
+		if int(h.seq-c.ack) < recvWindow/maxPayload {
+			c.ooo[h.seq] = &inPacket{h.typ, append([]byte(nil), payload...)}
+		}
+		return true
+	}
+	if !c.fits(h.typ, payload) {
+		return false
+	}
+	// a packet held back below may have been sent again
+	delete(c.ooo, h.seq)
+	c.accept(h.typ, payload)
+	for {
+		next, ok := c.ooo[c.ack+1]
+		if !ok || !c.fits(next.typ, next.payload) {
+			return true
+		}
+		delete(c.ooo, c.ack+1)
+		c.accept(next.typ, next.payload)
+	}
+}
+
+// fits reports whether the read buffer has room for a packet, caller holds mu
+func (c *Conn) fits(typ byte, payload []byte) bool {
+	return typ == stFin || len(c.readBuf)+len(payload) <= recvWindow
+}
+
+func (c *Conn) accept(typ byte, payload []byte) {
+	c.ack++
+	if typ == stFin {
+		c.gotFin = true
+		return
+	}
+	c.readBuf = append(c.readBuf, payload...)
+}
+
+// tick retransmits on timeout and keeps idle connections alive
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// wake readers and writers so they notice passed deadlines
+	c.cond.Broadcast()
+	if c.state == stateClosed {
+		return
+	}
+	if len(c.unacked) > 0 {
+		oldest := c.unacked[0]
+		if now.Sub(oldest.sent) < c.rto {
+			return
+		}
+		if oldest.transmissions > maxRetransmits {
+			c.mu.Unlock()
+			c.fail(errTimeout)
+			c.mu.Lock()
+			return
+		}
+		c.lost()
+		c.cwnd = minWindow
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+		c.transmit(oldest)
+		return
+	}
+	if c.state == stateConnected && now.Sub(c.lastSend) > keepAlive {
+		c.sendState()
+	}
+}
+
+// Read reads data in order, returning io.EOF once the remote closed its side
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.readBuf) == 0 {
+		if c.gotFin {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	wasFull := len(c.readBuf) >= recvWindow-maxPayload
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	if wasFull {
+		// the remote may be waiting for the window to open
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write sends p, blocking while the congestion or remote window is full
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.finSent {
+			return written, net.ErrClosed
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		n := len(p)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		window := int(c.cwnd)
+		if c.peerWnd < window {
+			window = c.peerWnd
+		}
+		if c.inFlight > 0 && c.inFlight+n > window {
+			c.cond.Wait()
+			continue
+		}
+		c.sendPacket(stData, append([]byte(nil), p[:n]...))
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends a FIN. Data already written is still delivered.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.err = net.ErrClosed
+	c.cond.Broadcast()
+	if c.state == stateConnected && !c.finSent {
+		c.finSent = true
+		c.sendPacket(stFin, nil)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.s.Addr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
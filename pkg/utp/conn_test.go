@@ -0,0 +1,60 @@
+package utp
+
+import "testing"
+
+func TestReceiveWindow(t *testing.T) {
+	type step struct {
+		typ  byte
+		seq  uint16
+		n    int  // payload bytes
+		read bool // instead of a packet, the buffer is read
+	}
+	tests := []struct {
+		name     string
+		buffered int // unread bytes to start with
+		steps    []step
+		acked    []bool // per packet
+		ack      uint16
+		held     int // packets kept for later
+	}{
+		{"room", 0, []step{{stData, 1, maxPayload, false}}, []bool{true}, 1, 0},
+		{"exactly full", recvWindow - 100, []step{{stData, 1, 100, false}}, []bool{true}, 1, 0},
+		{"full", recvWindow - 10, []step{{stData, 1, 100, false}}, []bool{false}, 0, 0},
+		{"sent again once read", recvWindow - 10, []step{{stData, 1, 100, false}, {read: true}, {stData, 1, 100, false}}, []bool{false, true}, 1, 0},
+		{"early packet left waiting", recvWindow - 150, []step{{stData, 2, 100, false}, {stData, 1, 100, false}}, []bool{true, true}, 1, 1},
+		{"early packet sent again", recvWindow - 150, []step{{stData, 2, 100, false}, {stData, 1, 100, false}, {read: true}, {stData, 2, 100, false}}, []bool{true, true, true}, 2, 0},
+		{"fin when full", recvWindow, []step{{stFin, 1, 0, false}}, []bool{true}, 1, 0},
+	}
+	for _, tt := range tests {
+		c := newConn(nil, nil, 1, 2)
+		c.readBuf = make([]byte, tt.buffered)
+		var acked []bool
+		for _, s := range tt.steps {
+			if s.read {
+				// as Read leaves it, without the state packet it sends
+				c.readBuf = nil
+				continue
+			}
+			before := len(c.readBuf)
+			ok := c.receive(header{typ: s.typ, seq: s.seq}, make([]byte, s.n))
+			acked = append(acked, ok)
+			if !ok && len(c.readBuf) != before {
+				t.Errorf("%s: dropped packet %d buffered", tt.name, s.seq)
+			}
+			if len(c.readBuf) > recvWindow {
+				t.Errorf("%s: %d bytes buffered, past the window", tt.name, len(c.readBuf))
+			}
+		}
+		if len(acked) != len(tt.acked) {
+			t.Fatalf("%s: %d packets, want %d", tt.name, len(acked), len(tt.acked))
+		}
+		for i := range acked {
+			if acked[i] != tt.acked[i] {
+				t.Errorf("%s: packet %d acked %v, want %v", tt.name, i, acked[i], tt.acked[i])
+			}
+		}
+		if c.ack != tt.ack || len(c.ooo) != tt.held {
+			t.Errorf("%s: ack %d with %d held, want %d with %d", tt.name, c.ack, len(c.ooo), tt.ack, tt.held)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerLen  = 20
+	maxPacket  = 1400 // UDP payload we send, small enough to avoid fragmentation on most paths
+	maxPayload = maxPacket - headerLen
+)
+
+var errShortPacket = errors.New("utp: short packet")
+
+// header the fixed part of every uTP packet
+type header struct {
+	typ    byte
+	ext    byte
+	connID uint16
+	ts     uint32 // sender's clock in microseconds
+	tsDiff uint32 // sender's clock minus the ts of the last packet it received
+	wnd    uint32 // receive window in bytes
+	seq    uint16
+	ack    uint16
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	b := make([]byte, headerLen, headerLen+len(payload))
+	b[0] = h.typ<<4 | version
+	b[1] = 0 // we send no extensions
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.ts)
+	binary.BigEndian.PutUint32(b[8:], h.tsDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wnd)
+	binary.BigEndian.PutUint16(b[16:], h.seq)
+	binary.BigEndian.PutUint16(b[18:], h.ack)
+	return append(b, payload...)
+}
+
+// parsePacket splits b into header and payload, skipping extension headers
+func parsePacket(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerLen {
+		return h, nil, errShortPacket
+	}
+	h.typ = b[0] >> 4
+	h.ext = b[1]
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.ts = binary.BigEndian.Uint32(b[4:])
+	h.tsDiff = binary.BigEndian.Uint32(b[8:])
+	h.wnd = binary.BigEndian.Uint32(b[12:])
+	h.seq = binary.BigEndian.Uint16(b[16:])
+	h.ack = binary.BigEndian.Uint16(b[18:])
+	rest := b[headerLen:]
+	for ext := h.ext; ext != 0; {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, errShortPacket
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+// isUTP reports whether b looks like a uTP packet rather than DHT or tracker traffic
+func isUTP(b []byte) bool {
+	return len(b) >= headerLen && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+// seqLess compares sequence numbers allowing for wraparound
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+var epoch = time.Now()
+
+// micros our clock for timestamps, only ever compared with itself
+func micros() uint32 {
+	return uint32(time.Since(epoch).Microseconds())
+}
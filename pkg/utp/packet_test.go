@@ -0,0 +1,105 @@
+package utp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       header
+		payload []byte
+	}{
+		{"syn", header{typ: stSyn, connID: 7, ts: 1, wnd: 1 << 20, seq: 1}, nil},
+		{"data", header{typ: stData, connID: 0xffff, ts: 0xdeadbeef, tsDiff: 42, wnd: 65535, seq: 0xfffe, ack: 3}, []byte("payload")},
+		{"state", header{typ: stState, connID: 8, seq: 9, ack: 0xffff}, nil},
+		{"fin", header{typ: stFin, connID: 1, seq: 100, ack: 99}, nil},
+		{"reset", header{typ: stReset, connID: 2}, nil},
+		{"full", header{typ: stData, connID: 3}, bytes.Repeat([]byte{0xaa}, maxPayload)},
+	}
+	for _, tt := range tests {
+		b := tt.h.marshal(tt.payload)
+		if len(b) != headerLen+len(tt.payload) || len(b) > maxPacket {
+			t.Errorf("%s: %d bytes", tt.name, len(b))
+		}
+		if !isUTP(b) {
+			t.Errorf("%s: not recognised as uTP", tt.name)
+		}
+		h, payload, err := parsePacket(b)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if h != tt.h || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: got %+v %q, want %+v %q", tt.name, h, payload, tt.h, tt.payload)
+		}
+	}
+}
+
+func TestParsePacketExtensions(t *testing.T) {
+	base := (&header{typ: stState, connID: 5, seq: 1, ack: 2}).marshal(nil)
+	withExt := func(ext byte, rest ...byte) []byte {
+		b := append([]byte{}, base...)
+		b[1] = ext
+		return append(b, rest...)
+	}
+	tests := []struct {
+		name    string
+		packet  []byte
+		payload []byte
+		err     error
+	}{
+		{"no extensions", append(append([]byte{}, base...), 'x'), []byte("x"), nil},
+		// selective ack, 4 bytes of bitmask, then the payload
+		{"selective ack", withExt(1, 0, 4, 1, 2, 3, 4, 'x'), []byte("x"), nil},
+		{"two extensions", withExt(1, 2, 4, 1, 2, 3, 4, 0, 1, 9, 'x', 'y'), []byte("xy"), nil},
+		{"extension cut short", withExt(1, 0, 4, 1, 2), nil, errShortPacket},
+		{"extension header missing", withExt(1), nil, errShortPacket},
+		{"short header", base[:headerLen-1], nil, errShortPacket},
+	}
+	for _, tt := range tests {
+		_, payload, err := parsePacket(tt.packet)
+		if err != tt.err || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: %q, %v", tt.name, payload, err)
+		}
+	}
+}
+
+func TestIsUTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"syn", (&header{typ: stSyn}).marshal(nil), true},
+		{"dht query", []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), false},
+		{"udp tracker connect reply", append([]byte{0, 0, 0, 0}, make([]byte, 12)...), false},
+		{"unknown type", append([]byte{5<<4 | version}, make([]byte, headerLen-1)...), false},
+		{"wrong version", append([]byte{stData<<4 | 2}, make([]byte, headerLen-1)...), false},
+		{"short", []byte{stData<<4 | version}, false},
+	}
+	for _, tt := range tests {
+		if got := isUTP(tt.packet); got != tt.want {
+			t.Errorf("%s: %v", tt.name, got)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xffff, 0, true}, // wraps around
+		{0, 0xffff, false},
+		{0xfff0, 0x0010, true},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqLess(%d, %d) = %v", tt.a, tt.b, got)
+		}
+	}
+}
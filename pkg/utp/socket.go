@@ -0,0 +1,329 @@
+// utp the Micro Transport Protocol (BEP 29), reliable streams over UDP with
+// LEDBAT congestion control so BitTorrent traffic yields to everything else
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	acceptBacklog = 64
+	viewQueueLen  = 64
+	tickInterval  = 50 * time.Millisecond
+)
+
+// connKey identifies a connection by remote address and the id its packets carry
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket a UDP socket carrying uTP connections. It is a net.Listener for
+// incoming connections, dials outgoing ones, and hands every packet that isn't
+// uTP to the views returned by PacketConn so DHT and UDP trackers can share it.
+type Socket struct {
+	pc net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	views   map[*packetView]struct{}
+	backlog chan *Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Listen opens a uTP socket on a UDP address such as ":6881"
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over pc, which the Socket takes ownership of
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		conns:   make(map[connKey]*Conn),
+		views:   make(map[*packetView]struct{}),
+		backlog: make(chan *Conn, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Addr the local address, part of net.Listener
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Accept waits for an incoming connection, part of net.Listener
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the socket and every connection on it
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// Dial connects to a uTP peer at addr
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialTimeout Dial with a timeout for the SYN exchange
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.DialContext(ctx, addr)
+}
+
+// DialContext Dial, giving up when ctx is done
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	var c *Conn
+	for {
+		recvID := uint16(rand.Uint32())
+		key := connKey{raddr.String(), recvID}
+		if _, taken := s.conns[key]; taken {
+			continue
+		}
+		c = newConn(s, raddr, recvID, recvID+1)
+		s.conns[key] = c
+		break
+	}
+	s.mu.Unlock()
+
+	if err := c.connect(ctx); err != nil {
+		c.fail(err)
+		return nil, &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: err}
+	}
+	return c, nil
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) write(b []byte, to net.Addr) error {
+	_, err := s.pc.WriteTo(b, to)
+	return err
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		b := buf[:n]
+		if isUTP(b) {
+			if s.dispatch(b, from) {
+				continue
+			}
+		}
+		s.deliver(append([]byte(nil), b...), from)
+	}
+}
+
+// dispatch routes a uTP packet to its connection, returning false if it
+// turned out not to be one of ours after all
+func (s *Socket) dispatch(b []byte, from net.Addr) bool {
+	h, payload, err := parsePacket(b)
+	if err != nil {
+		return false
+	}
+	addr := from.String()
+	s.mu.Lock()
+	if h.typ == stSyn {
+		// the initiator's packets will carry its id plus one
+		key := connKey{addr, h.connID + 1}
+		c, dup := s.conns[key]
+		if !dup {
+			c = newConn(s, from, h.connID+1, h.connID)
+			s.conns[key] = c
+		}
+		s.mu.Unlock()
+		c.handleSyn(h, dup)
+		if !dup {
+			select {
+			case s.backlog <- c:
+			default:
+				c.reset()
+			}
+		}
+		return true
+	}
+	c, ok := s.conns[connKey{addr, h.connID}]
+	s.mu.Unlock()
+	if !ok {
+		if h.typ != stReset {
+			// tell the sender we've forgotten the connection
+			rh := header{typ: stReset, connID: h.connID, ts: micros(), ack: h.seq}
+			s.write(rh.marshal(nil), from)
+		}
+		return true
+	}
+	c.handle(h, payload)
+	return true
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+// packetView a net.PacketConn receiving the socket's non-uTP packets
+type packetView struct {
+	s      *Socket
+	ch     chan viewPacket
+	closed chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+type viewPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+// PacketConn returns a view of the socket for other UDP protocols. Each view
+// receives a copy of every packet that isn't uTP; writes go out through the
+// shared socket. Close the view when done with it.
+func (s *Socket) PacketConn() net.PacketConn {
+	v := &packetView{s: s, ch: make(chan viewPacket, viewQueueLen), closed: make(chan struct{})}
+	s.mu.Lock()
+	s.views[v] = struct{}{}
+	s.mu.Unlock()
+	return v
+}
+
+func (s *Socket) deliver(b []byte, from net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for v := range s.views {
+		select {
+		case v.ch <- viewPacket{b, from}:
+		default:
+			// a slow reader loses packets, as it would with a full socket buffer
+		}
+	}
+}
+
+func (v *packetView) ReadFrom(p []byte) (int, net.Addr, error) {
+	v.mu.Lock()
+	deadline := v.deadline
+	v.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case pkt := <-v.ch:
+		return copy(p, pkt.b), pkt.from, nil
+	case <-v.closed:
+		return 0, nil, net.ErrClosed
+	case <-v.s.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (v *packetView) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-v.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return v.s.pc.WriteTo(p, addr)
+}
+
+func (v *packetView) Close() error {
+	v.once.Do(func() {
+		close(v.closed)
+		v.s.mu.Lock()
+		delete(v.s.views, v)
+		v.s.mu.Unlock()
+	})
+	return nil
+}
+
+func (v *packetView) LocalAddr() net.Addr { return v.s.pc.LocalAddr() }
+
+func (v *packetView) SetDeadline(t time.Time) error { return v.SetReadDeadline(t) }
+
+func (v *packetView) SetReadDeadline(t time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.deadline = t
+	return nil
+}
+
+// SetWriteDeadline writes never block on a UDP socket, so it's a no-op
+func (v *packetView) SetWriteDeadline(t time.Time) error { return nil }
+
+var errTimeout = errors.New("utp: connection timed out")
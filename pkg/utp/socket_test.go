@@ -0,0 +1,55 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLoopbackTransfer(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(20 * time.Second))
+		b, _ := io.ReadAll(io.LimitReader(c, int64(len(data))))
+		c.Write([]byte("done"))
+		received <- b
+	}()
+
+	c, err := client.DialTimeout(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(c, reply); err != nil || string(reply) != "done" {
+		t.Fatalf("reply %q, %v", reply, err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, not what was sent", len(got))
+	}
+}
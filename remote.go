@@ -0,0 +1,372 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mbags/gtc/pkg/config"
+	"github.com/mbags/gtc/pkg/daemon"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// apiFlag adds the -api flag daemon commands share
+func apiFlag(fs *flag.FlagSet) *string {
+	addr := os.Getenv("GTC_API")
+	if addr == "" {
+		addr = daemon.DefaultAPIAddr
+	}
+	return fs.String("api", addr, `daemon API address, host:port or "unix:" and a socket path`)
+}
+
+// eachTorrent runs fn for every hash prefix in args, carrying on past
+// failures and exiting with the code of the last one
+func eachTorrent(c *daemon.Client, args []string, fn func(hash string) error) int {
+	code := exitOK
+	for _, prefix := range args {
+		hash, err := c.Resolve(prefix)
+		if err == nil {
+			err = fn(hash)
+		}
+		if err != nil {
+			code = fail(err)
+		}
+	}
+	return code
+}
+
+// short the start of an info hash, enough to tell torrents apart in a listing
+func short(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// addMain adds torrents to the daemon
+func addMain(args []string) int {
+	fs := newFlags("add", "<torrent file, URL or magnet>...")
+	api := apiFlag(fs)
+	paused := fs.Bool("paused", false, "add without connecting to peers")
+	alloc := fs.String("allocation", "", "sparse, full or compact (default the daemon's)")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, -1); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	code := exitOK
+	added := []torrent.Stats{}
+	for _, source := range fs.Args() {
+		st, err := addSource(c, source, *alloc)
+		if err == nil && *paused {
+			st, err = c.Pause(st.InfoHash)
+		}
+		if err != nil {
+			code = fail(fmt.Errorf("%s: %w", source, err))
+			continue
+		}
+		added = append(added, st)
+		if !*asJSON {
+			fmt.Printf("Added %s %s\n", short(st.InfoHash), st.Name)
+		}
+	}
+	if *asJSON {
+		printJSON(added)
+	}
+	return code
+}
+
+// addSource sends a local .torrent's contents, as the daemon may not see our
+// files, and anything else as a source for the daemon to open
+func addSource(c *daemon.Client, source, alloc string) (torrent.Stats, error) {
+	if !strings.Contains(source, "://") && !strings.HasPrefix(source, "magnet:") {
+		f, err := os.Open(source)
+		if err != nil {
+			return torrent.Stats{}, err
+		}
+		defer f.Close()
+		return c.AddTorrentWith(f, alloc)
+	}
+	return c.AddWith(daemon.AddRequest{Source: source, Allocation: alloc})
+}
+
+// lsMain lists the daemon's torrents
+func lsMain(args []string) int {
+	fs := newFlags("ls", "")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+	list, err := daemon.NewClient(*api).Torrents()
+	if err != nil {
+		return fail(err)
+	}
+	if *asJSON {
+		return printJSON(list)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tSTATE\tDONE\tSIZE\tDOWN\tUP\tPEERS\tNAME")
+	for _, st := range list {
+		fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%s\t%s\t%s\t%d\t%s\n", short(st.InfoHash), st.State,
+			percent(st.Done, st.Size), formatBytes(st.Size), formatRate(st.DownloadRate),
+			formatRate(st.UploadRate), st.Peers, st.Name)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// stateMain pauses or resumes torrents with op
+func stateMain(name string, args []string, op func(*daemon.Client, string) (torrent.Stats, error)) int {
+	fs := newFlags(name, "<hash>...")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, -1); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	list := []torrent.Stats{}
+	code := eachTorrent(c, fs.Args(), func(hash string) error {
+		st, err := op(c, hash)
+		if err != nil {
+			return err
+		}
+		list = append(list, st)
+		if !*asJSON {
+			fmt.Printf("%s %s %s\n", short(st.InfoHash), st.State, st.Name)
+		}
+		return nil
+	})
+	if *asJSON {
+		printJSON(list)
+	}
+	return code
+}
+
+func pauseMain(args []string) int {
+	return stateMain("pause", args, (*daemon.Client).Pause)
+}
+
+func resumeMain(args []string) int {
+	return stateMain("resume", args, (*daemon.Client).Resume)
+}
+
+// rmMain removes torrents from the daemon
+func rmMain(args []string) int {
+	fs := newFlags("rm", "<hash>...")
+	api := apiFlag(fs)
+	data := fs.Bool("data", false, "delete the downloaded data too")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, -1); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	removed := []string{}
+	code := eachTorrent(c, fs.Args(), func(hash string) error {
+		if err := c.Remove(hash, *data); err != nil {
+			return err
+		}
+		removed = append(removed, hash)
+		if !*asJSON {
+			fmt.Printf("Removed %s\n", short(hash))
+		}
+		return nil
+	})
+	if *asJSON {
+		printJSON(map[string][]string{"removed": removed})
+	}
+	return code
+}
+
+// mvMain moves a torrent's files to another directory on the daemon's machine
+func mvMain(args []string) int {
+	fs := newFlags("mv", "<hash> <dir>")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 2, 2); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	var st torrent.Stats
+	code := eachTorrent(c, fs.Args()[:1], func(hash string) (err error) {
+		st, err = c.Move(hash, fs.Arg(1))
+		return err
+	})
+	if code != exitOK {
+		return code
+	}
+	if *asJSON {
+		return printJSON(st)
+	}
+	fmt.Printf("Moved %s to %s\n", st.Name, st.Dir)
+	return exitOK
+}
+
+// renameMain moves one of a torrent's files within its directory
+func renameMain(args []string) int {
+	fs := newFlags("rename", "<hash> <file index> <path>")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 3, 3); code >= 0 {
+		return code
+	}
+	index, err := strconv.Atoi(fs.Arg(1))
+	if err != nil {
+		fs.Usage()
+		return exitUsage
+	}
+	c := daemon.NewClient(*api)
+	var f torrent.FileStats
+	code := eachTorrent(c, fs.Args()[:1], func(hash string) (err error) {
+		f, err = c.RenameFile(hash, index, fs.Arg(2))
+		return err
+	})
+	if code != exitOK {
+		return code
+	}
+	if *asJSON {
+		return printJSON(f)
+	}
+	fmt.Printf("Renamed file %d to %s\n", index, f.Path)
+	return exitOK
+}
+
+// peersMain lists a torrent's connected peers
+func peersMain(args []string) int {
+	fs := newFlags("peers", "<hash>")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	var peers []torrent.PeerStats
+	code := eachTorrent(c, fs.Args(), func(hash string) (err error) {
+		peers, err = c.Peers(hash)
+		return err
+	})
+	if code != exitOK {
+		return code
+	}
+	if *asJSON {
+		if peers == nil {
+			peers = []torrent.PeerStats{}
+		}
+		return printJSON(peers)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tCLIENT\tFLAGS\tPIECES\tDOWN\tUP")
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", p.Addr, p.Client, peerFlags(p), p.Pieces,
+			formatRate(p.DownloadRate), formatRate(p.UploadRate))
+	}
+	w.Flush()
+	return exitOK
+}
+
+// peerFlags the peer in short: I incoming, E encrypted, U uTP, S seed,
+// C choking us, i interested in our pieces
+func peerFlags(p torrent.PeerStats) string {
+	flags := ""
+	if p.Incoming {
+		flags += "I"
+	}
+	if p.Encrypted {
+		flags += "E"
+	}
+	if p.Transport == "utp" {
+		flags += "U"
+	}
+	if p.Seed {
+		flags += "S"
+	}
+	if p.Choked {
+		flags += "C"
+	}
+	if p.Interested {
+		flags += "i"
+	}
+	if flags == "" {
+		return "-"
+	}
+	return flags
+}
+
+// trackersMain lists a torrent's trackers
+func trackersMain(args []string) int {
+	fs := newFlags("trackers", "<hash>")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	var list []torrent.TrackerStatus
+	code := eachTorrent(c, fs.Args(), func(hash string) (err error) {
+		list, err = c.Trackers(hash)
+		return err
+	})
+	if code != exitOK {
+		return code
+	}
+	if *asJSON {
+		if list == nil {
+			list = []torrent.TrackerStatus{}
+		}
+		return printJSON(list)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIER\tURL\tLAST ANNOUNCE\tPEERS\tERROR")
+	for _, tr := range list {
+		last := "never"
+		if !tr.LastAnnounce.IsZero() {
+			last = time.Since(tr.LastAnnounce).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", tr.Tier, tr.URL, last, tr.Peers, tr.Error)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// configMain shows the daemon's settings, or changes those given as key=value
+func configMain(args []string) int {
+	fs := newFlags("config", "[<key>=<value>...]")
+	api := apiFlag(fs)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if code := parse(fs, args, 0, -1); code >= 0 {
+		return code
+	}
+	c := daemon.NewClient(*api)
+	cfg, err := c.Config()
+	if err != nil {
+		return fail(err)
+	}
+	if fs.NArg() > 0 {
+		for _, arg := range fs.Args() {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				fs.Usage()
+				return exitUsage
+			}
+			if err := cfg.Set(key, value); err != nil {
+				return fail(err)
+			}
+		}
+		if cfg, err = c.SetConfig(cfg); err != nil {
+			return fail(err)
+		}
+	}
+	if *asJSON {
+		return printJSON(cfg)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, key := range config.Keys() {
+		fmt.Fprintf(w, "%s\t%s\n", key, cfg.Get(key))
+	}
+	w.Flush()
+	return exitOK
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// terminal puts the controlling terminal in a mode for full screen drawing
+// and unbuffered key presses, through stty so it needs neither cgo nor
+// anything outside the standard library
+type terminal struct {
+	saved string // stty settings to restore
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// openTerminal switches to the alternate screen with echo and line buffering
+// off. Signals still work so ^C gets through.
+func openTerminal() (*terminal, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("not a terminal: %w", err)
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	os.Stdout.WriteString("\033[?1049h\033[?25l")
+	return &terminal{saved: saved}, nil
+}
+
+// close puts the terminal back the way openTerminal found it
+func (t *terminal) close() {
+	os.Stdout.WriteString("\033[?25h\033[?1049l")
+	stty(t.saved)
+}
+
+// size the terminal's rows and columns, 24x80 when stty can't tell
+func (t *terminal) size() (rows, cols int) {
+	out, err := stty("size")
+	if err == nil {
+		if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+// draw replaces the screen with lines, cut to cols
+func (t *terminal) draw(lines []string, cols int) {
+	var b strings.Builder
+	b.WriteString("\033[H")
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(truncate(l, cols))
+		b.WriteString("\033[K")
+	}
+	b.WriteString("\033[J")
+	os.Stdout.WriteString(b.String())
+}
+
+// truncate cuts s to n runes, leaving escape sequences intact
+func truncate(s string, n int) string {
+	width := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\033' {
+			// skip to the sequence's final letter
+			j := i + 1
+			for j < len(s) && !(s[j] >= '@' && s[j] <= '~' && s[j] != '[') {
+				j++
+			}
+			i = j + 1
+			continue
+		}
+		if width == n {
+			return s[:i] + "\033[m"
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		width++
+	}
+	return s
+}
+
+// keys the names of keys pressed
+const (
+	keyUp    = "up"
+	keyDown  = "down"
+	keyLeft  = "left"
+	keyRight = "right"
+	keyPgUp  = "pgup"
+	keyPgDn  = "pgdn"
+	keyEnter = "enter"
+	keyEsc   = "esc"
+	keyTab   = "tab"
+	keyBack  = "backspace"
+)
+
+// readKeys sends each key pressed to keys until stdin fails
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 32)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		keys <- keyName(buf[:n])
+	}
+}
+
+func keyName(b []byte) string {
+	switch {
+	case len(b) >= 3 && b[0] == '\033' && (b[1] == '[' || b[1] == 'O'):
+		switch string(b[2:]) {
+		case "A":
+			return keyUp
+		case "B":
+			return keyDown
+		case "C":
+			return keyRight
+		case "D":
+			return keyLeft
+		case "5~":
+			return keyPgUp
+		case "6~":
+			return keyPgDn
+		}
+		return ""
+	case len(b) == 1:
+		switch b[0] {
+		case '\033':
+			return keyEsc
+		case '\r', '\n':
+			return keyEnter
+		case '\t':
+			return keyTab
+		case 127, '\b':
+			return keyBack
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mbags/gtc/pkg/daemon"
+	"github.com/mbags/gtc/pkg/torrent"
+)
+
+// the views of a torrent in top
+const (
+	tabPeers = iota
+	tabTrackers
+	tabFiles
+	tabPieces
+	numTabs
+)
+
+var tabNames = [numTabs]string{"Peers", "Trackers", "Files", "Pieces"}
+
+// top the state of the monitor: the torrent list, or one torrent's tab
+type top struct {
+	c    *daemon.Client
+	term *terminal
+
+	list []torrent.Stats
+	sel  int    // index into list
+	hash string // the torrent shown, "" for the list
+	tab  int
+	off  int // lines scrolled in the tab
+	err  error
+
+	peers    []torrent.PeerStats
+	trackers []torrent.TrackerStatus
+	files    []torrent.FileStats
+	pieces   torrent.PieceMap
+}
+
+// topMain monitors the daemon's torrents in a full screen view
+func topMain(args []string) int {
+	fs := newFlags("top", "")
+	api := apiFlag(fs)
+	interval := fs.Duration("interval", time.Second, "how often to refresh")
+	if code := parse(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+	t := &top{c: daemon.NewClient(*api)}
+	if t.list, t.err = t.c.Torrents(); t.err != nil {
+		return fail(t.err)
+	}
+	term, err := openTerminal()
+	if err != nil {
+		return fail(err)
+	}
+	t.term = term
+	defer term.close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	keys := make(chan string)
+	go readKeys(keys)
+	tick := time.NewTicker(*interval)
+	defer tick.Stop()
+	for {
+		t.draw()
+		select {
+		case <-sig:
+			return exitOK
+		case <-tick.C:
+			t.refresh()
+		case k, ok := <-keys:
+			if !ok || !t.key(k) {
+				return exitOK
+			}
+		}
+	}
+}
+
+// refresh fetches what's on screen from the daemon
+func (t *top) refresh() {
+	t.list, t.err = t.c.Torrents()
+	if t.err != nil {
+		return
+	}
+	if t.sel >= len(t.list) {
+		t.sel = max(len(t.list)-1, 0)
+	}
+	if t.hash == "" {
+		return
+	}
+	switch t.tab {
+	case tabPeers:
+		t.peers, t.err = t.c.Peers(t.hash)
+	case tabTrackers:
+		t.trackers, t.err = t.c.Trackers(t.hash)
+	case tabFiles:
+		t.files, t.err = t.c.Files(t.hash)
+	case tabPieces:
+		t.pieces, t.err = t.c.Pieces(t.hash)
+	}
+}
+
+// key handles a key press, reporting false to quit
+func (t *top) key(k string) bool {
+	switch k {
+	case "q", "Q":
+		return false
+	case "p":
+		if st, ok := t.current(); ok {
+			if st.State == torrent.StatePaused.String() || st.State == torrent.StateError.String() {
+				_, t.err = t.c.Resume(st.InfoHash)
+			} else {
+				_, t.err = t.c.Pause(st.InfoHash)
+			}
+		}
+	}
+	if t.hash == "" {
+		switch k {
+		case keyUp, "k":
+			t.sel = max(t.sel-1, 0)
+		case keyDown, "j":
+			t.sel = min(t.sel+1, max(len(t.list)-1, 0))
+		case keyEnter, keyRight, "l":
+			if st, ok := t.current(); ok {
+				t.hash, t.tab, t.off = st.InfoHash, tabPeers, 0
+			}
+		}
+	} else {
+		rows, _ := t.term.size()
+		switch k {
+		case keyEsc, keyBack, keyLeft, "h":
+			t.hash = ""
+		case keyTab:
+			t.tab, t.off = (t.tab+1)%numTabs, 0
+		case "1", "2", "3", "4":
+			t.tab, t.off = int(k[0]-'1'), 0
+		case keyUp, "k":
+			t.off = max(t.off-1, 0)
+		case keyDown, "j":
+			t.off++
+		case keyPgUp:
+			t.off = max(t.off-(rows-8), 0)
+		case keyPgDn:
+			t.off += rows - 8
+		}
+	}
+	t.refresh()
+	return true
+}
+
+// current the selected torrent, or the one being shown
+func (t *top) current() (torrent.Stats, bool) {
+	if t.hash != "" {
+		for _, st := range t.list {
+			if st.InfoHash == t.hash {
+				return st, true
+			}
+		}
+		return torrent.Stats{}, false
+	}
+	if t.sel < len(t.list) {
+		return t.list[t.sel], true
+	}
+	return torrent.Stats{}, false
+}
+
+func (t *top) draw() {
+	rows, cols := t.term.size()
+	var lines []string
+	var help string
+	if t.hash == "" {
+		lines = t.drawList(rows, cols)
+		help = "↑↓ select  enter details  p pause/resume  q quit"
+	} else {
+		lines = t.drawTorrent(rows, cols)
+		help = "tab/1-4 switch  ↑↓ scroll  p pause/resume  esc back  q quit"
+	}
+	// the status line goes on the terminal's last row
+	for len(lines) < rows-1 {
+		lines = append(lines, "")
+	}
+	lines = lines[:rows-1]
+	status := help
+	if t.err != nil {
+		status = "error: " + t.err.Error()
+	}
+	lines = append(lines, "\033[7m"+pad(status, cols)+"\033[m")
+	t.term.draw(lines, cols)
+}
+
+func (t *top) drawList(height, cols int) []string {
+	var down, up float64
+	for _, st := range t.list {
+		down += st.DownloadRate
+		up += st.UploadRate
+	}
+	lines := []string{
+		fmt.Sprintf("\033[1mgtc\033[m  %d torrents  ↓ %s  ↑ %s", len(t.list), formatRate(down), formatRate(up)),
+		"",
+	}
+	rows := [][]string{{"NAME", "PROGRESS", "", "STATE", "SIZE", "DOWN", "UP", "ETA", "RATIO", "PEERS", "SEEDS"}}
+	for _, st := range t.list {
+		rows = append(rows, []string{
+			st.Name, progressBar(st.Done, st.Size, 20), fmt.Sprintf("%.1f%%", percent(st.Done, st.Size)),
+			st.State, formatBytes(st.Size), formatRate(st.DownloadRate), formatRate(st.UploadRate),
+			eta(st), ratio(st), fmt.Sprint(st.Peers), fmt.Sprint(st.Seeds),
+		})
+	}
+	tbl := table(rows)
+	lines = append(lines, "\033[1m  "+tbl[0]+"\033[m")
+	// scroll to keep the selection on screen
+	room := max(height-1-len(lines), 1)
+	first := max(t.sel-room+1, 0)
+	for i := first; i < min(first+room, len(t.list)); i++ {
+		l := "  " + tbl[i+1]
+		if i == t.sel {
+			l = "\033[7m> " + pad(tbl[i+1], cols-2) + "\033[m"
+		}
+		lines = append(lines, l)
+	}
+	if len(t.list) == 0 {
+		lines = append(lines, "  no torrents, add some with gtc add")
+	}
+	return lines
+}
+
+func (t *top) drawTorrent(rows, cols int) []string {
+	st, ok := t.current()
+	if !ok {
+		t.hash = ""
+		return t.drawList(rows, cols)
+	}
+	lines := []string{
+		"\033[1m" + st.Name + "\033[m",
+		fmt.Sprintf("%s  %s  %s %.1f%% of %s", st.InfoHash, st.State,
+			progressBar(st.Done, st.Size, 20), percent(st.Done, st.Size), formatBytes(st.Size)),
+		fmt.Sprintf("↓ %s  ↑ %s  ETA %s  ratio %s  %d peers, %d seeds",
+			formatRate(st.DownloadRate), formatRate(st.UploadRate), eta(st), ratio(st), st.Peers, st.Seeds),
+		"",
+	}
+	var tabs []string
+	for i, name := range tabNames {
+		label := fmt.Sprintf(" %d %s ", i+1, name)
+		if i == t.tab {
+			label = "\033[7m" + label + "\033[m"
+		}
+		tabs = append(tabs, label)
+	}
+	lines = append(lines, strings.Join(tabs, " "), "")
+
+	var body []string
+	switch t.tab {
+	case tabPeers:
+		body = t.drawPeers(st)
+	case tabTrackers:
+		body = t.drawTrackers()
+	case tabFiles:
+		body = t.drawFiles()
+	case tabPieces:
+		body = drawPieces(t.pieces, cols)
+	}
+	// keep the header row of tables in place while scrolling
+	header := 0
+	if t.tab != tabPieces && len(body) > 0 {
+		header = 1
+		lines = append(lines, "\033[1m"+body[0]+"\033[m")
+	}
+	room := max(rows-1-len(lines), 0)
+	t.off = max(min(t.off, len(body)-header-room), 0)
+	end := min(header+t.off+room, len(body))
+	return append(lines, body[header+t.off:end]...)
+}
+
+func (t *top) drawPeers(st torrent.Stats) []string {
+	rows := [][]string{{"ADDRESS", "CLIENT", "FLAGS", "PROGRESS", "", "DOWN", "UP", "DOWNLOADED", "UPLOADED"}}
+	for _, p := range t.peers {
+		rows = append(rows, []string{
+			p.Addr, p.Client, peerFlags(p), progressBar(int64(p.Pieces), int64(st.Pieces), 10),
+			fmt.Sprintf("%.0f%%", percent(int64(p.Pieces), int64(st.Pieces))),
+			formatRate(p.DownloadRate), formatRate(p.UploadRate), formatBytes(p.Downloaded), formatBytes(p.Uploaded),
+		})
+	}
+	return table(rows)
+}
+
+func (t *top) drawTrackers() []string {
+	rows := [][]string{{"TIER", "URL", "LAST ANNOUNCE", "PEERS", "ERROR"}}
+	for _, tr := range t.trackers {
+		last := "never"
+		if !tr.LastAnnounce.IsZero() {
+			last = time.Since(tr.LastAnnounce).Round(time.Second).String() + " ago"
+		}
+		rows = append(rows, []string{fmt.Sprint(tr.Tier), tr.URL, last, fmt.Sprint(tr.Peers), tr.Error})
+	}
+	return table(rows)
+}
+
+func (t *top) drawFiles() []string {
+	rows := [][]string{{"#", "PROGRESS", "", "SIZE", "PRIORITY", "PATH"}}
+	for _, f := range t.files {
+		rows = append(rows, []string{
+			fmt.Sprint(f.Index), progressBar(f.Done, f.Length, 10), fmt.Sprintf("%.0f%%", percent(f.Done, f.Length)),
+			formatBytes(f.Length), f.Priority, f.Path,
+		})
+	}
+	return table(rows)
+}
+
+// drawPieces the piece map as a grid cols wide, a cell standing for several
+// pieces when there are more pieces than fit: █ all of them, ▒ some, · none
+func drawPieces(pm torrent.PieceMap, cols int) []string {
+	if pm.Pieces == 0 {
+		return nil
+	}
+	cells := min(pm.Pieces, cols*16)
+	per := float64(pm.Pieces) / float64(cells)
+	var lines []string
+	var line strings.Builder
+	for c := 0; c < cells; c++ {
+		from, to := int(math.Round(float64(c)*per)), int(math.Round(float64(c+1)*per))
+		have := 0
+		for i := from; i < to; i++ {
+			if pm.Has(i) {
+				have++
+			}
+		}
+		switch {
+		case have == to-from:
+			line.WriteString("█")
+		case have > 0:
+			line.WriteString("▒")
+		default:
+			line.WriteString("·")
+		}
+		if (c+1)%cols == 0 {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	if per > 1 {
+		lines = append(lines, "", fmt.Sprintf("%d pieces, %.1f per cell", pm.Pieces, per))
+	}
+	return lines
+}
+
+// table lays rows out in aligned columns
+func table(rows [][]string) []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func progressBar(done, total int64, width int) string {
+	filled := width
+	if total > 0 {
+		filled = int(done * int64(width) / total)
+	}
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// pad s with spaces to n runes
+func pad(s string, n int) string {
+	if l := len([]rune(s)); l < n {
+		return s + strings.Repeat(" ", n-l)
+	}
+	return s
+}
+
+func eta(st torrent.Stats) string {
+	left := st.Size - st.Done
+	switch {
+	case left == 0:
+		return "-"
+	case st.State != torrent.StateDownloading.String() || st.DownloadRate < 1:
+		return "∞"
+	}
+	d := time.Duration(float64(left)/st.DownloadRate) * time.Second
+	if d > 24*time.Hour {
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	}
+	return d.Round(time.Second).String()
+}
+
+// ratio uploaded over downloaded, or over the data we have when we
+// downloaded none of it
+func ratio(st torrent.Stats) string {
+	base := st.Downloaded
+	if base == 0 {
+		base = st.Done
+	}
+	if base == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(st.Uploaded)/float64(base))
+}